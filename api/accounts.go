@@ -0,0 +1,487 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrInvalidAccount tags errors caused by an account given by the user
+var ErrInvalidAccount = errors.New("invalid account")
+
+var ErrAccountNotFound = errors.New("account not found")
+
+// ErrAccountInUse is returned when deleting an account which payments or
+// transfers still use
+var ErrAccountInUse = errors.New("account in use")
+
+// ErrInvalidTransfer tags errors caused by a transfer given by the user
+var ErrInvalidTransfer = errors.New("invalid transfer")
+
+var ErrTransferNotFound = errors.New("transfer not found")
+
+// the kinds of accounts
+const (
+	AccountChecking = "checking"
+	AccountSavings  = "savings"
+	AccountCash     = "cash"
+	AccountCredit   = "credit"
+)
+
+// Account is where the money of payments comes from
+type Account struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Currency string `json:"currency"`
+	// Opening is the balance on the morning of Opened (negative for a credit
+	// card which is owed money). The payments and transfers before Opened
+	// are already in it, so they aren't counted
+	Opening Money `json:"opening"`
+	Opened  Date  `json:"opened"`
+}
+
+// Transfer moves money from an account to an other. It isn't spending
+type Transfer struct {
+	ID   string `json:"id"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Amount is what leaves From, in its currency
+	Amount Money `json:"amount"`
+	// Received is what arrives in To, in its currency. It's Amount when the
+	// accounts have the same currency
+	Received Money  `json:"received"`
+	Date     Date   `json:"date"`
+	Notes    string `json:"notes,omitempty"`
+}
+
+// AccountBalance is the balance of an account at the end of a day
+type AccountBalance struct {
+	Account Account `json:"account"`
+	Balance Money   `json:"balance"`
+}
+
+func loadAccounts(u db.Store) ([]Account, error) {
+	var accounts []Account
+	if _, err := loadJSON(u, "/accounts", &accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func findAccount(accounts []Account, id string) int {
+	for i, a := range accounts {
+		if a.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func loadTransfers(u db.Store) ([]Transfer, error) {
+	var transfers []Transfer
+	if _, err := loadJSON(u, "/transfers", &transfers); err != nil {
+		return nil, err
+	}
+	return transfers, nil
+}
+
+func findTransfer(transfers []Transfer, id string) int {
+	for i, t := range transfers {
+		if t.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// rescaleAmount gives the amount the exponent of the currency, or fails if it
+// has too many decimal digits
+func rescaleAmount(m Money, currency string) (Money, error) {
+	exp := currencyExponent(currency)
+	if m.Exponent > exp {
+		return m, fmt.Errorf("has more decimal digits than %s allows", currency)
+	}
+	m, err := m.Rescale(exp)
+	if err != nil {
+		return m, errors.New("is too big")
+	}
+	return m, nil
+}
+
+func checkAccount(a *Account, accounts []Account) error {
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Name == "" {
+		return fmt.Errorf("need 'name' (%w)", ErrInvalidAccount)
+	}
+	for _, other := range accounts {
+		if other.ID != a.ID && strings.EqualFold(other.Name, a.Name) {
+			return fmt.Errorf("an account is already called %q (%w)", other.Name, ErrInvalidAccount)
+		}
+	}
+	switch a.Kind {
+	case AccountChecking, AccountSavings, AccountCash, AccountCredit:
+	default:
+		return fmt.Errorf("kind should be %q, %q, %q or %q, got %q (%w)", AccountChecking, AccountSavings, AccountCash, AccountCredit, a.Kind, ErrInvalidAccount)
+	}
+	if !currencyRegexp.MatchString(a.Currency) {
+		return fmt.Errorf("'currency' should be a 3 letter ISO 4217 code, got %q (%w)", a.Currency, ErrInvalidAccount)
+	}
+	if a.Opened.IsZero() {
+		return fmt.Errorf("need 'opened' date (%w)", ErrInvalidAccount)
+	}
+	opening, err := rescaleAmount(a.Opening, a.Currency)
+	if err != nil {
+		return fmt.Errorf("opening balance %s (%w)", err, ErrInvalidAccount)
+	}
+	a.Opening = opening
+	return nil
+}
+
+// checkPaymentAccount makes sure the payment's account exists, and that the
+// payment is in its currency. A payment without a currency gets the
+// account's. Errors: ErrInvalidPayment, err
+func checkPaymentAccount(u db.Store, p *Payment) error {
+	if p.Account == "" {
+		return nil
+	}
+	accounts, err := loadAccounts(u)
+	if err != nil {
+		return fmt.Errorf("loading accounts: %s", err)
+	}
+	i := findAccount(accounts, p.Account)
+	if i == -1 {
+		return fmt.Errorf("account %q doesn't exist (%w)", p.Account, ErrInvalidPayment)
+	}
+	if p.Currency == "" {
+		p.Currency = accounts[i].Currency
+	} else if p.Currency != accounts[i].Currency {
+		return fmt.Errorf("payment is in %s, but account %q is in %s (%w)", p.Currency, accounts[i].Name, accounts[i].Currency, ErrInvalidPayment)
+	}
+	return nil
+}
+
+// ListAccounts returns the user's accounts, sorted by name
+func (api *API) ListAccounts(u db.Store) ([]Account, error) {
+	accounts, err := loadAccounts(u)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return strings.ToLower(accounts[i].Name) < strings.ToLower(accounts[j].Name)
+	})
+	return accounts, nil
+}
+
+// AddAccount creates an account. If it isn't given an opening date, it opens
+// on today. Errors: ErrInvalidAccount, err
+func (api *API) AddAccount(u db.Store, serializedaccount []byte, today Date) (*Account, error) {
+	var account Account
+	if err := json.Unmarshal(serializedaccount, &account); err != nil {
+		return nil, fmt.Errorf("unmarshaling json account: %s (%w)", err, ErrInvalidAccount)
+	}
+	if account.Opened.IsZero() {
+		account.Opened = today
+	}
+	if account.Currency == "" {
+		settings, err := loadSettings(u)
+		if err != nil {
+			return nil, fmt.Errorf("loading settings: %s", err)
+		}
+		account.Currency = settings.BaseCurrency
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	account.ID = id
+
+	accounts, err := loadAccounts(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAccount(&account, accounts); err != nil {
+		return nil, err
+	}
+	accounts = append(accounts, account)
+	return &account, saveJSON(u, "/accounts", accounts)
+}
+
+// accountInUse returns true if a payment or a transfer uses the account
+func accountInUse(u db.Store, id string) (bool, error) {
+	payments, err := loadPayments(u)
+	if err != nil {
+		return false, fmt.Errorf("loading payments: %s", err)
+	}
+	for _, p := range payments {
+		if p.Account == id {
+			return true, nil
+		}
+	}
+	recurring, err := loadRecurring(u)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range recurring {
+		if r.Payment.Account == id {
+			return true, nil
+		}
+	}
+	transfers, err := loadTransfers(u)
+	if err != nil {
+		return false, err
+	}
+	for _, t := range transfers {
+		if t.From == id || t.To == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UpdateAccount changes the fields present in serializedpatch. The currency
+// can't change once the account is used. Errors: ErrAccountNotFound,
+// ErrInvalidAccount, err
+func (api *API) UpdateAccount(u db.Store, id string, serializedpatch []byte) (*Account, error) {
+	accounts, err := loadAccounts(u)
+	if err != nil {
+		return nil, err
+	}
+	i := findAccount(accounts, id)
+	if i == -1 {
+		return nil, ErrAccountNotFound
+	}
+
+	account := accounts[i]
+	if err := json.Unmarshal(serializedpatch, &account); err != nil {
+		return nil, fmt.Errorf("unmarshaling json account: %s (%w)", err, ErrInvalidAccount)
+	}
+	account.ID = id
+	if err := checkAccount(&account, accounts); err != nil {
+		return nil, err
+	}
+	if account.Currency != accounts[i].Currency {
+		used, err := accountInUse(u, id)
+		if err != nil {
+			return nil, err
+		}
+		if used {
+			return nil, fmt.Errorf("can't change the currency of an account which is used (%w)", ErrInvalidAccount)
+		}
+	}
+
+	accounts[i] = account
+	return &account, saveJSON(u, "/accounts", accounts)
+}
+
+// DeleteAccount removes an account. Errors: ErrAccountNotFound,
+// ErrAccountInUse, err
+func (api *API) DeleteAccount(u db.Store, id string) error {
+	accounts, err := loadAccounts(u)
+	if err != nil {
+		return err
+	}
+	i := findAccount(accounts, id)
+	if i == -1 {
+		return ErrAccountNotFound
+	}
+	used, err := accountInUse(u, id)
+	if err != nil {
+		return err
+	}
+	if used {
+		return ErrAccountInUse
+	}
+	accounts = append(accounts[:i], accounts[i+1:]...)
+	return saveJSON(u, "/accounts", accounts)
+}
+
+func checkTransfer(t *Transfer, accounts []Account) error {
+	if t.From == t.To {
+		return fmt.Errorf("can't transfer from an account to itself (%w)", ErrInvalidTransfer)
+	}
+	from, to := findAccount(accounts, t.From), findAccount(accounts, t.To)
+	if from == -1 {
+		return fmt.Errorf("account %q doesn't exist (%w)", t.From, ErrInvalidTransfer)
+	}
+	if to == -1 {
+		return fmt.Errorf("account %q doesn't exist (%w)", t.To, ErrInvalidTransfer)
+	}
+	if t.Date.IsZero() {
+		return fmt.Errorf("need 'date' (%w)", ErrInvalidTransfer)
+	}
+	if t.Amount.Sign() <= 0 {
+		return fmt.Errorf("amount should be positive (%w)", ErrInvalidTransfer)
+	}
+
+	fromcur, tocur := accounts[from].Currency, accounts[to].Currency
+	amount, err := rescaleAmount(t.Amount, fromcur)
+	if err != nil {
+		return fmt.Errorf("amount %s (%w)", err, ErrInvalidTransfer)
+	}
+	t.Amount = amount
+
+	if fromcur == tocur {
+		t.Received = t.Amount
+		return nil
+	}
+	if t.Received.Sign() <= 0 {
+		return fmt.Errorf("need a positive 'received' amount in %s (%w)", tocur, ErrInvalidTransfer)
+	}
+	received, err := rescaleAmount(t.Received, tocur)
+	if err != nil {
+		return fmt.Errorf("received %s (%w)", err, ErrInvalidTransfer)
+	}
+	t.Received = received
+	return nil
+}
+
+// ListTransfers returns the transfers between from and to (both included, the
+// zero date means no bound), sorted by date
+func (api *API) ListTransfers(u db.Store, from, to Date) ([]Transfer, error) {
+	transfers, err := loadTransfers(u)
+	if err != nil {
+		return nil, err
+	}
+	selected := []Transfer{}
+	for _, t := range transfers {
+		if (!from.IsZero() && t.Date.Before(from.Time)) || (!to.IsZero() && t.Date.After(to.Time)) {
+			continue
+		}
+		selected = append(selected, t)
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].Date.Before(selected[j].Date.Time)
+	})
+	return selected, nil
+}
+
+// AddTransfer moves money between two accounts. Errors: ErrInvalidTransfer,
+// err
+func (api *API) AddTransfer(u db.Store, serializedtransfer []byte) (*Transfer, error) {
+	var transfer Transfer
+	if err := json.Unmarshal(serializedtransfer, &transfer); err != nil {
+		return nil, fmt.Errorf("unmarshaling json transfer: %s (%w)", err, ErrInvalidTransfer)
+	}
+	accounts, err := loadAccounts(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTransfer(&transfer, accounts); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	transfer.ID = id
+
+	transfers, err := loadTransfers(u)
+	if err != nil {
+		return nil, err
+	}
+	transfers = append(transfers, transfer)
+	return &transfer, saveJSON(u, "/transfers", transfers)
+}
+
+// UpdateTransfer changes the fields present in serializedpatch. Errors:
+// ErrTransferNotFound, ErrInvalidTransfer, err
+func (api *API) UpdateTransfer(u db.Store, id string, serializedpatch []byte) (*Transfer, error) {
+	transfers, err := loadTransfers(u)
+	if err != nil {
+		return nil, err
+	}
+	i := findTransfer(transfers, id)
+	if i == -1 {
+		return nil, ErrTransferNotFound
+	}
+	accounts, err := loadAccounts(u)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer := transfers[i]
+	if err := json.Unmarshal(serializedpatch, &transfer); err != nil {
+		return nil, fmt.Errorf("unmarshaling json transfer: %s (%w)", err, ErrInvalidTransfer)
+	}
+	transfer.ID = id
+	if err := checkTransfer(&transfer, accounts); err != nil {
+		return nil, err
+	}
+
+	transfers[i] = transfer
+	return &transfer, saveJSON(u, "/transfers", transfers)
+}
+
+// DeleteTransfer removes a transfer. Errors: ErrTransferNotFound, err
+func (api *API) DeleteTransfer(u db.Store, id string) error {
+	transfers, err := loadTransfers(u)
+	if err != nil {
+		return err
+	}
+	i := findTransfer(transfers, id)
+	if i == -1 {
+		return ErrTransferNotFound
+	}
+	transfers = append(transfers[:i], transfers[i+1:]...)
+	return saveJSON(u, "/transfers", transfers)
+}
+
+// Balances returns the balance of every account at the end of the day on: the
+// opening balance, minus the expenses, plus the income, minus the transfers
+// out, plus the transfers in. The accounts opened after on are left out
+func (api *API) Balances(u db.Store, on Date) ([]AccountBalance, error) {
+	accounts, err := api.ListAccounts(u)
+	if err != nil {
+		return nil, err
+	}
+	payments, err := loadPayments(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading payments: %s", err)
+	}
+	transfers, err := loadTransfers(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// counts is true if the movement happened between the account's opening
+	// and on
+	counts := func(a Account, d Date) bool {
+		return !d.Before(a.Opened.Time) && !d.After(on.Time)
+	}
+
+	balances := []AccountBalance{}
+	for _, a := range accounts {
+		if a.Opened.After(on.Time) {
+			continue
+		}
+		balance := a.Opening
+		for _, p := range payments {
+			if p.Account == a.ID && counts(a, p.Date) {
+				if balance, err = balance.Sub(p.spending()); err != nil {
+					return nil, fmt.Errorf("balance of %s: %s", a.Name, err)
+				}
+			}
+		}
+		for _, t := range transfers {
+			if t.From == a.ID && counts(a, t.Date) {
+				if balance, err = balance.Sub(t.Amount); err != nil {
+					return nil, fmt.Errorf("balance of %s: %s", a.Name, err)
+				}
+			}
+			if t.To == a.ID && counts(a, t.Date) {
+				if balance, err = balance.Add(t.Received); err != nil {
+					return nil, fmt.Errorf("balance of %s: %s", a.Name, err)
+				}
+			}
+		}
+		balances = append(balances, AccountBalance{Account: a, Balance: balance})
+	}
+	return balances, nil
+}
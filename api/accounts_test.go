@@ -0,0 +1,124 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAccounts(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	opened, _ := ParseDate("2019-12-01")
+	checking, err := api.AddAccount(u, []byte(`{"name": "Checking", "kind": "checking", "opening": "1000", "opened": "2019-12-01"}`), opened)
+	if err != nil {
+		t.Fatalf("adding checking account: %s", err)
+	}
+	if checking.Currency != "AUD" || checking.Opening.String() != "1000.00" {
+		t.Errorf("account should have the base currency and a rescaled opening, got %s %s", checking.Opening, checking.Currency)
+	}
+	cash, err := api.AddAccount(u, []byte(`{"name": "Wallet", "kind": "cash", "currency": "JPY"}`), opened)
+	if err != nil {
+		t.Fatalf("adding cash account: %s", err)
+	}
+
+	invalid := []string{
+		`{"name": "checking", "kind": "checking"}`,
+		`{"name": "Card", "kind": "card"}`,
+		`{"name": "Card", "kind": "credit", "opening": "1.5", "currency": "JPY"}`,
+		`{"kind": "credit"}`,
+	}
+	for _, serialized := range invalid {
+		if _, err := api.AddAccount(u, []byte(serialized), opened); !errors.Is(err, ErrInvalidAccount) {
+			t.Errorf("adding %s should have ErrInvalidAccount, got %v", serialized, err)
+		}
+	}
+
+	payments := []string{
+		// before the account was opened, it's in the opening balance
+		`{"name": "old", "amount": "30", "date": "2019-11-30", "account": "%s"}`,
+		`{"name": "groceries", "amount": "45.50", "date": "2019-12-05", "account": "%s"}`,
+		`{"name": "refund", "amount": "-10", "date": "2019-12-10", "account": "%s"}`,
+		`{"name": "rent", "amount": "400", "date": "2019-12-20", "account": "%s"}`,
+	}
+	for _, serialized := range payments {
+		if _, err := api.AddPayment(u, []byte(fmt.Sprintf(serialized, checking.ID))); err != nil {
+			t.Fatalf("adding payment: %s", err)
+		}
+	}
+	if _, err := api.AddPayment(u, []byte(`{"name": "x", "amount": "1", "date": "2019-12-05", "account": "nope"}`)); !errors.Is(err, ErrInvalidPayment) {
+		t.Errorf("payment with unknown account should have ErrInvalidPayment, got %v", err)
+	}
+	if _, err := api.AddPayment(u, []byte(fmt.Sprintf(`{"name": "x", "amount": "1", "currency": "AUD", "date": "2019-12-05", "account": %q}`, cash.ID))); !errors.Is(err, ErrInvalidPayment) {
+		t.Errorf("payment in the wrong currency should have ErrInvalidPayment, got %v", err)
+	}
+	ramen, err := api.AddPayment(u, []byte(fmt.Sprintf(`{"name": "ramen", "amount": "800", "date": "2019-12-08", "account": %q}`, cash.ID)))
+	if err != nil {
+		t.Fatalf("adding cash payment: %s", err)
+	}
+	if ramen.Currency != "JPY" {
+		t.Errorf("payment should have the account's currency, got %s", ramen.Currency)
+	}
+
+	transfer := fmt.Sprintf(`{"from": %q, "to": %q, "amount": "100", "received": "7000", "date": "2019-12-07"}`, checking.ID, cash.ID)
+	if _, err := api.AddTransfer(u, []byte(transfer)); err != nil {
+		t.Fatalf("adding transfer: %s", err)
+	}
+	invalidTransfers := []string{
+		fmt.Sprintf(`{"from": %q, "to": %q, "amount": "100", "date": "2019-12-07"}`, checking.ID, checking.ID),
+		fmt.Sprintf(`{"from": %q, "to": %q, "amount": "100", "date": "2019-12-07"}`, checking.ID, cash.ID),
+		fmt.Sprintf(`{"from": %q, "to": %q, "amount": "-5", "received": "1", "date": "2019-12-07"}`, checking.ID, cash.ID),
+		fmt.Sprintf(`{"from": %q, "to": "nope", "amount": "5", "date": "2019-12-07"}`, checking.ID),
+	}
+	for _, serialized := range invalidTransfers {
+		if _, err := api.AddTransfer(u, []byte(serialized)); !errors.Is(err, ErrInvalidTransfer) {
+			t.Errorf("adding transfer %s should have ErrInvalidTransfer, got %v", serialized, err)
+		}
+	}
+
+	expected := []struct {
+		date     string
+		checking string
+		cash     string
+	}{
+		{"2019-11-30", "", ""},
+		{"2019-12-06", "954.50", "0"},
+		{"2019-12-08", "854.50", "6200"},
+		{"2019-12-31", "464.50", "6200"},
+	}
+	for _, e := range expected {
+		on, _ := ParseDate(e.date)
+		balances, err := api.Balances(u, on)
+		if err != nil {
+			t.Fatalf("computing balances: %s", err)
+		}
+		got := make(map[string]string)
+		for _, b := range balances {
+			got[b.Account.ID] = b.Balance.String()
+		}
+		if got[checking.ID] != e.checking || got[cash.ID] != e.cash {
+			t.Errorf("balances on %s should have %q and %q, got %q and %q", e.date, e.checking, e.cash, got[checking.ID], got[cash.ID])
+		}
+	}
+
+	// payments are spending, transfers aren't
+	page, err := api.ListPayments(u, PaymentsQuery{Account: cash.ID})
+	if err != nil {
+		t.Fatalf("listing payments: %s", err)
+	}
+	if page.Total != 1 || page.Payments[0].ID != ramen.ID {
+		t.Errorf("payments of the cash account should have the ramen, got %v", page.Payments)
+	}
+
+	if err := api.DeleteAccount(u, cash.ID); !errors.Is(err, ErrAccountInUse) {
+		t.Errorf("deleting used account should have ErrAccountInUse, got %v", err)
+	}
+	if _, err := api.UpdateAccount(u, cash.ID, []byte(`{"currency": "EUR"}`)); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("changing the currency of a used account should have ErrInvalidAccount, got %v", err)
+	}
+	if _, err := api.UpdateAccount(u, cash.ID, []byte(`{"name": "Pocket"}`)); err != nil {
+		t.Errorf("renaming account: %s", err)
+	}
+}
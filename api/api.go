@@ -2,13 +2,14 @@ package api
 
 import (
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/math2001/money/db"
 	"github.com/math2001/money/keysmanager"
 )
 
@@ -39,22 +40,35 @@ const (
 )
 
 type API struct {
-	dataroot  string
-	userslist string
-	Usersdir  string
+	dataroot string
+	// Usersdir has the users' keys, in a folder per user
+	Usersdir string
+	// backends has the users list, the users' files, and a folder per shared
+	// ledger (see db.Backends)
+	backends  db.Backends
 	ocrserver string
 	// this salt is used to hash the passwords in the database
 	sm     *keysmanager.SM
 	client *http.Client
+
+	// migrated are the stores (see db.Store's String) migrated since the
+	// server started (see Migrate)
+	migrated   map[string]bool
+	migratedMu sync.Mutex
 }
 
-func NewAPI(dataroot string, ocrserver string) *API {
+// NewAPI returns the API whose keys are in dataroot, and files in backends.
+// If backends is nil, the files are in dataroot too
+func NewAPI(dataroot string, ocrserver string, backends db.Backends) *API {
 	log.Printf("API dataroot: %q", dataroot)
 
+	if backends == nil {
+		backends = db.FSBackends(dataroot)
+	}
 	api := &API{
 		dataroot:  dataroot,
-		userslist: filepath.Join(dataroot, "users.list"),
 		Usersdir:  filepath.Join(dataroot, "users"),
+		backends:  backends,
 		ocrserver: ocrserver,
 		client: &http.Client{
 			Timeout: 1 * time.Minute,
@@ -76,7 +90,7 @@ func (api *API) Initialize() error {
 	if err := api.sm.GenerateNew(); err != nil {
 		return fmt.Errorf("generating new salts: %s", err)
 	}
-	if err := ioutil.WriteFile(api.userslist, []byte("[]"), 0644); err != nil {
+	if err := api.backends("").Put(usersList, []byte("[]")); err != nil {
 		return fmt.Errorf("writing [] to file %s", err)
 	}
 	return nil
@@ -87,5 +101,48 @@ func (api *API) Resume() error {
 	if err := api.sm.Load(); err != nil {
 		return fmt.Errorf("loading salt: %s", err)
 	}
+	// nothing is writing yet, so the temporary files are left over by a crash
+	removed, err := db.RemoveTempFiles(api.dataroot)
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Printf("removed %d temporary files left over by a crash", removed)
+	}
+	return nil
+}
+
+// Migrate rewrites the store's files which are still in an old format, and
+// moves the payments and the history to their logs. It has to run before
+// anything reads the store: when the user logs in, when a ledger is opened,
+// and on the first request after the server started. It only does something
+// the first time for each store
+func (api *API) Migrate(u db.Store) error {
+	u = unwrapStore(u)
+	api.migratedMu.Lock()
+	done := api.migrated[u.String()]
+	api.migratedMu.Unlock()
+	if done {
+		return nil
+	}
+
+	// nothing else reads the store while it's migrated
+	defer u.Lock()()
+	if err := u.Migrate(); err != nil {
+		return fmt.Errorf("migrating %s: %s", u, err)
+	}
+	if err := moveLegacyPayments(u); err != nil {
+		return fmt.Errorf("migrating %s: %s", u, err)
+	}
+	if err := moveLegacyHistory(u); err != nil {
+		return fmt.Errorf("migrating %s: %s", u, err)
+	}
+
+	api.migratedMu.Lock()
+	if api.migrated == nil {
+		api.migrated = make(map[string]bool)
+	}
+	api.migrated[u.String()] = true
+	api.migratedMu.Unlock()
 	return nil
 }
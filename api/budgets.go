@@ -0,0 +1,295 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrInvalidBudget tags errors caused by a budget given by the user
+var ErrInvalidBudget = errors.New("invalid budget")
+
+var ErrBudgetNotFound = errors.New("budget not found")
+
+// Budget is the amount the user plans to spend in a category (and its
+// children) every period
+type Budget struct {
+	ID       string `json:"id"`
+	Category string `json:"category"`
+	// Period is PeriodWeek or PeriodMonth
+	Period Period `json:"period"`
+	// Amount is in the user's base currency
+	Amount Money `json:"amount"`
+	// Rollover carries what's left (or what was overspent) over to the next
+	// period
+	Rollover bool `json:"rollover"`
+	// Start is the first day the budget applies. The periods before it aren't
+	// rolled over
+	Start Date `json:"start"`
+}
+
+// BudgetStatus is where a budget is at for a given period. Every amount is in
+// Currency (the user's base currency)
+type BudgetStatus struct {
+	Budget      Budget `json:"budget"`
+	Currency    string `json:"currency"`
+	PeriodStart Date   `json:"period_start"`
+	PeriodEnd   Date   `json:"period_end"`
+	// Carried is what was rolled over from the previous periods
+	Carried   Money `json:"carried"`
+	Spent     Money `json:"spent"`
+	Remaining Money `json:"remaining"`
+	// Projected is what will have been spent at the end of the period if the
+	// user keeps spending at the same rate
+	Projected Money `json:"projected"`
+	// Unconverted are the IDs of the payments which couldn't be converted to
+	// the base currency. They aren't counted
+	Unconverted []string `json:"unconverted"`
+}
+
+func loadBudgets(u db.Store) ([]Budget, error) {
+	var budgets []Budget
+	if _, err := loadJSON(u, "/budgets", &budgets); err != nil {
+		return nil, err
+	}
+	return budgets, nil
+}
+
+func findBudget(budgets []Budget, id string) int {
+	for i, b := range budgets {
+		if b.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func checkBudget(u db.Store, b *Budget) error {
+	if b.Period != PeriodWeek && b.Period != PeriodMonth {
+		return fmt.Errorf("period should be %q or %q, got %q (%w)", PeriodWeek, PeriodMonth, b.Period, ErrInvalidBudget)
+	}
+	if b.Amount.Sign() <= 0 {
+		return fmt.Errorf("amount should be positive (%w)", ErrInvalidBudget)
+	}
+	if b.Start.IsZero() {
+		return fmt.Errorf("need 'start' date (%w)", ErrInvalidBudget)
+	}
+	path, err := normalizeCategory(b.Category)
+	if err != nil {
+		return fmt.Errorf("%s (%w)", err, ErrInvalidBudget)
+	}
+	c, err := loadCategories(u)
+	if err != nil {
+		return fmt.Errorf("loading categories: %s", err)
+	}
+	if !c[path] {
+		return fmt.Errorf("category %q doesn't exist (%w)", path, ErrInvalidBudget)
+	}
+	b.Category = path
+
+	settings, err := loadSettings(u)
+	if err != nil {
+		return fmt.Errorf("loading settings: %s", err)
+	}
+	exp := currencyExponent(settings.BaseCurrency)
+	if b.Amount.Exponent > exp {
+		return fmt.Errorf("amount has more decimal digits than %s allows (%w)", settings.BaseCurrency, ErrInvalidBudget)
+	}
+	if b.Amount, err = b.Amount.Rescale(exp); err != nil {
+		return fmt.Errorf("amount: %s (%w)", err, ErrInvalidBudget)
+	}
+	return nil
+}
+
+// AddBudget creates a budget. If it doesn't have a start date, it starts on
+// today. Errors: ErrInvalidBudget, err
+func (api *API) AddBudget(u db.Store, serializedbudget []byte, today Date) (*Budget, error) {
+	var budget Budget
+	if err := json.Unmarshal(serializedbudget, &budget); err != nil {
+		return nil, fmt.Errorf("unmarshaling json budget: %s (%w)", err, ErrInvalidBudget)
+	}
+	if budget.Start.IsZero() {
+		budget.Start = today
+	}
+	if err := checkBudget(u, &budget); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	budget.ID = id
+
+	budgets, err := loadBudgets(u)
+	if err != nil {
+		return nil, err
+	}
+	budgets = append(budgets, budget)
+	return &budget, saveJSON(u, "/budgets", budgets)
+}
+
+// UpdateBudget changes the fields present in serializedpatch. Errors:
+// ErrBudgetNotFound, ErrInvalidBudget, err
+func (api *API) UpdateBudget(u db.Store, id string, serializedpatch []byte) (*Budget, error) {
+	budgets, err := loadBudgets(u)
+	if err != nil {
+		return nil, err
+	}
+	i := findBudget(budgets, id)
+	if i == -1 {
+		return nil, ErrBudgetNotFound
+	}
+
+	budget := budgets[i]
+	if err := json.Unmarshal(serializedpatch, &budget); err != nil {
+		return nil, fmt.Errorf("unmarshaling json budget: %s (%w)", err, ErrInvalidBudget)
+	}
+	budget.ID = id
+	if err := checkBudget(u, &budget); err != nil {
+		return nil, err
+	}
+
+	budgets[i] = budget
+	return &budget, saveJSON(u, "/budgets", budgets)
+}
+
+// DeleteBudget removes a budget. Errors: ErrBudgetNotFound, err
+func (api *API) DeleteBudget(u db.Store, id string) error {
+	budgets, err := loadBudgets(u)
+	if err != nil {
+		return err
+	}
+	i := findBudget(budgets, id)
+	if i == -1 {
+		return ErrBudgetNotFound
+	}
+	budgets = append(budgets[:i], budgets[i+1:]...)
+	return saveJSON(u, "/budgets", budgets)
+}
+
+// BudgetStatuses returns the status of every budget for the period on is in
+func (api *API) BudgetStatuses(u db.Store, on Date) ([]BudgetStatus, error) {
+	budgets, err := loadBudgets(u)
+	if err != nil {
+		return nil, err
+	}
+	payments, err := loadPayments(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading payments: %s", err)
+	}
+	settings, err := loadSettings(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading settings: %s", err)
+	}
+	rates, err := loadRates(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading rates: %s", err)
+	}
+
+	statuses := make([]BudgetStatus, 0, len(budgets))
+	for _, b := range budgets {
+		status, err := budgetStatus(b, payments, rates, settings.BaseCurrency, on)
+		if err != nil {
+			return nil, fmt.Errorf("budget %s: %s", b.ID, err)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+func budgetStatus(b Budget, payments []Payment, rates *rates, currency string, on Date) (BudgetStatus, error) {
+	zero := Money{Exponent: currencyExponent(currency)}
+	status := BudgetStatus{
+		Budget:      b,
+		Currency:    currency,
+		PeriodStart: b.Period.start(on),
+		PeriodEnd:   b.Period.end(on),
+		Carried:     zero,
+		Spent:       zero,
+		Unconverted: []string{},
+	}
+
+	// spent per period, indexed by the period's first day
+	spent := make(map[string]Money)
+	first := b.Period.start(b.Start)
+	for _, p := range payments {
+		if p.Direction == DirectionIncome || !isCategoryOrChild(p.Category, b.Category) {
+			continue
+		}
+		if p.Date.Before(b.Start.Time) || p.Date.After(status.PeriodEnd.Time) {
+			continue
+		}
+		converted, err := rates.convert(p.Amount, p.Currency, currency, p.Date)
+		if errors.Is(err, ErrNoRate) {
+			if !p.Date.Before(status.PeriodStart.Time) {
+				status.Unconverted = append(status.Unconverted, p.ID)
+			}
+			continue
+		} else if err != nil {
+			return status, err
+		}
+		start := b.Period.start(p.Date).String()
+		if spent[start], err = spent[start].Add(converted); err != nil {
+			return status, err
+		}
+	}
+
+	if b.Rollover {
+		for start := first; start.Before(status.PeriodStart.Time); start = b.Period.next(start) {
+			left, err := b.Amount.Sub(spent[start.String()])
+			if err != nil {
+				return status, err
+			}
+			if status.Carried, err = status.Carried.Add(left); err != nil {
+				return status, err
+			}
+		}
+	}
+
+	var err error
+	if status.Spent, err = status.Spent.Add(spent[status.PeriodStart.String()]); err != nil {
+		return status, err
+	}
+	if status.Remaining, err = b.Amount.Add(status.Carried); err != nil {
+		return status, err
+	}
+	if status.Remaining, err = status.Remaining.Sub(status.Spent); err != nil {
+		return status, err
+	}
+
+	// project from the days elapsed in the period (today included). A budget
+	// which hasn't started yet, or a period which is over, projects what was
+	// spent
+	elapsed := days(status.PeriodStart, on)
+	if b.Start.After(status.PeriodStart.Time) {
+		elapsed = days(b.Start, on)
+	}
+	total := days(status.PeriodStart, status.PeriodEnd)
+	if elapsed <= 0 || elapsed >= total {
+		status.Projected = status.Spent
+	} else {
+		projected, err := status.Spent.Mul(int64(total))
+		if err != nil {
+			return status, err
+		}
+		status.Projected = projected.Div(int64(elapsed))
+	}
+	return status, nil
+}
+
+// renameBudgetsCategory makes the budgets follow a category which moved
+func renameBudgetsCategory(u db.Store, moved func(string) (string, bool)) error {
+	budgets, err := loadBudgets(u)
+	if err != nil {
+		return err
+	}
+	for i, b := range budgets {
+		if path, ok := moved(b.Category); ok {
+			budgets[i].Category = path
+		}
+	}
+	return saveJSON(u, "/budgets", budgets)
+}
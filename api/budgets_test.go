@@ -0,0 +1,118 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBudgets(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	for _, path := range []string{"Food > Groceries", "Transport"} {
+		if _, err := api.AddCategory(u, path); err != nil {
+			t.Fatalf("adding category: %s", err)
+		}
+	}
+
+	today, _ := ParseDate("2019-12-10")
+	if _, err := api.AddBudget(u, []byte(`{"category": "Food", "period": "year", "amount": "100"}`), today); !errors.Is(err, ErrInvalidBudget) {
+		t.Errorf("yearly budget should have ErrInvalidBudget, got %v", err)
+	}
+	if _, err := api.AddBudget(u, []byte(`{"category": "Food", "period": "month", "amount": "-100"}`), today); !errors.Is(err, ErrInvalidBudget) {
+		t.Errorf("negative amount should have ErrInvalidBudget, got %v", err)
+	}
+	if _, err := api.AddBudget(u, []byte(`{"category": "Rent", "period": "month", "amount": "100"}`), today); !errors.Is(err, ErrInvalidBudget) {
+		t.Errorf("unknown category should have ErrInvalidBudget, got %v", err)
+	}
+
+	budget, err := api.AddBudget(u, []byte(`{"category": "Food", "period": "month", "amount": "100", "rollover": true, "start": "2019-11-15"}`), today)
+	if err != nil {
+		t.Fatalf("adding budget: %s", err)
+	}
+
+	payments := []string{
+		`{"name": "before start", "amount": "1000", "date": "2019-11-14", "category": "Food"}`,
+		`{"name": "november", "amount": "80", "date": "2019-11-20", "category": "Food > Groceries"}`,
+		`{"name": "december", "amount": "10", "date": "2019-12-01", "category": "Food"}`,
+		`{"name": "december", "amount": "20.50", "date": "2019-12-05", "category": "Food > Groceries"}`,
+		`{"name": "other category", "amount": "15", "date": "2019-12-05", "category": "Transport"}`,
+		`{"name": "income", "amount": "200", "direction": "income", "date": "2019-12-05", "category": "Food"}`,
+		`{"name": "next month", "amount": "15", "date": "2020-01-01", "category": "Food"}`,
+	}
+	for _, serialized := range payments {
+		if _, err := api.AddPayment(u, []byte(serialized)); err != nil {
+			t.Fatalf("adding payment: %s", err)
+		}
+	}
+	abroad, err := api.AddPayment(u, []byte(`{"name": "no rate", "amount": "5", "currency": "USD", "date": "2019-12-06", "category": "Food"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+
+	statuses, err := api.BudgetStatuses(u, today)
+	if err != nil {
+		t.Fatalf("getting budget statuses: %s", err)
+	}
+	if len(statuses) != 1 {
+		t.Fatalf("should have 1 budget, got %d", len(statuses))
+	}
+	status := statuses[0]
+	if status.PeriodStart.String() != "2019-12-01" || status.PeriodEnd.String() != "2019-12-31" {
+		t.Errorf("period should be december, got %s to %s", status.PeriodStart, status.PeriodEnd)
+	}
+	expected := map[string]string{
+		"carried":   "20.00",
+		"spent":     "30.50",
+		"remaining": "89.50",
+		// 30.50 / 10 days * 31 days
+		"projected": "94.55",
+	}
+	actual := map[string]string{
+		"carried":   status.Carried.String(),
+		"spent":     status.Spent.String(),
+		"remaining": status.Remaining.String(),
+		"projected": status.Projected.String(),
+	}
+	for key, value := range expected {
+		if actual[key] != value {
+			t.Errorf("%s should be %s, got %s", key, value, actual[key])
+		}
+	}
+	if len(status.Unconverted) != 1 || status.Unconverted[0] != abroad.ID {
+		t.Errorf("payment without rate should be unconverted, got %v", status.Unconverted)
+	}
+
+	if _, err := api.UpdateBudget(u, budget.ID, []byte(`{"rollover": false}`)); err != nil {
+		t.Fatalf("updating budget: %s", err)
+	}
+	statuses, err = api.BudgetStatuses(u, today)
+	if err != nil {
+		t.Fatalf("getting budget statuses: %s", err)
+	}
+	if !statuses[0].Carried.IsZero() || statuses[0].Remaining.String() != "69.50" {
+		t.Errorf("without rollover, nothing should be carried, got %s carried and %s remaining", statuses[0].Carried, statuses[0].Remaining)
+	}
+
+	if err := api.DeleteCategory(u, "Food > Groceries"); !errors.Is(err, ErrCategoryInUse) {
+		t.Errorf("deleting a category with payments should have ErrCategoryInUse, got %v", err)
+	}
+	if err := api.RenameCategory(u, "Food", "Eating"); err != nil {
+		t.Fatalf("renaming category: %s", err)
+	}
+	statuses, err = api.BudgetStatuses(u, today)
+	if err != nil {
+		t.Fatalf("getting budget statuses: %s", err)
+	}
+	if statuses[0].Budget.Category != "Eating" || statuses[0].Spent.String() != "30.50" {
+		t.Errorf("budget should follow the renamed category, got %q with %s spent", statuses[0].Budget.Category, statuses[0].Spent)
+	}
+
+	if err := api.DeleteBudget(u, budget.ID); err != nil {
+		t.Fatalf("deleting budget: %s", err)
+	}
+	if err := api.DeleteBudget(u, budget.ID); !errors.Is(err, ErrBudgetNotFound) {
+		t.Errorf("deleting twice should have ErrBudgetNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,323 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/math2001/money/db"
+)
+
+// categorySeparator separates the levels of a category path (Food > Groceries)
+const categorySeparator = " > "
+
+var ErrInvalidCategory = errors.New("invalid category")
+
+var ErrCategoryNotFound = errors.New("category not found")
+
+var ErrCategoryExists = errors.New("category already exists")
+
+// ErrCategoryInUse is returned when deleting a category some payments still
+// use. Merge it into an other one instead
+var ErrCategoryInUse = errors.New("category in use")
+
+// Category is a node of the categories tree
+type Category struct {
+	Name     string      `json:"name"`
+	Path     string      `json:"path"`
+	Children []*Category `json:"children"`
+}
+
+// normalizeCategory cleans up the spaces around each level of the path. It
+// returns ErrInvalidCategory if a level is empty
+func normalizeCategory(path string) (string, error) {
+	levels := strings.Split(path, ">")
+	for i, level := range levels {
+		levels[i] = strings.TrimSpace(level)
+		if levels[i] == "" {
+			return "", fmt.Errorf("empty level in category %q (%w)", path, ErrInvalidCategory)
+		}
+	}
+	return strings.Join(levels, categorySeparator), nil
+}
+
+// isCategoryOrChild returns true if path is category, or one of its children
+// (at any depth). category must be normalized, path doesn't have to (payments
+// saved before categories were normalized have paths like "Food>Groceries")
+func isCategoryOrChild(path, category string) bool {
+	path = storedCategory(path)
+	return path == category || strings.HasPrefix(path, category+categorySeparator)
+}
+
+// storedCategory normalizes a path which was saved, and might not have been
+// normalized. It's returned as is if it's invalid
+func storedCategory(path string) string {
+	if normalized, err := normalizeCategory(path); err == nil {
+		return normalized
+	}
+	return path
+}
+
+// categories is the set of the user's categories paths
+type categories map[string]bool
+
+// add adds the path and all its parents
+func (c categories) add(path string) {
+	levels := strings.Split(path, categorySeparator)
+	for i := range levels {
+		c[strings.Join(levels[:i+1], categorySeparator)] = true
+	}
+}
+
+func (c categories) sorted() []string {
+	var paths []string
+	for path := range c {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// tree builds the categories tree. Roots are sorted by name, and so are the
+// children
+func (c categories) tree() []*Category {
+	var roots []*Category
+	nodes := make(map[string]*Category)
+	// sorted guarantees parents come before their children
+	for _, path := range c.sorted() {
+		node := &Category{
+			Path:     path,
+			Children: []*Category{},
+		}
+		i := strings.LastIndex(path, categorySeparator)
+		if i == -1 {
+			node.Name = path
+			roots = append(roots, node)
+		} else {
+			node.Name = path[i+len(categorySeparator):]
+			parent := nodes[path[:i]]
+			parent.Children = append(parent.Children, node)
+		}
+		nodes[path] = node
+	}
+	return roots
+}
+
+// loadCategories loads the user's categories. The first time, they are
+// created from the categories the payments use
+func loadCategories(u db.Store) (categories, error) {
+	var paths []string
+	exists, err := loadJSON(u, "/categories", &paths)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(categories)
+	for _, path := range paths {
+		c[path] = true
+	}
+	if exists {
+		return c, nil
+	}
+
+	payments, err := loadPayments(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading payments: %s", err)
+	}
+	for _, p := range payments {
+		if path, err := normalizeCategory(p.Category); err == nil {
+			c.add(path)
+		}
+	}
+	return c, nil
+}
+
+func saveCategories(u db.Store, c categories) error {
+	return saveJSON(u, "/categories", c.sorted())
+}
+
+// ListCategories returns the user's categories as a tree
+func (api *API) ListCategories(u db.Store) ([]*Category, error) {
+	c, err := loadCategories(u)
+	if err != nil {
+		return nil, err
+	}
+	return c.tree(), nil
+}
+
+// AddCategory creates the category, and its parents if they don't exist.
+// Errors: ErrInvalidCategory, ErrCategoryExists, err
+func (api *API) AddCategory(u db.Store, path string) (string, error) {
+	path, err := normalizeCategory(path)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := loadCategories(u)
+	if err != nil {
+		return "", err
+	}
+	if c[path] {
+		return "", ErrCategoryExists
+	}
+	c.add(path)
+	return path, saveCategories(u, c)
+}
+
+// RenameCategory renames the category and its children, and updates the
+// payments which use them. Errors: ErrInvalidCategory, ErrCategoryNotFound,
+// ErrCategoryExists, err
+func (api *API) RenameCategory(u db.Store, from, to string) error {
+	return moveCategory(u, from, to, false)
+}
+
+// MergeCategory moves the payments and children of from into into, and
+// removes from. Errors: ErrInvalidCategory, ErrCategoryNotFound, err
+func (api *API) MergeCategory(u db.Store, from, into string) error {
+	return moveCategory(u, from, into, true)
+}
+
+func moveCategory(u db.Store, from, to string, merge bool) error {
+	from, err := normalizeCategory(from)
+	if err != nil {
+		return err
+	}
+	to, err = normalizeCategory(to)
+	if err != nil {
+		return err
+	}
+	if isCategoryOrChild(to, from) {
+		return fmt.Errorf("can't move %q into itself (%w)", from, ErrInvalidCategory)
+	}
+
+	c, err := loadCategories(u)
+	if err != nil {
+		return err
+	}
+	if !c[from] {
+		return fmt.Errorf("%q (%w)", from, ErrCategoryNotFound)
+	}
+	if merge && !c[to] {
+		return fmt.Errorf("%q (%w)", to, ErrCategoryNotFound)
+	} else if !merge && c[to] {
+		return fmt.Errorf("%q (%w)", to, ErrCategoryExists)
+	}
+
+	moved := func(path string) string {
+		return to + strings.TrimPrefix(storedCategory(path), from)
+	}
+
+	for _, path := range c.sorted() {
+		if isCategoryOrChild(path, from) {
+			delete(c, path)
+			c.add(moved(path))
+		}
+	}
+
+	previous, nrecords, err := readPayments(u)
+	if err != nil {
+		return fmt.Errorf("loading payments: %s", err)
+	}
+	payments := copyPayments(previous)
+	for i, p := range payments {
+		if isCategoryOrChild(p.Category, from) {
+			payments[i].Category = moved(p.Category)
+		}
+	}
+
+	if err := saveCategories(u, c); err != nil {
+		return err
+	}
+	if err := savePayments(u, previous, nrecords, payments); err != nil {
+		return err
+	}
+	follow := func(path string) (string, bool) {
+		if path == "" || !isCategoryOrChild(path, from) {
+			return "", false
+		}
+		return moved(path), true
+	}
+	if err := renameRulesCategory(u, follow); err != nil {
+		return err
+	}
+	if err := renameBudgetsCategory(u, follow); err != nil {
+		return err
+	}
+	return renameRecurringCategory(u, follow)
+}
+
+// DeleteCategory deletes the category and its children, unless payments,
+// budgets or recurring payments use them. Errors: ErrInvalidCategory,
+// ErrCategoryNotFound, ErrCategoryInUse, err
+func (api *API) DeleteCategory(u db.Store, path string) error {
+	path, err := normalizeCategory(path)
+	if err != nil {
+		return err
+	}
+
+	c, err := loadCategories(u)
+	if err != nil {
+		return err
+	}
+	if !c[path] {
+		return fmt.Errorf("%q (%w)", path, ErrCategoryNotFound)
+	}
+
+	payments, err := loadPayments(u)
+	if err != nil {
+		return fmt.Errorf("loading payments: %s", err)
+	}
+	for _, p := range payments {
+		if isCategoryOrChild(p.Category, path) {
+			return fmt.Errorf("%q is used by %q (%w)", p.Category, p.Name, ErrCategoryInUse)
+		}
+	}
+
+	budgets, err := loadBudgets(u)
+	if err != nil {
+		return fmt.Errorf("loading budgets: %s", err)
+	}
+	for _, b := range budgets {
+		if isCategoryOrChild(b.Category, path) {
+			return fmt.Errorf("%q has a budget (%w)", b.Category, ErrCategoryInUse)
+		}
+	}
+	recurring, err := loadRecurring(u)
+	if err != nil {
+		return fmt.Errorf("loading recurring payments: %s", err)
+	}
+	for _, r := range recurring {
+		if isCategoryOrChild(r.Payment.Category, path) {
+			return fmt.Errorf("%q is used by the recurring payment %q (%w)", r.Payment.Category, r.Payment.Name, ErrCategoryInUse)
+		}
+	}
+
+	for other := range c {
+		if isCategoryOrChild(other, path) {
+			delete(c, other)
+		}
+	}
+	return saveCategories(u, c)
+}
+
+// checkPaymentCategory normalizes the payment's category, and makes sure it
+// exists. Errors: ErrInvalidPayment, err
+func checkPaymentCategory(u db.Store, p *Payment) error {
+	if p.Category == "" {
+		return nil
+	}
+	path, err := normalizeCategory(p.Category)
+	if err != nil {
+		return fmt.Errorf("%s (%w)", err, ErrInvalidPayment)
+	}
+	c, err := loadCategories(u)
+	if err != nil {
+		return fmt.Errorf("loading categories: %s", err)
+	}
+	if !c[path] {
+		return fmt.Errorf("category %q doesn't exist (%w)", path, ErrInvalidPayment)
+	}
+	p.Category = path
+	return nil
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCategories(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	if _, err := api.AddCategory(u, "Food >  Groceries"); err != nil {
+		t.Fatalf("adding category: %s", err)
+	}
+	if _, err := api.AddCategory(u, "Food"); !errors.Is(err, ErrCategoryExists) {
+		t.Errorf("parent should have been created, got %v", err)
+	}
+	if _, err := api.AddCategory(u, "Food > > Fruits"); !errors.Is(err, ErrInvalidCategory) {
+		t.Errorf("should have ErrInvalidCategory, got %v", err)
+	}
+	if _, err := api.AddCategory(u, "Eating out"); err != nil {
+		t.Fatalf("adding category: %s", err)
+	}
+
+	if _, err := api.AddPayment(u, []byte(`{"name": "a", "amount": 1, "date": "2019-12-20", "category": "Transport"}`)); !errors.Is(err, ErrInvalidPayment) {
+		t.Errorf("unknown category should have ErrInvalidPayment, got %v", err)
+	}
+	groceries, err := api.AddPayment(u, []byte(`{"name": "a", "amount": 1, "date": "2019-12-20", "category": "Food>Groceries"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	if groceries.Category != "Food > Groceries" {
+		t.Errorf("category should be normalized, got %q", groceries.Category)
+	}
+	restaurant, err := api.AddPayment(u, []byte(`{"name": "b", "amount": 1, "date": "2019-12-20", "category": "Eating out"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+
+	// saved before categories were normalized
+	previous, nrecords, err := readPayments(u)
+	if err != nil {
+		t.Fatalf("loading payments: %s", err)
+	}
+	date, _ := ParseDate("2019-12-20")
+	legacy := Payment{ID: "legacy", Name: "c", Amount: Money{Units: 1}, Date: date, Category: "Food>Groceries"}
+	if err := savePayments(u, previous, nrecords, append(copyPayments(previous), legacy)); err != nil {
+		t.Fatalf("saving legacy payment: %s", err)
+	}
+
+	if err := api.DeleteCategory(u, "Food"); !errors.Is(err, ErrCategoryInUse) {
+		t.Errorf("should have ErrCategoryInUse, got %v", err)
+	}
+	if err := api.RenameCategory(u, "Food", "Eating out"); !errors.Is(err, ErrCategoryExists) {
+		t.Errorf("should have ErrCategoryExists, got %v", err)
+	}
+	if err := api.RenameCategory(u, "Food", "Food > Home"); !errors.Is(err, ErrInvalidCategory) {
+		t.Errorf("should have ErrInvalidCategory, got %v", err)
+	}
+	if err := api.RenameCategory(u, "Food", "Meals"); err != nil {
+		t.Fatalf("renaming category: %s", err)
+	}
+	if err := api.MergeCategory(u, "Eating out", "Meals"); err != nil {
+		t.Fatalf("merging category: %s", err)
+	}
+
+	tree, err := api.ListCategories(u)
+	if err != nil {
+		t.Fatalf("listing categories: %s", err)
+	}
+	if len(tree) != 1 || tree[0].Path != "Meals" || len(tree[0].Children) != 1 || tree[0].Children[0].Path != "Meals > Groceries" {
+		t.Errorf("should only have Meals > Groceries, got %+v", tree)
+	}
+
+	payments, err := loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading payments: %s", err)
+	}
+	expected := map[string]string{
+		groceries.ID:  "Meals > Groceries",
+		restaurant.ID: "Meals",
+		legacy.ID:     "Meals > Groceries",
+	}
+	if len(payments) != len(expected) {
+		t.Errorf("should have %d payments, got %d", len(expected), len(payments))
+	}
+	for _, p := range payments {
+		if p.Category != expected[p.ID] {
+			t.Errorf("payment %s should be in %q, got %q", p.Name, expected[p.ID], p.Category)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrDuplicatePayment is returned in strict mode when a new payment looks like
+// an existing one. The error is a *DuplicateError
+var ErrDuplicatePayment = errors.New("duplicate payment")
+
+// DuplicateError lists the payments a new one looks like
+type DuplicateError struct {
+	Candidates []Payment
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("looks like %d existing payment(s)", len(e.Candidates))
+}
+
+func (e *DuplicateError) Is(target error) bool {
+	return target == ErrDuplicatePayment
+}
+
+// duplicateWindow is how many days apart two payments can be and still be
+// duplicates (banks and people don't always agree on the date)
+const duplicateWindow = 3
+
+// normalizeName lowercases the name, and only keeps its letters and digits
+func normalizeName(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// levenshtein returns the number of runes to insert, delete or substitute to
+// go from a to b
+func levenshtein(a, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// similarNames is true if a and b are probably the name of the same thing:
+// they are equal once normalized, one is contained in the other (bank
+// descriptions add locations and card numbers), or they differ by at most a
+// fifth of their characters
+func similarNames(a, b string) bool {
+	a, b = normalizeName(a), normalizeName(b)
+	if a == "" || b == "" {
+		return a == b
+	}
+	if strings.Contains(" "+a+" ", " "+b+" ") || strings.Contains(" "+b+" ", " "+a+" ") {
+		return true
+	}
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return levenshtein(ra, rb)*5 <= longest
+}
+
+// isDuplicate is true if a and b are likely the same payment: the same
+// amount, a few days apart, with similar names
+func isDuplicate(a, b Payment) bool {
+	if a.Direction != b.Direction || a.Currency != b.Currency || a.Amount.Cmp(b.Amount) != 0 {
+		return false
+	}
+	gap := days(a.Date, b.Date)
+	if a.Date.After(b.Date.Time) {
+		gap = days(b.Date, a.Date)
+	}
+	// days counts both ends
+	if gap-1 > duplicateWindow {
+		return false
+	}
+	return similarNames(a.Name, b.Name)
+}
+
+// findDuplicates returns the payments p looks like (p itself excluded)
+func findDuplicates(payments []Payment, p Payment) []Payment {
+	var candidates []Payment
+	for _, other := range payments {
+		if other.ID != p.ID && isDuplicate(p, other) {
+			candidates = append(candidates, other)
+		}
+	}
+	return candidates
+}
+
+// checkDuplicates returns a *DuplicateError if p looks like one of the
+// payments and the user is in strict mode (unless force is true). Otherwise,
+// it returns the candidates
+func checkDuplicates(u db.Store, payments []Payment, p Payment, force bool) ([]Payment, error) {
+	candidates := findDuplicates(payments, p)
+	if len(candidates) == 0 || force {
+		return candidates, nil
+	}
+	settings, err := loadSettings(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading settings: %s", err)
+	}
+	if settings.StrictDuplicates {
+		return candidates, &DuplicateError{Candidates: candidates}
+	}
+	return candidates, nil
+}
+
+// FindDuplicates returns the payments which look like the one with the given
+// id. Errors: ErrPaymentNotFound, err
+func (api *API) FindDuplicates(u db.Store, id string) ([]Payment, error) {
+	payments, err := loadPayments(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading payments: %s", err)
+	}
+	i := findPayment(payments, id)
+	if i == -1 {
+		return nil, ErrPaymentNotFound
+	}
+	return findDuplicates(payments, payments[i]), nil
+}
+
+// MergePayments merges the payment duplicateid into keepid, and deletes it.
+// The fields keepid doesn't have are taken from duplicateid, and the tags are
+// combined. Errors: ErrPaymentNotFound, ErrInvalidPayment, err
+func (api *API) MergePayments(u db.Store, keepid, duplicateid string) (*Payment, error) {
+	if keepid == duplicateid {
+		return nil, fmt.Errorf("can't merge a payment with itself (%w)", ErrInvalidPayment)
+	}
+	previous, nrecords, err := readPayments(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading payments: %s", err)
+	}
+	payments := copyPayments(previous)
+	i := findPayment(payments, keepid)
+	j := findPayment(payments, duplicateid)
+	if i == -1 || j == -1 {
+		return nil, ErrPaymentNotFound
+	}
+
+	keep, duplicate := copyPayment(payments[i]), payments[j]
+	if keep.Category == "" {
+		keep.Category = duplicate.Category
+	}
+	if keep.Merchant == "" {
+		keep.Merchant = duplicate.Merchant
+	}
+	if keep.Account == "" {
+		keep.Account = duplicate.Account
+	}
+	if keep.Notes == "" {
+		keep.Notes = duplicate.Notes
+	}
+	if keep.ImportID == "" {
+		keep.ImportID = duplicate.ImportID
+	}
+	if keep.Receipt == "" {
+		keep.Receipt = duplicate.Receipt
+	} else if duplicate.Receipt != "" {
+		// a payment only has one receipt, and we don't throw receipts away
+		return nil, fmt.Errorf("both payments have a receipt (%w)", ErrInvalidPayment)
+	}
+	if keep.Split == nil && keep.Amount.Cmp(duplicate.Amount) == 0 {
+		keep.Split = copySplit(duplicate.Split)
+	}
+	for _, tag := range duplicate.Tags {
+		if !hasTag(keep, tag) {
+			keep.Tags = append(keep.Tags, tag)
+		}
+	}
+	for key, value := range duplicate.Custom {
+		if _, ok := keep.Custom[key]; !ok {
+			if keep.Custom == nil {
+				keep.Custom = make(map[string]string)
+			}
+			keep.Custom[key] = value
+		}
+	}
+
+	payments[i] = keep
+	payments = append(payments[:j], payments[j+1:]...)
+	if err := savePayments(u, previous, nrecords, payments); err != nil {
+		return nil, err
+	}
+	return &keep, nil
+}
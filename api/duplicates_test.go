@@ -0,0 +1,117 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSimilarNames(t *testing.T) {
+	table := []struct {
+		a, b    string
+		similar bool
+	}{
+		{"Coffee", "coffee", true},
+		{"WOOLWORTHS 1234 SYDNEY", "Woolworths", true},
+		{"Netflix.com", "netflix com", true},
+		{"Starbucks", "Starbuck", true},
+		{"rent", "bus", false},
+		{"Woolworths", "Wool", false},
+		{"Uber trip", "Uber eats", false},
+	}
+	for _, row := range table {
+		if similarNames(row.a, row.b) != row.similar {
+			t.Errorf("similarNames(%q, %q) should be %t", row.a, row.b, row.similar)
+		}
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	if _, err := api.AddCategory(u, "Food"); err != nil {
+		t.Fatalf("adding category: %s", err)
+	}
+	original, err := api.AddPayment(u, []byte(`{"name": "Woolworths", "amount": "45.20", "date": "2019-12-20", "category": "Food"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+
+	// not strict: it's added, and reported
+	double, err := api.AddPayment(u, []byte(`{"name": "WOOLWORTHS 1234 SYDNEY", "amount": "45.2", "date": "2019-12-22", "tags": ["weekly"]}`))
+	if err != nil {
+		t.Fatalf("adding duplicate: %s", err)
+	}
+	candidates, err := api.FindDuplicates(u, double.ID)
+	if err != nil {
+		t.Fatalf("finding duplicates: %s", err)
+	}
+	if len(candidates) != 1 || candidates[0].ID != original.ID {
+		t.Errorf("should have the original as candidate, got %+v", candidates)
+	}
+
+	for _, serialized := range []string{
+		`{"name": "Woolworths", "amount": "45.20", "date": "2019-12-26"}`,
+		`{"name": "Woolworths", "amount": "45.21", "date": "2019-12-20"}`,
+		`{"name": "Woolworths", "amount": "45.20", "currency": "USD", "date": "2019-12-20"}`,
+		`{"name": "Coles", "amount": "45.20", "date": "2019-12-20"}`,
+	} {
+		p, err := api.AddPayment(u, []byte(serialized))
+		if err != nil {
+			t.Fatalf("adding payment: %s", err)
+		}
+		if candidates, _ := api.FindDuplicates(u, p.ID); len(candidates) != 0 {
+			t.Errorf("%s shouldn't be a duplicate, got %+v", serialized, candidates)
+		}
+		if err := api.DeletePayment(u, p.ID, 0); err != nil {
+			t.Fatalf("deleting payment: %s", err)
+		}
+	}
+
+	merged, err := api.MergePayments(u, original.ID, double.ID)
+	if err != nil {
+		t.Fatalf("merging payments: %s", err)
+	}
+	if merged.Category != "Food" || len(merged.Tags) != 1 || merged.Name != "Woolworths" {
+		t.Errorf("merged payment should keep its fields and get the tags, got %+v", merged)
+	}
+	if _, err := api.FindDuplicates(u, double.ID); !errors.Is(err, ErrPaymentNotFound) {
+		t.Errorf("merged duplicate should be deleted, got %v", err)
+	}
+	if _, err := api.MergePayments(u, original.ID, original.ID); !errors.Is(err, ErrInvalidPayment) {
+		t.Errorf("merging a payment with itself should have ErrInvalidPayment, got %v", err)
+	}
+
+	// strict mode
+	if _, err := api.UpdateSettings(u, []byte(`{"strict_duplicates": true}`)); err != nil {
+		t.Fatalf("updating settings: %s", err)
+	}
+	serialized := []byte(`{"name": "woolworths", "amount": "45.20", "date": "2019-12-19"}`)
+	_, err = api.AddPayment(u, serialized)
+	var duplicate *DuplicateError
+	if !errors.As(err, &duplicate) || !errors.Is(err, ErrDuplicatePayment) || duplicate.Candidates[0].ID != original.ID {
+		t.Fatalf("strict mode should refuse duplicates with a *DuplicateError, got %v", err)
+	}
+	if _, err := api.ForceAddPayment(u, serialized); err != nil {
+		t.Fatalf("forcing duplicate: %s", err)
+	}
+
+	profile, err := api.AddImportProfile(u, []byte(`{"name": "bank", "columns": {"date": 1, "name": 2, "amount": 3}}`))
+	if err != nil {
+		t.Fatalf("adding profile: %s", err)
+	}
+	file := "2019-12-21,WOOLWORTHS,-45.20\n2019-12-21,Bakery,-3\n"
+	result, err := api.ImportCSV(u, profile.ID, strings.NewReader(file), ImportOptions{})
+	if !errors.Is(err, ErrInvalidImport) || result.Errors != 1 || len(result.Rows[0].Candidates) != 2 {
+		t.Errorf("strict mode should refuse rows which look like existing payments, got %v %+v", err, result)
+	}
+	result, err = api.ImportCSV(u, profile.ID, strings.NewReader(file), ImportOptions{Force: true})
+	if err != nil {
+		t.Fatalf("forcing import: %s", err)
+	}
+	if result.Imported != 2 || len(result.Rows[0].Candidates) != 2 {
+		t.Errorf("forced import should import every row and still report candidates, got %+v", result)
+	}
+}
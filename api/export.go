@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrUnknownFormat is returned when exporting to a format we don't know
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// the formats payments can be exported to
+const (
+	FormatCSV    = "csv"
+	FormatJSON   = "json"
+	FormatLedger = "ledger"
+)
+
+// ledgerBalancingAccount is where the money of the payments comes from. We
+// don't know, so it's left for the user to reconcile
+const ledgerBalancingAccount = "Assets:Unknown"
+
+// ExportPayments returns a function which writes the payments between from
+// and to (both included, the zero date means no bound) to a writer, sorted by
+// date. The payments are loaded before it returns, so that errors can be
+// reported before anything is written. Format is FormatCSV, FormatJSON or
+// FormatLedger (an hledger/ledger journal, where the categories are accounts
+// under Expenses or Income). Errors: ErrUnknownFormat, err
+func (api *API) ExportPayments(u db.Store, format string, from, to Date) (func(io.Writer) error, error) {
+	var export func(io.Writer, []Payment) error
+	switch format {
+	case FormatCSV:
+		export = exportCSV
+	case FormatJSON:
+		export = exportJSON
+	case FormatLedger:
+		export = exportLedger
+	default:
+		return nil, fmt.Errorf("%q (%w)", format, ErrUnknownFormat)
+	}
+
+	page, err := api.ListPayments(u, PaymentsQuery{From: from, To: to})
+	if err != nil {
+		return nil, err
+	}
+
+	return func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		if err := export(bw, page.Payments); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}, nil
+}
+
+// exportCSV writes a header line, and a line per payment. Tags are separated
+// by ";", and every custom field has its own column
+func exportCSV(w io.Writer, payments []Payment) error {
+	customs := make(map[string]bool)
+	for _, p := range payments {
+		for key := range p.Custom {
+			customs[key] = true
+		}
+	}
+	var custom []string
+	for key := range customs {
+		custom = append(custom, key)
+	}
+	sort.Strings(custom)
+
+	writer := csv.NewWriter(w)
+	header := append([]string{"id", "date", "name", "amount", "direction", "currency", "category", "merchant", "tags", "notes"}, custom...)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, p := range payments {
+		record := []string{
+			p.ID,
+			p.Date.String(),
+			p.Name,
+			p.Amount.String(),
+			p.Direction,
+			p.Currency,
+			p.Category,
+			p.Merchant,
+			strings.Join(p.Tags, ";"),
+			p.Notes,
+		}
+		for _, key := range custom {
+			record = append(record, p.Custom[key])
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// exportJSON writes a JSON array of payments, one payment at a time
+func exportJSON(w io.Writer, payments []Payment) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i, p := range payments {
+		content, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			content = append([]byte(","), content...)
+		}
+		if _, err := w.Write(append([]byte("\n"), content...)); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n]\n")
+	return err
+}
+
+// ledgerText makes s fit on one line of a journal
+func ledgerText(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// ledgerAccount maps a category to an account: Food > Groceries becomes
+// Expenses:Food:Groceries (or Income:Food:Groceries for income)
+func ledgerAccount(p Payment) string {
+	root := "Expenses"
+	if p.Direction == DirectionIncome {
+		root = "Income"
+	}
+	category := p.Category
+	if category == "" {
+		return root + ":Uncategorized"
+	}
+	levels := strings.Split(category, categorySeparator)
+	for i, level := range levels {
+		// : separates the levels, and two spaces end the account name
+		levels[i] = strings.Replace(ledgerText(level), ":", "-", -1)
+	}
+	return root + ":" + strings.Join(levels, ":")
+}
+
+// exportLedger writes a transaction per payment. The payment's id, tags and
+// custom fields are kept as hledger tags
+func exportLedger(w io.Writer, payments []Payment) error {
+	for _, p := range payments {
+		description := ledgerText(p.Name)
+		if p.Merchant != "" {
+			// hledger reads it as payee | note
+			description = ledgerText(p.Merchant) + " | " + description
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %s\n", p.Date, description)
+		fmt.Fprintf(&b, "    ; id:%s\n", p.ID)
+		for _, tag := range p.Tags {
+			fmt.Fprintf(&b, "    ; %s:\n", ledgerTag(tag))
+		}
+		var keys []string
+		for key := range p.Custom {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "    ; %s:%s\n", ledgerTag(key), ledgerText(p.Custom[key]))
+		}
+		if p.Notes != "" {
+			fmt.Fprintf(&b, "    ; %s\n", ledgerText(p.Notes))
+		}
+		// income comes out of the Income account, so it's negative
+		fmt.Fprintf(&b, "    %s  %s %s\n", ledgerAccount(p), p.spending(), p.Currency)
+		fmt.Fprintf(&b, "    %s\n\n", ledgerBalancingAccount)
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ledgerTag makes s a valid tag name (no spaces, no colons, no commas)
+func ledgerTag(s string) string {
+	return strings.NewReplacer(" ", "-", ":", "-", ",", "-").Replace(ledgerText(s))
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExportPayments(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	if _, err := api.AddCategory(u, "Food > Groceries"); err != nil {
+		t.Fatalf("adding category: %s", err)
+	}
+	payments := []string{
+		`{"name": "dinner", "amount": "40", "date": "2019-12-24", "tags": ["family", "xmas eve"]}`,
+		`{"name": "bread,\nflour", "amount": "5.20", "date": "2019-12-20", "category": "Food > Groceries", "merchant": "Bakery", "warranty": "yes"}`,
+		`{"name": "too old", "amount": "1", "date": "2019-11-30"}`,
+	}
+	for _, serialized := range payments {
+		if _, err := api.AddPayment(u, []byte(serialized)); err != nil {
+			t.Fatalf("adding payment: %s", err)
+		}
+	}
+
+	if _, err := api.ExportPayments(u, "xls", Date{}, Date{}); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("unknown format should have ErrUnknownFormat, got %v", err)
+	}
+
+	from, _ := ParseDate("2019-12-01")
+	export := func(format string) string {
+		stream, err := api.ExportPayments(u, format, from, Date{})
+		if err != nil {
+			t.Fatalf("exporting %s: %s", format, err)
+		}
+		var b bytes.Buffer
+		if err := stream(&b); err != nil {
+			t.Fatalf("writing %s export: %s", format, err)
+		}
+		return b.String()
+	}
+
+	csv := export(FormatCSV)
+	lines := strings.Split(csv, "\n")
+	if lines[0] != "id,date,name,amount,direction,currency,category,merchant,tags,notes,warranty" {
+		t.Errorf("csv header should have the custom fields, got %q", lines[0])
+	}
+	if !strings.Contains(csv, `,2019-12-20,"bread,`+"\n"+`flour",5.20,expense,AUD,Food > Groceries,Bakery,,,yes`) {
+		t.Errorf("csv should have the bread, got %q", csv)
+	}
+	if !strings.Contains(csv, ",2019-12-24,dinner,40.00,expense,AUD,,,family;xmas eve,,") || strings.Contains(csv, "too old") {
+		t.Errorf("csv should have the dinner, and not the payment before 'from', got %q", csv)
+	}
+
+	var decoded []Payment
+	if err := json.Unmarshal([]byte(export(FormatJSON)), &decoded); err != nil {
+		t.Fatalf("json export should be valid json: %s", err)
+	}
+	if len(decoded) != 2 || decoded[0].Name != "bread,\nflour" || decoded[1].Amount.String() != "40.00" {
+		t.Errorf("json export should have the 2 payments sorted by date, got %+v", decoded)
+	}
+
+	ledger := export(FormatLedger)
+	expected := "2019-12-20 Bakery | bread, flour\n" +
+		"    ; id:" + decoded[0].ID + "\n" +
+		"    ; warranty:yes\n" +
+		"    Expenses:Food:Groceries  5.20 AUD\n" +
+		"    Assets:Unknown\n\n" +
+		"2019-12-24 dinner\n" +
+		"    ; id:" + decoded[1].ID + "\n" +
+		"    ; family:\n" +
+		"    ; xmas-eve:\n" +
+		"    Expenses:Uncategorized  40.00 AUD\n" +
+		"    Assets:Unknown\n\n"
+	if ledger != expected {
+		t.Errorf("ledger export should be\n%s\ngot\n%s", expected, ledger)
+	}
+}
+
+func TestLedgerAccount(t *testing.T) {
+	payments := map[string]Payment{
+		"Expenses:Food:Groceries": {Category: "Food > Groceries", Direction: DirectionExpense},
+		"Expenses:Uncategorized":  {Direction: DirectionExpense},
+		"Income:Salary":           {Category: "Salary", Direction: DirectionIncome},
+		"Income:Uncategorized":    {Direction: DirectionIncome},
+	}
+	for expected, p := range payments {
+		if account := ledgerAccount(p); account != expected {
+			t.Errorf("account of %+v should have %q, got %q", p, expected, account)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrNothingToUndo is returned when every change has been undone already
+var ErrNothingToUndo = errors.New("nothing to undo")
+
+// ErrUndoConflict is returned when a payment was changed since the change
+// being undone, so undoing it would loose data
+var ErrUndoConflict = errors.New("can't undo: the payment was changed since")
+
+// what happened to a payment
+const (
+	EventCreate = "create"
+	EventUpdate = "update"
+	EventDelete = "delete"
+)
+
+// Actor is who (and from where) changes the payments
+type Actor struct {
+	UserID int    `json:"user_id,omitempty"`
+	Email  string `json:"email,omitempty"`
+	// Session identifies the login the change was made from
+	Session string `json:"session,omitempty"`
+	// Device is the user agent of the browser
+	Device string `json:"device,omitempty"`
+}
+
+// actingStore is a store with who is using it, so that the history can say
+// who changed what
+type actingStore struct {
+	db.Store
+	actor Actor
+}
+
+// ActingAs returns u, for which the changes are recorded as made by actor
+func ActingAs(u db.Store, actor Actor) db.Store {
+	return &actingStore{Store: unwrapStore(u), actor: actor}
+}
+
+// unwrapStore returns the store actingStore wraps
+func unwrapStore(u db.Store) db.Store {
+	if a, ok := u.(*actingStore); ok {
+		return a.Store
+	}
+	return u
+}
+
+// storeActor returns who is using u (the zero Actor if nobody said, like when
+// recurring payments are created)
+func storeActor(u db.Store) Actor {
+	if a, ok := u.(*actingStore); ok {
+		return a.actor
+	}
+	return Actor{}
+}
+
+// PaymentEvent is a change to a payment. The history is append only: events
+// are never changed or removed, even by undo (which adds its own events)
+type PaymentEvent struct {
+	ID        string    `json:"id"`
+	PaymentID string    `json:"payment_id"`
+	Action    string    `json:"action"`
+	Time      time.Time `json:"time"`
+	Actor     Actor     `json:"actor"`
+	// Before is nil for a creation, and After for a deletion
+	Before *Payment `json:"before"`
+	After  *Payment `json:"after"`
+	// Change groups the events saved together (applying rules changes several
+	// payments at once for example). They are undone together
+	Change string `json:"change"`
+	// Undoes is the change these events revert
+	Undoes string `json:"undoes,omitempty"`
+}
+
+// historyLog is where the events are, one per record
+const historyLog = "/history.log"
+
+// readHistory calls fn with every event, oldest first
+func readHistory(u db.Store, fn func(e PaymentEvent) error) error {
+	return u.ReadLog(historyLog, func(record []byte) error {
+		var e PaymentEvent
+		if err := json.Unmarshal(record, &e); err != nil {
+			return fmt.Errorf("parsing event: %s", err)
+		}
+		return fn(e)
+	})
+}
+
+func loadHistory(u db.Store) ([]PaymentEvent, error) {
+	var history []PaymentEvent
+	err := readHistory(u, func(e PaymentEvent) error {
+		history = append(history, e)
+		return nil
+	})
+	return history, err
+}
+
+// moveLegacyHistory moves the events from the /history file (which was
+// rewritten for every change) to the log. It's part of the store's migration
+func moveLegacyHistory(u db.Store) error {
+	var history []PaymentEvent
+	found, err := loadJSON(u, "/history", &history)
+	if err != nil || !found {
+		return err
+	}
+	records, err := encodeEvents(history)
+	if err != nil {
+		return err
+	}
+	if err := u.Compact(historyLog, records); err != nil {
+		return fmt.Errorf("moving history to the log: %s", err)
+	}
+	return u.Remove("/history")
+}
+
+func encodeEvents(events []PaymentEvent) ([][]byte, error) {
+	records := make([][]byte, 0, len(events))
+	for _, e := range events {
+		record, err := json.Marshal(e)
+		if err != nil {
+			return nil, fmt.Errorf("json encoding event: %s", err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// samePayment returns true if a and b are identical (nil for no payment)
+func samePayment(a, b *Payment) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ja, erra := json.Marshal(a)
+	jb, errb := json.Marshal(b)
+	return erra == nil && errb == nil && string(ja) == string(jb)
+}
+
+// withoutVersion returns a copy of p with the zero version (nil for no
+// payment)
+func withoutVersion(p *Payment) *Payment {
+	if p == nil {
+		return nil
+	}
+	c := copyPayment(*p)
+	c.Version = 0
+	return &c
+}
+
+// diffPayments returns the events which turn before into after
+func diffPayments(before, after []Payment) []PaymentEvent {
+	previous := make(map[string]*Payment, len(before))
+	for i := range before {
+		previous[before[i].ID] = &before[i]
+	}
+	var events []PaymentEvent
+	kept := make(map[string]bool, len(after))
+	for i := range after {
+		p := copyPayment(after[i])
+		kept[p.ID] = true
+		old, ok := previous[p.ID]
+		if !ok {
+			events = append(events, PaymentEvent{PaymentID: p.ID, Action: EventCreate, After: &p})
+		} else if !samePayment(old, &p) {
+			b := copyPayment(*old)
+			events = append(events, PaymentEvent{PaymentID: p.ID, Action: EventUpdate, Before: &b, After: &p})
+		}
+	}
+	for i := range before {
+		if !kept[before[i].ID] {
+			b := copyPayment(before[i])
+			events = append(events, PaymentEvent{PaymentID: b.ID, Action: EventDelete, Before: &b})
+		}
+	}
+	return events
+}
+
+// recordChange appends the events to the history, as one change
+func recordChange(u db.Store, events []PaymentEvent, undoes string) error {
+	if len(events) == 0 {
+		return nil
+	}
+	change, err := newID()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	actor := storeActor(u)
+	for i := range events {
+		if events[i].ID, err = newID(); err != nil {
+			return err
+		}
+		events[i].Time = now
+		events[i].Actor = actor
+		events[i].Change = change
+		events[i].Undoes = undoes
+	}
+
+	records, err := encodeEvents(events)
+	if err != nil {
+		return err
+	}
+	return u.Append(historyLog, records...)
+}
+
+// PaymentHistory returns every change made to the payment, oldest first. It
+// works for deleted payments too. Errors: ErrPaymentNotFound, err
+func (api *API) PaymentHistory(u db.Store, id string) ([]PaymentEvent, error) {
+	events := []PaymentEvent{}
+	err := readHistory(u, func(e PaymentEvent) error {
+		if e.PaymentID == id {
+			events = append(events, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		// it was created before the history was recorded
+		payments, err := loadPayments(u)
+		if err != nil {
+			return nil, fmt.Errorf("loading payments: %s", err)
+		}
+		if findPayment(payments, id) == -1 {
+			return nil, ErrPaymentNotFound
+		}
+	}
+	return events, nil
+}
+
+// Undo reverts the last change which hasn't been undone yet (so calling it
+// again goes further back). It returns the events of the undo. Errors:
+// ErrNothingToUndo, ErrUndoConflict, err
+func (api *API) Undo(u db.Store) ([]PaymentEvent, error) {
+	history, err := loadHistory(u)
+	if err != nil {
+		return nil, err
+	}
+	undone := make(map[string]bool)
+	for _, e := range history {
+		if e.Undoes != "" {
+			undone[e.Undoes] = true
+		}
+	}
+	change := ""
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Undoes == "" && !undone[history[i].Change] {
+			change = history[i].Change
+			break
+		}
+	}
+	if change == "" {
+		return nil, ErrNothingToUndo
+	}
+
+	payments, nrecords, err := readPayments(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading payments: %s", err)
+	}
+	reverted := append([]Payment(nil), payments...)
+	// the receipts of the payments which are removed are kept for a while, as
+	// if they were just scanned
+	var receipts []string
+	for i := len(history) - 1; i >= 0; i-- {
+		e := history[i]
+		if e.Change != change {
+			continue
+		}
+		j := findPayment(reverted, e.PaymentID)
+		var current *Payment
+		if j != -1 {
+			current = &reverted[j]
+		}
+		// the version doesn't count: undoing a change gives the payment a
+		// new one, which the change before it never had
+		if !samePayment(withoutVersion(current), withoutVersion(e.After)) {
+			return nil, fmt.Errorf("payment %s (%w)", e.PaymentID, ErrUndoConflict)
+		}
+		switch {
+		case e.Before == nil:
+			if current.Receipt != "" {
+				receipts = append(receipts, current.Receipt)
+			}
+			reverted = append(reverted[:j], reverted[j+1:]...)
+		case e.After == nil:
+			p := copyPayment(*e.Before)
+			// the receipt is deleted with the payment
+			if p.Receipt != "" && checkReceipt(u, reverted, p.Receipt) != nil {
+				p.Receipt = ""
+			}
+			reverted = append(reverted, p)
+		default:
+			reverted[j] = copyPayment(*e.Before)
+		}
+	}
+
+	bumpVersions(payments, reverted)
+	events := diffPayments(payments, reverted)
+	if err := recordChange(u, events, change); err != nil {
+		return nil, err
+	}
+	if err := appendPayments(u, events, nrecords, reverted); err != nil {
+		return nil, err
+	}
+	if err := addPendingReceipts(u, time.Now(), receipts...); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	user, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+	actor := Actor{UserID: user.ID, Email: user.Email, Session: "abc", Device: "test"}
+	u := ActingAs(user, actor)
+
+	if _, err := api.Undo(u); err != ErrNothingToUndo {
+		t.Errorf("no history: should have ErrNothingToUndo, got %v", err)
+	}
+
+	rent, err := api.AddPayment(u, []byte(`{"name": "rent", "amount": "400", "date": "2020-03-01"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	coffee, err := api.AddPayment(u, []byte(`{"name": "coffee", "amount": "4.50", "date": "2020-03-02"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	if _, err := api.UpdatePayment(u, rent.ID, []byte(`{"amount": "450"}`)); err != nil {
+		t.Fatalf("updating payment: %s", err)
+	}
+	if err := api.DeletePayment(u, coffee.ID, 0); err != nil {
+		t.Fatalf("deleting payment: %s", err)
+	}
+
+	events, err := api.PaymentHistory(u, rent.ID)
+	if err != nil {
+		t.Fatalf("loading history: %s", err)
+	}
+	if len(events) != 2 || events[0].Action != EventCreate || events[1].Action != EventUpdate {
+		t.Fatalf("should have create and update, got %+v", events)
+	}
+	if events[1].Before.Amount.String() != "400.00" || events[1].After.Amount.String() != "450.00" {
+		t.Errorf("should have 400.00 before and 450.00 after, got %s and %s", events[1].Before.Amount, events[1].After.Amount)
+	}
+	if events[1].Actor != actor || events[1].Time.IsZero() {
+		t.Errorf("should have %+v at some time, got %+v at %s", actor, events[1].Actor, events[1].Time)
+	}
+	events, err = api.PaymentHistory(u, coffee.ID)
+	if err != nil || len(events) != 2 || events[1].Action != EventDelete || events[1].After != nil {
+		t.Fatalf("deleted payment: should have create and delete, got %+v (%v)", events, err)
+	}
+	if _, err := api.PaymentHistory(u, "nope"); err != ErrPaymentNotFound {
+		t.Errorf("should have ErrPaymentNotFound, got %v", err)
+	}
+
+	// undo the delete, then the update
+	if _, err := api.Undo(u); err != nil {
+		t.Fatalf("undoing delete: %s", err)
+	}
+	if _, err := api.Undo(u); err != nil {
+		t.Fatalf("undoing update: %s", err)
+	}
+	page, err := api.ListPayments(u, PaymentsQuery{Sort: SortDate})
+	if err != nil {
+		t.Fatalf("listing payments: %s", err)
+	}
+	if len(page.Payments) != 2 {
+		t.Fatalf("should have the coffee back, got %+v", page.Payments)
+	}
+	for _, p := range page.Payments {
+		if p.ID == rent.ID && p.Amount.String() != "400.00" {
+			t.Errorf("should have the rent back to 400.00, got %s", p.Amount)
+		}
+	}
+
+	// a change made of several payments is undone at once
+	if _, err := api.AddRule(u, []byte(`{"name_regex": ".", "tags": ["all"]}`)); err != nil {
+		t.Fatalf("adding rule: %s", err)
+	}
+	changes, err := api.ApplyRules(u, false)
+	if err != nil || len(changes) != 2 {
+		t.Fatalf("should change 2 payments, got %+v (%v)", changes, err)
+	}
+	undo, err := api.Undo(u)
+	if err != nil {
+		t.Fatalf("undoing rules: %s", err)
+	}
+	if len(undo) != 2 || undo[0].Change != undo[1].Change || undo[0].Undoes == "" {
+		t.Errorf("should have undone both payments in one change, got %+v", undo)
+	}
+
+	// the payment changed outside of the history (like an upgrade of the
+	// payments file)
+	payments, err := loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading payments: %s", err)
+	}
+	for i := range payments {
+		payments[i].Notes = "changed"
+	}
+	if err := compactPayments(u, payments); err != nil {
+		t.Fatalf("writing payments: %s", err)
+	}
+	if _, err := api.Undo(u); !errors.Is(err, ErrUndoConflict) {
+		t.Errorf("should have ErrUndoConflict, got %v", err)
+	}
+}
+
+func TestUndoTwice(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	rent, err := api.AddPayment(u, []byte(`{"name": "rent", "amount": "400", "date": "2020-03-01"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	if _, err := api.UpdatePayment(u, rent.ID, []byte(`{"name": "flat", "amount": "450"}`)); err != nil {
+		t.Fatalf("updating payment: %s", err)
+	}
+
+	// each undo goes further back on the same payment
+	if _, err := api.Undo(u); err != nil {
+		t.Fatalf("undoing update: %s", err)
+	}
+	payments, err := loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading payments: %s", err)
+	}
+	if len(payments) != 1 || payments[0].Name != "rent" || payments[0].Amount.String() != "400.00" {
+		t.Fatalf("should have the rent back to 400.00, got %+v", payments)
+	}
+	if _, err := api.Undo(u); err != nil {
+		t.Fatalf("undoing create: %s", err)
+	}
+	payments, err = loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading payments: %s", err)
+	}
+	if len(payments) != 0 {
+		t.Errorf("should have no payments left, got %+v", payments)
+	}
+}
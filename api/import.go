@@ -0,0 +1,159 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrInvalidImport tags errors caused by a file which can't be imported. When
+// some rows are invalid, the ImportResult says which ones
+var ErrInvalidImport = errors.New("invalid import")
+
+// ImportOptions are the options of every import
+type ImportOptions struct {
+	// Preview doesn't save anything
+	Preview bool
+	// Force imports the rows which look like existing payments, even in strict
+	// mode
+	Force bool
+}
+
+// ImportRow is what a line of an imported file gives
+type ImportRow struct {
+	Line    int      `json:"line"`
+	Payment *Payment `json:"payment,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	// Duplicate is true if the row was already imported. It's skipped
+	Duplicate bool `json:"duplicate,omitempty"`
+	// Candidates are the existing payments the row looks like
+	Candidates []Payment `json:"candidates,omitempty"`
+}
+
+// ImportResult is what an import did, or would do in preview
+type ImportResult struct {
+	Rows []ImportRow `json:"rows"`
+	// Imported is the number of payments that were added (0 in preview)
+	Imported int `json:"imported"`
+	// Errors is the number of rows with an error
+	Errors int `json:"errors"`
+	// Duplicates is the number of rows which were skipped because they were
+	// already imported
+	Duplicates int `json:"duplicates"`
+}
+
+// importer turns rows into payments the same way AddPayment does, and checks
+// them against the existing payments
+type importer struct {
+	u        db.Store
+	opts     ImportOptions
+	rs       *ruleset
+	strict   bool
+	existing []Payment
+	// nrecords is the number of records in the payments log
+	nrecords int
+	// imported are the import ids of the existing payments, and of the rows
+	// already added
+	imported map[string]bool
+	result   *ImportResult
+}
+
+func newImporter(u db.Store, opts ImportOptions) (*importer, error) {
+	rs, err := loadRuleset(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading rules: %s", err)
+	}
+	settings, err := loadSettings(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading settings: %s", err)
+	}
+	payments, nrecords, err := readPayments(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading existing payments: %s", err)
+	}
+
+	imp := &importer{
+		u:        u,
+		opts:     opts,
+		rs:       rs,
+		strict:   settings.StrictDuplicates && !opts.Force,
+		existing: payments,
+		nrecords: nrecords,
+		imported: make(map[string]bool),
+		result:   &ImportResult{Rows: []ImportRow{}},
+	}
+	for _, p := range payments {
+		if p.ImportID != "" {
+			imp.imported[p.ImportID] = true
+		}
+	}
+	return imp, nil
+}
+
+// add adds the row of the payment read on the given line (err is the error
+// reading it)
+func (imp *importer) add(line int, payment Payment, err error) {
+	row := ImportRow{Line: line}
+	if err == nil && payment.ImportID != "" && imp.imported[payment.ImportID] {
+		row.Duplicate = true
+		imp.result.Duplicates++
+		imp.result.Rows = append(imp.result.Rows, row)
+		return
+	}
+
+	if err == nil && payment.Amount.Sign() < 0 {
+		// the bank's amounts are signed: money coming in is income
+		payment.Direction = DirectionIncome
+		payment.Amount = payment.Amount.Neg()
+	}
+	if err == nil {
+		err = preparePayment(imp.u, &payment, imp.rs)
+	}
+	if err == nil {
+		row.Candidates = findDuplicates(imp.existing, payment)
+		if imp.strict && len(row.Candidates) > 0 {
+			err = &DuplicateError{Candidates: row.Candidates}
+		}
+	}
+
+	if err != nil {
+		row.Error = err.Error()
+		imp.result.Errors++
+	} else {
+		row.Payment = &payment
+		if payment.ImportID != "" {
+			imp.imported[payment.ImportID] = true
+		}
+	}
+	imp.result.Rows = append(imp.result.Rows, row)
+}
+
+// finish saves the payments, unless it's a preview or a row has an error
+func (imp *importer) finish() (*ImportResult, error) {
+	result := imp.result
+	if imp.opts.Preview {
+		return result, nil
+	}
+	if result.Errors > 0 {
+		return result, fmt.Errorf("%d rows have errors (%w)", result.Errors, ErrInvalidImport)
+	}
+
+	payments := copyPayments(imp.existing)
+	for _, row := range result.Rows {
+		if row.Payment == nil {
+			continue
+		}
+		id, err := newID()
+		if err != nil {
+			return nil, err
+		}
+		row.Payment.ID = id
+		payments = append(payments, *row.Payment)
+	}
+	if err := savePayments(imp.u, imp.existing, imp.nrecords, payments); err != nil {
+		return nil, err
+	}
+	result.Imported = len(payments) - len(imp.existing)
+	return result, nil
+}
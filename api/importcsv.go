@@ -0,0 +1,381 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrInvalidProfile tags errors caused by an import profile given by the user
+var ErrInvalidProfile = errors.New("invalid import profile")
+
+var ErrProfileNotFound = errors.New("import profile not found")
+
+// the amount sign conventions of the banks
+const (
+	// SignExpensesNegative is when spending money shows up as a negative
+	// amount (most banks)
+	SignExpensesNegative = "expenses_negative"
+	SignExpensesPositive = "expenses_positive"
+)
+
+// the columns a profile can map on top of the payment's custom fields
+var importColumns = map[string]bool{
+	"date":     true,
+	"name":     true,
+	"amount":   true,
+	"debit":    true,
+	"credit":   true,
+	"currency": true,
+	"category": true,
+	"merchant": true,
+	"notes":    true,
+}
+
+// ImportProfile says how to read a bank's CSV export
+type ImportProfile struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Delimiter is a single character. Defaults to ","
+	Delimiter string `json:"delimiter"`
+	// HasHeader skips the first line
+	HasHeader bool `json:"has_header"`
+	// DateFormat uses YYYY, YY, MM, M, MMM (Jan), DD and D. Defaults to
+	// YYYY-MM-DD
+	DateFormat string `json:"date_format"`
+	// DecimalComma is for amounts written 1.234,56
+	DecimalComma bool `json:"decimal_comma"`
+	// Sign is SignExpensesNegative (the default) or SignExpensesPositive. It's
+	// ignored for the debit and credit columns, which are always positive
+	Sign string `json:"sign"`
+	// Columns maps the fields (date, name, amount or debit and credit,
+	// currency, category, merchant, notes, or the name of a custom field) to
+	// the number of the column they are in (starting from 1)
+	Columns map[string]int `json:"columns"`
+}
+
+var dateFormatReplacer = strings.NewReplacer(
+	"YYYY", "2006",
+	"YY", "06",
+	"MMM", "Jan",
+	"MM", "01",
+	"M", "1",
+	"DD", "02",
+	"D", "2",
+)
+
+// layout returns the time layout of the profile's date format
+func (profile ImportProfile) layout() string {
+	if profile.DateFormat == "" {
+		return dateLayout
+	}
+	return dateFormatReplacer.Replace(profile.DateFormat)
+}
+
+func (profile ImportProfile) delimiter() rune {
+	if profile.Delimiter == "" {
+		return ','
+	}
+	r, _ := utf8.DecodeRuneInString(profile.Delimiter)
+	return r
+}
+
+func checkProfile(profile *ImportProfile) error {
+	if profile.Name == "" {
+		return fmt.Errorf("need 'name' (%w)", ErrInvalidProfile)
+	}
+	if utf8.RuneCountInString(profile.Delimiter) > 1 {
+		return fmt.Errorf("delimiter should be a single character, got %q (%w)", profile.Delimiter, ErrInvalidProfile)
+	}
+	if r := profile.delimiter(); r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return fmt.Errorf("invalid delimiter %q (%w)", profile.Delimiter, ErrInvalidProfile)
+	}
+	if profile.Sign == "" {
+		profile.Sign = SignExpensesNegative
+	} else if profile.Sign != SignExpensesNegative && profile.Sign != SignExpensesPositive {
+		return fmt.Errorf("sign should be %q or %q, got %q (%w)", SignExpensesNegative, SignExpensesPositive, profile.Sign, ErrInvalidProfile)
+	}
+	// a date formatted with the layout should parse back to itself
+	example := time.Date(2019, time.December, 24, 0, 0, 0, 0, time.UTC)
+	if parsed, err := time.Parse(profile.layout(), example.Format(profile.layout())); err != nil || !parsed.Equal(example) {
+		return fmt.Errorf("date format %q should have a year, a month and a day (%w)", profile.DateFormat, ErrInvalidProfile)
+	}
+
+	for field, column := range profile.Columns {
+		if column < 1 {
+			return fmt.Errorf("column of %q should be at least 1, got %d (%w)", field, column, ErrInvalidProfile)
+		}
+		if !importColumns[field] && (field == "" || knownPaymentFields[field]) {
+			return fmt.Errorf("can't import field %q (%w)", field, ErrInvalidProfile)
+		}
+	}
+	_, hasAmount := profile.Columns["amount"]
+	_, hasDebit := profile.Columns["debit"]
+	_, hasCredit := profile.Columns["credit"]
+	if hasAmount == (hasDebit || hasCredit) {
+		return fmt.Errorf("need either an 'amount' column, or 'debit' and/or 'credit' columns (%w)", ErrInvalidProfile)
+	}
+	for _, field := range []string{"date", "name"} {
+		if _, ok := profile.Columns[field]; !ok {
+			return fmt.Errorf("need a %q column (%w)", field, ErrInvalidProfile)
+		}
+	}
+	return nil
+}
+
+func loadProfiles(u db.Store) ([]ImportProfile, error) {
+	var profiles []ImportProfile
+	if _, err := loadJSON(u, "/importprofiles", &profiles); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+func findProfile(profiles []ImportProfile, id string) int {
+	for i, profile := range profiles {
+		if profile.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// ListImportProfiles returns the user's CSV import profiles
+func (api *API) ListImportProfiles(u db.Store) ([]ImportProfile, error) {
+	return loadProfiles(u)
+}
+
+// AddImportProfile saves a new CSV import profile. Errors: ErrInvalidProfile,
+// err
+func (api *API) AddImportProfile(u db.Store, serializedprofile []byte) (*ImportProfile, error) {
+	var profile ImportProfile
+	if err := json.Unmarshal(serializedprofile, &profile); err != nil {
+		return nil, fmt.Errorf("unmarshaling json profile: %s (%w)", err, ErrInvalidProfile)
+	}
+	if err := checkProfile(&profile); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	profile.ID = id
+
+	profiles, err := loadProfiles(u)
+	if err != nil {
+		return nil, err
+	}
+	profiles = append(profiles, profile)
+	return &profile, saveJSON(u, "/importprofiles", profiles)
+}
+
+// UpdateImportProfile changes the fields present in serializedpatch. The
+// columns are replaced as a whole. Errors: ErrProfileNotFound,
+// ErrInvalidProfile, err
+func (api *API) UpdateImportProfile(u db.Store, id string, serializedpatch []byte) (*ImportProfile, error) {
+	profiles, err := loadProfiles(u)
+	if err != nil {
+		return nil, err
+	}
+	i := findProfile(profiles, id)
+	if i == -1 {
+		return nil, ErrProfileNotFound
+	}
+
+	profile := profiles[i]
+	// json.Unmarshal would merge the columns with the current ones
+	profile.Columns = nil
+	if err := json.Unmarshal(serializedpatch, &profile); err != nil {
+		return nil, fmt.Errorf("unmarshaling json profile: %s (%w)", err, ErrInvalidProfile)
+	}
+	if profile.Columns == nil {
+		profile.Columns = profiles[i].Columns
+	}
+	profile.ID = id
+	if err := checkProfile(&profile); err != nil {
+		return nil, err
+	}
+
+	profiles[i] = profile
+	return &profile, saveJSON(u, "/importprofiles", profiles)
+}
+
+// DeleteImportProfile removes a CSV import profile. Errors:
+// ErrProfileNotFound, err
+func (api *API) DeleteImportProfile(u db.Store, id string) error {
+	profiles, err := loadProfiles(u)
+	if err != nil {
+		return err
+	}
+	i := findProfile(profiles, id)
+	if i == -1 {
+		return ErrProfileNotFound
+	}
+	profiles = append(profiles[:i], profiles[i+1:]...)
+	return saveJSON(u, "/importprofiles", profiles)
+}
+
+// parseImportAmount parses a bank's amount (1,234.56, -12.00, (12.00), $12,
+// 1.234,56 with a decimal comma...)
+func parseImportAmount(s string, decimalComma bool) (Money, error) {
+	s = strings.TrimSpace(s)
+	negative := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		negative = true
+		s = s[1 : len(s)-1]
+	}
+	if strings.HasSuffix(s, "-") {
+		negative = true
+		s = s[:len(s)-1]
+	}
+	thousands, decimal := ",", "."
+	if decimalComma {
+		thousands, decimal = ".", ","
+	}
+	s = strings.NewReplacer(thousands, "", " ", "", " ", "", "$", "", "€", "", "£", "").Replace(s)
+	s = strings.Replace(s, decimal, ".", 1)
+	m, err := ParseMoney(s)
+	if err != nil {
+		return m, err
+	}
+	if negative {
+		m = m.Neg()
+	}
+	return m, nil
+}
+
+// paymentFromRecord builds the payment of a CSV row
+func (profile ImportProfile) paymentFromRecord(record []string) (Payment, error) {
+	var p Payment
+	cell := func(field string) (string, bool) {
+		column, ok := profile.Columns[field]
+		if !ok {
+			return "", false
+		}
+		if column > len(record) {
+			return "", false
+		}
+		return strings.TrimSpace(record[column-1]), true
+	}
+
+	for field := range profile.Columns {
+		if _, ok := cell(field); !ok {
+			return p, fmt.Errorf("no column %d for %q", profile.Columns[field], field)
+		}
+	}
+
+	date, _ := cell("date")
+	t, err := time.Parse(profile.layout(), date)
+	if err != nil {
+		return p, fmt.Errorf("invalid date %q: %s", date, err)
+	}
+	p.Date = NewDate(t)
+	p.Name, _ = cell("name")
+	p.Currency, _ = cell("currency")
+	p.Currency = strings.ToUpper(p.Currency)
+	p.Category, _ = cell("category")
+	p.Merchant, _ = cell("merchant")
+	p.Notes, _ = cell("notes")
+
+	if amount, ok := cell("amount"); ok {
+		if p.Amount, err = parseImportAmount(amount, profile.DecimalComma); err != nil {
+			return p, fmt.Errorf("invalid amount %q: %s", amount, err)
+		}
+		if profile.Sign == SignExpensesNegative {
+			p.Amount = p.Amount.Neg()
+		}
+	} else {
+		// debits are expenses, credits refunds or income
+		for _, field := range []string{"debit", "credit"} {
+			value, _ := cell(field)
+			if value == "" {
+				continue
+			}
+			m, err := parseImportAmount(value, profile.DecimalComma)
+			if err != nil {
+				return p, fmt.Errorf("invalid %s %q: %s", field, value, err)
+			}
+			if field == "debit" {
+				p.Amount, err = p.Amount.Add(m.Abs())
+			} else {
+				p.Amount, err = p.Amount.Sub(m.Abs())
+			}
+			if err != nil {
+				return p, fmt.Errorf("invalid %s %q: %s", field, value, err)
+			}
+		}
+	}
+
+	for field := range profile.Columns {
+		if importColumns[field] {
+			continue
+		}
+		if value, _ := cell(field); value != "" {
+			if p.Custom == nil {
+				p.Custom = make(map[string]string)
+			}
+			p.Custom[field] = value
+		}
+	}
+	return p, nil
+}
+
+// ImportCSV turns the rows of a bank CSV export into payments, read with the
+// given profile. They are validated like the payments added by hand. In
+// preview, or if any row is invalid, nothing is saved: the result says what
+// each row gives. Errors: ErrProfileNotFound, ErrInvalidImport, err
+func (api *API) ImportCSV(u db.Store, profileid string, r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	profiles, err := loadProfiles(u)
+	if err != nil {
+		return nil, err
+	}
+	i := findProfile(profiles, profileid)
+	if i == -1 {
+		return nil, ErrProfileNotFound
+	}
+	profile := profiles[i]
+
+	// Excel likes to start UTF-8 files with a byte order mark
+	br := bufio.NewReader(r)
+	if bom, err := br.Peek(3); err == nil && bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		br.Discard(3)
+	}
+	reader := csv.NewReader(br)
+	reader.Comma = profile.delimiter()
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	imp, err := newImporter(u, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// line is the number of the record (multiline cells count as one line)
+	line := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("reading csv: %s (%w)", err, ErrInvalidImport)
+		}
+		line++
+		if line == 1 && profile.HasHeader {
+			continue
+		}
+		payment, err := profile.paymentFromRecord(record)
+		imp.add(line, payment, err)
+	}
+	return imp.finish()
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseImportAmount(t *testing.T) {
+	table := []struct {
+		input        string
+		decimalComma bool
+		expected     string
+	}{
+		{"12.50", false, "12.50"},
+		{"-1,234.56", false, "-1234.56"},
+		{"(12.00)", false, "-12.00"},
+		{"$ 8", false, "8"},
+		{"12.00-", false, "-12.00"},
+		{"1.234,56", true, "1234.56"},
+		{"-0,5", true, "-0.5"},
+	}
+	for _, row := range table {
+		m, err := parseImportAmount(row.input, row.decimalComma)
+		if err != nil {
+			t.Errorf("parsing %q: %s", row.input, err)
+		} else if m.String() != row.expected {
+			t.Errorf("%q should be %s, got %s", row.input, row.expected, m)
+		}
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	invalid := []string{
+		`{"columns": {"date": 1, "name": 2, "amount": 3}}`,
+		`{"name": "bank", "columns": {"date": 1, "amount": 3}}`,
+		`{"name": "bank", "columns": {"date": 1, "name": 2}}`,
+		`{"name": "bank", "columns": {"date": 1, "name": 2, "amount": 3, "debit": 4}}`,
+		`{"name": "bank", "columns": {"date": 1, "name": 2, "amount": 0}}`,
+		`{"name": "bank", "columns": {"date": 1, "name": 2, "amount": 3, "tags": 4}}`,
+		`{"name": "bank", "delimiter": ";;", "columns": {"date": 1, "name": 2, "amount": 3}}`,
+		`{"name": "bank", "date_format": "MM/DD", "columns": {"date": 1, "name": 2, "amount": 3}}`,
+		`{"name": "bank", "sign": "whatever", "columns": {"date": 1, "name": 2, "amount": 3}}`,
+	}
+	for _, serialized := range invalid {
+		if _, err := api.AddImportProfile(u, []byte(serialized)); !errors.Is(err, ErrInvalidProfile) {
+			t.Errorf("%s should have ErrInvalidProfile, got %v", serialized, err)
+		}
+	}
+
+	profile, err := api.AddImportProfile(u, []byte(`{
+		"name": "european bank",
+		"delimiter": ";",
+		"has_header": true,
+		"date_format": "DD.MM.YYYY",
+		"decimal_comma": true,
+		"columns": {"date": 1, "name": 2, "amount": 3, "reference": 4}
+	}`))
+	if err != nil {
+		t.Fatalf("adding profile: %s", err)
+	}
+	if profile.Sign != SignExpensesNegative {
+		t.Errorf("sign should default to %q, got %q", SignExpensesNegative, profile.Sign)
+	}
+
+	file := "\xef\xbb\xbfDate;Description;Amount;Reference\n" +
+		"24.12.2019;Bakery;-1.234,50;AB12\n" +
+		"25.12.2019;Refund;10,00;\n" +
+		"2019-12-26;Bad date;-1,00;\n"
+
+	result, err := api.ImportCSV(u, profile.ID, strings.NewReader(file), ImportOptions{Preview: true})
+	if err != nil {
+		t.Fatalf("previewing import: %s", err)
+	}
+	if len(result.Rows) != 3 || result.Errors != 1 || result.Imported != 0 {
+		t.Fatalf("should have 3 rows with 1 error, got %+v", result)
+	}
+	bakery := result.Rows[0].Payment
+	if bakery == nil || bakery.Name != "Bakery" || bakery.Amount.String() != "1234.50" || bakery.Date.String() != "2019-12-24" || bakery.Currency != "AUD" || bakery.Custom["reference"] != "AB12" {
+		t.Errorf("first row should be the bakery, got %+v", result.Rows[0])
+	}
+	if refund := result.Rows[1].Payment; refund == nil || refund.Amount.String() != "10.00" || refund.Direction != DirectionIncome || refund.Custom != nil {
+		t.Errorf("second row should be income without reference, got %+v", result.Rows[1])
+	}
+	if result.Rows[2].Line != 4 || result.Rows[2].Error == "" {
+		t.Errorf("line 4 should have an error, got %+v", result.Rows[2])
+	}
+
+	if _, err := api.ImportCSV(u, profile.ID, strings.NewReader(file), ImportOptions{}); !errors.Is(err, ErrInvalidImport) {
+		t.Errorf("importing rows with errors should have ErrInvalidImport, got %v", err)
+	}
+	if payments, _ := loadPayments(u); len(payments) != 0 {
+		t.Errorf("nothing should be saved in preview or with errors, got %d payments", len(payments))
+	}
+
+	// use debit and credit columns instead
+	if _, err := api.UpdateImportProfile(u, profile.ID, []byte(`{"has_header": false, "columns": {"date": 1, "name": 2, "debit": 3, "credit": 4}}`)); err != nil {
+		t.Fatalf("updating profile: %s", err)
+	}
+	file = "24.12.2019;Bakery;12,50;\n25.12.2019;Refund;;3,00\n"
+	result, err = api.ImportCSV(u, profile.ID, strings.NewReader(file), ImportOptions{})
+	if err != nil {
+		t.Fatalf("importing: %s", err)
+	}
+	if result.Imported != 2 || result.Rows[0].Payment.Amount.String() != "12.50" || result.Rows[1].Payment.Amount.String() != "3.00" || result.Rows[1].Payment.Direction != DirectionIncome {
+		t.Errorf("should have imported 12.50 of expense and 3.00 of income, got %+v", result)
+	}
+	payments, err := loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading payments: %s", err)
+	}
+	if len(payments) != 2 || payments[0].ID == "" {
+		t.Errorf("should have saved 2 payments with ids, got %+v", payments)
+	}
+
+	if _, err := api.ImportCSV(u, "nope", strings.NewReader(file), ImportOptions{Preview: true}); !errors.Is(err, ErrProfileNotFound) {
+		t.Errorf("unknown profile should have ErrProfileNotFound, got %v", err)
+	}
+	if err := api.DeleteImportProfile(u, profile.ID); err != nil {
+		t.Fatalf("deleting profile: %s", err)
+	}
+}
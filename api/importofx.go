@@ -0,0 +1,241 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/math2001/money/db"
+)
+
+// ofxNode is an element of an OFX file. Aggregates have children, elements
+// have a value
+type ofxNode struct {
+	name     string
+	value    string
+	children []*ofxNode
+}
+
+// child returns the first child with the given name (nil if there is none)
+func (n *ofxNode) child(name string) *ofxNode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// get returns the value of the element at the given path (empty if there is
+// none)
+func (n *ofxNode) get(path ...string) string {
+	for _, name := range path {
+		if n = n.child(name); n == nil {
+			return ""
+		}
+	}
+	return n.value
+}
+
+// find returns every aggregate with the given name, at any depth
+func (n *ofxNode) find(name string) []*ofxNode {
+	var found []*ofxNode
+	for _, c := range n.children {
+		if c.name == name {
+			found = append(found, c)
+		} else {
+			found = append(found, c.find(name)...)
+		}
+	}
+	return found
+}
+
+var ofxUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&", "&nbsp;", " ", "&quot;", `"`, "&apos;", "'")
+
+// parseOFX parses both OFX 1.x (SGML, where the elements don't have a closing
+// tag) and 2.x (XML). The headers (OFXHEADER:100 lines, or <?xml ?> and <?OFX
+// ?>) are skipped
+func parseOFX(content []byte) (*ofxNode, error) {
+	start := bytes.Index(bytes.ToUpper(content), []byte("<OFX>"))
+	if start == -1 {
+		return nil, fmt.Errorf("no <OFX> element")
+	}
+	content = content[start:]
+
+	root := &ofxNode{}
+	stack := []*ofxNode{root}
+	for len(content) > 0 {
+		if content[0] != '<' {
+			// text between an aggregate's tags
+			next := bytes.IndexByte(content, '<')
+			if next == -1 {
+				next = len(content)
+			}
+			if text := bytes.TrimSpace(content[:next]); len(text) > 0 {
+				return nil, fmt.Errorf("unexpected text %q", text)
+			}
+			content = content[next:]
+			continue
+		}
+
+		end := bytes.IndexByte(content, '>')
+		if end == -1 {
+			return nil, fmt.Errorf("unclosed tag %q", content)
+		}
+		tag := strings.ToUpper(strings.TrimSpace(string(content[1:end])))
+		content = content[end+1:]
+
+		if strings.HasPrefix(tag, "?") || strings.HasPrefix(tag, "!") {
+			// processing instruction or comment
+			continue
+		}
+
+		if strings.HasPrefix(tag, "/") {
+			name := tag[1:]
+			// SGML elements don't need to be closed, but aggregates do, and
+			// they close every element they contain
+			i := len(stack) - 1
+			for i > 0 && stack[i].name != name {
+				i--
+			}
+			if i == 0 {
+				return nil, fmt.Errorf("closing tag </%s> doesn't match any open one", name)
+			}
+			stack = stack[:i]
+			continue
+		}
+
+		// self closing XML element (<TAG/>)
+		selfclosing := strings.HasSuffix(tag, "/")
+		tag = strings.TrimSpace(strings.TrimSuffix(tag, "/"))
+		if i := strings.IndexAny(tag, " \t\r\n"); i != -1 {
+			// we don't care about attributes
+			tag = tag[:i]
+		}
+		node := &ofxNode{name: tag}
+		parent := stack[len(stack)-1]
+		parent.children = append(parent.children, node)
+		if selfclosing {
+			continue
+		}
+
+		next := bytes.IndexByte(content, '<')
+		if next == -1 {
+			next = len(content)
+		}
+		if value := bytes.TrimSpace(content[:next]); len(value) > 0 {
+			// it's an element: its value goes up to the next tag, which
+			// might be its closing tag (XML)
+			node.value = ofxUnescaper.Replace(string(value))
+			content = content[next:]
+			closing := []byte("</" + tag + ">")
+			if len(content) >= len(closing) && bytes.EqualFold(content[:len(closing)], closing) {
+				content = content[len(closing):]
+			}
+			continue
+		}
+		stack = append(stack, node)
+	}
+	if len(root.children) == 0 {
+		return nil, fmt.Errorf("empty file")
+	}
+	return root, nil
+}
+
+// ofxAmount parses a TRNAMT. Some banks use a decimal comma
+func ofxAmount(s string) (Money, error) {
+	return ParseMoney(strings.Replace(strings.TrimPrefix(s, "+"), ",", ".", 1))
+}
+
+// ofxDate parses a DTPOSTED (YYYYMMDD, followed by an optional time and
+// timezone we don't care about)
+func ofxDate(s string) (Date, error) {
+	if len(s) < 8 {
+		return Date{}, fmt.Errorf("date should start with YYYYMMDD, got %q", s)
+	}
+	return ParseDate(s[:4] + "-" + s[4:6] + "-" + s[6:8])
+}
+
+// ofxPayment builds the payment of a STMTTRN. Money going out of the account
+// (negative TRNAMT) is a positive payment
+func ofxPayment(trn *ofxNode, account, currency string) (Payment, error) {
+	var p Payment
+	fitid := trn.get("FITID")
+	if fitid == "" {
+		return p, fmt.Errorf("no FITID")
+	}
+	p.ImportID = "ofx:" + account + ":" + fitid
+
+	date, err := ofxDate(trn.get("DTPOSTED"))
+	if err != nil {
+		return p, fmt.Errorf("invalid DTPOSTED: %s", err)
+	}
+	p.Date = date
+
+	amount, err := ofxAmount(trn.get("TRNAMT"))
+	if err != nil {
+		return p, fmt.Errorf("invalid TRNAMT %q: %s", trn.get("TRNAMT"), err)
+	}
+	p.Amount = amount.Neg()
+
+	p.Name = trn.get("NAME")
+	if p.Name == "" {
+		p.Name = trn.get("PAYEE", "NAME")
+	}
+	p.Notes = trn.get("MEMO")
+	if p.Name == "" {
+		p.Name, p.Notes = p.Notes, ""
+	}
+
+	p.Currency = currency
+	if cur := trn.get("CURRENCY", "CURSYM"); cur != "" {
+		p.Currency = cur
+	} else if cur := trn.get("ORIGCURRENCY", "CURSYM"); cur != "" {
+		p.Currency = cur
+	}
+	p.Currency = strings.ToUpper(p.Currency)
+	return p, nil
+}
+
+// ImportOFX turns the transactions (STMTTRN) of an OFX or QFX statement into
+// payments, which are validated like the payments added by hand. The
+// transactions which were already imported are skipped (they are identified by
+// their account and FITID). In preview, or if any transaction is invalid,
+// nothing is saved. ImportRow.Line is the number of the transaction in the
+// file. Errors: ErrInvalidImport, err
+func (api *API) ImportOFX(u db.Store, r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading ofx: %s", err)
+	}
+	root, err := parseOFX(content)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ofx: %s (%w)", err, ErrInvalidImport)
+	}
+
+	imp, err := newImporter(u, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	line := 0
+	// bank statements, and credit card statements
+	statements := append(root.find("STMTRS"), root.find("CCSTMTRS")...)
+	for _, statement := range statements {
+		account := statement.get("BANKACCTFROM", "BANKID") + "/" + statement.get("BANKACCTFROM", "ACCTID")
+		if statement.name == "CCSTMTRS" {
+			account = "cc/" + statement.get("CCACCTFROM", "ACCTID")
+		}
+		for _, trn := range statement.find("STMTTRN") {
+			line++
+			payment, err := ofxPayment(trn, account, statement.get("CURDEF"))
+			imp.add(line, payment, err)
+		}
+	}
+	if line == 0 {
+		return nil, fmt.Errorf("no transactions (%w)", ErrInvalidImport)
+	}
+	return imp.finish()
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const sgmlStatement = `OFXHEADER:100
+DATA:OFXSGML
+VERSION:102
+SECURITY:NONE
+ENCODING:USASCII
+CHARSET:1252
+COMPRESSION:NONE
+OLDFILEUID:NONE
+NEWFILEUID:NONE
+
+<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0<SEVERITY>INFO</STATUS><DTSERVER>20191231<LANGUAGE>ENG</SONRS></SIGNONMSGSRSV1>
+<BANKMSGSRSV1>
+<STMTTRNRS>
+<TRNUID>1
+<STMTRS>
+<CURDEF>AUD
+<BANKACCTFROM>
+<BANKID>062000
+<ACCTID>12345678
+<ACCTTYPE>CHECKING
+</BANKACCTFROM>
+<BANKTRANLIST>
+<DTSTART>20191201
+<DTEND>20191231
+<STMTTRN>
+<TRNTYPE>DEBIT
+<DTPOSTED>20191224120000.000[+11:AEDT]
+<TRNAMT>-12.50
+<FITID>2019122401
+<NAME>BAKERY &amp; CO
+<MEMO>card 1234
+</STMTTRN>
+<STMTTRN>
+<TRNTYPE>CREDIT
+<DTPOSTED>20191226
+<TRNAMT>3.00
+<FITID>2019122601
+<MEMO>REFUND
+</STMTTRN>
+</BANKTRANLIST>
+<LEDGERBAL><BALAMT>100.00<DTASOF>20191231</LEDGERBAL>
+</STMTRS>
+</STMTTRNRS>
+</BANKMSGSRSV1>
+</OFX>
+`
+
+const xmlStatement = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+  <CREDITCARDMSGSRSV1>
+    <CCSTMTTRNRS>
+      <TRNUID>1</TRNUID>
+      <CCSTMTRS>
+        <CURDEF>USD</CURDEF>
+        <CCACCTFROM><ACCTID>4111</ACCTID></CCACCTFROM>
+        <BANKTRANLIST>
+          <STMTTRN>
+            <TRNTYPE>DEBIT</TRNTYPE>
+            <DTPOSTED>20191220</DTPOSTED>
+            <TRNAMT>-20.00</TRNAMT>
+            <FITID>A1</FITID>
+            <PAYEE><NAME>Book shop</NAME></PAYEE>
+            <MEMO></MEMO>
+          </STMTTRN>
+          <STMTTRN>
+            <TRNTYPE>DEBIT</TRNTYPE>
+            <DTPOSTED>20191221</DTPOSTED>
+            <TRNAMT>-5</TRNAMT>
+            <FITID>A2</FITID>
+            <NAME>Coffee</NAME>
+            <CURRENCY><CURRATE>1.5</CURRATE><CURSYM>EUR</CURSYM></CURRENCY>
+          </STMTTRN>
+        </BANKTRANLIST>
+      </CCSTMTRS>
+    </CCSTMTTRNRS>
+  </CREDITCARDMSGSRSV1>
+</OFX>
+`
+
+func TestImportOFX(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	result, err := api.ImportOFX(u, strings.NewReader(sgmlStatement), ImportOptions{Preview: true})
+	if err != nil {
+		t.Fatalf("previewing sgml import: %s", err)
+	}
+	if len(result.Rows) != 2 || result.Errors != 0 {
+		t.Fatalf("should have 2 transactions without errors, got %+v", result)
+	}
+	bakery := result.Rows[0].Payment
+	if bakery.Name != "BAKERY & CO" || bakery.Notes != "card 1234" || bakery.Amount.String() != "12.50" || bakery.Date.String() != "2019-12-24" || bakery.Currency != "AUD" {
+		t.Errorf("first transaction should be the bakery, got %+v", bakery)
+	}
+	if bakery.ImportID != "ofx:062000/12345678:2019122401" {
+		t.Errorf("import id should identify the account and the FITID, got %q", bakery.ImportID)
+	}
+	if refund := result.Rows[1].Payment; refund.Name != "REFUND" || refund.Amount.String() != "3.00" || refund.Direction != DirectionIncome {
+		t.Errorf("second transaction should be income named after its memo, got %+v", refund)
+	}
+
+	if _, err := api.ImportOFX(u, strings.NewReader(sgmlStatement), ImportOptions{}); err != nil {
+		t.Fatalf("importing sgml: %s", err)
+	}
+	result, err = api.ImportOFX(u, strings.NewReader(sgmlStatement), ImportOptions{})
+	if err != nil {
+		t.Fatalf("importing sgml again: %s", err)
+	}
+	if result.Imported != 0 || result.Duplicates != 2 || !result.Rows[0].Duplicate {
+		t.Errorf("importing the same statement twice shouldn't import anything, got %+v", result)
+	}
+
+	result, err = api.ImportOFX(u, strings.NewReader(xmlStatement), ImportOptions{})
+	if err != nil {
+		t.Fatalf("importing xml: %s", err)
+	}
+	if result.Imported != 2 {
+		t.Fatalf("should have imported 2 transactions, got %+v", result)
+	}
+	book, coffee := result.Rows[0].Payment, result.Rows[1].Payment
+	if book.Name != "Book shop" || book.Currency != "USD" || book.Amount.String() != "20.00" || book.ImportID != "ofx:cc/4111:A1" {
+		t.Errorf("first transaction should be the book shop, got %+v", book)
+	}
+	if coffee.Name != "Coffee" || coffee.Currency != "EUR" {
+		t.Errorf("second transaction should be a coffee in EUR, got %+v", coffee)
+	}
+
+	payments, err := loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading payments: %s", err)
+	}
+	if len(payments) != 4 {
+		t.Errorf("should have 4 payments, got %d", len(payments))
+	}
+
+	// the client can't change where a payment was imported from
+	updated, err := api.UpdatePayment(u, payments[0].ID, []byte(`{"import_id": "", "name": "Bakery"}`))
+	if err != nil {
+		t.Fatalf("updating payment: %s", err)
+	}
+	if updated.ImportID != payments[0].ImportID {
+		t.Errorf("import id should be kept, got %q", updated.ImportID)
+	}
+
+	for _, invalid := range []string{"", "OFXHEADER:100\n", "<OFX><BANKMSGSRSV1></BANKMSGSRSV1></OFX>", "<OFX></STMTRS></OFX>"} {
+		if _, err := api.ImportOFX(u, strings.NewReader(invalid), ImportOptions{Preview: true}); !errors.Is(err, ErrInvalidImport) {
+			t.Errorf("%q should have ErrInvalidImport, got %v", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,620 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrLedgerNotFound is returned when a ledger doesn't exist, or when the user
+// isn't a member of it
+var ErrLedgerNotFound = errors.New("ledger not found")
+
+// ErrInvalidLedger tags errors caused by what the user asked of a ledger
+// (inviting someone who already is a member, etc)
+var ErrInvalidLedger = errors.New("invalid ledger")
+
+// ErrUnknownUser is returned when inviting an email nobody signed up with
+var ErrUnknownUser = errors.New("unknown user")
+
+// ErrInviteNotFound is returned when the user wasn't invited to a ledger
+var ErrInviteNotFound = errors.New("invite not found")
+
+// A shared ledger is a folder in the backend of "ledgers" (see db.Backends):
+//
+//     {id}/
+//         members    # ledgerMembers, in clear text
+//         data/      # a db.Ledger, encrypted with the ledger's key
+//
+// The ledger's key is wrapped for every member (and invitee) with their public
+// key. It's rotated when a member is removed, so that their copy of the key
+// becomes useless: the data is copied to a new folder (data.1/, data.2/...),
+// encrypted with the new key, and saving the members switches to it at once
+// (see ledgerMembers.Generation). A rotation which fails half way leaves the
+// ledger as it was
+
+// ledgerMember is a member (or an invitee) of a ledger
+type ledgerMember struct {
+	UserID int    `json:"user_id"`
+	Email  string `json:"email"`
+	// Key is the ledger's key, wrapped for the user
+	Key []byte `json:"key"`
+	// InvitedBy is the email of the member who invited the user
+	InvitedBy string `json:"invited_by,omitempty"`
+}
+
+type ledgerMembers struct {
+	Members []ledgerMember `json:"members"`
+	Invites []ledgerMember `json:"invites"`
+	// Generation is the folder the data is in (see dataFolder). It goes up
+	// every time the key is rotated
+	Generation int `json:"generation,omitempty"`
+}
+
+// ledgerInfo is stored in the ledger, so that its name is encrypted
+type ledgerInfo struct {
+	Name string `json:"name"`
+}
+
+// LedgerMember is a member of a ledger, as seen by the other members
+type LedgerMember struct {
+	ID        int    `json:"id"`
+	Email     string `json:"email"`
+	InvitedBy string `json:"invited_by,omitempty"`
+}
+
+// Ledger is a ledger shared by several users. Its ID is given as ?ledger= to
+// work on the ledger instead of the user's own data
+type Ledger struct {
+	ID      string         `json:"id"`
+	Name    string         `json:"name"`
+	Members []LedgerMember `json:"members"`
+	Invites []LedgerMember `json:"invites"`
+}
+
+// sharedLedger is an opened ledger. It knows its members, so that payments
+// can be split between them.
+//
+// Its lock is the ledger's, whatever the generation: the key can be rotated
+// while a request waits for it (see RemoveMember). So locking reloads the
+// members, and reopens the data if it moved. If the user can't open it
+// anymore, everything fails
+type sharedLedger struct {
+	db.Store
+	api  *API
+	user *db.User
+	id   string
+	// invited opens the ledger with the key of the user's invite
+	invited    bool
+	generation int
+	members    []LedgerMember
+}
+
+func (l *sharedLedger) String() string {
+	return "ledger " + l.id
+}
+
+func (l *sharedLedger) Lock() (unlock func()) {
+	unlock = l.api.lockLedger(l.id)
+	l.reload()
+	return unlock
+}
+
+func (l *sharedLedger) RLock() (unlock func()) {
+	unlock = l.api.rlockLedger(l.id)
+	l.reload()
+	return unlock
+}
+
+func (l *sharedLedger) reload() {
+	if err := l.open(); err != nil {
+		l.Store = revokedLedger{err: err}
+	}
+}
+
+// open loads the members, and opens the current generation of the data if it
+// isn't opened yet
+func (l *sharedLedger) open() error {
+	members, err := l.api.loadMembers(l.id)
+	if err != nil {
+		return err
+	}
+	list := members.Members
+	if l.invited {
+		list = members.Invites
+	}
+	i := findMember(list, l.user.ID)
+	if i == -1 {
+		return ErrLedgerNotFound
+	}
+	if _, ok := l.Store.(*db.Ledger); !ok || members.Generation != l.generation {
+		data, err := l.api.unwrapLedger(l.user, l.id, members.Generation, list[i])
+		if err != nil {
+			return err
+		}
+		l.Store, l.generation = data, members.Generation
+	}
+	l.members = nil
+	for _, m := range members.Members {
+		l.members = append(l.members, LedgerMember{ID: m.UserID, Email: m.Email})
+	}
+	return nil
+}
+
+// revokedLedger is a ledger the user can't open anymore: everything fails
+// with err
+type revokedLedger struct {
+	err error
+}
+
+func (l revokedLedger) Load(string) ([]byte, error)                     { return nil, l.err }
+func (l revokedLedger) Save(string, []byte) error                       { return l.err }
+func (l revokedLedger) Remove(string) error                             { return l.err }
+func (l revokedLedger) Append(string, ...[]byte) error                  { return l.err }
+func (l revokedLedger) ReadLog(string, func(record []byte) error) error { return l.err }
+func (l revokedLedger) Compact(string, [][]byte) error                  { return l.err }
+func (l revokedLedger) Migrate() error                                  { return l.err }
+func (l revokedLedger) Lock() (unlock func())                           { return func() {} }
+func (l revokedLedger) RLock() (unlock func())                          { return func() {} }
+func (l revokedLedger) String() string                                  { return "revoked ledger" }
+
+// storeMembers returns the members of the shared ledger u, and nil if u is a
+// user's own store
+func storeMembers(u db.Store) []LedgerMember {
+	if l, ok := unwrapStore(u).(*sharedLedger); ok {
+		return l.members
+	}
+	return nil
+}
+
+func findMember(members []ledgerMember, userid int) int {
+	for i, m := range members {
+		if m.UserID == userid {
+			return i
+		}
+	}
+	return -1
+}
+
+// ledgerBackend returns the backend of the ledger's folder
+func (api *API) ledgerBackend(id string) db.Backend {
+	return api.backends("ledgers/" + id)
+}
+
+// dataFolder is the folder of a generation of the ledger's data
+func dataFolder(generation int) string {
+	if generation == 0 {
+		return "data"
+	}
+	return fmt.Sprintf("data.%d", generation)
+}
+
+// openLedger returns a generation of the ledger's data
+func (api *API) openLedger(id string, generation int, key []byte) (*db.Ledger, error) {
+	return db.NewLedgerWithBackend(id, api.backends("ledgers/"+id+"/"+dataFolder(generation)), key)
+}
+
+// lockLedger locks the ledger for writing, rlockLedger for reading. It's the
+// lock of sharedLedger
+func (api *API) lockLedger(id string) (unlock func()) {
+	return db.LockPath(api.ledgerBackend(id).String() + "/")
+}
+
+func (api *API) rlockLedger(id string) (unlock func()) {
+	return db.RLockPath(api.ledgerBackend(id).String() + "/")
+}
+
+func (api *API) loadMembers(id string) (*ledgerMembers, error) {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return nil, ErrLedgerNotFound
+	}
+	content, err := api.ledgerBackend(id).Get("members")
+	var patherr *os.PathError
+	if errors.As(err, &patherr) && os.IsNotExist(patherr) {
+		return nil, ErrLedgerNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("reading ledger members: %s", err)
+	}
+	var members ledgerMembers
+	if err := json.Unmarshal(content, &members); err != nil {
+		return nil, fmt.Errorf("parsing ledger members: %s", err)
+	}
+	return &members, nil
+}
+
+// lockMembers locks the ledger's members, which are changed with loadMembers
+// and saveMembers. It's taken before the ledger's lock
+func (api *API) lockMembers(id string) (unlock func()) {
+	return db.LockPath(api.ledgerBackend(id).String() + "/members")
+}
+
+func (api *API) saveMembers(id string, members *ledgerMembers) error {
+	content, err := json.Marshal(members)
+	if err != nil {
+		return fmt.Errorf("json encoding ledger members: %s", err)
+	}
+	if err := api.ledgerBackend(id).Put("members", content); err != nil {
+		return fmt.Errorf("writing ledger members: %s", err)
+	}
+	return nil
+}
+
+// unwrapLedger opens a generation of the ledger's data with the key wrapped
+// for u. It isn't migrated (see openShared)
+func (api *API) unwrapLedger(u *db.User, id string, generation int, member ledgerMember) (*db.Ledger, error) {
+	key, err := u.UnwrapKey(member.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping ledger key: %s", err)
+	}
+	return api.openLedger(id, generation, key)
+}
+
+// openShared opens the ledger u is a member of (or invited to)
+func (api *API) openShared(u *db.User, id string, invited bool) (*sharedLedger, error) {
+	l := &sharedLedger{api: api, user: u, id: id, invited: invited}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	if err := api.Migrate(l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// sharedView returns the public view of the ledger, which is locked for
+// reading
+func sharedView(l *sharedLedger, members *ledgerMembers) (*Ledger, error) {
+	defer l.RLock()()
+	return ledger(l.id, l, members)
+}
+
+// ledger returns the public view of a ledger
+func ledger(id string, l db.Store, members *ledgerMembers) (*Ledger, error) {
+	var info ledgerInfo
+	if _, err := loadJSON(l, "/info", &info); err != nil {
+		return nil, err
+	}
+	view := &Ledger{
+		ID:      id,
+		Name:    info.Name,
+		Members: []LedgerMember{},
+		Invites: []LedgerMember{},
+	}
+	for _, m := range members.Members {
+		view.Members = append(view.Members, LedgerMember{ID: m.UserID, Email: m.Email})
+	}
+	for _, m := range members.Invites {
+		view.Invites = append(view.Invites, LedgerMember{ID: m.UserID, Email: m.Email, InvitedBy: m.InvitedBy})
+	}
+	return view, nil
+}
+
+// wrapFor wraps the ledger's key for a user. Errors: ErrInvalidLedger, err
+func (api *API) wrapFor(key []byte, userid int, email string) ([]byte, error) {
+	public, err := api.OpenUser(userid, email).PublicKey()
+	if errors.Is(err, db.ErrNoPublicKey) {
+		return nil, fmt.Errorf("%s has to log in once before being invited (%w)", email, ErrInvalidLedger)
+	} else if err != nil {
+		return nil, err
+	}
+	return db.WrapKey(key, public)
+}
+
+// CreateLedger creates a ledger whose only member is u. Errors:
+// ErrInvalidLedger, err
+func (api *API) CreateLedger(u *db.User, name string) (*Ledger, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("need a name (%w)", ErrInvalidLedger)
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	key, err := db.NewLedgerKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := api.wrapFor(key, u.ID, u.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := api.openLedger(id, 0, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := api.Migrate(l); err != nil {
+		return nil, err
+	}
+	if err := saveJSON(l, "/info", ledgerInfo{Name: name}); err != nil {
+		return nil, err
+	}
+	members := &ledgerMembers{
+		Members: []ledgerMember{{UserID: u.ID, Email: u.Email, Key: wrapped}},
+		Invites: []ledgerMember{},
+	}
+	if err := api.saveMembers(id, members); err != nil {
+		return nil, err
+	}
+	return ledger(id, l, members)
+}
+
+// ledgerIDs returns the id of every ledger (the folders with members)
+func (api *API) ledgerIDs() ([]string, error) {
+	keys, err := api.backends("ledgers").List("")
+	if err != nil {
+		return nil, fmt.Errorf("listing ledgers: %s", err)
+	}
+	var ids []string
+	for _, key := range keys {
+		if id := strings.TrimSuffix(key, "/members"); id != key && !strings.Contains(id, "/") {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// deleteLedger removes every file of the ledger, the members last
+func (api *API) deleteLedger(id string) error {
+	if err := api.removeGenerations(id, -1); err != nil {
+		return err
+	}
+	return api.ledgerBackend(id).Delete("members")
+}
+
+// removeGenerations removes the data of the ledger which isn't in the folder
+// of generation keep: the generations it replaced, and the copies of
+// rotations which failed
+func (api *API) removeGenerations(id string, keep int) error {
+	b := api.ledgerBackend(id)
+	keys, err := b.List("")
+	if err != nil {
+		return fmt.Errorf("listing ledger files: %s", err)
+	}
+	for _, key := range keys {
+		if key == "members" || keep >= 0 && strings.HasPrefix(key, dataFolder(keep)+"/") {
+			continue
+		}
+		if err := b.Delete(key); err != nil {
+			return fmt.Errorf("removing %s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// ListLedgers returns the ledgers u is a member of, sorted by name
+func (api *API) ListLedgers(u *db.User) ([]Ledger, error) {
+	return api.listLedgers(u, false)
+}
+
+// ListInvites returns the ledgers u is invited to, sorted by name
+func (api *API) ListInvites(u *db.User) ([]Ledger, error) {
+	return api.listLedgers(u, true)
+}
+
+func (api *API) listLedgers(u *db.User, invites bool) ([]Ledger, error) {
+	ids, err := api.ledgerIDs()
+	if err != nil {
+		return nil, err
+	}
+	ledgers := []Ledger{}
+	for _, id := range ids {
+		members, err := api.loadMembers(id)
+		if err != nil {
+			return nil, fmt.Errorf("ledger %s: %s", id, err)
+		}
+		list := members.Members
+		if invites {
+			list = members.Invites
+		}
+		if findMember(list, u.ID) == -1 {
+			continue
+		}
+		l, err := api.openShared(u, id, invites)
+		if err != nil {
+			return nil, fmt.Errorf("ledger %s: %s", id, err)
+		}
+		view, err := sharedView(l, members)
+		if err != nil {
+			return nil, fmt.Errorf("ledger %s: %s", id, err)
+		}
+		ledgers = append(ledgers, *view)
+	}
+	sort.Slice(ledgers, func(i, j int) bool {
+		return strings.ToLower(ledgers[i].Name) < strings.ToLower(ledgers[j].Name)
+	})
+	return ledgers, nil
+}
+
+// OpenLedger returns the ledger's store, to use instead of the user's to work
+// on the ledger. Locking it picks up the changes to the members, so it must be
+// locked before it's used. Errors: ErrLedgerNotFound, err
+func (api *API) OpenLedger(u *db.User, id string) (db.Store, error) {
+	return api.openShared(u, id, false)
+}
+
+// InviteMember invites the user with the given email to the ledger. Any
+// member can invite. Errors: ErrLedgerNotFound, ErrUnknownUser,
+// ErrInvalidLedger, err
+func (api *API) InviteMember(u *db.User, id, email string) (*Ledger, error) {
+	defer api.lockMembers(id)()
+	members, err := api.loadMembers(id)
+	if err != nil {
+		return nil, err
+	}
+	i := findMember(members.Members, u.ID)
+	if i == -1 {
+		return nil, ErrLedgerNotFound
+	}
+	l, err := api.openShared(u, id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	invitee, err := api.findUser(email)
+	if err != nil {
+		return nil, err
+	}
+	if invitee.ID == 0 {
+		return nil, ErrUnknownUser
+	}
+	if findMember(members.Members, invitee.ID) != -1 {
+		return nil, fmt.Errorf("%s is already a member (%w)", email, ErrInvalidLedger)
+	}
+	if findMember(members.Invites, invitee.ID) != -1 {
+		return nil, fmt.Errorf("%s is already invited (%w)", email, ErrInvalidLedger)
+	}
+
+	key, err := u.UnwrapKey(members.Members[i].Key)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping ledger key: %s", err)
+	}
+	wrapped, err := api.wrapFor(key, invitee.ID, invitee.Email)
+	if err != nil {
+		return nil, err
+	}
+	members.Invites = append(members.Invites, ledgerMember{
+		UserID:    invitee.ID,
+		Email:     invitee.Email,
+		Key:       wrapped,
+		InvitedBy: u.Email,
+	})
+	if err := api.saveMembers(id, members); err != nil {
+		return nil, err
+	}
+	return sharedView(l, members)
+}
+
+// AcceptInvite makes u a member of the ledger they were invited to. Errors:
+// ErrInviteNotFound, err
+func (api *API) AcceptInvite(u *db.User, id string) (*Ledger, error) {
+	defer api.lockMembers(id)()
+	members, err := api.loadMembers(id)
+	if errors.Is(err, ErrLedgerNotFound) {
+		return nil, ErrInviteNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	i := findMember(members.Invites, u.ID)
+	if i == -1 {
+		return nil, ErrInviteNotFound
+	}
+	invite := members.Invites[i]
+	// make sure we can actually open it before accepting
+	l, err := api.openShared(u, id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	members.Invites = append(members.Invites[:i], members.Invites[i+1:]...)
+	invite.InvitedBy = ""
+	members.Members = append(members.Members, invite)
+	if err := api.saveMembers(id, members); err != nil {
+		return nil, err
+	}
+	l.invited = false
+	return sharedView(l, members)
+}
+
+// DeclineInvite removes u's invite to the ledger. Errors: ErrInviteNotFound,
+// err
+func (api *API) DeclineInvite(u *db.User, id string) error {
+	defer api.lockMembers(id)()
+	members, err := api.loadMembers(id)
+	if errors.Is(err, ErrLedgerNotFound) {
+		return ErrInviteNotFound
+	} else if err != nil {
+		return err
+	}
+	i := findMember(members.Invites, u.ID)
+	if i == -1 {
+		return ErrInviteNotFound
+	}
+	members.Invites = append(members.Invites[:i], members.Invites[i+1:]...)
+	return api.saveMembers(id, members)
+}
+
+// RemoveMember removes a member (or cancels an invite) from the ledger. Any
+// member can remove any other member, or leave. When a member is removed, the
+// ledger is encrypted with a new key, wrapped for the remaining members and
+// invitees only. When the last member leaves, the ledger is deleted. Errors:
+// ErrLedgerNotFound, ErrInvalidLedger, err
+func (api *API) RemoveMember(u *db.User, id string, userid int) error {
+	defer api.lockMembers(id)()
+	// requests which are waiting for the ledger reload it once we are done,
+	// so none of them writes with the old key
+	defer api.lockLedger(id)()
+	members, err := api.loadMembers(id)
+	if err != nil {
+		return err
+	}
+	i := findMember(members.Members, u.ID)
+	if i == -1 {
+		return ErrLedgerNotFound
+	}
+
+	if j := findMember(members.Invites, userid); j != -1 {
+		// they never had access to the data, and their copy of the key is
+		// deleted with the invite
+		members.Invites = append(members.Invites[:j], members.Invites[j+1:]...)
+		return api.saveMembers(id, members)
+	}
+
+	j := findMember(members.Members, userid)
+	if j == -1 {
+		return fmt.Errorf("user %d isn't a member (%w)", userid, ErrInvalidLedger)
+	}
+	if len(members.Members) == 1 {
+		return api.deleteLedger(id)
+	}
+
+	l, err := api.unwrapLedger(u, id, members.Generation, members.Members[i])
+	if err != nil {
+		return err
+	}
+	if err := api.Migrate(l); err != nil {
+		return err
+	}
+	key, err := db.NewLedgerKey()
+	if err != nil {
+		return err
+	}
+
+	members.Members = append(members.Members[:j], members.Members[j+1:]...)
+	for _, list := range [][]ledgerMember{members.Members, members.Invites} {
+		for k := range list {
+			list[k].Key, err = api.wrapFor(key, list[k].UserID, list[k].Email)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the data is copied into the next generation, and saving the members
+	// switches to it. If anything fails before, the ledger is left as it was
+	if err := api.removeGenerations(id, members.Generation); err != nil {
+		return err
+	}
+	next, err := api.openLedger(id, members.Generation+1, key)
+	if err != nil {
+		return err
+	}
+	if err := l.Rekey(next); err != nil {
+		return fmt.Errorf("rekeying ledger: %s", err)
+	}
+	members.Generation++
+	if err := api.saveMembers(id, members); err != nil {
+		return err
+	}
+	if err := api.removeGenerations(id, members.Generation); err != nil {
+		log.Printf("ledger %s: removing old generations: %s", id, err)
+	}
+	return nil
+}
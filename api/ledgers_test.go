@@ -0,0 +1,221 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/math2001/money/db"
+)
+
+// newTestLedgersAPI signs up users with the given emails (their IDs start at 1)
+// and returns an API which knows about them. Their keys are in a temporary
+// folder, the files in memory
+func newTestLedgersAPI(t *testing.T, emails ...string) (*API, []*db.User, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "money-test-"+t.Name())
+	if err != nil {
+		t.Fatalf("creating temporary directory: %s", err)
+	}
+	api := &API{
+		Usersdir: filepath.Join(dir, "users"),
+		backends: db.MemoryBackends(),
+	}
+	if err := os.Mkdir(api.Usersdir, 0700); err != nil {
+		t.Fatalf("creating users folder: %s", err)
+	}
+	var list []user
+	var users []*db.User
+	for i, email := range emails {
+		u := api.OpenUser(i+1, email)
+		if err := u.SignUp([]byte("test password")); err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("signing up %s: %s", email, err)
+		}
+		users = append(users, u)
+		list = append(list, user{ID: u.ID, Email: email})
+	}
+	content, err := json.Marshal(list)
+	if err != nil {
+		t.Fatalf("encoding users list: %s", err)
+	}
+	if err := api.backends("").Put(usersList, content); err != nil {
+		t.Fatalf("writing users list: %s", err)
+	}
+	return api, users, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatalf("removing temporary directory: %s", err)
+		}
+	}
+}
+
+func TestLedgers(t *testing.T) {
+	api, users, cleanup := newTestLedgersAPI(t, "a@example.com", "b@example.com", "c@example.com")
+	defer cleanup()
+	a, b, c := users[0], users[1], users[2]
+
+	l, err := api.CreateLedger(a, "  Home ")
+	if err != nil {
+		t.Fatalf("creating ledger: %s", err)
+	}
+	if l.Name != "Home" || len(l.Members) != 1 || l.Members[0].Email != a.Email {
+		t.Fatalf("should have Home with a as only member, got %+v", l)
+	}
+	if _, err := api.CreateLedger(a, " "); !errors.Is(err, ErrInvalidLedger) {
+		t.Errorf("should have ErrInvalidLedger for empty name, got %v", err)
+	}
+
+	if _, err := api.OpenLedger(b, l.ID); err != ErrLedgerNotFound {
+		t.Errorf("non member: should have ErrLedgerNotFound, got %v", err)
+	}
+	if _, err := api.InviteMember(a, l.ID, "nobody@example.com"); err != ErrUnknownUser {
+		t.Errorf("should have ErrUnknownUser, got %v", err)
+	}
+	if _, err := api.InviteMember(b, l.ID, c.Email); err != ErrLedgerNotFound {
+		t.Errorf("non member inviting: should have ErrLedgerNotFound, got %v", err)
+	}
+	for _, email := range []string{b.Email, c.Email} {
+		if _, err := api.InviteMember(a, l.ID, email); err != nil {
+			t.Fatalf("inviting %s: %s", email, err)
+		}
+	}
+	if _, err := api.InviteMember(a, l.ID, b.Email); !errors.Is(err, ErrInvalidLedger) {
+		t.Errorf("inviting twice: should have ErrInvalidLedger, got %v", err)
+	}
+
+	invites, err := api.ListInvites(b)
+	if err != nil {
+		t.Fatalf("listing invites: %s", err)
+	}
+	if len(invites) != 1 || invites[0].Name != "Home" || invites[0].Invites[0].InvitedBy != a.Email {
+		t.Fatalf("should have b invited to Home by a, got %+v", invites)
+	}
+	if _, err := api.OpenLedger(b, l.ID); err != ErrLedgerNotFound {
+		t.Errorf("invitee: should have ErrLedgerNotFound, got %v", err)
+	}
+	if _, err := api.AcceptInvite(b, l.ID); err != nil {
+		t.Fatalf("accepting invite: %s", err)
+	}
+	if _, err := api.AcceptInvite(b, l.ID); err != ErrInviteNotFound {
+		t.Errorf("accepting twice: should have ErrInviteNotFound, got %v", err)
+	}
+	if err := api.DeclineInvite(c, l.ID); err != nil {
+		t.Fatalf("declining invite: %s", err)
+	}
+	if invites, err := api.ListInvites(c); err != nil || len(invites) != 0 {
+		t.Errorf("should have no invites left for c, got %+v (%v)", invites, err)
+	}
+
+	// both members work on the same payments
+	la, err := api.OpenLedger(a, l.ID)
+	if err != nil {
+		t.Fatalf("a opening ledger: %s", err)
+	}
+	lb, err := api.OpenLedger(b, l.ID)
+	if err != nil {
+		t.Fatalf("b opening ledger: %s", err)
+	}
+	p, err := api.AddPayment(la, []byte(`{"name": "groceries", "amount": "42.50", "date": "2020-03-01"}`))
+	if err != nil {
+		t.Fatalf("a adding payment: %s", err)
+	}
+	if _, err := api.UpdatePayment(lb, p.ID, []byte(`{"name": "weekly groceries"}`)); err != nil {
+		t.Fatalf("b updating payment: %s", err)
+	}
+	payments, err := api.ListPayments(la, PaymentsQuery{})
+	if err != nil {
+		t.Fatalf("a listing payments: %s", err)
+	}
+	if len(payments.Payments) != 1 || payments.Payments[0].Name != "weekly groceries" {
+		t.Fatalf("should have b's update, got %+v", payments.Payments)
+	}
+	ledgers, err := api.ListLedgers(b)
+	if err != nil || len(ledgers) != 1 || len(ledgers[0].Members) != 2 {
+		t.Fatalf("should have b in Home with 2 members, got %+v (%v)", ledgers, err)
+	}
+
+	// removing b rotates the key: their old copy is useless
+	members, err := api.loadMembers(l.ID)
+	if err != nil {
+		t.Fatalf("loading members: %s", err)
+	}
+	oldkey := members.Members[findMember(members.Members, b.ID)].Key
+	if err := api.RemoveMember(a, l.ID, b.ID); err != nil {
+		t.Fatalf("removing b: %s", err)
+	}
+	if _, err := api.OpenLedger(b, l.ID); err != ErrLedgerNotFound {
+		t.Errorf("removed member: should have ErrLedgerNotFound, got %v", err)
+	}
+	members, err = api.loadMembers(l.ID)
+	if err != nil {
+		t.Fatalf("loading members: %s", err)
+	}
+	if members.Generation != 1 {
+		t.Errorf("should have generation 1 after rekey, got %d", members.Generation)
+	}
+	stale, err := api.unwrapLedger(b, l.ID, members.Generation, ledgerMember{Key: oldkey})
+	if err != nil {
+		t.Fatalf("unwrapping old key: %s", err)
+	}
+	if _, err := loadPayments(stale); err == nil {
+		t.Errorf("should fail to decrypt payments with the old key")
+	}
+	if keys, err := api.ledgerBackend(l.ID).List("data/"); err != nil || len(keys) != 0 {
+		t.Errorf("should have removed the old generation, got %q (%v)", keys, err)
+	}
+
+	// the stores opened before are reloaded when they are locked, like
+	// requests which were waiting for the ledger: a's uses the new key, b's
+	// doesn't work anymore
+	unlock := la.Lock()
+	payments, err = api.ListPayments(la, PaymentsQuery{})
+	if err != nil || len(payments.Payments) != 1 {
+		t.Fatalf("should still have 1 payment after rekey, got %+v (%v)", payments, err)
+	}
+	if _, err := api.AddPayment(la, []byte(`{"name": "rent", "amount": "800", "date": "2020-03-02"}`)); err != nil {
+		t.Errorf("a adding payment after rekey: %s", err)
+	}
+	unlock()
+	unlock = lb.Lock()
+	if _, err := api.AddPayment(lb, []byte(`{"name": "sneaky", "amount": "1", "date": "2020-03-02"}`)); err == nil {
+		t.Errorf("removed member: should fail to add payment")
+	}
+	unlock()
+	la, err = api.OpenLedger(a, l.ID)
+	if err != nil {
+		t.Fatalf("a reopening ledger: %s", err)
+	}
+	payments, err = api.ListPayments(la, PaymentsQuery{})
+	if err != nil || len(payments.Payments) != 2 {
+		t.Fatalf("should have 2 payments after rekey, got %+v (%v)", payments, err)
+	}
+
+	// the last member leaving deletes the ledger
+	if err := api.RemoveMember(a, l.ID, a.ID); err != nil {
+		t.Fatalf("leaving: %s", err)
+	}
+	if _, err := api.OpenLedger(a, l.ID); err != ErrLedgerNotFound {
+		t.Errorf("deleted ledger: should have ErrLedgerNotFound, got %v", err)
+	}
+	if keys, err := api.backends("ledgers").List(""); err != nil || len(keys) != 0 {
+		t.Errorf("should have removed every file of the ledger, got %q (%v)", keys, err)
+	}
+
+	// only the keys are on the disk, everything else is in the backends
+	err = filepath.Walk(api.Usersdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if rel, _ := filepath.Rel(api.Usersdir, path); !strings.Contains(filepath.ToSlash(rel), "/secrets/") {
+			t.Errorf("should only have keys on the disk, got %s", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("listing users folder: %s", err)
+	}
+}
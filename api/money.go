@@ -0,0 +1,288 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// ErrAmountOverflow is returned when an amount doesn't fit in Money's units
+var ErrAmountOverflow = errors.New("amount out of range")
+
+// maxExponent is the highest number of decimal digits an amount can have
+const maxExponent = 6
+
+// maxIntegerDigits bounds the amounts which are parsed: they are smaller than
+// 10^12. With at most maxExponent decimal digits, that's less than 10^18
+// units, so a parsed amount can always be rescaled. Sums and products can
+// still overflow, which the arithmetic reports
+const maxIntegerDigits = 12
+
+// decimalRegexp matches the decimal notation, with an optional (short)
+// exponent
+var decimalRegexp = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]{1,2})?$`)
+
+// defaultExponent is the exponent of the currencies not in currencyExponents
+const defaultExponent = 2
+
+// currencyExponents are the ISO 4217 currencies which don't have 2 decimal
+// digits
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0,
+	"KRW": 0, "PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0,
+	"XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// currencyExponent returns the number of decimal digits of the currency's
+// minor unit
+func currencyExponent(currency string) int {
+	if exp, ok := currencyExponents[currency]; ok {
+		return exp
+	}
+	return defaultExponent
+}
+
+// Money is an exact amount of money: Units is the amount in minor units, and
+// Exponent the number of decimal digits. So Money{1234, 2} is 12.34
+//
+// Use the methods to do arithmetic, they handle different exponents and report
+// overflows (ErrAmountOverflow). It's serialized as a JSON string ("12.34"),
+// but can be unmarshaled from a JSON number too
+type Money struct {
+	Units    int64
+	Exponent int
+}
+
+// ParseMoney parses a decimal amount ("-12.34", "3", "1e2"). The exponent of
+// the result is the number of decimal digits written ("1.50" has exponent 2),
+// or the number needed to represent it exactly in scientific notation. The
+// amount must be smaller than 10^12 (in absolute value)
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if !decimalRegexp.MatchString(s) {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	max := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(maxIntegerDigits), nil))
+	if new(big.Rat).Abs(r).Cmp(max) >= 0 {
+		return Money{}, fmt.Errorf("amount %s should have at most %d integer digits (%w)", s, maxIntegerDigits, ErrAmountOverflow)
+	}
+	m, err := moneyFromRat(r)
+	if err != nil {
+		return m, err
+	}
+	if point := strings.IndexByte(s, '.'); point != -1 && !strings.ContainsAny(s, "eE") {
+		if written := len(s) - point - 1; written > m.Exponent && written <= maxExponent {
+			return m.Rescale(written)
+		}
+	}
+	return m, nil
+}
+
+func moneyFromRat(r *big.Rat) (Money, error) {
+	scaled := new(big.Rat).Set(r)
+	ten := big.NewRat(10, 1)
+	for exp := 0; exp <= maxExponent; exp++ {
+		if scaled.IsInt() {
+			return moneyFromUnits(scaled.Num(), exp)
+		}
+		scaled.Mul(scaled, ten)
+	}
+	return Money{}, fmt.Errorf("amount %s has more than %d decimal digits", r.FloatString(maxExponent+1), maxExponent)
+}
+
+// moneyFromUnits returns the amount if the units fit. math.MinInt64 doesn't,
+// so that every amount can be negated
+func moneyFromUnits(units *big.Int, exponent int) (Money, error) {
+	if !units.IsInt64() || units.Int64() == math.MinInt64 {
+		return Money{}, fmt.Errorf("%s units with exponent %d (%w)", units, exponent, ErrAmountOverflow)
+	}
+	return Money{Units: units.Int64(), Exponent: exponent}, nil
+}
+
+// rat returns m as an exact fraction
+func (m Money) rat() *big.Rat {
+	denom := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(m.Exponent)), nil)
+	return new(big.Rat).SetFrac(big.NewInt(m.Units), denom)
+}
+
+// Rescale returns m with the given exponent. If that means loosing decimal
+// digits, m is rounded half away from zero. Errors: ErrAmountOverflow
+func (m Money) Rescale(exponent int) (Money, error) {
+	if exponent < m.Exponent {
+		return m.Round(exponent), nil
+	}
+	units := m.Units
+	for e := m.Exponent; e < exponent; e++ {
+		var err error
+		if units, err = mulUnits(units, 10); err != nil {
+			return Money{}, err
+		}
+	}
+	return Money{Units: units, Exponent: exponent}, nil
+}
+
+// Round rounds m to the given exponent, half away from zero
+func (m Money) Round(exponent int) Money {
+	if exponent >= m.Exponent {
+		return m
+	}
+	r := m.rat()
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)
+	r.Mul(r, new(big.Rat).SetInt(scale))
+	// rounding to fewer digits can't make the units bigger
+	return Money{Units: roundRat(r).Int64(), Exponent: exponent}
+}
+
+// roundRat rounds r to the nearest integer, half away from zero
+func roundRat(r *big.Rat) *big.Int {
+	num := new(big.Int).Set(r.Num())
+	denom := r.Denom()
+	negative := num.Sign() < 0
+	num.Abs(num)
+	// (2*num + denom) / (2*denom)
+	num.Mul(num, big.NewInt(2))
+	num.Add(num, denom)
+	q := num.Quo(num, new(big.Int).Mul(denom, big.NewInt(2)))
+	if negative {
+		q.Neg(q)
+	}
+	return q
+}
+
+// mulUnits multiplies a by b. Errors: ErrAmountOverflow
+func mulUnits(a, b int64) (int64, error) {
+	c := a * b
+	if a != 0 && c/a != b || c == math.MinInt64 {
+		return 0, fmt.Errorf("%d * %d (%w)", a, b, ErrAmountOverflow)
+	}
+	return c, nil
+}
+
+// align returns a and b with the same exponent. Errors: ErrAmountOverflow
+func align(a, b Money) (Money, Money, error) {
+	var err error
+	if a.Exponent < b.Exponent {
+		a, err = a.Rescale(b.Exponent)
+	} else if b.Exponent < a.Exponent {
+		b, err = b.Rescale(a.Exponent)
+	}
+	return a, b, err
+}
+
+// Add returns m + o. Errors: ErrAmountOverflow
+func (m Money) Add(o Money) (Money, error) {
+	m, o, err := align(m, o)
+	if err != nil {
+		return Money{}, err
+	}
+	sum := m.Units + o.Units
+	if o.Units > 0 && sum < m.Units || o.Units < 0 && sum > m.Units || sum == math.MinInt64 {
+		return Money{}, fmt.Errorf("%s + %s (%w)", m, o, ErrAmountOverflow)
+	}
+	m.Units = sum
+	return m, nil
+}
+
+// Sub returns m - o. Errors: ErrAmountOverflow
+func (m Money) Sub(o Money) (Money, error) {
+	return m.Add(o.Neg())
+}
+
+func (m Money) Neg() Money {
+	m.Units = -m.Units
+	return m
+}
+
+// Mul multiplies m by an integer (to compute averages, use Div). Errors:
+// ErrAmountOverflow
+func (m Money) Mul(n int64) (Money, error) {
+	units, err := mulUnits(m.Units, n)
+	if err != nil {
+		return Money{}, err
+	}
+	m.Units = units
+	return m, nil
+}
+
+// Div divides m by n, rounding to m's exponent. It panics if n is 0
+func (m Money) Div(n int64) Money {
+	if n == 0 {
+		panic("money: division by zero")
+	}
+	r := new(big.Rat).SetFrac64(m.Units, n)
+	return Money{Units: roundRat(r).Int64(), Exponent: m.Exponent}
+}
+
+// Cmp returns -1 if m < o, 0 if m == o and 1 if m > o
+func (m Money) Cmp(o Money) int {
+	a, b, err := align(m, o)
+	if err != nil {
+		return m.rat().Cmp(o.rat())
+	}
+	return compareInt64(a.Units, b.Units)
+}
+
+func (m Money) IsZero() bool {
+	return m.Units == 0
+}
+
+// Sign returns -1, 0 or 1
+func (m Money) Sign() int {
+	return compareInt64(m.Units, 0)
+}
+
+func (m Money) Abs() Money {
+	if m.Units < 0 {
+		return m.Neg()
+	}
+	return m
+}
+
+// String formats m with exactly Exponent decimal digits
+func (m Money) String() string {
+	units := m.Units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	digits := fmt.Sprintf("%0*d", m.Exponent+1, units)
+	if m.Exponent == 0 {
+		return sign + digits
+	}
+	point := len(digits) - m.Exponent
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON accepts "12.34" and 12.34. The number is read from its
+// decimal representation, so there is no floating point rounding
+func (m *Money) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n json.Number
+		if err := json.Unmarshal(b, &n); err != nil {
+			return errors.New("amount should be a string or a number")
+		}
+		s = n.String()
+	}
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
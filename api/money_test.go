@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestMoneyArithmetic(t *testing.T) {
+	a, err := ParseMoney("0.1")
+	if err != nil {
+		t.Fatalf("parsing 0.1: %s", err)
+	}
+	b, err := ParseMoney("0.2")
+	if err != nil {
+		t.Fatalf("parsing 0.2: %s", err)
+	}
+	c, err := ParseMoney("0.3")
+	if err != nil {
+		t.Fatalf("parsing 0.3: %s", err)
+	}
+	if sum, err := a.Add(b); err != nil || sum.Cmp(c) != 0 {
+		t.Errorf("0.1 + 0.2 should equal 0.3, got %s (%v)", sum, err)
+	}
+	diff, err := Money{1234, 2}.Sub(Money{5, 0})
+	if err != nil {
+		t.Fatalf("subtracting: %s", err)
+	}
+
+	cases := []struct {
+		got, expected string
+	}{
+		{diff.String(), "7.34"},
+		{Money{1234, 2}.Neg().String(), "-12.34"},
+		{Money{5, 3}.String(), "0.005"},
+		{Money{-5, 1}.String(), "-0.5"},
+		{Money{1200, 0}.String(), "1200"},
+		{Money{1005, 3}.Round(2).String(), "1.01"},
+		{Money{-1005, 3}.Round(2).String(), "-1.01"},
+		{Money{1004, 3}.Round(2).String(), "1.00"},
+		{Money{1000, 2}.Div(3).String(), "3.33"},
+		{Money{-1000, 2}.Div(6).String(), "-1.67"},
+	}
+	for _, c := range cases {
+		if c.got != c.expected {
+			t.Errorf("should have %s, got %s", c.expected, c.got)
+		}
+	}
+
+	if m, err := (Money{1005, 3}).Rescale(2); err != nil || m.String() != "1.01" {
+		t.Errorf("rescaling 1.005 should round to 1.01, got %s (%v)", m, err)
+	}
+	if m, err := (Money{105, 2}).Rescale(3); err != nil || m.String() != "1.050" {
+		t.Errorf("rescaling 1.05 should give 1.050, got %s (%v)", m, err)
+	}
+	if (Money{10, 1}).Cmp(Money{1, 0}) != 0 {
+		t.Errorf("1.0 should equal 1")
+	}
+}
+
+func TestMoneyOverflow(t *testing.T) {
+	if _, err := (Money{100000000000000000, 0}).Rescale(2); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("rescaling 10^17 to 2 decimal digits: should have ErrAmountOverflow, got %v", err)
+	}
+	big := Money{9000000000000000000, 0}
+	if _, err := big.Add(big); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("9e18 + 9e18: should have ErrAmountOverflow, got %v", err)
+	}
+	if _, err := big.Neg().Sub(big); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("-9e18 - 9e18: should have ErrAmountOverflow, got %v", err)
+	}
+	if _, err := big.Mul(2); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("9e18 * 2: should have ErrAmountOverflow, got %v", err)
+	}
+	if _, err := (Money{math.MaxInt64, 0}).Add(Money{-1, 0}); err != nil {
+		t.Errorf("MaxInt64 - 1 should fit, got %v", err)
+	}
+	if big.Cmp(Money{1, 2}) != 1 {
+		t.Errorf("9e18 should be bigger than 0.01, even though it can't be rescaled")
+	}
+
+	if _, err := ParseMoney("100000000000000000"); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("parsing 10^17: should have ErrAmountOverflow, got %v", err)
+	}
+	if _, err := ParseMoney("-1e12"); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("parsing -10^12: should have ErrAmountOverflow, got %v", err)
+	}
+	m, err := ParseMoney("999999999999.999999")
+	if err != nil {
+		t.Fatalf("parsing the biggest amount: %s", err)
+	}
+	if _, err := m.Rescale(maxExponent); err != nil {
+		t.Errorf("the biggest amount should rescale to %d decimal digits, got %s", maxExponent, err)
+	}
+}
+
+func TestParseMoneyDecimal(t *testing.T) {
+	for _, s := range []string{"12", "-12.34", "+0.5", ".5", "5.", "1e2", "1.5E-1"} {
+		if _, err := ParseMoney(s); err != nil {
+			t.Errorf("parsing %q: %s", s, err)
+		}
+	}
+	for _, s := range []string{"1/4", "0x10", "1_000", "", "-", "1e", "1e999999999", "Inf"} {
+		if m, err := ParseMoney(s); err == nil {
+			t.Errorf("parsing %q: should have error, got %s", s, m)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var m struct{ A, B Money }
+	if err := json.Unmarshal([]byte(`{"A": 12.50, "B": "0.10"}`), &m); err != nil {
+		t.Fatalf("unmarshaling: %s", err)
+	}
+	if m.A != (Money{1250, 2}) || m.B != (Money{10, 2}) {
+		t.Errorf("should keep the written decimal digits, got %v %v", m.A, m.B)
+	}
+	content, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("marshaling: %s", err)
+	}
+	if string(content) != `{"A":"12.50","B":"0.10"}` {
+		t.Errorf("should marshal as strings, got %s", content)
+	}
+
+	if err := json.Unmarshal([]byte(`{"A": "12,5"}`), &m); err == nil {
+		t.Errorf("should have error for invalid amount")
+	}
+}
@@ -0,0 +1,263 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// ErrInvalidPayment tags every error caused by a payment given by the user
+// (missing field, wrong type, etc)
+var ErrInvalidPayment = errors.New("invalid payment")
+
+// ErrPaymentNotFound is returned when no payment has the given ID
+var ErrPaymentNotFound = errors.New("payment not found")
+
+// ErrVersionConflict is returned when a payment has been changed since the
+// client loaded it. The error is a *VersionConflictError
+var ErrVersionConflict = errors.New("payment changed since it was loaded")
+
+// VersionConflictError gives the payment as it is now, so that the client can
+// show what changed
+type VersionConflictError struct {
+	Current Payment
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("payment %s is at version %d", e.Current.ID, e.Current.Version)
+}
+
+func (e *VersionConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+// dateLayout is the format of every date exchanged with the pwa (it's what
+// <input type="date"> gives us)
+const dateLayout = "2006-01-02"
+
+// Date is a calendar day. It is serialized as YYYY-MM-DD, and is always
+// stored at midnight UTC so that two dates can be compared directly
+type Date struct {
+	time.Time
+}
+
+// ParseDate parses a YYYY-MM-DD date
+func ParseDate(s string) (Date, error) {
+	t, err := time.Parse(dateLayout, s)
+	if err != nil {
+		return Date{}, err
+	}
+	return Date{t}, nil
+}
+
+// NewDate returns the day t is in (the time of the day is dropped)
+func NewDate(t time.Time) Date {
+	return Date{time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)}
+}
+
+func (d Date) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format(dateLayout)
+}
+
+func (d Date) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON accepts an empty string as the zero date
+func (d *Date) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("date should be a string: %s", err)
+	}
+	if s == "" {
+		*d = Date{}
+		return nil
+	}
+	parsed, err := ParseDate(s)
+	if err != nil {
+		return fmt.Errorf("date should be formatted as YYYY-MM-DD: %s", err)
+	}
+	*d = parsed
+	return nil
+}
+
+// the directions money can go in
+const (
+	DirectionExpense = "expense"
+	DirectionIncome  = "income"
+)
+
+// Payment is a single spending, or income. Every field the pwa sends that we
+// don't know about is kept in Custom
+type Payment struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+	// Amount is what was spent (or received, for income). A negative expense
+	// is a refund
+	Amount    Money  `json:"amount"`
+	Direction string `json:"direction"`
+	Currency  string `json:"currency,omitempty"`
+	Date      Date   `json:"date"`
+	Category  string `json:"category,omitempty"`
+	Merchant  string `json:"merchant,omitempty"`
+	// Account is the id of the account the money came from (or went to)
+	Account string            `json:"account,omitempty"`
+	Tags    []string          `json:"tags,omitempty"`
+	Notes   string            `json:"notes,omitempty"`
+	Custom  map[string]string `json:"custom,omitempty"`
+	// ImportID identifies the bank transaction the payment was imported from
+	// (an OFX FITID for example), so that it isn't imported twice
+	ImportID string `json:"import_id,omitempty"`
+	// Receipt is the id of the scanned receipt (see Scan)
+	Receipt string `json:"receipt,omitempty"`
+	// Split shares the payment between members of a shared ledger
+	Split *Split `json:"split,omitempty"`
+	// Version goes up every time the payment is saved. Clients send back the
+	// version they loaded, so that they don't overwrite a change they haven't
+	// seen (see ErrVersionConflict)
+	Version int `json:"version,omitempty"`
+}
+
+// knownPaymentFields lists the JSON keys which aren't custom fields
+var knownPaymentFields = map[string]bool{
+	"id":        true,
+	"name":      true,
+	"amount":    true,
+	"direction": true,
+	"currency":  true,
+	"date":      true,
+	"category":  true,
+	"merchant":  true,
+	"account":   true,
+	"tags":      true,
+	"notes":     true,
+	"custom":    true,
+	"import_id": true,
+	"receipt":   true,
+	"split":     true,
+	"version":   true,
+}
+
+// UnmarshalJSON only sets the fields present in b (so it can be used to patch
+// an existing payment), and stores the unknown keys as custom fields
+func (p *Payment) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+
+	// the alias doesn't have the UnmarshalJSON method, so we don't recurse
+	type payment Payment
+	known := make(map[string]json.RawMessage)
+	for key, value := range fields {
+		if knownPaymentFields[key] {
+			known[key] = value
+			continue
+		}
+		if p.Custom == nil {
+			p.Custom = make(map[string]string)
+		}
+		p.Custom[key] = customValue(value)
+	}
+
+	// a split is replaced as a whole (and removed with null)
+	if _, ok := known["split"]; ok {
+		p.Split = nil
+	}
+
+	content, err := json.Marshal(known)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, (*payment)(p))
+}
+
+// customValue converts a raw JSON value to the string stored in the custom
+// fields. Strings are stored as is, anything else as JSON
+func customValue(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// newID generates a random ID. They are never reused, so the pwa can use
+// them to refer to a payment (or a rule, etc)
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", fmt.Errorf("generating id: %s", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// findPayment returns the index of the payment with the given ID, or -1
+func findPayment(payments []Payment, id string) int {
+	for i, p := range payments {
+		if p.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+var currencyRegexp = regexp.MustCompile("^[A-Z]{3}$")
+
+// isValidPayment makes sure the required fields are set, and that the
+// optional ones are well formed
+func isValidPayment(p Payment) error {
+	// this should combine errors (ie find as many errors as possible)
+	if p.Name == "" {
+		return fmt.Errorf("need 'name' field (%w)", ErrInvalidPayment)
+	}
+	if p.Amount.IsZero() {
+		return fmt.Errorf("need non-zero 'amount' field (%w)", ErrInvalidPayment)
+	}
+	if p.Date.IsZero() {
+		return fmt.Errorf("need 'date' field (%w)", ErrInvalidPayment)
+	}
+	if p.Direction != DirectionExpense && p.Direction != DirectionIncome {
+		return fmt.Errorf("'direction' should be %q or %q, got %q (%w)", DirectionExpense, DirectionIncome, p.Direction, ErrInvalidPayment)
+	}
+	if !currencyRegexp.MatchString(p.Currency) {
+		return fmt.Errorf("'currency' should be a 3 letter ISO 4217 code, got %q (%w)", p.Currency, ErrInvalidPayment)
+	}
+	if p.Amount.Exponent > currencyExponent(p.Currency) {
+		return fmt.Errorf("'amount' has more decimal digits than the currency allows (%w)", ErrInvalidPayment)
+	}
+	for key := range p.Custom {
+		if key == "" || knownPaymentFields[key] {
+			return fmt.Errorf("invalid custom field name %q (%w)", key, ErrInvalidPayment)
+		}
+	}
+	return nil
+}
+
+// spending is what the payment costs: its amount for an expense, and minus its
+// amount for income
+func (p Payment) spending() Money {
+	if p.Direction == DirectionIncome {
+		return p.Amount.Neg()
+	}
+	return p.Amount
+}
+
+// normalizeAmount gives the amount the exponent of its currency, so that
+// every amount of a currency is formatted the same way
+func normalizeAmount(p *Payment) error {
+	amount, err := p.Amount.Rescale(currencyExponent(p.Currency))
+	if err != nil {
+		return fmt.Errorf("'amount' is too big (%w)", ErrInvalidPayment)
+	}
+	p.Amount = amount
+	return nil
+}
@@ -0,0 +1,315 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestPaymentCustomFields(t *testing.T) {
+	var p Payment
+	input := `{"name": "coffee", "amount": 4.5, "date": "2019-12-20", "shop": "corner", "items": 2}`
+	if err := json.Unmarshal([]byte(input), &p); err != nil {
+		t.Fatalf("unmarshaling payment: %s", err)
+	}
+	if p.Name != "coffee" || p.Amount.String() != "4.5" || p.Date.String() != "2019-12-20" {
+		t.Errorf("known fields not decoded: %+v", p)
+	}
+	if p.Custom["shop"] != "corner" || p.Custom["items"] != "2" {
+		t.Errorf("should have custom fields shop and items, got %v", p.Custom)
+	}
+
+	// unmarshaling over an existing payment only changes the given fields
+	if err := json.Unmarshal([]byte(`{"amount": 5, "shop": "station"}`), &p); err != nil {
+		t.Fatalf("patching payment: %s", err)
+	}
+	if p.Name != "coffee" || p.Amount.String() != "5" || p.Custom["shop"] != "station" || p.Custom["items"] != "2" {
+		t.Errorf("patch should only change amount and shop, got %+v", p)
+	}
+}
+
+func TestInvalidPayments(t *testing.T) {
+	cases := []string{
+		`{"amount": 1, "date": "2019-12-20"}`,
+		`{"name": "a", "date": "2019-12-20"}`,
+		`{"name": "a", "amount": 1}`,
+		`{"name": "a", "amount": 1, "date": "2019-12-20", "currency": "dollars"}`,
+	}
+	for _, input := range cases {
+		var p Payment
+		if err := json.Unmarshal([]byte(input), &p); err != nil {
+			t.Fatalf("unmarshaling %s: %s", input, err)
+		}
+		if err := isValidPayment(p); !errors.Is(err, ErrInvalidPayment) {
+			t.Errorf("%s: should have ErrInvalidPayment, got %v", input, err)
+		}
+	}
+
+	var p Payment
+	if err := json.Unmarshal([]byte(`{"name": "a", "amount": 1, "date": "20/12/2019"}`), &p); err == nil {
+		t.Errorf("should have error for badly formatted date")
+	}
+}
+
+func TestUpgradeLegacyPayments(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+
+	legacy := `[{"name": "rent", "amount": 800, "date": "2019-12-01", "flatmate": "bob"},
+		{"name": "book", "amount": 12.5, "date": "yesterday"}]`
+	if err := u.Save("/payments", []byte(legacy)); err != nil {
+		t.Fatalf("saving legacy payments: %s", err)
+	}
+	history := `[{"id": "e1", "payment_id": "p1", "action": "create", "after": {"id": "p1", "name": "old"}}]`
+	if err := u.Save("/history", []byte(history)); err != nil {
+		t.Fatalf("saving legacy history: %s", err)
+	}
+
+	// reading never migrates: two readers would both do it
+	if payments, err := loadPayments(u); err != nil || len(payments) != 0 {
+		t.Errorf("should only see the legacy payments once migrated, got %+v (%v)", payments, err)
+	}
+	if _, err := u.Load("/payments"); err != nil {
+		t.Errorf("reading shouldn't have moved the legacy file, got %v", err)
+	}
+
+	if err := (&API{}).Migrate(u); err != nil {
+		t.Fatalf("migrating: %s", err)
+	}
+	payments, err := loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading legacy payments: %s", err)
+	}
+	if len(payments) != 2 {
+		t.Fatalf("should have 2 payments, got %d", len(payments))
+	}
+	if payments[0].Custom["flatmate"] != "bob" || payments[0].Amount.String() != "800.00" || payments[0].Currency != defaultBaseCurrency || payments[0].ID == "" {
+		t.Errorf("first payment not upgraded properly: %+v", payments[0])
+	}
+	if !payments[1].Date.IsZero() || payments[1].Custom["original date"] != "yesterday" {
+		t.Errorf("unparsable date should be kept in custom fields, got %+v", payments[1])
+	}
+
+	// the payments are moved to the log
+	var patherr *os.PathError
+	if _, err := u.Load("/payments"); !errors.As(err, &patherr) || !os.IsNotExist(patherr) {
+		t.Errorf("legacy file should be removed, got %v", err)
+	}
+	again, err := loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading moved payments: %s", err)
+	}
+	if len(again) != 2 || again[0].ID != payments[0].ID || again[1].ID != payments[1].ID {
+		t.Errorf("should have the same payments from the log, got %+v", again)
+	}
+	events, err := loadHistory(u)
+	if err != nil || len(events) != 1 || events[0].ID != "e1" {
+		t.Errorf("should have moved the history to the log, got %+v (%v)", events, err)
+	}
+	if _, err := u.Load("/history"); !errors.As(err, &patherr) || !os.IsNotExist(patherr) {
+		t.Errorf("legacy history should be removed, got %v", err)
+	}
+}
+
+func TestPaymentsLog(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	var ids []string
+	for i := 0; i < 10; i++ {
+		p, err := api.AddPayment(u, []byte(fmt.Sprintf(`{"name": "p%d", "amount": "%d", "date": "2020-03-01"}`, i, i+1)))
+		if err != nil {
+			t.Fatalf("adding payment: %s", err)
+		}
+		ids = append(ids, p.ID)
+	}
+	if err := api.DeletePayment(u, ids[3], 0); err != nil {
+		t.Fatalf("deleting payment: %s", err)
+	}
+	if _, err := api.UpdatePayment(u, ids[5], []byte(`{"amount": "100"}`)); err != nil {
+		t.Fatalf("updating payment: %s", err)
+	}
+
+	payments, nrecords, err := readPayments(u)
+	if err != nil {
+		t.Fatalf("reading payments: %s", err)
+	}
+	if nrecords != 12 {
+		t.Errorf("should have 12 records, got %d", nrecords)
+	}
+	if len(payments) != 9 || payments[3].ID != ids[4] || payments[4].Amount.String() != "100.00" {
+		t.Errorf("should have 9 payments in order, with p5 updated, got %+v", payments)
+	}
+
+	// updating over and over only appends, until the log is compacted
+	for i := 0; i < compactSlack; i++ {
+		if _, err := api.UpdatePayment(u, ids[0], []byte(fmt.Sprintf(`{"notes": "%d"}`, i))); err != nil {
+			t.Fatalf("updating payment: %s", err)
+		}
+	}
+	payments, nrecords, err = readPayments(u)
+	if err != nil {
+		t.Fatalf("reading payments: %s", err)
+	}
+	if nrecords > compactRatio*len(payments)+compactSlack {
+		t.Errorf("should have compacted the log, got %d records for %d payments", nrecords, len(payments))
+	}
+	if len(payments) != 9 || payments[0].Notes != fmt.Sprint(compactSlack-1) {
+		t.Errorf("should have kept the payments when compacting, got %+v", payments)
+	}
+}
+
+func TestUpdateDeletePayment(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	first, err := api.AddPayment(u, []byte(`{"name": "coffe", "amount": 4, "date": "2019-12-20", "shop": "corner"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	second, err := api.AddPayment(u, []byte(`{"name": "bread", "amount": 3, "date": "2019-12-21"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	if first.ID == "" || first.ID == second.ID {
+		t.Fatalf("payments should have unique ids, got %q and %q", first.ID, second.ID)
+	}
+
+	updated, err := api.UpdatePayment(u, first.ID, []byte(`{"name": "coffee", "id": "hijack", "shop": null}`))
+	if err != nil {
+		t.Fatalf("updating payment: %s", err)
+	}
+	if updated.ID != first.ID || updated.Name != "coffee" || updated.Amount.String() != "4.00" || len(updated.Custom) != 0 {
+		t.Errorf("update should only change the name and remove shop, got %+v", updated)
+	}
+
+	if _, err := api.UpdatePayment(u, first.ID, []byte(`{"name": ""}`)); !errors.Is(err, ErrInvalidPayment) {
+		t.Errorf("should have ErrInvalidPayment, got %v", err)
+	}
+	if _, err := api.UpdatePayment(u, "unknown", []byte(`{}`)); !errors.Is(err, ErrPaymentNotFound) {
+		t.Errorf("should have ErrPaymentNotFound, got %v", err)
+	}
+
+	if err := api.DeletePayment(u, second.ID, 0); err != nil {
+		t.Fatalf("deleting payment: %s", err)
+	}
+	if err := api.DeletePayment(u, second.ID, 0); !errors.Is(err, ErrPaymentNotFound) {
+		t.Errorf("should have ErrPaymentNotFound, got %v", err)
+	}
+
+	page, err := api.ListPayments(u, PaymentsQuery{})
+	if err != nil {
+		t.Fatalf("listing payments: %s", err)
+	}
+	if len(page.Payments) != 1 || page.Payments[0].Name != "coffee" {
+		t.Errorf("should only have the updated payment left, got %+v", page.Payments)
+	}
+}
+
+func TestMigrateDirection(t *testing.T) {
+	ps := []map[string]interface{}{
+		{"name": "rent", "amount": "800.00"},
+		{"name": "salary", "amount": "-3000.00"},
+	}
+	if err := migrateDirection(ps, Settings{}); err != nil {
+		t.Fatalf("migrating: %s", err)
+	}
+	if ps[0]["direction"] != DirectionExpense || ps[0]["amount"] != "800.00" {
+		t.Errorf("positive amount should have stayed an expense, got %v", ps[0])
+	}
+	if ps[1]["direction"] != DirectionIncome || ps[1]["amount"] != "3000.00" {
+		t.Errorf("negative expense should have become income, got %v", ps[1])
+	}
+}
+
+func TestPaymentVersions(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	p, err := api.AddPayment(u, []byte(`{"name": "rent", "amount": "400", "date": "2020-03-01", "version": 12}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	if p.Version != 1 {
+		t.Errorf("new payment should have version 1, got %d", p.Version)
+	}
+
+	// the phone and the laptop both loaded version 1
+	phone, err := api.UpdatePayment(u, p.ID, []byte(`{"amount": "450", "version": 1}`))
+	if err != nil {
+		t.Fatalf("updating payment: %s", err)
+	}
+	if phone.Version != 2 {
+		t.Errorf("updated payment should have version 2, got %d", phone.Version)
+	}
+	_, err = api.UpdatePayment(u, p.ID, []byte(`{"notes": "from the laptop", "version": 1}`))
+	var conflict *VersionConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("should have a *VersionConflictError, got %v", err)
+	}
+	if conflict.Current.Version != 2 || conflict.Current.Amount.String() != "450.00" {
+		t.Errorf("conflict should have the current payment, got %+v", conflict.Current)
+	}
+	if err := api.DeletePayment(u, p.ID, 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("deleting: should have ErrVersionConflict, got %v", err)
+	}
+
+	// without a version, the change isn't checked. Saving doesn't change the
+	// version of the payments which didn't change
+	if _, err := api.AddPayment(u, []byte(`{"name": "coffee", "amount": "4", "date": "2020-03-02"}`)); err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	updated, err := api.UpdatePayment(u, p.ID, []byte(`{"notes": "from the laptop"}`))
+	if err != nil || updated.Version != 3 {
+		t.Fatalf("should update to version 3, got %+v (%v)", updated, err)
+	}
+	if err := api.DeletePayment(u, p.ID, 3); err != nil {
+		t.Errorf("deleting version 3: %s", err)
+	}
+
+	// undo brings it back with a newer version
+	if _, err := api.Undo(u); err != nil {
+		t.Fatalf("undoing delete: %s", err)
+	}
+	payments, err := loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading payments: %s", err)
+	}
+	if i := findPayment(payments, p.ID); i == -1 || payments[i].Version != 4 {
+		t.Errorf("restored payment should have version 4, got %+v", payments)
+	}
+}
+
+func TestConcurrentAddPayment(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	// like the server does for every request (see server.lockStore)
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer u.Lock()()
+			_, err := api.ForceAddPayment(u, []byte(fmt.Sprintf(`{"name": "p%d", "amount": "1", "date": "2020-03-01"}`, i)))
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("adding payment: %s", err)
+		}
+	}
+	payments, err := loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading payments: %s", err)
+	}
+	if len(payments) != n {
+		t.Errorf("should have %d payments, got %d", n, len(payments))
+	}
+}
@@ -3,7 +3,6 @@ package api
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"image"
 	"image/png"
@@ -12,76 +11,203 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/url"
-	"os"
+	"time"
 
 	"github.com/math2001/money/db"
 )
 
-type ErrInvalidPayment error
+// AddPayment validates the payment, gives it a new ID and appends it to the
+// user's payments. It can be linked to a receipt given by Scan. In strict mode, it's refused with a *DuplicateError if it
+// looks like an existing payment. Errors: ErrInvalidPayment,
+// ErrDuplicatePayment, err
+func (api *API) AddPayment(u db.Store, serializedpayment []byte) (*Payment, error) {
+	return addPayment(u, serializedpayment, false)
+}
 
-type Payment map[string]interface{}
+// ForceAddPayment is AddPayment, even if the payment looks like an existing
+// one
+func (api *API) ForceAddPayment(u db.Store, serializedpayment []byte) (*Payment, error) {
+	return addPayment(u, serializedpayment, true)
+}
 
-func (api *API) AddPayment(u *db.User, serializedpayment []byte) error {
+func addPayment(u db.Store, serializedpayment []byte, force bool) (*Payment, error) {
 
 	var payment Payment
 	if err := json.Unmarshal(serializedpayment, &payment); err != nil {
-		return ErrInvalidPayment(fmt.Errorf("unmarshaling json payment: %s", err))
+		return nil, fmt.Errorf("unmarshaling json payment: %s (%w)", err, ErrInvalidPayment)
 	}
 
-	if err := isValidPayment(payment); err != nil {
-		return ErrInvalidPayment(err)
+	rs, err := loadRuleset(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading rules: %s", err)
+	}
+	if err := preparePayment(u, &payment, rs); err != nil {
+		return nil, err
 	}
 
-	content, err := u.Load("/payments")
-	var payments []Payment
-	var patherr *os.PathError
-
-	if errors.As(err, &patherr) && os.IsNotExist(patherr) {
-		content = []byte("[]")
-	} else if err != nil {
-		return fmt.Errorf("loading existing payments: %s", err)
+	id, err := newID()
+	if err != nil {
+		return nil, err
 	}
+	// the client doesn't get to choose the ids
+	payment.ID = id
+	payment.ImportID = ""
+	payment.Version = 0
 
-	err = json.Unmarshal(content, &payments)
+	previous, nrecords, err := readPayments(u)
 	if err != nil {
-		return fmt.Errorf("parsing existing payments: %s", err)
+		return nil, fmt.Errorf("loading existing payments: %s", err)
+	}
+	payments := copyPayments(previous)
+	if err := checkReceipt(u, payments, payment.Receipt); err != nil {
+		return nil, err
+	}
+	if _, err := checkDuplicates(u, payments, payment, force); err != nil {
+		return nil, err
 	}
 
 	payments = append(payments, payment)
 
-	content, err = json.Marshal(payments)
-	if err != nil {
-		return fmt.Errorf("json encoding payments: %s", err)
+	if err := savePayments(u, previous, nrecords, payments); err != nil {
+		return nil, err
+	}
+	if err := attachReceipt(u, payment.Receipt); err != nil {
+		return nil, err
+	}
+	// with its version
+	payment = payments[len(payments)-1]
+	return &payment, nil
+}
+
+// preparePayment applies the rules to a new payment, fills in its currency,
+// and makes sure it's valid. Errors: ErrInvalidPayment, err
+func preparePayment(u db.Store, payment *Payment, rs *ruleset) error {
+	rs.apply(payment)
+
+	if payment.Direction == "" {
+		payment.Direction = DirectionExpense
+	}
+
+	// the account's currency comes before the base currency
+	if err := checkPaymentAccount(u, payment); err != nil {
+		return err
+	}
+	if payment.Currency == "" {
+		settings, err := loadSettings(u)
+		if err != nil {
+			return fmt.Errorf("loading settings: %s", err)
+		}
+		payment.Currency = settings.BaseCurrency
 	}
 
-	err = u.Save("/payments", content)
+	if err := isValidPayment(*payment); err != nil {
+		return err
+	}
+	if err := checkPaymentCategory(u, payment); err != nil {
+		return err
+	}
+	if err := normalizeAmount(payment); err != nil {
+		return err
+	}
+	return splitPayment(u, payment)
+}
+
+// UpdatePayment changes the fields present in serializedpatch on the payment
+// with the given id. If the patch has a version, it must be the payment's
+// current one. Errors: ErrPaymentNotFound, ErrInvalidPayment,
+// ErrVersionConflict, err
+func (api *API) UpdatePayment(u db.Store, id string, serializedpatch []byte) (*Payment, error) {
+	previous, nrecords, err := readPayments(u)
 	if err != nil {
-		return fmt.Errorf("saving payments to db: %s", err)
+		return nil, fmt.Errorf("loading existing payments: %s", err)
+	}
+	payments := copyPayments(previous)
+
+	i := findPayment(payments, id)
+	if i == -1 {
+		return nil, ErrPaymentNotFound
 	}
 
-	return nil
+	// copy the payment so that a failed update doesn't change the loaded one
+	payment := copyPayment(payments[i])
+
+	if err := json.Unmarshal(serializedpatch, &payment); err != nil {
+		return nil, fmt.Errorf("unmarshaling json patch: %s (%w)", err, ErrInvalidPayment)
+	}
+	if payment.Version != payments[i].Version {
+		return nil, &VersionConflictError{Current: payments[i]}
+	}
+	payment.ID = id
+	payment.ImportID = payments[i].ImportID
+	payment.Receipt = payments[i].Receipt
+
+	// setting a custom field to null or "" removes it
+	for key, value := range payment.Custom {
+		if value == "" {
+			delete(payment.Custom, key)
+		}
+	}
+
+	if err := isValidPayment(payment); err != nil {
+		return nil, err
+	}
+	if err := checkPaymentCategory(u, &payment); err != nil {
+		return nil, err
+	}
+	if err := checkPaymentAccount(u, &payment); err != nil {
+		return nil, err
+	}
+	if err := normalizeAmount(&payment); err != nil {
+		return nil, err
+	}
+	if err := splitPayment(u, &payment); err != nil {
+		return nil, err
+	}
+
+	payments[i] = payment
+	if err := savePayments(u, previous, nrecords, payments); err != nil {
+		return nil, err
+	}
+	payment = payments[i]
+	return &payment, nil
 }
 
-func (api *API) ListPayments(u *db.User) ([]Payment, error) {
-	var ps []Payment
-	content, err := u.Load("/payments")
-	var patherr *os.PathError
-	if errors.As(err, &patherr) && os.IsNotExist(patherr) {
-		return ps, nil // no payments
-	} else if err != nil {
-		return nil, fmt.Errorf("loading payments: %s", err)
+// DeletePayment removes the payment with the given id, and its receipt.
+// version is the version of the payment the client loaded (0 deletes it
+// whatever its version). Errors: ErrPaymentNotFound, ErrVersionConflict, err
+func (api *API) DeletePayment(u db.Store, id string, version int) error {
+	previous, nrecords, err := readPayments(u)
+	if err != nil {
+		return fmt.Errorf("loading existing payments: %s", err)
 	}
+	payments := copyPayments(previous)
 
-	if err := json.Unmarshal(content, &ps); err != nil {
-		return nil, fmt.Errorf("parsing payments: %s", err)
+	i := findPayment(payments, id)
+	if i == -1 {
+		return ErrPaymentNotFound
+	}
+	if version != 0 && version != payments[i].Version {
+		return &VersionConflictError{Current: payments[i]}
 	}
 
-	return ps, nil
+	receipt := payments[i].Receipt
+	payments = append(payments[:i], payments[i+1:]...)
+	if err := savePayments(u, previous, nrecords, payments); err != nil {
+		return err
+	}
+	return removeReceipt(u, receipt)
 }
 
 // Scan requires user just to make sure that only members use this expensive
-// feature
-func (api *API) Scan(user *db.User, header *multipart.FileHeader, img image.Image) (*Payment, error) {
+// feature. The original image (the uploaded file) is kept, encrypted, along
+// with a thumbnail: the payment's Receipt is set so that the pwa can link them
+// when it adds the payment. If it doesn't within pendingReceiptTTL, the receipt
+// is deleted by a later scan. The rules and the receipt are those of u, which
+// is either user or a ledger they are a member of.
+//
+// u is locked once the ocr server answered, which can take a while, so u
+// mustn't be locked already
+func (api *API) Scan(user *db.User, u db.Store, header *multipart.FileHeader, original []byte, img image.Image) (*Payment, error) {
 	log.Printf("start scan job for %s: %q %d", user.Email, header.Filename, header.Size)
 	defer log.Printf("done scan job for %s: %q %d", user.Email, header.Filename, header.Size)
 
@@ -96,12 +222,12 @@ func (api *API) Scan(user *db.User, header *multipart.FileHeader, img image.Imag
 	png.Encode(part, img)
 	writer.Close()
 
-	u := &url.URL{
+	ocrurl := &url.URL{
 		Scheme: "http", // FIXME: use https
 		Host:   api.ocrserver,
 		Path:   "/file",
 	}
-	req, err := http.NewRequest(http.MethodPost, u.String(), body)
+	req, err := http.NewRequest(http.MethodPost, ocrurl.String(), body)
 	req.Header.Add("Content-Type", writer.FormDataContentType())
 	if err != nil {
 		return nil, fmt.Errorf("creating request: %s", err)
@@ -139,25 +265,25 @@ func (api *API) Scan(user *db.User, header *multipart.FileHeader, img image.Imag
 		return nil, fmt.Errorf("scan request, decode response: %s", err)
 	}
 
-	return payment, nil
-}
-
-// isValidPayment makes sure the required keys are present, and of the right
-// type
-func isValidPayment(p Payment) error {
-	// this should combine errors (ie find as many errors as possible)
-	if _, ok := p["name"]; !ok {
-		return errors.New("need 'name' field")
+	if payment == nil {
+		return nil, fmt.Errorf("scan request, empty response")
 	}
-	if _, ok := p["amount"]; !ok {
-		return errors.New("need 'amount' field")
+
+	defer u.Lock()()
+	rs, err := loadRuleset(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading rules: %s", err)
 	}
-	if _, ok := p["date"]; !ok {
-		return errors.New("need 'date' field")
+	rs.apply(payment)
+
+	if err := pruneReceipts(u, time.Now()); err != nil {
+		return nil, err
 	}
-	if _, ok := p["amount"].(float64); !ok {
-		return errors.New("'amount' should be a float")
+	receipt, err := saveReceipt(u, original, img)
+	if err != nil {
+		return nil, err
 	}
+	payment.Receipt = receipt
 
-	return nil
+	return payment, nil
 }
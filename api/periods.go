@@ -0,0 +1,74 @@
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// Period is a length of time payments are grouped by
+type Period string
+
+const (
+	PeriodDay   Period = "day"
+	PeriodWeek  Period = "week"
+	PeriodMonth Period = "month"
+	PeriodYear  Period = "year"
+)
+
+func (p Period) valid() bool {
+	return p == PeriodDay || p == PeriodWeek || p == PeriodMonth || p == PeriodYear
+}
+
+// start returns the first day of the period d is in. Weeks start on Monday
+func (p Period) start(d Date) Date {
+	t := d.Time
+	switch p {
+	case PeriodWeek:
+		// Sunday is 0, we want Monday to be 0
+		offset := (int(t.Weekday()) + 6) % 7
+		return Date{t.AddDate(0, 0, -offset)}
+	case PeriodMonth:
+		return Date{time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)}
+	case PeriodYear:
+		return Date{time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)}
+	}
+	return d
+}
+
+// next returns the first day of the period after the one d is in
+func (p Period) next(d Date) Date {
+	start := p.start(d).Time
+	switch p {
+	case PeriodWeek:
+		return Date{start.AddDate(0, 0, 7)}
+	case PeriodMonth:
+		return Date{start.AddDate(0, 1, 0)}
+	case PeriodYear:
+		return Date{start.AddDate(1, 0, 0)}
+	}
+	return Date{start.AddDate(0, 0, 1)}
+}
+
+// end returns the last day of the period d is in
+func (p Period) end(d Date) Date {
+	return Date{p.next(d).AddDate(0, 0, -1)}
+}
+
+// label names the period d is in (2019-12-20, 2019-W51, 2019-12, 2019)
+func (p Period) label(d Date) string {
+	switch p {
+	case PeriodWeek:
+		year, week := d.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case PeriodMonth:
+		return d.Format("2006-01")
+	case PeriodYear:
+		return d.Format("2006")
+	}
+	return d.String()
+}
+
+// days returns the number of days from a to b, both included
+func days(a, b Date) int {
+	return int(b.Sub(a.Time).Hours()/24) + 1
+}
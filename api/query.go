@@ -0,0 +1,318 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrInvalidQuery tags errors caused by a malformed PaymentsQuery (unknown
+// sort key, cursor from a different query, etc)
+var ErrInvalidQuery = errors.New("invalid query")
+
+// the keys payments can be sorted by
+const (
+	SortDate   = "date"
+	SortAmount = "amount"
+	SortName   = "name"
+)
+
+// PaymentsQuery selects, sorts and paginates payments. The zero value selects
+// every payment, sorted by date
+type PaymentsQuery struct {
+	// From and To are inclusive. The zero date means no bound
+	From, To Date
+	// Currency only selects the payments in this currency. Empty means every
+	// currency
+	Currency string
+	// MinAmount and MaxAmount are inclusive bounds on what the payments cost
+	// (see Payment.spending): income is negative, so that min=0 selects the
+	// expenses. Amounts in different currencies can't be compared, so they
+	// require Currency. nil means no bound
+	MinAmount, MaxAmount *Money
+	// Name is matched case insensitively anywhere in the payment's name
+	Name string
+	// Account is the id of the account the payments come from
+	Account string
+	// Direction is DirectionExpense or DirectionIncome. Empty means both
+	Direction string
+	// Custom fields must all be equal
+	Custom map[string]string
+
+	// Sort is SortDate, SortAmount or SortName. Amounts are sorted like they
+	// are filtered, by what they cost. Payments in different currencies are
+	// sorted by currency first, since their amounts can't be compared
+	Sort string
+	Desc bool
+
+	// Convert asks for the total of the matching payments in the user's base
+	// currency
+	Convert bool
+
+	// Cursor is PaymentsPage.Next from the previous page
+	Cursor string
+	// Limit is the maximum number of payments in a page. 0 means no limit
+	Limit int
+}
+
+// PaymentsPage is one page of payments matching a query
+type PaymentsPage struct {
+	Payments []Payment
+	// Total is the number of payments matching the query, on every page
+	Total int
+	// Next is the cursor to get the following page. It's empty on the last
+	// page
+	Next string
+
+	// Totals is the sum of the matching payments (on every page), per
+	// currency. Income is subtracted
+	Totals map[string]Money
+	// Converted is only set if the query asked for it
+	Converted *Total
+}
+
+// Total is a sum of payments converted to a single currency (income is
+// subtracted)
+type Total struct {
+	Currency string `json:"currency"`
+	Amount   Money  `json:"amount"`
+	// Unconverted are the IDs of the payments which couldn't be converted
+	// because there was no rate for them. They aren't in Amount
+	Unconverted []string `json:"unconverted"`
+}
+
+// cursor is the position of the last payment of a page
+type cursor struct {
+	Sort  string
+	Desc  bool
+	Value string
+	ID    string
+}
+
+// ListPayments returns the page of payments matching q. Errors:
+// ErrInvalidQuery, err
+func (api *API) ListPayments(u db.Store, q PaymentsQuery) (*PaymentsPage, error) {
+	if q.Sort == "" {
+		q.Sort = SortDate
+	}
+	if q.Sort != SortDate && q.Sort != SortAmount && q.Sort != SortName {
+		return nil, fmt.Errorf("unknown sort key %q (%w)", q.Sort, ErrInvalidQuery)
+	}
+	if q.Limit < 0 {
+		return nil, fmt.Errorf("negative limit (%w)", ErrInvalidQuery)
+	}
+	if (q.MinAmount != nil || q.MaxAmount != nil) && q.Currency == "" {
+		return nil, fmt.Errorf("amount bounds require a currency (%w)", ErrInvalidQuery)
+	}
+
+	payments, err := loadPayments(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []Payment
+	for _, p := range payments {
+		if q.matches(p) {
+			matching = append(matching, p)
+		}
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		return q.compare(matching[i], matching[j]) < 0
+	})
+
+	page := &PaymentsPage{
+		Total:  len(matching),
+		Totals: make(map[string]Money),
+	}
+	for _, p := range matching {
+		if page.Totals[p.Currency], err = page.Totals[p.Currency].Add(p.spending()); err != nil {
+			return nil, fmt.Errorf("total in %s: %s", p.Currency, err)
+		}
+	}
+
+	if q.Convert {
+		page.Converted, err = convertedTotal(u, matching)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if q.Cursor != "" {
+		after, err := q.decodeCursor()
+		if err != nil {
+			return nil, err
+		}
+		// the first payment strictly after the cursor
+		start := sort.Search(len(matching), func(i int) bool {
+			return q.compare(matching[i], after) > 0
+		})
+		matching = matching[start:]
+	}
+
+	if q.Limit != 0 && len(matching) > q.Limit {
+		matching = matching[:q.Limit]
+		page.Next = q.encodeCursor(matching[len(matching)-1])
+	}
+
+	page.Payments = matching
+	return page, nil
+}
+
+func (q PaymentsQuery) matches(p Payment) bool {
+	if !q.From.IsZero() && p.Date.Before(q.From.Time) {
+		return false
+	}
+	if !q.To.IsZero() && p.Date.After(q.To.Time) {
+		return false
+	}
+	if q.Currency != "" && p.Currency != q.Currency {
+		return false
+	}
+	if q.MinAmount != nil && p.spending().Cmp(*q.MinAmount) < 0 {
+		return false
+	}
+	if q.MaxAmount != nil && p.spending().Cmp(*q.MaxAmount) > 0 {
+		return false
+	}
+	if q.Name != "" && !strings.Contains(strings.ToLower(p.Name), strings.ToLower(q.Name)) {
+		return false
+	}
+	if q.Direction != "" && p.Direction != q.Direction {
+		return false
+	}
+	if q.Account != "" && p.Account != q.Account {
+		return false
+	}
+	for key, value := range q.Custom {
+		if p.Custom[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// compare orders a and b by the sort key, and then by ID so that the order is
+// total (required for the cursor to work)
+func (q PaymentsQuery) compare(a, b Payment) int {
+	var c int
+	switch q.Sort {
+	case SortDate:
+		c = compareInt64(a.Date.Unix(), b.Date.Unix())
+	case SortAmount:
+		c = strings.Compare(a.Currency, b.Currency)
+		if c == 0 {
+			c = a.spending().Cmp(b.spending())
+		}
+	case SortName:
+		c = strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	if q.Desc {
+		return -c
+	}
+	return c
+}
+
+func compareInt64(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func (q PaymentsQuery) encodeCursor(last Payment) string {
+	c := cursor{
+		Sort: q.Sort,
+		Desc: q.Desc,
+		ID:   last.ID,
+	}
+	switch q.Sort {
+	case SortDate:
+		c.Value = last.Date.String()
+	case SortAmount:
+		c.Value = last.Currency + " " + last.spending().String()
+	case SortName:
+		c.Value = last.Name
+	}
+	// marshaling a struct of strings and bool can't fail
+	content, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+// decodeCursor returns a payment which compares like the last payment of the
+// previous page
+func (q PaymentsQuery) decodeCursor() (Payment, error) {
+	var p Payment
+	content, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return p, fmt.Errorf("decoding cursor: %s (%w)", err, ErrInvalidQuery)
+	}
+	var c cursor
+	if err := json.Unmarshal(content, &c); err != nil {
+		return p, fmt.Errorf("parsing cursor: %s (%w)", err, ErrInvalidQuery)
+	}
+	if c.Sort != q.Sort || c.Desc != q.Desc {
+		return p, fmt.Errorf("cursor is for a different sort order (%w)", ErrInvalidQuery)
+	}
+
+	p.ID = c.ID
+	switch c.Sort {
+	case SortDate:
+		p.Date, err = ParseDate(c.Value)
+	case SortAmount:
+		// as an expense, so that its amount is what it costs
+		currency, amount := "", c.Value
+		if i := strings.IndexByte(c.Value, ' '); i != -1 {
+			currency, amount = c.Value[:i], c.Value[i+1:]
+		}
+		p.Currency = currency
+		p.Amount, err = ParseMoney(amount)
+	case SortName:
+		p.Name = c.Value
+	}
+	if err != nil {
+		return p, fmt.Errorf("parsing cursor value: %s (%w)", err, ErrInvalidQuery)
+	}
+	return p, nil
+}
+
+// convertedTotal sums the payments in the user's base currency, each one
+// converted with the rate in force on its date
+func convertedTotal(u db.Store, payments []Payment) (*Total, error) {
+	settings, err := loadSettings(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading settings: %s", err)
+	}
+	rates, err := loadRates(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading rates: %s", err)
+	}
+
+	total := &Total{
+		Currency: settings.BaseCurrency,
+		Amount:   Money{Exponent: currencyExponent(settings.BaseCurrency)},
+	}
+	for _, p := range payments {
+		converted, err := rates.convert(p.spending(), p.Currency, settings.BaseCurrency, p.Date)
+		if errors.Is(err, ErrNoRate) {
+			total.Unconverted = append(total.Unconverted, p.ID)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if total.Amount, err = total.Amount.Add(converted); err != nil {
+			return nil, fmt.Errorf("total: %s", err)
+		}
+	}
+	return total, nil
+}
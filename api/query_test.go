@@ -0,0 +1,142 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestListPaymentsPagination(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	var payments []Payment
+	for i := 0; i < 10; i++ {
+		date, _ := ParseDate(fmt.Sprintf("2019-12-%02d", 10+i))
+		payments = append(payments, Payment{
+			ID:       fmt.Sprintf("id%d", i),
+			Name:     fmt.Sprintf("Shop %d", i%3),
+			Amount:   Money{Units: int64(i % 4)},
+			Currency: "AUD",
+			Date:     date,
+			Custom:   map[string]string{"even": fmt.Sprint(i%2 == 0)},
+		})
+	}
+	if err := savePayments(u, nil, 0, payments); err != nil {
+		t.Fatalf("saving payments: %s", err)
+	}
+
+	min := Money{Units: 1}
+	q := PaymentsQuery{
+		Currency:  "AUD",
+		MinAmount: &min,
+		Sort:      SortAmount,
+		Desc:      true,
+		Limit:     2,
+	}
+	var got []string
+	for {
+		page, err := api.ListPayments(u, q)
+		if err != nil {
+			t.Fatalf("listing payments: %s", err)
+		}
+		if page.Total != 7 {
+			t.Errorf("should have a total of 7, got %d", page.Total)
+		}
+		for _, p := range page.Payments {
+			got = append(got, p.ID)
+		}
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+
+	expected := fmt.Sprint([]string{"id7", "id3", "id6", "id2", "id9", "id5", "id1"})
+	if fmt.Sprint(got) != expected {
+		t.Errorf("pages should be %s, got %s", expected, got)
+	}
+
+	from, _ := ParseDate("2019-12-12")
+	to, _ := ParseDate("2019-12-16")
+	page, err := api.ListPayments(u, PaymentsQuery{
+		From:   from,
+		To:     to,
+		Name:   "shop 1",
+		Custom: map[string]string{"even": "true"},
+	})
+	if err != nil {
+		t.Fatalf("listing payments: %s", err)
+	}
+	if page.Total != 1 || page.Payments[0].ID != "id4" {
+		t.Errorf("filters should only match id4, got %+v", page.Payments)
+	}
+
+	_, err = api.ListPayments(u, PaymentsQuery{Sort: SortName, Cursor: q.Cursor})
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("cursor from an other sort order should have ErrInvalidQuery, got %v", err)
+	}
+
+	_, err = api.ListPayments(u, PaymentsQuery{MinAmount: &min})
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("amount bound without currency should have ErrInvalidQuery, got %v", err)
+	}
+}
+
+func TestListPaymentsByAmount(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	date, _ := ParseDate("2020-01-01")
+	payments := []Payment{
+		{ID: "rent", Amount: Money{Units: 800}, Currency: "AUD", Direction: DirectionExpense},
+		{ID: "salary", Amount: Money{Units: 3000}, Currency: "AUD", Direction: DirectionIncome},
+		{ID: "coffee", Amount: Money{Units: 4}, Currency: "AUD", Direction: DirectionExpense},
+		{ID: "refund", Amount: Money{Units: 20}, Currency: "AUD", Direction: DirectionIncome},
+		{ID: "sushi", Amount: Money{Units: 5000}, Currency: "JPY", Direction: DirectionExpense},
+		{ID: "bagel", Amount: Money{Units: 3}, Currency: "EUR", Direction: DirectionExpense},
+	}
+	for i := range payments {
+		payments[i].Name = payments[i].ID
+		payments[i].Date = date
+	}
+	if err := savePayments(u, nil, 0, payments); err != nil {
+		t.Fatalf("saving payments: %s", err)
+	}
+
+	ids := func(q PaymentsQuery) string {
+		var got []string
+		for {
+			page, err := api.ListPayments(u, q)
+			if err != nil {
+				t.Fatalf("listing payments: %s", err)
+			}
+			for _, p := range page.Payments {
+				got = append(got, p.ID)
+			}
+			if page.Next == "" {
+				return fmt.Sprint(got)
+			}
+			q.Cursor = page.Next
+		}
+	}
+
+	// income costs less than nothing, and currencies aren't mixed
+	expected := fmt.Sprint([]string{"salary", "refund", "coffee", "rent", "bagel", "sushi"})
+	if got := ids(PaymentsQuery{Sort: SortAmount, Limit: 4}); got != expected {
+		t.Errorf("sorted by amount should have %s, got %s", expected, got)
+	}
+
+	zero, max := Money{}, Money{Units: 100}
+	expected = fmt.Sprint([]string{"coffee"})
+	if got := ids(PaymentsQuery{Currency: "AUD", MinAmount: &zero, MaxAmount: &max}); got != expected {
+		t.Errorf("expenses up to 100 AUD should have %s, got %s", expected, got)
+	}
+	min := Money{Units: -100}
+	expected = fmt.Sprint([]string{"refund", "coffee", "rent"})
+	if got := ids(PaymentsQuery{Currency: "AUD", MinAmount: &min, Sort: SortAmount}); got != expected {
+		t.Errorf("at least -100 AUD should have %s, got %s", expected, got)
+	}
+}
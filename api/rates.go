@@ -0,0 +1,180 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrInvalidRates tags errors caused by a malformed rates CSV file
+var ErrInvalidRates = errors.New("invalid rates")
+
+// ErrNoRate is returned when there is no rate to convert from one currency to
+// an other on a given date
+var ErrNoRate = errors.New("no exchange rate")
+
+// Rate says that on Date (and until the next rate), one unit of From is worth
+// Rate units of To
+type Rate struct {
+	Date Date   `json:"date"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Rate is a decimal string, so that it's exact
+	Rate string `json:"rate"`
+}
+
+// rates is the parsed rate table, sorted by date
+type rates struct {
+	list []Rate
+	rats []*big.Rat
+}
+
+func loadRates(u db.Store) (*rates, error) {
+	var list []Rate
+	if _, err := loadJSON(u, "/rates", &list); err != nil {
+		return nil, err
+	}
+	return newRates(list)
+}
+
+func newRates(list []Rate) (*rates, error) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Date.Before(list[j].Date.Time)
+	})
+	t := &rates{
+		list: list,
+		rats: make([]*big.Rat, len(list)),
+	}
+	for i, rate := range list {
+		r, ok := new(big.Rat).SetString(rate.Rate)
+		if !ok || r.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid rate %q for %s->%s on %s", rate.Rate, rate.From, rate.To, rate.Date)
+		}
+		t.rats[i] = r
+	}
+	return t, nil
+}
+
+// rate returns the rate in force on date to convert from to to. It uses the
+// inverse rate (to->from) if there isn't a direct one more recent
+func (t *rates) rate(from, to string, date Date) (*big.Rat, error) {
+	// the list is sorted by date, so the last match is the one in force
+	var found *big.Rat
+	for i, rate := range t.list {
+		if rate.Date.After(date.Time) {
+			break
+		}
+		if rate.From == from && rate.To == to {
+			found = t.rats[i]
+		} else if rate.From == to && rate.To == from {
+			found = new(big.Rat).Inv(t.rats[i])
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s->%s on %s (%w)", from, to, date, ErrNoRate)
+	}
+	return found, nil
+}
+
+// convert converts m from one currency to an other, using the rate in force
+// on date. The result is rounded to the minor unit of to
+func (t *rates) convert(m Money, from, to string, date Date) (Money, error) {
+	if from == to {
+		return m, nil
+	}
+	rate, err := t.rate(from, to, date)
+	if err != nil {
+		return Money{}, err
+	}
+	exp := currencyExponent(to)
+	r := m.rat()
+	r.Mul(r, rate)
+	r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil)))
+	return moneyFromUnits(roundRat(r), exp)
+}
+
+// ListRates returns the user's rate table, sorted by date
+func (api *API) ListRates(u db.Store) ([]Rate, error) {
+	t, err := loadRates(u)
+	if err != nil {
+		return nil, err
+	}
+	return t.list, nil
+}
+
+// ImportRates adds the rates from a CSV file with the columns date (YYYY-MM-DD),
+// from, to and rate. The header line is optional. A rate for the same date and
+// currencies as an existing one replaces it. Returns the number of rates
+// read. Errors: ErrInvalidRates, err
+func (api *API) ImportRates(u db.Store, r io.Reader) (int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 4
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return 0, fmt.Errorf("reading csv: %s (%w)", err, ErrInvalidRates)
+	}
+	if len(records) > 0 && strings.EqualFold(records[0][0], "date") {
+		records = records[1:]
+	}
+
+	var imported []Rate
+	for i, record := range records {
+		date, err := ParseDate(record[0])
+		if err != nil {
+			return 0, fmt.Errorf("line %d: invalid date: %s (%w)", i+1, err, ErrInvalidRates)
+		}
+		rate := Rate{
+			Date: date,
+			From: strings.ToUpper(record[1]),
+			To:   strings.ToUpper(record[2]),
+			Rate: record[3],
+		}
+		if !currencyRegexp.MatchString(rate.From) || !currencyRegexp.MatchString(rate.To) {
+			return 0, fmt.Errorf("line %d: currencies should be 3 letter ISO 4217 codes (%w)", i+1, ErrInvalidRates)
+		}
+		if r, ok := new(big.Rat).SetString(rate.Rate); !ok || r.Sign() <= 0 {
+			return 0, fmt.Errorf("line %d: rate should be a positive decimal number, got %q (%w)", i+1, rate.Rate, ErrInvalidRates)
+		}
+		imported = append(imported, rate)
+	}
+
+	t, err := loadRates(u)
+	if err != nil {
+		return 0, err
+	}
+
+	type key struct {
+		date     string
+		from, to string
+	}
+	index := make(map[key]int)
+	list := t.list
+	for i, rate := range list {
+		index[key{rate.Date.String(), rate.From, rate.To}] = i
+	}
+	for _, rate := range imported {
+		k := key{rate.Date.String(), rate.From, rate.To}
+		if i, ok := index[k]; ok {
+			list[i] = rate
+		} else {
+			index[k] = len(list)
+			list = append(list, rate)
+		}
+	}
+
+	if _, err := newRates(list); err != nil {
+		return 0, err
+	}
+	if err := saveJSON(u, "/rates", list); err != nil {
+		return 0, err
+	}
+	return len(imported), nil
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestImportRatesAndConvert(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	csv := `date,from,to,rate
+2019-12-01,EUR,AUD,1.6
+2019-12-15,EUR,AUD,1.65
+2019-12-01,aud,jpy,75
+`
+	n, err := api.ImportRates(u, strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("importing rates: %s", err)
+	}
+	if n != 3 {
+		t.Errorf("should have imported 3 rates, got %d", n)
+	}
+
+	// replaces the rate of the 15th
+	if _, err := api.ImportRates(u, strings.NewReader("2019-12-15,EUR,AUD,1.7\n")); err != nil {
+		t.Fatalf("importing rates: %s", err)
+	}
+
+	if _, err := api.ImportRates(u, strings.NewReader("2019-12-15,EUR,AUD,-1\n")); !errors.Is(err, ErrInvalidRates) {
+		t.Errorf("negative rate should have ErrInvalidRates, got %v", err)
+	}
+
+	rates, err := loadRates(u)
+	if err != nil {
+		t.Fatalf("loading rates: %s", err)
+	}
+	if len(rates.list) != 3 {
+		t.Errorf("should have 3 rates, got %d", len(rates.list))
+	}
+
+	date := func(s string) Date {
+		d, err := ParseDate(s)
+		if err != nil {
+			t.Fatalf("parsing date: %s", err)
+		}
+		return d
+	}
+
+	cases := []struct {
+		amount   Money
+		from, to string
+		date     Date
+		expected string
+	}{
+		{Money{1000, 2}, "EUR", "AUD", date("2019-12-10"), "16.00"},
+		{Money{1000, 2}, "EUR", "AUD", date("2019-12-20"), "17.00"},
+		{Money{1700, 2}, "AUD", "EUR", date("2019-12-20"), "10.00"},
+		{Money{1000, 2}, "AUD", "JPY", date("2019-12-20"), "750"},
+		{Money{1, 2}, "AUD", "AUD", date("2000-01-01"), "0.01"},
+	}
+	for _, c := range cases {
+		converted, err := rates.convert(c.amount, c.from, c.to, c.date)
+		if err != nil {
+			t.Errorf("converting %s %s to %s: %s", c.amount, c.from, c.to, err)
+			continue
+		}
+		if converted.String() != c.expected {
+			t.Errorf("%s %s should be %s %s, got %s", c.amount, c.from, c.expected, c.to, converted)
+		}
+	}
+
+	if _, err := rates.convert(Money{100, 2}, "EUR", "AUD", date("2019-11-30")); !errors.Is(err, ErrNoRate) {
+		t.Errorf("converting before the first rate should have ErrNoRate, got %v", err)
+	}
+
+	if _, err := api.AddPayment(u, []byte(`{"name": "hotel", "amount": "100", "currency": "EUR", "date": "2019-12-16"}`)); err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	if _, err := api.AddPayment(u, []byte(`{"name": "food", "amount": "30", "date": "2019-12-16"}`)); err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	if _, err := api.AddPayment(u, []byte(`{"name": "coffee", "amount": "3", "currency": "USD", "date": "2019-12-16"}`)); err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+
+	page, err := api.ListPayments(u, PaymentsQuery{Convert: true})
+	if err != nil {
+		t.Fatalf("listing payments: %s", err)
+	}
+	if page.Totals["AUD"].String() != "30.00" || page.Totals["EUR"].String() != "100.00" {
+		t.Errorf("should have totals per currency, got %v", page.Totals)
+	}
+	if page.Converted.Currency != "AUD" || page.Converted.Amount.String() != "200.00" || len(page.Converted.Unconverted) != 1 {
+		t.Errorf("should have 200.00 AUD and 1 unconverted payment, got %+v", page.Converted)
+	}
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"time"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrReceiptNotFound is returned when a payment doesn't have a receipt
+var ErrReceiptNotFound = errors.New("receipt not found")
+
+// the receipts are stored as scanned (PNG), and their thumbnails as JPEG
+const (
+	ReceiptContentType   = "image/png"
+	ThumbnailContentType = "image/jpeg"
+)
+
+// thumbnailSize is the maximum width and height of a thumbnail
+const thumbnailSize = 256
+
+// pendingReceiptsFile lists the receipts which were scanned, but aren't linked
+// to a payment yet, with when they were scanned. The user might never save the
+// payment: they are deleted after pendingReceiptTTL
+const pendingReceiptsFile = "/receipts-pending"
+
+const pendingReceiptTTL = 24 * time.Hour
+
+func receiptFilename(id string) string {
+	return "/receipt-" + id
+}
+
+func thumbnailFilename(id string) string {
+	return "/receipt-" + id + "-thumb"
+}
+
+// thumbnail scales img down so that it fits in a thumbnailSize square. Each
+// pixel of the thumbnail is the average of the pixels it covers
+func thumbnail(img image.Image) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return image.NewRGBA(image.Rect(0, 0, 0, 0))
+	}
+	tw, th := w, h
+	if tw > thumbnailSize || th > thumbnailSize {
+		if w >= h {
+			tw, th = thumbnailSize, h*thumbnailSize/w
+		} else {
+			tw, th = w*thumbnailSize/h, thumbnailSize
+		}
+		if tw == 0 {
+			tw = 1
+		}
+		if th == 0 {
+			th = 1
+		}
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := y*h/th, (y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := x*w/tw, (x+1)*w/tw
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			thumb.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return thumb
+}
+
+// saveReceipt encrypts the original image and its thumbnail in the user's
+// folder, and returns the receipt's id. It's pending until a payment is linked
+// to it (see attachReceipt). The store must be locked for writing
+func saveReceipt(u db.Store, original []byte, img image.Image) (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, thumbnail(img), &jpeg.Options{Quality: 80}); err != nil {
+		return "", fmt.Errorf("encoding thumbnail: %s", err)
+	}
+
+	if err := u.Save(receiptFilename(id), original); err != nil {
+		return "", fmt.Errorf("saving receipt: %s", err)
+	}
+	if err := u.Save(thumbnailFilename(id), thumb.Bytes()); err != nil {
+		return "", fmt.Errorf("saving thumbnail: %s", err)
+	}
+	if err := addPendingReceipts(u, time.Now(), id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func loadPendingReceipts(u db.Store) (map[string]time.Time, error) {
+	pending := make(map[string]time.Time)
+	if _, err := loadJSON(u, pendingReceiptsFile, &pending); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// addPendingReceipts marks the receipts as scanned at the given time. They
+// are deleted if no payment is linked to them by then + pendingReceiptTTL
+func addPendingReceipts(u db.Store, scanned time.Time, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	pending, err := loadPendingReceipts(u)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		pending[id] = scanned
+	}
+	return saveJSON(u, pendingReceiptsFile, pending)
+}
+
+// attachReceipt marks the receipt as linked to a payment, so that it's kept
+func attachReceipt(u db.Store, id string) error {
+	if id == "" {
+		return nil
+	}
+	pending, err := loadPendingReceipts(u)
+	if err != nil {
+		return err
+	}
+	if _, ok := pending[id]; !ok {
+		return nil
+	}
+	delete(pending, id)
+	return saveJSON(u, pendingReceiptsFile, pending)
+}
+
+// pruneReceipts deletes the pending receipts which expired at now. The store
+// must be locked for writing
+func pruneReceipts(u db.Store, now time.Time) error {
+	pending, err := loadPendingReceipts(u)
+	if err != nil {
+		return err
+	}
+	var payments []Payment
+	changed := false
+	for id, scanned := range pending {
+		if now.Sub(scanned) < pendingReceiptTTL {
+			continue
+		}
+		if payments == nil {
+			if payments, err = loadPayments(u); err != nil {
+				return fmt.Errorf("loading payments: %s", err)
+			}
+		}
+		// a payment could have been linked to it without attachReceipt
+		// being called (if the server crashed in between)
+		linked := false
+		for _, p := range payments {
+			linked = linked || p.Receipt == id
+		}
+		if !linked {
+			if err := removeReceipt(u, id); err != nil {
+				return err
+			}
+		}
+		delete(pending, id)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return saveJSON(u, pendingReceiptsFile, pending)
+}
+
+// checkReceipt makes sure the receipt the pwa wants to link a new payment to
+// was scanned, and isn't already linked to an other payment
+func checkReceipt(u db.Store, payments []Payment, id string) error {
+	if id == "" {
+		return nil
+	}
+	for _, p := range payments {
+		if p.Receipt == id {
+			return fmt.Errorf("receipt is already linked to an other payment (%w)", ErrInvalidPayment)
+		}
+	}
+	_, err := u.Load(thumbnailFilename(id))
+	var patherr *os.PathError
+	if errors.As(err, &patherr) && os.IsNotExist(patherr) {
+		return fmt.Errorf("unknown receipt %q (%w)", id, ErrInvalidPayment)
+	} else if err != nil {
+		return fmt.Errorf("loading receipt thumbnail: %s", err)
+	}
+	return nil
+}
+
+// removeReceipt deletes the receipt and its thumbnail
+func removeReceipt(u db.Store, id string) error {
+	if id == "" {
+		return nil
+	}
+	if err := u.Remove(receiptFilename(id)); err != nil {
+		return fmt.Errorf("removing receipt: %s", err)
+	}
+	if err := u.Remove(thumbnailFilename(id)); err != nil {
+		return fmt.Errorf("removing thumbnail: %s", err)
+	}
+	return nil
+}
+
+// Receipt returns the receipt (or its thumbnail) of the payment with the given
+// id, and its content type. Errors: ErrPaymentNotFound, ErrReceiptNotFound,
+// err
+func (api *API) Receipt(u db.Store, paymentid string, thumb bool) ([]byte, string, error) {
+	payments, err := loadPayments(u)
+	if err != nil {
+		return nil, "", fmt.Errorf("loading payments: %s", err)
+	}
+	i := findPayment(payments, paymentid)
+	if i == -1 {
+		return nil, "", ErrPaymentNotFound
+	}
+	id := payments[i].Receipt
+	if id == "" {
+		return nil, "", ErrReceiptNotFound
+	}
+
+	filename, contenttype := receiptFilename(id), ReceiptContentType
+	if thumb {
+		filename, contenttype = thumbnailFilename(id), ThumbnailContentType
+	}
+	content, err := u.Load(filename)
+	var patherr *os.PathError
+	if errors.As(err, &patherr) && os.IsNotExist(patherr) {
+		return nil, "", fmt.Errorf("receipt file is missing (%w)", ErrReceiptNotFound)
+	} else if err != nil {
+		return nil, "", fmt.Errorf("loading receipt: %s", err)
+	}
+	return content, contenttype, nil
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestThumbnail(t *testing.T) {
+	sizes := []struct {
+		w, h, tw, th int
+	}{
+		{100, 50, 100, 50},
+		{1024, 768, 256, 192},
+		{600, 2400, 64, 256},
+		{5000, 3, 256, 1},
+	}
+	for _, size := range sizes {
+		img := image.NewGray(image.Rect(0, 0, size.w, size.h))
+		bounds := thumbnail(img).Bounds()
+		if bounds.Dx() != size.tw || bounds.Dy() != size.th {
+			t.Errorf("thumbnail of %dx%d should have %dx%d, got %dx%d", size.w, size.h, size.tw, size.th, bounds.Dx(), bounds.Dy())
+		}
+	}
+
+	// half black, half white
+	img := image.NewGray(image.Rect(0, 0, 512, 512))
+	for y := 0; y < 512; y++ {
+		for x := 256; x < 512; x++ {
+			img.SetGray(x, y, color.Gray{Y: 255})
+		}
+	}
+	thumb := thumbnail(img)
+	if r, _, _, _ := thumb.At(10, 10).RGBA(); r != 0 {
+		t.Errorf("left of the thumbnail should have black, got %d", r)
+	}
+	if r, _, _, _ := thumb.At(200, 10).RGBA(); r != 0xffff {
+		t.Errorf("right of the thumbnail should have white, got %d", r)
+	}
+}
+
+func TestReceipts(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	img := image.NewGray(image.Rect(0, 0, 800, 600))
+	var original bytes.Buffer
+	if err := png.Encode(&original, img); err != nil {
+		t.Fatalf("encoding image: %s", err)
+	}
+	receipt, err := saveReceipt(u, original.Bytes(), img)
+	if err != nil {
+		t.Fatalf("saving receipt: %s", err)
+	}
+
+	serialized := fmt.Sprintf(`{"name": "fridge", "amount": "899", "date": "2019-12-20", "receipt": %q}`, receipt)
+	payment, err := api.AddPayment(u, []byte(serialized))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	if payment.Receipt != receipt {
+		t.Errorf("payment should have receipt %q, got %q", receipt, payment.Receipt)
+	}
+	if pending, err := loadPendingReceipts(u); err != nil || len(pending) != 0 {
+		t.Errorf("linked receipt should have no pending receipts, got %v (%v)", pending, err)
+	}
+
+	content, contenttype, err := api.Receipt(u, payment.ID, false)
+	if err != nil {
+		t.Fatalf("loading receipt: %s", err)
+	}
+	if contenttype != ReceiptContentType || !bytes.Equal(content, original.Bytes()) {
+		t.Errorf("receipt should have the original image, got %s (%d bytes)", contenttype, len(content))
+	}
+	content, contenttype, err = api.Receipt(u, payment.ID, true)
+	if err != nil {
+		t.Fatalf("loading thumbnail: %s", err)
+	}
+	if contenttype != ThumbnailContentType {
+		t.Errorf("thumbnail should have content type %s, got %s", ThumbnailContentType, contenttype)
+	}
+	thumb, err := jpeg.Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("decoding thumbnail: %s", err)
+	}
+	if bounds := thumb.Bounds(); bounds.Dx() != 256 || bounds.Dy() != 192 {
+		t.Errorf("thumbnail should have 256x192, got %dx%d", bounds.Dx(), bounds.Dy())
+	}
+
+	// a receipt belongs to one payment, and has to exist
+	if _, err := api.AddPayment(u, []byte(serialized)); !errors.Is(err, ErrInvalidPayment) {
+		t.Errorf("reusing a receipt should have ErrInvalidPayment, got %v", err)
+	}
+	if _, err := api.AddPayment(u, []byte(`{"name": "tv", "amount": "1", "date": "2019-12-20", "receipt": "nope"}`)); !errors.Is(err, ErrInvalidPayment) {
+		t.Errorf("unknown receipt should have ErrInvalidPayment, got %v", err)
+	}
+
+	// it can't be changed by an update
+	updated, err := api.UpdatePayment(u, payment.ID, []byte(`{"receipt": "", "notes": "2 year warranty"}`))
+	if err != nil {
+		t.Fatalf("updating payment: %s", err)
+	}
+	if updated.Receipt != receipt {
+		t.Errorf("updated payment should have receipt %q, got %q", receipt, updated.Receipt)
+	}
+
+	other, err := api.AddPayment(u, []byte(`{"name": "tv", "amount": "1", "date": "2019-12-20"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	if _, _, err := api.Receipt(u, other.ID, false); !errors.Is(err, ErrReceiptNotFound) {
+		t.Errorf("payment without receipt should have ErrReceiptNotFound, got %v", err)
+	}
+
+	// deleting the payment deletes the receipt
+	if err := api.DeletePayment(u, payment.ID, 0); err != nil {
+		t.Fatalf("deleting payment: %s", err)
+	}
+	if _, err := u.Load(receiptFilename(receipt)); err == nil {
+		t.Errorf("deleting the payment should have removed the receipt")
+	}
+	if _, err := u.Load(thumbnailFilename(receipt)); err == nil {
+		t.Errorf("deleting the payment should have removed the thumbnail")
+	}
+
+	// receipts which are never linked to a payment expire
+	abandoned, err := saveReceipt(u, original.Bytes(), img)
+	if err != nil {
+		t.Fatalf("saving receipt: %s", err)
+	}
+	if err := pruneReceipts(u, time.Now()); err != nil {
+		t.Fatalf("pruning receipts: %s", err)
+	}
+	if _, err := u.Load(receiptFilename(abandoned)); err != nil {
+		t.Errorf("should keep a receipt which was just scanned, got %s", err)
+	}
+	if err := pruneReceipts(u, time.Now().Add(pendingReceiptTTL)); err != nil {
+		t.Fatalf("pruning receipts: %s", err)
+	}
+	if _, err := u.Load(receiptFilename(abandoned)); err == nil {
+		t.Errorf("should have removed the abandoned receipt")
+	}
+	if _, err := u.Load(thumbnailFilename(abandoned)); err == nil {
+		t.Errorf("should have removed the abandoned thumbnail")
+	}
+	if pending, err := loadPendingReceipts(u); err != nil || len(pending) != 0 {
+		t.Errorf("should have no pending receipts left, got %v (%v)", pending, err)
+	}
+}
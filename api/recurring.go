@@ -0,0 +1,464 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrInvalidRecurring tags errors caused by a recurring payment given by the
+// user
+var ErrInvalidRecurring = errors.New("invalid recurring payment")
+
+var ErrRecurringNotFound = errors.New("recurring payment not found")
+
+// Schedule says when a recurring payment is due. It's written like an iCal
+// RRULE: FREQ=MONTHLY;BYMONTHDAY=15, FREQ=WEEKLY;INTERVAL=2, FREQ=YEARLY, etc.
+// Only FREQ, INTERVAL, BYMONTHDAY, COUNT and UNTIL are supported
+type Schedule struct {
+	Freq Period
+	// Interval is the number of periods between two payments (at least 1)
+	Interval int
+	// MonthDay is the day of the month monthly payments are due on. 0 means
+	// the start's day, -1 the last day of the month. Days past the end of the
+	// month are the last day of the month
+	MonthDay int
+	// Count is the maximum number of payments (0 for no limit)
+	Count int
+	// Until is the last day a payment can be due on (zero for no limit)
+	Until Date
+}
+
+var rruleFreqs = map[string]Period{
+	"DAILY":   PeriodDay,
+	"WEEKLY":  PeriodWeek,
+	"MONTHLY": PeriodMonth,
+	"YEARLY":  PeriodYear,
+}
+
+// ParseSchedule parses a RRULE
+func ParseSchedule(rrule string) (Schedule, error) {
+	s := Schedule{Interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(rrule, "RRULE:"), ";") {
+		i := strings.Index(part, "=")
+		if i == -1 {
+			return s, fmt.Errorf("%q should be NAME=VALUE", part)
+		}
+		name, value := strings.ToUpper(part[:i]), part[i+1:]
+		var err error
+		switch name {
+		case "FREQ":
+			freq, ok := rruleFreqs[strings.ToUpper(value)]
+			if !ok {
+				return s, fmt.Errorf("unsupported FREQ %q", value)
+			}
+			s.Freq = freq
+		case "INTERVAL":
+			s.Interval, err = strconv.Atoi(value)
+			if err == nil && s.Interval < 1 {
+				err = errors.New("should be at least 1")
+			}
+		case "BYMONTHDAY":
+			s.MonthDay, err = strconv.Atoi(value)
+			if err == nil && (s.MonthDay == 0 || s.MonthDay < -1 || s.MonthDay > 31) {
+				err = errors.New("should be between 1 and 31, or -1")
+			}
+		case "COUNT":
+			s.Count, err = strconv.Atoi(value)
+			if err == nil && s.Count < 1 {
+				err = errors.New("should be at least 1")
+			}
+		case "UNTIL":
+			// only the date matters
+			if len(value) < 8 {
+				err = errors.New("should be YYYYMMDD")
+				break
+			}
+			var t time.Time
+			t, err = time.Parse("20060102", value[:8])
+			s.Until = Date{t}
+		default:
+			return s, fmt.Errorf("unsupported %s", name)
+		}
+		if err != nil {
+			return s, fmt.Errorf("invalid %s %q: %s", name, value, err)
+		}
+	}
+	if s.Freq == "" {
+		return s, errors.New("need FREQ")
+	}
+	if s.MonthDay != 0 && s.Freq != PeriodMonth {
+		return s, errors.New("BYMONTHDAY is only supported with FREQ=MONTHLY")
+	}
+	return s, nil
+}
+
+func (s Schedule) String() string {
+	var freq string
+	for name, period := range rruleFreqs {
+		if period == s.Freq {
+			freq = name
+		}
+	}
+	parts := []string{"FREQ=" + freq}
+	if s.Interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", s.Interval))
+	}
+	if s.MonthDay != 0 {
+		parts = append(parts, fmt.Sprintf("BYMONTHDAY=%d", s.MonthDay))
+	}
+	if s.Count != 0 {
+		parts = append(parts, fmt.Sprintf("COUNT=%d", s.Count))
+	}
+	if !s.Until.IsZero() {
+		parts = append(parts, "UNTIL="+s.Until.Format("20060102"))
+	}
+	return strings.Join(parts, ";")
+}
+
+func (s Schedule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Schedule) UnmarshalJSON(b []byte) error {
+	var rrule string
+	if err := json.Unmarshal(b, &rrule); err != nil {
+		return fmt.Errorf("schedule should be a string: %s", err)
+	}
+	parsed, err := ParseSchedule(rrule)
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+// occurrence returns the nth date the schedule gives from start (n = 0 is
+// around start, but can be before it with BYMONTHDAY)
+func (s Schedule) occurrence(start Date, n int) Date {
+	t := start.Time
+	step := n * s.Interval
+	switch s.Freq {
+	case PeriodWeek:
+		return Date{t.AddDate(0, 0, 7*step)}
+	case PeriodMonth:
+		first := time.Date(t.Year(), t.Month()+time.Month(step), 1, 0, 0, 0, 0, time.UTC)
+		day := s.MonthDay
+		if day == 0 {
+			day = t.Day()
+		}
+		return Date{first.AddDate(0, 0, monthDay(first, day)-1)}
+	case PeriodYear:
+		first := time.Date(t.Year()+step, t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return Date{first.AddDate(0, 0, monthDay(first, t.Day())-1)}
+	}
+	return Date{t.AddDate(0, 0, step)}
+}
+
+// monthDay returns the day of the month starting on first which day refers to
+// (-1 is the last day, and days after the last day are the last day)
+func monthDay(first time.Time, day int) int {
+	last := first.AddDate(0, 1, -1).Day()
+	if day < 0 || day > last {
+		return last
+	}
+	return day
+}
+
+// due returns the dates on which payments are due after last (excluded) up to
+// today (included), going through the occurrences from the nth one. next is
+// the occurrence to start from the next time
+func (s Schedule) due(start, last, today Date, n int) (dates []Date, next int) {
+	// only the first occurrence can be before start (with BYMONTHDAY), and it
+	// doesn't count
+	skipped := 0
+	if s.occurrence(start, 0).Before(start.Time) {
+		skipped = 1
+	}
+	for ; ; n++ {
+		d := s.occurrence(start, n)
+		if d.Before(start.Time) {
+			continue
+		}
+		if (s.Count != 0 && n+1-skipped > s.Count) || (!s.Until.IsZero() && d.After(s.Until.Time)) || d.After(today.Time) {
+			return dates, n
+		}
+		if d.After(last.Time) {
+			dates = append(dates, d)
+		}
+	}
+}
+
+// Recurring is a payment which is added automatically on a schedule (rent,
+// subscriptions, etc)
+type Recurring struct {
+	ID string `json:"id"`
+	// Payment is the template of the payments to create. Its date is ignored
+	Payment  Payment  `json:"payment"`
+	Schedule Schedule `json:"schedule"`
+	Start    Date     `json:"start"`
+	// Last is the date of the last payment created
+	Last Date `json:"last"`
+	// Next is the occurrence the next run starts from (see Schedule.due), so
+	// that it doesn't go through every one since Start
+	Next int `json:"next,omitempty"`
+}
+
+func loadRecurring(u db.Store) ([]Recurring, error) {
+	var recurring []Recurring
+	if _, err := loadJSON(u, "/recurring", &recurring); err != nil {
+		return nil, err
+	}
+	return recurring, nil
+}
+
+func findRecurring(recurring []Recurring, id string) int {
+	for i, r := range recurring {
+		if r.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkRecurring makes sure the template would give valid payments
+func checkRecurring(u db.Store, r *Recurring) error {
+	if r.Schedule.Freq == "" {
+		return fmt.Errorf("need 'schedule' (%w)", ErrInvalidRecurring)
+	}
+	if r.Start.IsZero() {
+		return fmt.Errorf("need 'start' date (%w)", ErrInvalidRecurring)
+	}
+	r.Payment.ID = ""
+	r.Payment.Date = Date{}
+	if r.Payment.Direction == "" {
+		r.Payment.Direction = DirectionExpense
+	}
+
+	p := copyPayment(r.Payment)
+	p.Date = r.Start
+	if err := checkPaymentAccount(u, &p); err != nil {
+		if errors.Is(err, ErrInvalidPayment) {
+			return fmt.Errorf("%s (%w)", err, ErrInvalidRecurring)
+		}
+		return err
+	}
+	if p.Currency == "" {
+		// it's filled in when the payments are created
+		settings, err := loadSettings(u)
+		if err != nil {
+			return fmt.Errorf("loading settings: %s", err)
+		}
+		p.Currency = settings.BaseCurrency
+	}
+	if err := isValidPayment(p); err != nil {
+		return fmt.Errorf("%s (%w)", err, ErrInvalidRecurring)
+	}
+	if err := checkPaymentCategory(u, &p); err != nil {
+		if errors.Is(err, ErrInvalidPayment) {
+			return fmt.Errorf("%s (%w)", err, ErrInvalidRecurring)
+		}
+		return err
+	}
+	if err := normalizeAmount(&p); err != nil {
+		return fmt.Errorf("%s (%w)", err, ErrInvalidRecurring)
+	}
+	if err := splitPayment(u, &p); err != nil {
+		return fmt.Errorf("%s (%w)", err, ErrInvalidRecurring)
+	}
+	r.Payment.Category = p.Category
+	return nil
+}
+
+// ListRecurring returns the user's recurring payments
+func (api *API) ListRecurring(u db.Store) ([]Recurring, error) {
+	return loadRecurring(u)
+}
+
+// AddRecurring adds a recurring payment. If it doesn't have a start date, it
+// starts on today. The payments already due are only created when the
+// scheduler runs. Errors: ErrInvalidRecurring, err
+func (api *API) AddRecurring(u db.Store, serializedrecurring []byte, today Date) (*Recurring, error) {
+	var r Recurring
+	if err := json.Unmarshal(serializedrecurring, &r); err != nil {
+		return nil, fmt.Errorf("unmarshaling json recurring payment: %s (%w)", err, ErrInvalidRecurring)
+	}
+	if r.Start.IsZero() {
+		r.Start = today
+	}
+	// the client doesn't get to say which payments were already created
+	r.Last = Date{}
+	r.Next = 0
+	if err := checkRecurring(u, &r); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	r.ID = id
+
+	recurring, err := loadRecurring(u)
+	if err != nil {
+		return nil, err
+	}
+	recurring = append(recurring, r)
+	return &r, saveJSON(u, "/recurring", recurring)
+}
+
+// UpdateRecurring changes the fields present in serializedpatch. The payments
+// that were already created aren't changed, and aren't created again. Errors:
+// ErrRecurringNotFound, ErrInvalidRecurring, err
+func (api *API) UpdateRecurring(u db.Store, id string, serializedpatch []byte) (*Recurring, error) {
+	recurring, err := loadRecurring(u)
+	if err != nil {
+		return nil, err
+	}
+	i := findRecurring(recurring, id)
+	if i == -1 {
+		return nil, ErrRecurringNotFound
+	}
+
+	r := recurring[i]
+	r.Payment = copyPayment(r.Payment)
+	if err := json.Unmarshal(serializedpatch, &r); err != nil {
+		return nil, fmt.Errorf("unmarshaling json recurring payment: %s (%w)", err, ErrInvalidRecurring)
+	}
+	r.ID = id
+	r.Last = recurring[i].Last
+	// the schedule might have changed, the next run goes through it again
+	r.Next = 0
+	if err := checkRecurring(u, &r); err != nil {
+		return nil, err
+	}
+
+	recurring[i] = r
+	return &r, saveJSON(u, "/recurring", recurring)
+}
+
+// DeleteRecurring removes a recurring payment. The payments it created are
+// kept. Errors: ErrRecurringNotFound, err
+func (api *API) DeleteRecurring(u db.Store, id string) error {
+	recurring, err := loadRecurring(u)
+	if err != nil {
+		return err
+	}
+	i := findRecurring(recurring, id)
+	if i == -1 {
+		return ErrRecurringNotFound
+	}
+	recurring = append(recurring[:i], recurring[i+1:]...)
+	return saveJSON(u, "/recurring", recurring)
+}
+
+// RunRecurring creates the payments which are due up to today (included),
+// catching up on every period since the last run. Running it twice on the
+// same day doesn't create anything the second time. A template which doesn't
+// give a valid payment anymore (its account was removed for example) is
+// skipped, and tried again on the next run. Returns the created payments
+func (api *API) RunRecurring(u db.Store, today Date) ([]Payment, error) {
+	recurring, err := loadRecurring(u)
+	if err != nil {
+		return nil, err
+	}
+
+	var created []Payment
+	var rs *ruleset
+	changed := false
+	for i, r := range recurring {
+		dates, next := r.Schedule.due(r.Start, r.Last, today, r.Next)
+		if len(dates) == 0 {
+			if next != r.Next {
+				recurring[i].Next = next
+				changed = true
+			}
+			continue
+		}
+		if rs == nil {
+			if rs, err = loadRuleset(u); err != nil {
+				return nil, fmt.Errorf("loading rules: %s", err)
+			}
+		}
+		payments, err := recurringPayments(u, r, dates, rs)
+		if errors.Is(err, ErrInvalidPayment) {
+			log.Printf("[err] skipping recurring payment %s of %s: %s", r.ID, u, err)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		created = append(created, payments...)
+		recurring[i].Last = dates[len(dates)-1]
+		recurring[i].Next = next
+		changed = true
+	}
+	if !changed {
+		return created, nil
+	}
+
+	// the payments were maybe saved already, by a run which crashed before
+	// saving Last
+	payments, nrecords, err := readPayments(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading existing payments: %s", err)
+	}
+	fresh := created[:0]
+	for _, p := range created {
+		if findPayment(payments, p.ID) == -1 {
+			fresh = append(fresh, p)
+		}
+	}
+	created = fresh
+	if len(created) > 0 {
+		if err := savePayments(u, payments, nrecords, append(copyPayments(payments), created...)); err != nil {
+			return nil, err
+		}
+	}
+	return created, saveJSON(u, "/recurring", recurring)
+}
+
+// recurringPayments returns the payments r creates on the dates
+func recurringPayments(u db.Store, r Recurring, dates []Date, rs *ruleset) ([]Payment, error) {
+	var payments []Payment
+	for _, date := range dates {
+		payment := copyPayment(r.Payment)
+		payment.Date = date
+		if err := preparePayment(u, &payment, rs); err != nil {
+			return nil, fmt.Errorf("on %s: %w", date, err)
+		}
+		payment.ID = recurringPaymentID(r.ID, date)
+		payments = append(payments, payment)
+	}
+	return payments, nil
+}
+
+// recurringPaymentID is the ID of the payment created by the recurring
+// payment on date. It's always the same, so that a payment can't be created
+// twice
+func recurringPaymentID(id string, date Date) string {
+	sum := sha256.Sum256([]byte(id + " " + date.String()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// renameRecurringCategory makes the recurring payments follow a category
+// which moved
+func renameRecurringCategory(u db.Store, moved func(string) (string, bool)) error {
+	recurring, err := loadRecurring(u)
+	if err != nil {
+		return err
+	}
+	for i, r := range recurring {
+		if path, ok := moved(r.Payment.Category); ok {
+			recurring[i].Payment.Category = path
+		}
+	}
+	return saveJSON(u, "/recurring", recurring)
+}
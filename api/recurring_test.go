@@ -0,0 +1,198 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestScheduleDue(t *testing.T) {
+	table := []struct {
+		rrule       string
+		start, last string
+		today       string
+		expected    string
+	}{
+		{"FREQ=MONTHLY;BYMONTHDAY=31", "2019-01-15", "", "2019-04-30", "2019-01-31 2019-02-28 2019-03-31 2019-04-30"},
+		{"FREQ=MONTHLY;BYMONTHDAY=10", "2019-01-15", "", "2019-03-09", "2019-02-10"},
+		{"FREQ=MONTHLY;BYMONTHDAY=-1", "2019-01-01", "2019-01-31", "2019-03-30", "2019-02-28"},
+		{"FREQ=MONTHLY", "2019-01-31", "", "2019-03-31", "2019-01-31 2019-02-28 2019-03-31"},
+		{"FREQ=WEEKLY;INTERVAL=2", "2019-12-02", "2019-12-02", "2019-12-31", "2019-12-16 2019-12-30"},
+		{"FREQ=YEARLY", "2016-02-29", "", "2019-12-31", "2016-02-29 2017-02-28 2018-02-28 2019-02-28"},
+		{"FREQ=DAILY;COUNT=3", "2019-12-01", "", "2019-12-31", "2019-12-01 2019-12-02 2019-12-03"},
+		{"FREQ=DAILY;UNTIL=20191202", "2019-12-01", "", "2019-12-31", "2019-12-01 2019-12-02"},
+		{"FREQ=DAILY", "2019-12-01", "", "2019-11-30", ""},
+	}
+	for _, row := range table {
+		schedule, err := ParseSchedule(row.rrule)
+		if err != nil {
+			t.Errorf("parsing %q: %s", row.rrule, err)
+			continue
+		}
+		if schedule.String() != row.rrule {
+			t.Errorf("%q should serialize back to itself, got %q", row.rrule, schedule.String())
+		}
+		start, _ := ParseDate(row.start)
+		today, _ := ParseDate(row.today)
+		var last Date
+		if row.last != "" {
+			last, _ = ParseDate(row.last)
+		}
+		var actual []string
+		dates, next := schedule.due(start, last, today, 0)
+		for _, d := range dates {
+			actual = append(actual, d.String())
+		}
+		if strings.Join(actual, " ") != row.expected {
+			t.Errorf("%s from %s: should have %q, got %q", row.rrule, row.start, row.expected, strings.Join(actual, " "))
+		}
+
+		// starting from next gives the same as going through everything
+		later := Date{today.AddDate(0, 2, 0)}
+		if len(dates) > 0 {
+			last = dates[len(dates)-1]
+		}
+		all, _ := schedule.due(start, last, later, 0)
+		fromNext, _ := schedule.due(start, last, later, next)
+		if fmt.Sprint(all) != fmt.Sprint(fromNext) {
+			t.Errorf("%s from %s: from occurrence %d, should have %v, got %v", row.rrule, row.start, next, all, fromNext)
+		}
+	}
+
+	for _, rrule := range []string{"", "INTERVAL=2", "FREQ=HOURLY", "FREQ=WEEKLY;BYMONTHDAY=2", "FREQ=MONTHLY;BYMONTHDAY=32", "FREQ=DAILY;INTERVAL=0", "FREQ=DAILY;BYDAY=MO"} {
+		if _, err := ParseSchedule(rrule); err == nil {
+			t.Errorf("%q should be invalid", rrule)
+		}
+	}
+}
+
+func TestRunRecurring(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	if _, err := api.AddCategory(u, "Housing"); err != nil {
+		t.Fatalf("adding category: %s", err)
+	}
+
+	today, _ := ParseDate("2019-12-10")
+	if _, err := api.AddRecurring(u, []byte(`{"payment": {"name": "rent", "amount": "1200"}}`), today); !errors.Is(err, ErrInvalidRecurring) {
+		t.Errorf("recurring payment without schedule should have ErrInvalidRecurring, got %v", err)
+	}
+	if _, err := api.AddRecurring(u, []byte(`{"payment": {"name": "rent"}, "schedule": "FREQ=MONTHLY"}`), today); !errors.Is(err, ErrInvalidRecurring) {
+		t.Errorf("recurring payment without amount should have ErrInvalidRecurring, got %v", err)
+	}
+
+	rent, err := api.AddRecurring(u, []byte(`{"payment": {"name": "rent", "amount": "1200", "category": "Housing"}, "schedule": "FREQ=MONTHLY;BYMONTHDAY=1", "start": "2019-10-01"}`), today)
+	if err != nil {
+		t.Fatalf("adding recurring payment: %s", err)
+	}
+	if _, err := api.AddRecurring(u, []byte(`{"payment": {"name": "music", "amount": "11.99", "currency": "USD"}, "schedule": "FREQ=MONTHLY"}`), today); err != nil {
+		t.Fatalf("adding recurring payment: %s", err)
+	}
+
+	// the server was down since october
+	created, err := api.RunRecurring(u, today)
+	if err != nil {
+		t.Fatalf("running recurring payments: %s", err)
+	}
+	var dates []string
+	for _, p := range created {
+		dates = append(dates, p.Name+" "+p.Date.String())
+	}
+	expected := "rent 2019-10-01 rent 2019-11-01 rent 2019-12-01 music 2019-12-10"
+	if strings.Join(dates, " ") != expected {
+		t.Errorf("should have created %q, got %q", expected, strings.Join(dates, " "))
+	}
+	if created[0].ID == "" || created[0].ID == created[1].ID || created[0].Currency != "AUD" || created[0].Category != "Housing" {
+		t.Errorf("created payments should have ids and a currency, got %+v", created[:2])
+	}
+
+	if created, err := api.RunRecurring(u, today); err != nil || len(created) != 0 {
+		t.Errorf("running twice should create nothing, got %v %v", created, err)
+	}
+
+	if _, err := api.UpdateRecurring(u, rent.ID, []byte(`{"payment": {"amount": "1300"}}`)); err != nil {
+		t.Fatalf("updating recurring payment: %s", err)
+	}
+	next, _ := ParseDate("2020-01-01")
+	created, err = api.RunRecurring(u, next)
+	if err != nil {
+		t.Fatalf("running recurring payments: %s", err)
+	}
+	if len(created) != 1 || created[0].Amount.String() != "1300.00" || created[0].Name != "rent" {
+		t.Errorf("should have created the new rent, got %+v", created)
+	}
+
+	payments, err := loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading payments: %s", err)
+	}
+	if len(payments) != 5 {
+		t.Errorf("should have 5 payments, got %d", len(payments))
+	}
+
+	if err := api.DeleteCategory(u, "Housing"); !errors.Is(err, ErrCategoryInUse) {
+		t.Errorf("deleting a category used by a recurring payment should have ErrCategoryInUse, got %v", err)
+	}
+	if err := api.DeleteRecurring(u, rent.ID); err != nil {
+		t.Fatalf("deleting recurring payment: %s", err)
+	}
+	if err := api.DeleteRecurring(u, rent.ID); !errors.Is(err, ErrRecurringNotFound) {
+		t.Errorf("deleting twice should have ErrRecurringNotFound, got %v", err)
+	}
+}
+
+func TestRunRecurringFailures(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	today, _ := ParseDate("2019-12-10")
+	if _, err := api.AddRecurring(u, []byte(`{"payment": {"name": "gym", "amount": "30"}, "schedule": "FREQ=MONTHLY", "start": "2019-11-10"}`), today); err != nil {
+		t.Fatalf("adding recurring payment: %s", err)
+	}
+	recurring, err := loadRecurring(u)
+	if err != nil {
+		t.Fatalf("loading recurring payments: %s", err)
+	}
+	// a template which became invalid doesn't stop the others
+	broken := recurring[0]
+	broken.ID = "broken"
+	broken.Payment.Currency = "dollars"
+	if err := saveJSON(u, "/recurring", append(recurring, broken)); err != nil {
+		t.Fatalf("saving recurring payments: %s", err)
+	}
+	before, err := loadRecurring(u)
+	if err != nil {
+		t.Fatalf("loading recurring payments: %s", err)
+	}
+
+	created, err := api.RunRecurring(u, today)
+	if err != nil {
+		t.Fatalf("running recurring payments: %s", err)
+	}
+	if len(created) != 2 {
+		t.Errorf("should have created the 2 valid payments, got %+v", created)
+	}
+	after, err := loadRecurring(u)
+	if err != nil {
+		t.Fatalf("loading recurring payments: %s", err)
+	}
+	if !after[1].Last.IsZero() {
+		t.Errorf("the broken template should be tried again, got last %s", after[1].Last)
+	}
+
+	// crash after saving the payments, before saving Last
+	if err := saveJSON(u, "/recurring", before); err != nil {
+		t.Fatalf("saving recurring payments: %s", err)
+	}
+	if created, err := api.RunRecurring(u, today); err != nil || len(created) != 0 {
+		t.Errorf("running again shouldn't create the payments twice, got %+v (%v)", created, err)
+	}
+	payments, err := loadPayments(u)
+	if err != nil || len(payments) != 2 {
+		t.Errorf("should have 2 payments, got %d (%v)", len(payments), err)
+	}
+}
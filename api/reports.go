@@ -0,0 +1,299 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrInvalidReport tags errors caused by a malformed ReportQuery
+var ErrInvalidReport = errors.New("invalid report")
+
+// maxReportPeriods stops someone from asking for 50 years of daily sums
+const maxReportPeriods = 1000
+
+// what payments can be grouped by (on top of the period)
+const (
+	GroupNone     = ""
+	GroupCategory = "category"
+	GroupTag      = "tag"
+	GroupName     = "name"
+	GroupMerchant = "merchant"
+	// GroupSource is where income comes from: the merchant, or the name
+	// if there isn't one
+	GroupSource = "source"
+)
+
+// ReportQuery says how to aggregate the payments
+type ReportQuery struct {
+	// From and To are inclusive. The zero date means from the first payment
+	// and up to the last one
+	From, To Date
+	Period   Period
+	GroupBy  string
+	// Direction is which payments the series are about: DirectionExpense
+	// (the default) or DirectionIncome. The cash flow always has both
+	Direction string
+}
+
+// ReportPeriod is a period of the report
+type ReportPeriod struct {
+	Label string `json:"label"`
+	Start Date   `json:"start"`
+	End   Date   `json:"end"`
+}
+
+// Series is the aggregate of the payments of a group, period by period. The
+// slices are in the same order as Report.Periods
+type Series struct {
+	// Key is the category, tag, name or merchant of the group. It's empty for
+	// the payments without one
+	Key      string  `json:"key"`
+	Sums     []Money `json:"sums"`
+	Counts   []int   `json:"counts"`
+	Averages []Money `json:"averages"`
+
+	// over the whole report
+	Sum     Money `json:"sum"`
+	Count   int   `json:"count"`
+	Average Money `json:"average"`
+}
+
+// CashFlow is what came in and went out during a period
+type CashFlow struct {
+	Income   Money `json:"income"`
+	Expenses Money `json:"expenses"`
+	// Net is Income - Expenses
+	Net Money `json:"net"`
+	// SavingsRate is Net / Income (0.25 means a quarter of the income was
+	// saved). It's nil without income
+	SavingsRate *float64 `json:"savings_rate"`
+}
+
+// add counts the payment's amount (in the base currency)
+func (f *CashFlow) add(p Payment, converted Money) error {
+	var err error
+	if p.Direction == DirectionIncome {
+		if f.Income, err = f.Income.Add(converted); err != nil {
+			return err
+		}
+		f.Net, err = f.Net.Add(converted)
+	} else {
+		if f.Expenses, err = f.Expenses.Add(converted); err != nil {
+			return err
+		}
+		f.Net, err = f.Net.Sub(converted)
+	}
+	return err
+}
+
+func (f *CashFlow) computeSavingsRate() {
+	f.SavingsRate = nil
+	if f.Income.Sign() <= 0 {
+		return
+	}
+	r := f.Net.rat()
+	r.Quo(r, f.Income.rat())
+	rate, _ := r.Float64()
+	rate = math.Round(rate*10000) / 10000
+	f.SavingsRate = &rate
+}
+
+// Report is ready to be given to a chart: Periods are the x axis (every
+// period between From and To, even the empty ones), and each series is a
+// line. The amounts are in the user's base currency
+type Report struct {
+	Currency string `json:"currency"`
+	Period   Period `json:"period"`
+	GroupBy  string `json:"group_by"`
+	// Direction is the direction of the payments in the series
+	Direction string         `json:"direction"`
+	Periods   []ReportPeriod `json:"periods"`
+	Series    []*Series      `json:"series"`
+	// Flows is the cash flow of each period, and Flow the one of the whole
+	// report
+	Flows []CashFlow `json:"flows"`
+	Flow  CashFlow   `json:"flow"`
+	// Unconverted are the IDs of the payments which couldn't be converted
+	// to the base currency. They aren't counted
+	Unconverted []string `json:"unconverted"`
+}
+
+// groupKeys returns the groups p belongs to. With tags, it can be in several,
+// or none
+func groupKeys(p Payment, groupby string) []string {
+	switch groupby {
+	case GroupCategory:
+		return []string{p.Category}
+	case GroupTag:
+		if len(p.Tags) == 0 {
+			return []string{""}
+		}
+		return p.Tags
+	case GroupName:
+		return []string{p.Name}
+	case GroupMerchant:
+		return []string{p.Merchant}
+	case GroupSource:
+		if p.Merchant != "" {
+			return []string{p.Merchant}
+		}
+		return []string{p.Name}
+	}
+	return []string{""}
+}
+
+// Report sums, counts and averages the expenses (or the income) by period and
+// group, and computes the cash flow of each period. Errors: ErrInvalidReport,
+// err
+func (api *API) Report(u db.Store, q ReportQuery) (*Report, error) {
+	if !q.Period.valid() {
+		return nil, fmt.Errorf("unknown period %q (%w)", q.Period, ErrInvalidReport)
+	}
+	switch q.GroupBy {
+	case GroupNone, GroupCategory, GroupTag, GroupName, GroupMerchant, GroupSource:
+	default:
+		return nil, fmt.Errorf("can't group by %q (%w)", q.GroupBy, ErrInvalidReport)
+	}
+	if q.Direction == "" {
+		q.Direction = DirectionExpense
+	} else if q.Direction != DirectionExpense && q.Direction != DirectionIncome {
+		return nil, fmt.Errorf("direction should be %q or %q, got %q (%w)", DirectionExpense, DirectionIncome, q.Direction, ErrInvalidReport)
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.To.Before(q.From.Time) {
+		return nil, fmt.Errorf("'to' is before 'from' (%w)", ErrInvalidReport)
+	}
+
+	payments, err := loadPayments(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading payments: %s", err)
+	}
+	settings, err := loadSettings(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading settings: %s", err)
+	}
+	rates, err := loadRates(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading rates: %s", err)
+	}
+
+	var selected []Payment
+	from, to := q.From, q.To
+	for _, p := range payments {
+		if (!q.From.IsZero() && p.Date.Before(q.From.Time)) || (!q.To.IsZero() && p.Date.After(q.To.Time)) {
+			continue
+		}
+		selected = append(selected, p)
+		if q.From.IsZero() && (from.IsZero() || p.Date.Before(from.Time)) {
+			from = p.Date
+		}
+		if q.To.IsZero() && p.Date.After(to.Time) {
+			to = p.Date
+		}
+	}
+
+	report := &Report{
+		Currency:    settings.BaseCurrency,
+		Period:      q.Period,
+		GroupBy:     q.GroupBy,
+		Direction:   q.Direction,
+		Periods:     []ReportPeriod{},
+		Series:      []*Series{},
+		Flows:       []CashFlow{},
+		Unconverted: []string{},
+	}
+	if from.IsZero() || to.IsZero() {
+		// no payments, and no range to show
+		return report, nil
+	}
+
+	// index of each period, by its first day
+	index := make(map[string]int)
+	for start := q.Period.start(from); !start.After(to.Time); start = q.Period.next(start) {
+		if len(report.Periods) == maxReportPeriods {
+			return nil, fmt.Errorf("more than %d periods, use a longer period or a shorter range (%w)", maxReportPeriods, ErrInvalidReport)
+		}
+		index[start.String()] = len(report.Periods)
+		report.Periods = append(report.Periods, ReportPeriod{
+			Label: q.Period.label(start),
+			Start: start,
+			End:   q.Period.end(start),
+		})
+	}
+
+	zero := Money{Exponent: currencyExponent(settings.BaseCurrency)}
+	report.Flow = CashFlow{Income: zero, Expenses: zero, Net: zero}
+	for range report.Periods {
+		report.Flows = append(report.Flows, report.Flow)
+	}
+	series := make(map[string]*Series)
+	for _, p := range selected {
+		converted, err := rates.convert(p.Amount, p.Currency, settings.BaseCurrency, p.Date)
+		if errors.Is(err, ErrNoRate) {
+			report.Unconverted = append(report.Unconverted, p.ID)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		i := index[q.Period.start(p.Date).String()]
+		if err := report.Flows[i].add(p, converted); err != nil {
+			return nil, fmt.Errorf("cash flow: %s", err)
+		}
+		if err := report.Flow.add(p, converted); err != nil {
+			return nil, fmt.Errorf("cash flow: %s", err)
+		}
+		if p.Direction != q.Direction {
+			continue
+		}
+		for _, key := range groupKeys(p, q.GroupBy) {
+			s, ok := series[key]
+			if !ok {
+				s = &Series{
+					Key:      key,
+					Sums:     make([]Money, len(report.Periods)),
+					Counts:   make([]int, len(report.Periods)),
+					Averages: make([]Money, len(report.Periods)),
+					Sum:      zero,
+					Average:  zero,
+				}
+				for j := range report.Periods {
+					s.Sums[j] = zero
+					s.Averages[j] = zero
+				}
+				series[key] = s
+				report.Series = append(report.Series, s)
+			}
+			if s.Sums[i], err = s.Sums[i].Add(converted); err != nil {
+				return nil, fmt.Errorf("sum of %s: %s", key, err)
+			}
+			s.Counts[i]++
+			if s.Sum, err = s.Sum.Add(converted); err != nil {
+				return nil, fmt.Errorf("sum of %s: %s", key, err)
+			}
+			s.Count++
+		}
+	}
+
+	for i := range report.Flows {
+		report.Flows[i].computeSavingsRate()
+	}
+	report.Flow.computeSavingsRate()
+	for _, s := range report.Series {
+		for i, count := range s.Counts {
+			if count != 0 {
+				s.Averages[i] = s.Sums[i].Div(int64(count))
+			}
+		}
+		if s.Count != 0 {
+			s.Average = s.Sum.Div(int64(s.Count))
+		}
+	}
+	sort.Slice(report.Series, func(i, j int) bool {
+		return report.Series[i].Key < report.Series[j].Key
+	})
+	return report, nil
+}
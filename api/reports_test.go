@@ -0,0 +1,159 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	report, err := api.Report(u, ReportQuery{Period: PeriodMonth})
+	if err != nil {
+		t.Fatalf("building empty report: %s", err)
+	}
+	if len(report.Periods) != 0 || len(report.Series) != 0 {
+		t.Errorf("report without payments should be empty, got %+v", report)
+	}
+
+	for _, path := range []string{"Food", "Transport"} {
+		if _, err := api.AddCategory(u, path); err != nil {
+			t.Fatalf("adding category: %s", err)
+		}
+	}
+	payments := []string{
+		`{"name": "lunch", "amount": "10", "date": "2019-10-05", "category": "Food", "tags": ["work"]}`,
+		`{"name": "lunch", "amount": "15", "date": "2019-10-20", "category": "Food"}`,
+		`{"name": "bus", "amount": "3.50", "date": "2019-10-21", "category": "Transport", "tags": ["work", "travel"]}`,
+		`{"name": "dinner", "amount": "40.01", "date": "2019-12-24", "category": "Food"}`,
+		`{"name": "no rate", "amount": "5", "currency": "USD", "date": "2019-12-24", "category": "Food"}`,
+	}
+	for _, serialized := range payments {
+		if _, err := api.AddPayment(u, []byte(serialized)); err != nil {
+			t.Fatalf("adding payment: %s", err)
+		}
+	}
+
+	report, err = api.Report(u, ReportQuery{Period: PeriodMonth, GroupBy: GroupCategory})
+	if err != nil {
+		t.Fatalf("building report: %s", err)
+	}
+	var labels []string
+	for _, period := range report.Periods {
+		labels = append(labels, period.Label)
+	}
+	if strings.Join(labels, " ") != "2019-10 2019-11 2019-12" {
+		t.Errorf("should have every month from the first payment to the last, got %v", labels)
+	}
+	if len(report.Series) != 2 || report.Series[0].Key != "Food" || report.Series[1].Key != "Transport" {
+		t.Fatalf("should have a series per category, got %+v", report.Series)
+	}
+	food := report.Series[0]
+	if food.Sums[0].String() != "25.00" || food.Counts[0] != 2 || food.Averages[0].String() != "12.50" {
+		t.Errorf("october should have 2 payments, 25.00 in total, got %+v", food)
+	}
+	if !food.Sums[1].IsZero() || food.Counts[1] != 0 {
+		t.Errorf("november should be empty, got %s and %d", food.Sums[1], food.Counts[1])
+	}
+	if food.Sum.String() != "65.01" || food.Count != 3 || food.Average.String() != "21.67" {
+		t.Errorf("food should have 65.01 in 3 payments, got %s in %d (average %s)", food.Sum, food.Count, food.Average)
+	}
+	if len(report.Unconverted) != 1 {
+		t.Errorf("payment without rate should be unconverted, got %v", report.Unconverted)
+	}
+
+	from, _ := ParseDate("2019-10-01")
+	to, _ := ParseDate("2019-10-31")
+	report, err = api.Report(u, ReportQuery{From: from, To: to, Period: PeriodWeek, GroupBy: GroupTag})
+	if err != nil {
+		t.Fatalf("building report: %s", err)
+	}
+	if len(report.Periods) != 5 || report.Periods[0].Label != "2019-W40" || report.Periods[0].Start.String() != "2019-09-30" {
+		t.Errorf("should have 5 weeks starting on monday 2019-09-30, got %+v", report.Periods)
+	}
+	var keys []string
+	for _, s := range report.Series {
+		keys = append(keys, s.Key+":"+s.Sum.String())
+	}
+	if strings.Join(keys, " ") != ":15.00 travel:3.50 work:13.50" {
+		t.Errorf("payments should be in the series of each of their tags, got %v", keys)
+	}
+
+	if _, err := api.Report(u, ReportQuery{Period: "decade"}); !errors.Is(err, ErrInvalidReport) {
+		t.Errorf("unknown period should have ErrInvalidReport, got %v", err)
+	}
+	if _, err := api.Report(u, ReportQuery{Period: PeriodDay, GroupBy: "currency"}); !errors.Is(err, ErrInvalidReport) {
+		t.Errorf("unknown group should have ErrInvalidReport, got %v", err)
+	}
+	if _, err := api.Report(u, ReportQuery{From: to, To: from, Period: PeriodDay}); !errors.Is(err, ErrInvalidReport) {
+		t.Errorf("'to' before 'from' should have ErrInvalidReport, got %v", err)
+	}
+}
+
+func TestReportCashFlow(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	payments := []string{
+		`{"name": "salary", "merchant": "ACME", "amount": "3000", "direction": "income", "date": "2019-11-28"}`,
+		`{"name": "rent", "amount": "1200", "date": "2019-11-01"}`,
+		`{"name": "groceries", "amount": "300", "date": "2019-11-10"}`,
+		`{"name": "refund", "amount": "-50", "date": "2019-11-12"}`,
+		`{"name": "lottery", "amount": "20", "direction": "income", "date": "2019-12-05"}`,
+		`{"name": "holidays", "amount": "2000", "date": "2019-12-20"}`,
+	}
+	for _, serialized := range payments {
+		if _, err := api.AddPayment(u, []byte(serialized)); err != nil {
+			t.Fatalf("adding payment: %s", err)
+		}
+	}
+
+	report, err := api.Report(u, ReportQuery{Period: PeriodMonth})
+	if err != nil {
+		t.Fatalf("building report: %s", err)
+	}
+	if len(report.Series) != 1 || report.Series[0].Sum.String() != "3450.00" || report.Series[0].Count != 4 {
+		t.Errorf("series should only have the expenses, got %+v", report.Series)
+	}
+	november, december := report.Flows[0], report.Flows[1]
+	if november.Income.String() != "3000.00" || november.Expenses.String() != "1450.00" || november.Net.String() != "1550.00" {
+		t.Errorf("november should have 3000.00 in and 1450.00 out, got %+v", november)
+	}
+	if november.SavingsRate == nil || *november.SavingsRate != 0.5167 {
+		t.Errorf("november should have saved 51.67%%, got %v", november.SavingsRate)
+	}
+	if december.Net.String() != "-1980.00" || december.SavingsRate == nil || *december.SavingsRate != -99 {
+		t.Errorf("december should have -1980.00 of cash flow, got %+v", december)
+	}
+	if report.Flow.Net.String() != "-430.00" {
+		t.Errorf("report should have -430.00 of cash flow, got %s", report.Flow.Net)
+	}
+
+	report, err = api.Report(u, ReportQuery{Period: PeriodYear, GroupBy: GroupSource, Direction: DirectionIncome})
+	if err != nil {
+		t.Fatalf("building income report: %s", err)
+	}
+	var keys []string
+	for _, s := range report.Series {
+		keys = append(keys, s.Key+":"+s.Sum.String())
+	}
+	if strings.Join(keys, " ") != "ACME:3000.00 lottery:20.00" {
+		t.Errorf("income should be grouped by source, got %v", keys)
+	}
+
+	if _, err := api.Report(u, ReportQuery{Period: PeriodYear, Direction: "sideways"}); !errors.Is(err, ErrInvalidReport) {
+		t.Errorf("unknown direction should have ErrInvalidReport, got %v", err)
+	}
+
+	page, err := api.ListPayments(u, PaymentsQuery{Direction: DirectionIncome})
+	if err != nil {
+		t.Fatalf("listing income: %s", err)
+	}
+	if page.Total != 2 || page.Totals["AUD"].String() != "-3020.00" {
+		t.Errorf("income should have 2 payments, and subtract from the total, got %d and %v", page.Total, page.Totals)
+	}
+}
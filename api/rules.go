@@ -0,0 +1,353 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrInvalidRule tags errors caused by a rule given by the user
+var ErrInvalidRule = errors.New("invalid rule")
+
+var ErrRuleNotFound = errors.New("rule not found")
+
+// Rule fills in the category, tags and custom fields of the payments it
+// matches. A payment matches if it satisfies every condition that is set.
+// Rules only fill in what's missing: they never overwrite a category or a
+// custom field the payment already has
+type Rule struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// conditions
+	NameRegex string `json:"name_regex,omitempty"`
+	MinAmount *Money `json:"min_amount,omitempty"`
+	MaxAmount *Money `json:"max_amount,omitempty"`
+	// Merchant is compared case insensitively
+	Merchant string `json:"merchant,omitempty"`
+
+	// actions
+	Category string            `json:"category,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Custom   map[string]string `json:"custom,omitempty"`
+}
+
+// RuleChange is what applying the rules did (or would do) to a payment
+type RuleChange struct {
+	Before Payment `json:"before"`
+	After  Payment `json:"after"`
+}
+
+// compiledRule is a rule ready to be matched
+type compiledRule struct {
+	Rule
+	regexp *regexp.Regexp
+}
+
+func (r *compiledRule) matches(p Payment) bool {
+	if r.regexp != nil && !r.regexp.MatchString(p.Name) {
+		return false
+	}
+	if r.MinAmount != nil && p.Amount.Cmp(*r.MinAmount) < 0 {
+		return false
+	}
+	if r.MaxAmount != nil && p.Amount.Cmp(*r.MaxAmount) > 0 {
+		return false
+	}
+	if r.Merchant != "" && !strings.EqualFold(r.Merchant, p.Merchant) {
+		return false
+	}
+	return true
+}
+
+// apply fills in p. Categories which don't exist (anymore) aren't applied.
+// Returns true if p changed
+func (r *compiledRule) apply(p *Payment, c categories) bool {
+	changed := false
+	if p.Category == "" && r.Category != "" && c[r.Category] {
+		p.Category = r.Category
+		changed = true
+	}
+	for _, tag := range r.Tags {
+		if !hasTag(*p, tag) {
+			p.Tags = append(p.Tags, tag)
+			changed = true
+		}
+	}
+	for key, value := range r.Custom {
+		if _, ok := p.Custom[key]; !ok {
+			if p.Custom == nil {
+				p.Custom = make(map[string]string)
+			}
+			p.Custom[key] = value
+			changed = true
+		}
+	}
+	return changed
+}
+
+func hasTag(p Payment, tag string) bool {
+	for _, t := range p.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleset is the user's rules, in the order they are applied
+type ruleset struct {
+	rules      []*compiledRule
+	categories categories
+}
+
+func compileRule(rule Rule) (*compiledRule, error) {
+	compiled := &compiledRule{Rule: rule}
+	if rule.NameRegex != "" {
+		re, err := regexp.Compile(rule.NameRegex)
+		if err != nil {
+			return nil, fmt.Errorf("compiling name regex: %s (%w)", err, ErrInvalidRule)
+		}
+		compiled.regexp = re
+	}
+	return compiled, nil
+}
+
+func loadRules(u db.Store) ([]Rule, error) {
+	var rules []Rule
+	if _, err := loadJSON(u, "/rules", &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func loadRuleset(u db.Store) (*ruleset, error) {
+	rules, err := loadRules(u)
+	if err != nil {
+		return nil, err
+	}
+	c, err := loadCategories(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading categories: %s", err)
+	}
+	rs := &ruleset{categories: c}
+	for _, rule := range rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %s", rule.ID, err)
+		}
+		rs.rules = append(rs.rules, compiled)
+	}
+	return rs, nil
+}
+
+// apply applies every matching rule to p. Returns true if p changed
+func (rs *ruleset) apply(p *Payment) bool {
+	changed := false
+	for _, rule := range rs.rules {
+		if rule.matches(*p) && rule.apply(p, rs.categories) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// checkRule makes sure the rule has at least a condition and an action, and
+// that they are valid
+func checkRule(u db.Store, rule *Rule) error {
+	if rule.NameRegex == "" && rule.MinAmount == nil && rule.MaxAmount == nil && rule.Merchant == "" {
+		return fmt.Errorf("need at least one condition (%w)", ErrInvalidRule)
+	}
+	if rule.Category == "" && len(rule.Tags) == 0 && len(rule.Custom) == 0 {
+		return fmt.Errorf("need at least one action (%w)", ErrInvalidRule)
+	}
+	if _, err := compileRule(*rule); err != nil {
+		return err
+	}
+	for key := range rule.Custom {
+		if key == "" || knownPaymentFields[key] {
+			return fmt.Errorf("invalid custom field name %q (%w)", key, ErrInvalidRule)
+		}
+	}
+	for _, tag := range rule.Tags {
+		if tag == "" {
+			return fmt.Errorf("empty tag (%w)", ErrInvalidRule)
+		}
+	}
+	if rule.Category != "" {
+		path, err := normalizeCategory(rule.Category)
+		if err != nil {
+			return fmt.Errorf("%s (%w)", err, ErrInvalidRule)
+		}
+		c, err := loadCategories(u)
+		if err != nil {
+			return fmt.Errorf("loading categories: %s", err)
+		}
+		if !c[path] {
+			return fmt.Errorf("category %q doesn't exist (%w)", path, ErrInvalidRule)
+		}
+		rule.Category = path
+	}
+	return nil
+}
+
+// ListRules returns the user's rules, in the order they are applied
+func (api *API) ListRules(u db.Store) ([]Rule, error) {
+	return loadRules(u)
+}
+
+// AddRule appends a rule to the user's rules. Errors: ErrInvalidRule, err
+func (api *API) AddRule(u db.Store, serializedrule []byte) (*Rule, error) {
+	var rule Rule
+	if err := json.Unmarshal(serializedrule, &rule); err != nil {
+		return nil, fmt.Errorf("unmarshaling json rule: %s (%w)", err, ErrInvalidRule)
+	}
+	if err := checkRule(u, &rule); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	rule.ID = id
+
+	rules, err := loadRules(u)
+	if err != nil {
+		return nil, err
+	}
+	rules = append(rules, rule)
+	return &rule, saveJSON(u, "/rules", rules)
+}
+
+// UpdateRule changes the fields present in serializedpatch. Errors:
+// ErrRuleNotFound, ErrInvalidRule, err
+func (api *API) UpdateRule(u db.Store, id string, serializedpatch []byte) (*Rule, error) {
+	rules, err := loadRules(u)
+	if err != nil {
+		return nil, err
+	}
+	i := findRule(rules, id)
+	if i == -1 {
+		return nil, ErrRuleNotFound
+	}
+
+	// decode the patch over a deep copy of the current rule, so that an
+	// invalid patch doesn't change it
+	content, err := json.Marshal(rules[i])
+	if err != nil {
+		return nil, err
+	}
+	var rule Rule
+	if err := json.Unmarshal(content, &rule); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(serializedpatch, &rule); err != nil {
+		return nil, fmt.Errorf("unmarshaling json rule: %s (%w)", err, ErrInvalidRule)
+	}
+	rule.ID = id
+
+	if err := checkRule(u, &rule); err != nil {
+		return nil, err
+	}
+	rules[i] = rule
+	return &rule, saveJSON(u, "/rules", rules)
+}
+
+// DeleteRule removes a rule. Errors: ErrRuleNotFound, err
+func (api *API) DeleteRule(u db.Store, id string) error {
+	rules, err := loadRules(u)
+	if err != nil {
+		return err
+	}
+	i := findRule(rules, id)
+	if i == -1 {
+		return ErrRuleNotFound
+	}
+	rules = append(rules[:i], rules[i+1:]...)
+	return saveJSON(u, "/rules", rules)
+}
+
+func findRule(rules []Rule, id string) int {
+	for i, rule := range rules {
+		if rule.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// ApplyRules applies the rules to every existing payment, and returns the
+// changes. If dryrun is true, nothing is saved
+func (api *API) ApplyRules(u db.Store, dryrun bool) ([]RuleChange, error) {
+	rs, err := loadRuleset(u)
+	if err != nil {
+		return nil, err
+	}
+	previous, nrecords, err := readPayments(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading payments: %s", err)
+	}
+	payments := copyPayments(previous)
+
+	var changes []RuleChange
+	for i := range payments {
+		before := copyPayment(payments[i])
+		if rs.apply(&payments[i]) {
+			changes = append(changes, RuleChange{
+				Before: before,
+				After:  payments[i],
+			})
+		}
+	}
+
+	if dryrun || len(changes) == 0 {
+		return changes, nil
+	}
+	return changes, savePayments(u, previous, nrecords, payments)
+}
+
+// copyPayment returns a copy of p which doesn't share its custom fields and
+// tags
+func copyPayment(p Payment) Payment {
+	if p.Custom != nil {
+		custom := make(map[string]string, len(p.Custom))
+		for key, value := range p.Custom {
+			custom[key] = value
+		}
+		p.Custom = custom
+	}
+	if p.Tags != nil {
+		p.Tags = append([]string(nil), p.Tags...)
+	}
+	p.Split = copySplit(p.Split)
+	return p
+}
+
+// copyPayments copies every payment, so that changing the copies doesn't
+// change the originals
+func copyPayments(payments []Payment) []Payment {
+	copies := make([]Payment, len(payments))
+	for i, p := range payments {
+		copies[i] = copyPayment(p)
+	}
+	return copies
+}
+
+// renameRulesCategory makes the rules follow a category which moved
+func renameRulesCategory(u db.Store, moved func(string) (string, bool)) error {
+	rules, err := loadRules(u)
+	if err != nil {
+		return err
+	}
+	for i, rule := range rules {
+		if path, ok := moved(rule.Category); ok {
+			rules[i].Category = path
+		}
+	}
+	return saveJSON(u, "/rules", rules)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	u, cleanup := newTestUser(t)
+	defer cleanup()
+	api := &API{}
+
+	if _, err := api.AddCategory(u, "Transport"); err != nil {
+		t.Fatalf("adding category: %s", err)
+	}
+
+	old, err := api.AddPayment(u, []byte(`{"name": "Uber trip", "amount": "12", "date": "2019-12-01"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+
+	if _, err := api.AddRule(u, []byte(`{"name": "nothing to do", "name_regex": "."}`)); !errors.Is(err, ErrInvalidRule) {
+		t.Errorf("rule without action should have ErrInvalidRule, got %v", err)
+	}
+	if _, err := api.AddRule(u, []byte(`{"name_regex": "(", "tags": ["a"]}`)); !errors.Is(err, ErrInvalidRule) {
+		t.Errorf("invalid regex should have ErrInvalidRule, got %v", err)
+	}
+	if _, err := api.AddRule(u, []byte(`{"name_regex": "a", "category": "Food"}`)); !errors.Is(err, ErrInvalidRule) {
+		t.Errorf("unknown category should have ErrInvalidRule, got %v", err)
+	}
+
+	rule, err := api.AddRule(u, []byte(`{"name": "rides", "name_regex": "(?i)uber|taxi", "max_amount": "50", "category": "Transport", "tags": ["travel"], "custom": {"reimbursable": "no"}}`))
+	if err != nil {
+		t.Fatalf("adding rule: %s", err)
+	}
+	if _, err := api.AddRule(u, []byte(`{"merchant": "ACME", "tags": ["work"]}`)); err != nil {
+		t.Fatalf("adding rule: %s", err)
+	}
+
+	taxi, err := api.AddPayment(u, []byte(`{"name": "taxi", "amount": "20", "date": "2019-12-02", "merchant": "acme", "reimbursable": "yes"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	if taxi.Category != "Transport" || len(taxi.Tags) != 2 || taxi.Custom["reimbursable"] != "yes" {
+		t.Errorf("rules should fill in category and tags, but not overwrite custom fields, got %+v", taxi)
+	}
+
+	expensive, err := api.AddPayment(u, []byte(`{"name": "taxi", "amount": "80", "date": "2019-12-02"}`))
+	if err != nil {
+		t.Fatalf("adding payment: %s", err)
+	}
+	if expensive.Category != "" {
+		t.Errorf("amount is above the rule's maximum, should have no category, got %q", expensive.Category)
+	}
+
+	changes, err := api.ApplyRules(u, true)
+	if err != nil {
+		t.Fatalf("applying rules (dry run): %s", err)
+	}
+	if len(changes) != 1 || changes[0].Before.ID != old.ID || changes[0].After.Category != "Transport" {
+		t.Fatalf("only the old payment should change, got %+v", changes)
+	}
+	payments, err := loadPayments(u)
+	if err != nil {
+		t.Fatalf("loading payments: %s", err)
+	}
+	if payments[0].Category != "" {
+		t.Errorf("dry run shouldn't save anything")
+	}
+
+	if _, err := api.ApplyRules(u, false); err != nil {
+		t.Fatalf("applying rules: %s", err)
+	}
+	if changes, _ := api.ApplyRules(u, true); len(changes) != 0 {
+		t.Errorf("applying rules twice shouldn't change anything, got %+v", changes)
+	}
+
+	if err := api.RenameCategory(u, "Transport", "Travel"); err != nil {
+		t.Fatalf("renaming category: %s", err)
+	}
+	rules, err := api.ListRules(u)
+	if err != nil {
+		t.Fatalf("listing rules: %s", err)
+	}
+	if rules[0].ID != rule.ID || rules[0].Category != "Travel" {
+		t.Errorf("rule should follow the renamed category, got %+v", rules[0])
+	}
+
+	updated, err := api.UpdateRule(u, rule.ID, []byte(`{"max_amount": null}`))
+	if err != nil {
+		t.Fatalf("updating rule: %s", err)
+	}
+	if updated.MaxAmount != nil || updated.Category != "Travel" {
+		t.Errorf("update should only remove the maximum amount, got %+v", updated)
+	}
+	if err := api.DeleteRule(u, rule.ID); err != nil {
+		t.Fatalf("deleting rule: %s", err)
+	}
+	if err := api.DeleteRule(u, rule.ID); !errors.Is(err, ErrRuleNotFound) {
+		t.Errorf("should have ErrRuleNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,461 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/math2001/money/db"
+)
+
+// paymentsVersion is the version of the schema of the /payments file. Bump it
+// every time you add a migration
+const paymentsVersion = 5
+
+// paymentsMigrations[i] upgrades payments from version i to version i+1. They
+// work on the raw JSON objects (and not on Payment) so that they keep working
+// when Payment changes
+var paymentsMigrations = []func(ps []map[string]interface{}, settings Settings) error{
+	migrateFreeForm,
+	migrateAssignIDs,
+	migrateExactAmounts,
+	migrateDefaultCurrency,
+	migrateDirection,
+}
+
+// paymentsFile is the content of the /payments file, where the payments were
+// all saved at once before they were in a log
+type paymentsFile struct {
+	Version  int
+	Payments []Payment
+}
+
+// paymentsLog is where the payments are (see paymentRecord)
+const paymentsLog = "/payments.log"
+
+// paymentRecord is a record of the payments log: a payment, which replaces the
+// one with the same id if there is one, or the deletion of a payment
+type paymentRecord struct {
+	// Version is the paymentsVersion the record was written with, so that old
+	// payments are upgraded as they are read
+	Version int             `json:"v"`
+	Payment json.RawMessage `json:"payment,omitempty"`
+	Deleted string          `json:"deleted,omitempty"`
+}
+
+// the payments log is compacted when it has more than compactRatio records
+// per payment. compactSlack keeps small logs from being compacted all the time
+const (
+	compactRatio = 2
+	compactSlack = 64
+)
+
+// loadPayments loads the user's payments, upgrading them if they were written
+// by an older version
+func loadPayments(u db.Store) ([]Payment, error) {
+	payments, _, err := readPayments(u)
+	return payments, err
+}
+
+// readPayments replays the payments log. It also returns the number of
+// records in the log. Payments still in the /payments file are only seen once
+// the store is migrated (see API.Migrate)
+func readPayments(u db.Store) ([]Payment, int, error) {
+	var payments []Payment
+	index := make(map[string]int)
+	deleted := make(map[int]bool)
+	var settings *Settings
+	nrecords := 0
+	err := u.ReadLog(paymentsLog, func(content []byte) error {
+		nrecords++
+		var record paymentRecord
+		if err := json.Unmarshal(content, &record); err != nil {
+			return fmt.Errorf("parsing record: %s", err)
+		}
+		if record.Deleted != "" {
+			if i, ok := index[record.Deleted]; ok {
+				deleted[i] = true
+				delete(index, record.Deleted)
+			}
+			return nil
+		}
+
+		raw := record.Payment
+		if record.Version > paymentsVersion {
+			return fmt.Errorf("payment has version %d, but this server only knows up to %d", record.Version, paymentsVersion)
+		} else if record.Version < paymentsVersion {
+			if settings == nil {
+				loaded, err := loadSettings(u)
+				if err != nil {
+					return fmt.Errorf("loading settings: %s", err)
+				}
+				settings = &loaded
+			}
+			upgraded, err := upgradePayments(record.Version, append(append([]byte("["), raw...), ']'), *settings)
+			if err != nil {
+				return fmt.Errorf("upgrading payment from version %d: %s", record.Version, err)
+			}
+			raw = upgraded[1 : len(upgraded)-1]
+		}
+		var p Payment
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return fmt.Errorf("parsing payment: %s", err)
+		}
+		if i, ok := index[p.ID]; ok {
+			payments[i] = p
+		} else {
+			index[p.ID] = len(payments)
+			payments = append(payments, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading payments: %s", err)
+	}
+
+	if len(deleted) > 0 {
+		kept := payments[:0]
+		for i, p := range payments {
+			if !deleted[i] {
+				kept = append(kept, p)
+			}
+		}
+		payments = kept
+	}
+	return payments, nrecords, nil
+}
+
+// moveLegacyPayments moves the payments from the /payments file (if there is
+// one) to the log, upgrading them if they were written by an older version.
+// The upgrades aren't all deterministic (IDs are random), so it's part of the
+// store's migration, which only runs once
+func moveLegacyPayments(u db.Store) error {
+	content, err := u.Load("/payments")
+	var patherr *os.PathError
+	if errors.As(err, &patherr) && os.IsNotExist(patherr) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("loading payments: %s", err)
+	}
+
+	version, raw, err := decodePaymentsFile(content)
+	if err != nil {
+		return fmt.Errorf("parsing payments: %s", err)
+	}
+
+	if version > paymentsVersion {
+		return fmt.Errorf("payments have version %d, but this server only knows up to %d", version, paymentsVersion)
+	}
+
+	if version < paymentsVersion {
+		log.Printf("upgrading payments of %s from version %d to %d", u, version, paymentsVersion)
+		settings, err := loadSettings(u)
+		if err != nil {
+			return fmt.Errorf("loading settings: %s", err)
+		}
+		raw, err = upgradePayments(version, raw, settings)
+		if err != nil {
+			return fmt.Errorf("upgrading payments from version %d: %s", version, err)
+		}
+	}
+
+	var payments []Payment
+	if err := json.Unmarshal(raw, &payments); err != nil {
+		return fmt.Errorf("parsing payments: %s", err)
+	}
+
+	// moving isn't a change the user made, it doesn't go in the history
+	log.Printf("moving payments of %s to the log", u)
+	if err := compactPayments(u, payments); err != nil {
+		return fmt.Errorf("saving upgraded payments: %s", err)
+	}
+	return u.Remove("/payments")
+}
+
+// savePayments saves the payments, and records what changed in the history.
+// previous and nrecords are what readPayments returned: payments is a changed
+// copy of previous (see copyPayments), which mustn't be modified
+func savePayments(u db.Store, previous []Payment, nrecords int, payments []Payment) error {
+	bumpVersions(previous, payments)
+	events := diffPayments(previous, payments)
+	// the history first: it's better to record a change which failed than
+	// to loose one
+	if err := recordChange(u, events, ""); err != nil {
+		return fmt.Errorf("recording history: %s", err)
+	}
+	return appendPayments(u, events, nrecords, payments)
+}
+
+// bumpVersions sets the version of the payments, which go up if they changed
+// since previous
+func bumpVersions(previous, payments []Payment) {
+	before := make(map[string]*Payment, len(previous))
+	for i := range previous {
+		before[previous[i].ID] = &previous[i]
+	}
+	for i := range payments {
+		p := &payments[i]
+		old, ok := before[p.ID]
+		if !ok {
+			// a new payment (version 0), or a deleted one brought back by
+			// undo, which goes on from the version it had
+			p.Version++
+			continue
+		}
+		p.Version = old.Version
+		if !samePayment(old, p) {
+			p.Version++
+		}
+	}
+}
+
+// appendPayments appends the changes to the payments log (which has nrecords
+// records). The log is compacted when most of its records are outdated
+func appendPayments(u db.Store, events []PaymentEvent, nrecords int, payments []Payment) error {
+	var records [][]byte
+	for _, e := range events {
+		record := paymentRecord{Version: paymentsVersion}
+		if e.After == nil {
+			record.Deleted = e.PaymentID
+		} else {
+			raw, err := json.Marshal(e.After)
+			if err != nil {
+				return fmt.Errorf("json encoding payment: %s", err)
+			}
+			record.Payment = raw
+		}
+		content, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("json encoding record: %s", err)
+		}
+		records = append(records, content)
+	}
+
+	if nrecords+len(records) > compactRatio*len(payments)+compactSlack {
+		return compactPayments(u, payments)
+	}
+	if err := u.Append(paymentsLog, records...); err != nil {
+		return fmt.Errorf("saving payments to db: %s", err)
+	}
+	return nil
+}
+
+// compactPayments replaces the payments log with a record per payment
+func compactPayments(u db.Store, payments []Payment) error {
+	records := make([][]byte, 0, len(payments))
+	for _, p := range payments {
+		raw, err := json.Marshal(p)
+		if err != nil {
+			return fmt.Errorf("json encoding payment: %s", err)
+		}
+		content, err := json.Marshal(paymentRecord{Version: paymentsVersion, Payment: raw})
+		if err != nil {
+			return fmt.Errorf("json encoding record: %s", err)
+		}
+		records = append(records, content)
+	}
+	if err := u.Compact(paymentsLog, records); err != nil {
+		return fmt.Errorf("compacting payments: %s", err)
+	}
+	return nil
+}
+
+// decodePaymentsFile returns the version of the file and the raw list of
+// payments. Before versioning, the file was just a list of payments
+func decodePaymentsFile(content []byte) (int, json.RawMessage, error) {
+	content = bytes.TrimSpace(content)
+	if len(content) > 0 && content[0] == '[' {
+		return 0, content, nil
+	}
+
+	var file struct {
+		Version  int
+		Payments json.RawMessage
+	}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return 0, nil, err
+	}
+	if file.Version == 0 {
+		return 0, nil, errors.New("missing version")
+	}
+	return file.Version, file.Payments, nil
+}
+
+func upgradePayments(version int, raw json.RawMessage, settings Settings) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	// keep the numbers as they were written (no float64 rounding)
+	decoder.UseNumber()
+
+	var ps []map[string]interface{}
+	if err := decoder.Decode(&ps); err != nil {
+		return nil, err
+	}
+
+	for ; version < paymentsVersion; version++ {
+		if err := paymentsMigrations[version](ps, settings); err != nil {
+			return nil, fmt.Errorf("migration %d -> %d: %s", version, version+1, err)
+		}
+	}
+
+	return json.Marshal(ps)
+}
+
+// migrateFreeForm upgrades the payments from when they were free form
+// objects, with only name, amount and date required. Unknown fields are moved
+// to "custom", and the dates are normalized to YYYY-MM-DD
+func migrateFreeForm(ps []map[string]interface{}, settings Settings) error {
+	// the fields of version 1 (not knownPaymentFields, it changes)
+	known := map[string]bool{
+		"id": true, "name": true, "amount": true, "currency": true,
+		"date": true, "category": true, "notes": true, "custom": true,
+	}
+	for _, p := range ps {
+		custom := make(map[string]interface{})
+		for key, value := range p {
+			if known[key] {
+				continue
+			}
+			raw, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			custom[key] = customValue(raw)
+			delete(p, key)
+		}
+
+		switch date := p["date"].(type) {
+		case string:
+			normalized, ok := normalizeLegacyDate(date)
+			if !ok {
+				// we don't loose it, but the user will have to fix it
+				custom["original date"] = date
+			}
+			p["date"] = normalized
+		case nil:
+			p["date"] = ""
+		default:
+			custom["original date"] = fmt.Sprint(date)
+			p["date"] = ""
+		}
+
+		if _, ok := p["amount"].(json.Number); !ok {
+			if amount, ok := p["amount"]; ok {
+				custom["original amount"] = fmt.Sprint(amount)
+			}
+			p["amount"] = json.Number("0")
+		}
+
+		for _, key := range []string{"id", "name", "currency", "category", "notes"} {
+			if _, ok := p[key]; ok {
+				p[key] = fmt.Sprint(p[key])
+			}
+		}
+
+		if len(custom) > 0 {
+			p["custom"] = custom
+		}
+	}
+	return nil
+}
+
+// normalizeLegacyDate tries the formats that the pwa might have sent before
+// dates were validated
+func normalizeLegacyDate(date string) (string, bool) {
+	for _, layout := range []string{dateLayout, time.RFC3339, "2006/01/02", "02/01/2006"} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return NewDate(t).String(), true
+		}
+	}
+	return "", false
+}
+
+// migrateAssignIDs gives an ID to the payments created before they had one
+func migrateAssignIDs(ps []map[string]interface{}, settings Settings) error {
+	for _, p := range ps {
+		if id, ok := p["id"].(string); ok && id != "" {
+			continue
+		}
+		id, err := newID()
+		if err != nil {
+			return err
+		}
+		p["id"] = id
+	}
+	return nil
+}
+
+// migrateExactAmounts converts the float amounts to decimal strings, rounded
+// to the currency's minor unit
+func migrateExactAmounts(ps []map[string]interface{}, settings Settings) error {
+	for _, p := range ps {
+		currency, _ := p["currency"].(string)
+		number, ok := p["amount"].(json.Number)
+		if !ok {
+			return fmt.Errorf("amount of payment %v isn't a number", p["id"])
+		}
+		r, ok := new(big.Rat).SetString(number.String())
+		if !ok {
+			return fmt.Errorf("invalid amount %q", number)
+		}
+		scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(currencyExponent(currency))), nil))
+		r.Mul(r, scale)
+		m, err := moneyFromUnits(roundRat(r), currencyExponent(currency))
+		if err != nil {
+			return fmt.Errorf("amount of payment %v: %s", p["id"], err)
+		}
+		p["amount"] = m.String()
+	}
+	return nil
+}
+
+// migrateDefaultCurrency sets the currency of the payments which don't have
+// one to the user's base currency, and rounds their amount to it
+func migrateDefaultCurrency(ps []map[string]interface{}, settings Settings) error {
+	for _, p := range ps {
+		if currency, ok := p["currency"].(string); ok && currency != "" {
+			continue
+		}
+		p["currency"] = settings.BaseCurrency
+
+		amount, ok := p["amount"].(string)
+		if !ok {
+			return fmt.Errorf("amount of payment %v isn't a string", p["id"])
+		}
+		m, err := ParseMoney(amount)
+		if err != nil {
+			return err
+		}
+		if m, err = m.Rescale(currencyExponent(settings.BaseCurrency)); err != nil {
+			return fmt.Errorf("amount of payment %v: %s", p["id"], err)
+		}
+		p["amount"] = m.String()
+	}
+	return nil
+}
+
+// migrateDirection gives every payment a direction. Before, income was entered
+// as negative expenses, so those become income
+func migrateDirection(ps []map[string]interface{}, settings Settings) error {
+	for _, p := range ps {
+		amount, ok := p["amount"].(string)
+		if !ok {
+			return fmt.Errorf("amount of payment %v isn't a string", p["id"])
+		}
+		m, err := ParseMoney(amount)
+		if err != nil {
+			return err
+		}
+		if m.Sign() < 0 {
+			p["direction"] = DirectionIncome
+			p["amount"] = m.Neg().String()
+		} else {
+			p["direction"] = DirectionExpense
+		}
+	}
+	return nil
+}
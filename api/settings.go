@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrInvalidSettings tags errors caused by settings given by the user
+var ErrInvalidSettings = errors.New("invalid settings")
+
+// defaultBaseCurrency is the currency users start with
+const defaultBaseCurrency = "AUD"
+
+// Settings are the user's preferences
+type Settings struct {
+	// BaseCurrency is the currency payments without currency are in, and the
+	// one every total is converted to
+	BaseCurrency string `json:"base_currency"`
+	// StrictDuplicates refuses new payments which look like existing ones,
+	// unless they are forced
+	StrictDuplicates bool `json:"strict_duplicates"`
+}
+
+func loadSettings(u db.Store) (Settings, error) {
+	settings := Settings{
+		BaseCurrency: defaultBaseCurrency,
+	}
+	if _, err := loadJSON(u, "/settings", &settings); err != nil {
+		return settings, err
+	}
+	return settings, nil
+}
+
+// GetSettings returns the user's settings (the default ones if he never
+// changed them)
+func (api *API) GetSettings(u db.Store) (Settings, error) {
+	return loadSettings(u)
+}
+
+// UpdateSettings changes the settings present in serializedsettings. Errors:
+// ErrInvalidSettings, err
+func (api *API) UpdateSettings(u db.Store, serializedsettings []byte) (Settings, error) {
+	settings, err := loadSettings(u)
+	if err != nil {
+		return settings, err
+	}
+
+	if err := json.Unmarshal(serializedsettings, &settings); err != nil {
+		return settings, fmt.Errorf("unmarshaling json settings: %s (%w)", err, ErrInvalidSettings)
+	}
+
+	if !currencyRegexp.MatchString(settings.BaseCurrency) {
+		return settings, fmt.Errorf("base currency should be a 3 letter ISO 4217 code, got %q (%w)", settings.BaseCurrency, ErrInvalidSettings)
+	}
+
+	return settings, saveJSON(u, "/settings", settings)
+}
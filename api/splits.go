@@ -0,0 +1,553 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"sort"
+
+	"github.com/math2001/money/db"
+)
+
+// ErrInvalidSettlement tags errors caused by a settlement given by the user
+var ErrInvalidSettlement = errors.New("invalid settlement")
+
+var ErrSettlementNotFound = errors.New("settlement not found")
+
+// the ways a payment can be split
+const (
+	SplitEqual      = "equal"
+	SplitPercentage = "percentage"
+	SplitExact      = "exact"
+)
+
+// Split says which member of a shared ledger paid for a payment, and how it is
+// shared between the members
+type Split struct {
+	// PaidBy is the id of the member who paid
+	PaidBy int     `json:"paid_by"`
+	Method string  `json:"method"`
+	Shares []Share `json:"shares"`
+}
+
+// Share is a member's part of a split payment
+type Share struct {
+	UserID int `json:"user_id"`
+	// Percent is the member's part with the percentage method
+	Percent Money `json:"percent"`
+	// Amount is the member's part of the payment. It's given with the exact
+	// method, and computed with the others
+	Amount Money `json:"amount"`
+}
+
+// Settlement is money a member gave an other one to settle up
+type Settlement struct {
+	ID       string `json:"id"`
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+	Amount   Money  `json:"amount"`
+	Currency string `json:"currency"`
+	Date     Date   `json:"date"`
+	Notes    string `json:"notes,omitempty"`
+}
+
+// MemberBalance is what a member is owed in a currency. It's negative when
+// they owe money
+type MemberBalance struct {
+	UserID   int    `json:"user_id"`
+	Email    string `json:"email"`
+	Currency string `json:"currency"`
+	Balance  Money  `json:"balance"`
+}
+
+// SettleTransfer is money a member should give an other to settle up
+type SettleTransfer struct {
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+	Amount   Money  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// SplitBalances is who owes whom in a shared ledger
+type SplitBalances struct {
+	// Balances leaves out the members who are settled up
+	Balances []MemberBalance `json:"balances"`
+	// Transfers settle every balance
+	Transfers []SettleTransfer `json:"transfers"`
+}
+
+func copySplit(s *Split) *Split {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	c.Shares = append([]Share(nil), s.Shares...)
+	return &c
+}
+
+func isMember(members []LedgerMember, userid int) bool {
+	for _, m := range members {
+		if m.ID == userid {
+			return true
+		}
+	}
+	return false
+}
+
+// allocate divides amount in parts proportional to weights. The parts add up
+// to amount exactly: the minor units left over by rounding down go to the
+// parts which lost the most (the first ones on ties)
+func allocate(amount Money, weights []*big.Rat) []Money {
+	total := new(big.Rat)
+	for _, w := range weights {
+		total.Add(total, w)
+	}
+	units, sign := amount.Units, int64(1)
+	if units < 0 {
+		units, sign = -units, -1
+	}
+
+	parts := make([]Money, len(weights))
+	remainders := make([]*big.Rat, len(weights))
+	var allocated int64
+	for i, w := range weights {
+		exact := new(big.Rat).Mul(new(big.Rat).SetInt64(units), w)
+		exact.Quo(exact, total)
+		floor := new(big.Int).Quo(exact.Num(), exact.Denom())
+		parts[i] = Money{Units: floor.Int64(), Exponent: amount.Exponent}
+		remainders[i] = exact.Sub(exact, new(big.Rat).SetInt(floor))
+		allocated += floor.Int64()
+	}
+
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return remainders[order[i]].Cmp(remainders[order[j]]) > 0
+	})
+	for k := 0; allocated < units; k++ {
+		parts[order[k%len(order)]].Units++
+		allocated++
+	}
+
+	for i := range parts {
+		parts[i].Units *= sign
+	}
+	return parts
+}
+
+// splitPayment checks the payment's split, and computes the amount of every
+// share. The payment's amount must be normalized. Errors: ErrInvalidPayment
+func splitPayment(u db.Store, p *Payment) error {
+	s := p.Split
+	if s == nil {
+		return nil
+	}
+	members := storeMembers(u)
+	if members == nil {
+		return fmt.Errorf("payments can only be split in a shared ledger (%w)", ErrInvalidPayment)
+	}
+	if !isMember(members, s.PaidBy) {
+		return fmt.Errorf("'paid_by' should be a member of the ledger, got %d (%w)", s.PaidBy, ErrInvalidPayment)
+	}
+	if len(s.Shares) == 0 {
+		return fmt.Errorf("a split needs 'shares' (%w)", ErrInvalidPayment)
+	}
+	seen := make(map[int]bool)
+	for _, share := range s.Shares {
+		if !isMember(members, share.UserID) {
+			return fmt.Errorf("shares should be for members of the ledger, got %d (%w)", share.UserID, ErrInvalidPayment)
+		}
+		if seen[share.UserID] {
+			return fmt.Errorf("member %d has several shares (%w)", share.UserID, ErrInvalidPayment)
+		}
+		seen[share.UserID] = true
+	}
+
+	switch s.Method {
+	case SplitEqual:
+		weights := make([]*big.Rat, len(s.Shares))
+		for i := range weights {
+			weights[i] = big.NewRat(1, 1)
+		}
+		for i, amount := range allocate(p.Amount, weights) {
+			s.Shares[i].Percent = Money{}
+			s.Shares[i].Amount = amount
+		}
+	case SplitPercentage:
+		weights := make([]*big.Rat, len(s.Shares))
+		total := Money{}
+		for i, share := range s.Shares {
+			if share.Percent.Sign() <= 0 {
+				return fmt.Errorf("percentages should be positive, got %s (%w)", share.Percent, ErrInvalidPayment)
+			}
+			weights[i] = share.Percent.rat()
+			var err error
+			if total, err = total.Add(share.Percent); err != nil {
+				return fmt.Errorf("percentages: %s (%w)", err, ErrInvalidPayment)
+			}
+		}
+		if total.Cmp(Money{Units: 100}) != 0 {
+			return fmt.Errorf("percentages should add up to 100, got %s (%w)", total, ErrInvalidPayment)
+		}
+		for i, amount := range allocate(p.Amount, weights) {
+			s.Shares[i].Amount = amount
+		}
+	case SplitExact:
+		total := Money{}
+		for i, share := range s.Shares {
+			amount, err := rescaleAmount(share.Amount, p.Currency)
+			if err != nil {
+				return fmt.Errorf("share of %d %s (%w)", share.UserID, err, ErrInvalidPayment)
+			}
+			s.Shares[i].Percent = Money{}
+			s.Shares[i].Amount = amount
+			if total, err = total.Add(amount); err != nil {
+				return fmt.Errorf("shares: %s (%w)", err, ErrInvalidPayment)
+			}
+		}
+		if total.Cmp(p.Amount) != 0 {
+			return fmt.Errorf("shares should add up to %s, got %s (%w)", p.Amount, total, ErrInvalidPayment)
+		}
+	default:
+		return fmt.Errorf("split 'method' should be %q, %q or %q, got %q (%w)", SplitEqual, SplitPercentage, SplitExact, s.Method, ErrInvalidPayment)
+	}
+	return nil
+}
+
+func loadSettlements(u db.Store) ([]Settlement, error) {
+	var settlements []Settlement
+	if _, err := loadJSON(u, "/settlements", &settlements); err != nil {
+		return nil, err
+	}
+	return settlements, nil
+}
+
+// checkSettlement fills in the currency, and makes sure the settlement is
+// between two members of the ledger. Former members who still have a share in
+// some payments can settle up too. Errors: ErrInvalidSettlement, err
+func checkSettlement(u db.Store, s *Settlement) error {
+	members := storeMembers(u)
+	if members == nil {
+		return fmt.Errorf("settlements are only for shared ledgers (%w)", ErrInvalidSettlement)
+	}
+	payments, err := loadPayments(u)
+	if err != nil {
+		return fmt.Errorf("loading payments: %s", err)
+	}
+	known := make(map[int]bool)
+	for _, m := range members {
+		known[m.ID] = true
+	}
+	for _, p := range payments {
+		if p.Split == nil {
+			continue
+		}
+		known[p.Split.PaidBy] = true
+		for _, share := range p.Split.Shares {
+			known[share.UserID] = true
+		}
+	}
+	if !known[s.From] || !known[s.To] {
+		return fmt.Errorf("'from' and 'to' should be members of the ledger (%w)", ErrInvalidSettlement)
+	}
+	if s.From == s.To {
+		return fmt.Errorf("'from' and 'to' should be different members (%w)", ErrInvalidSettlement)
+	}
+	if s.Date.IsZero() {
+		return fmt.Errorf("need 'date' field (%w)", ErrInvalidSettlement)
+	}
+	if s.Currency == "" {
+		settings, err := loadSettings(u)
+		if err != nil {
+			return fmt.Errorf("loading settings: %s", err)
+		}
+		s.Currency = settings.BaseCurrency
+	}
+	if !currencyRegexp.MatchString(s.Currency) {
+		return fmt.Errorf("'currency' should be a 3 letter ISO 4217 code, got %q (%w)", s.Currency, ErrInvalidSettlement)
+	}
+	if s.Amount.Sign() <= 0 {
+		return fmt.Errorf("need a positive 'amount' (%w)", ErrInvalidSettlement)
+	}
+	amount, err := rescaleAmount(s.Amount, s.Currency)
+	if err != nil {
+		return fmt.Errorf("'amount' %s (%w)", err, ErrInvalidSettlement)
+	}
+	s.Amount = amount
+	return nil
+}
+
+// ListSettlements returns the ledger's settlements, sorted by date
+func (api *API) ListSettlements(u db.Store) ([]Settlement, error) {
+	settlements, err := loadSettlements(u)
+	if err != nil {
+		return nil, err
+	}
+	sorted := append([]Settlement{}, settlements...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Date.Before(sorted[j].Date.Time)
+	})
+	return sorted, nil
+}
+
+// AddSettlement records money a member gave an other to settle up. Errors:
+// ErrInvalidSettlement, err
+func (api *API) AddSettlement(u db.Store, serializedsettlement []byte) (*Settlement, error) {
+	var settlement Settlement
+	if err := json.Unmarshal(serializedsettlement, &settlement); err != nil {
+		return nil, fmt.Errorf("unmarshaling json settlement: %s (%w)", err, ErrInvalidSettlement)
+	}
+	if err := checkSettlement(u, &settlement); err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	settlement.ID = id
+
+	settlements, err := loadSettlements(u)
+	if err != nil {
+		return nil, err
+	}
+	settlements = append(settlements, settlement)
+	return &settlement, saveJSON(u, "/settlements", settlements)
+}
+
+// DeleteSettlement removes a settlement (recorded by mistake for example).
+// Errors: ErrSettlementNotFound, err
+func (api *API) DeleteSettlement(u db.Store, id string) error {
+	settlements, err := loadSettlements(u)
+	if err != nil {
+		return err
+	}
+	for i, s := range settlements {
+		if s.ID == id {
+			settlements = append(settlements[:i], settlements[i+1:]...)
+			return saveJSON(u, "/settlements", settlements)
+		}
+	}
+	return ErrSettlementNotFound
+}
+
+// SplitBalances returns what every member is owed (or owes) in each currency,
+// and the transfers which would settle up. The member who paid for a split
+// payment is owed its amount, and every member owes their share (it's the
+// other way around for income). Settlements move money back from the member
+// who received it
+func (api *API) SplitBalances(u db.Store) (*SplitBalances, error) {
+	payments, err := loadPayments(u)
+	if err != nil {
+		return nil, fmt.Errorf("loading payments: %s", err)
+	}
+	settlements, err := loadSettlements(u)
+	if err != nil {
+		return nil, err
+	}
+
+	// currency -> user id -> balance
+	balances := make(map[string]map[int]Money)
+	add := func(currency string, userid int, amount Money) error {
+		if balances[currency] == nil {
+			balances[currency] = make(map[int]Money)
+		}
+		balance, err := balances[currency][userid].Add(amount)
+		if err != nil {
+			return fmt.Errorf("balance of %d in %s: %s", userid, currency, err)
+		}
+		balances[currency][userid] = balance
+		return nil
+	}
+	for _, p := range payments {
+		if p.Split == nil {
+			continue
+		}
+		// the payer is owed what the payment cost, the members owe their
+		// shares
+		if err := add(p.Currency, p.Split.PaidBy, p.spending()); err != nil {
+			return nil, err
+		}
+		for _, share := range p.Split.Shares {
+			owed := share.Amount.Neg()
+			if p.Direction == DirectionIncome {
+				owed = share.Amount
+			}
+			if err := add(p.Currency, share.UserID, owed); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, s := range settlements {
+		if err := add(s.Currency, s.From, s.Amount); err != nil {
+			return nil, err
+		}
+		if err := add(s.Currency, s.To, s.Amount.Neg()); err != nil {
+			return nil, err
+		}
+	}
+
+	emails := make(map[int]string)
+	for _, m := range storeMembers(u) {
+		emails[m.ID] = m.Email
+	}
+	result := &SplitBalances{
+		Balances:  []MemberBalance{},
+		Transfers: []SettleTransfer{},
+	}
+	for currency, byuser := range balances {
+		var nonzero []MemberBalance
+		for userid, balance := range byuser {
+			if balance.IsZero() {
+				continue
+			}
+			nonzero = append(nonzero, MemberBalance{
+				UserID:   userid,
+				Email:    emails[userid],
+				Currency: currency,
+				Balance:  balance,
+			})
+		}
+		result.Balances = append(result.Balances, nonzero...)
+		result.Transfers = append(result.Transfers, settleUp(currency, nonzero)...)
+	}
+	sort.Slice(result.Balances, func(i, j int) bool {
+		a, b := result.Balances[i], result.Balances[j]
+		if a.Currency != b.Currency {
+			return a.Currency < b.Currency
+		}
+		return a.UserID < b.UserID
+	})
+	sort.SliceStable(result.Transfers, func(i, j int) bool {
+		return result.Transfers[i].Currency < result.Transfers[j].Currency
+	})
+	return result, nil
+}
+
+// maxExactSettle is the most members settleUp finds the fewest transfers for:
+// it takes 2^n steps
+const maxExactSettle = 15
+
+// settleUp returns transfers which settle the balances (which add up to zero),
+// as few as possible. The members are split in as many groups whose balances
+// add up to zero as possible, and each group settles on its own, with one
+// transfer less than it has members. That's the fewest transfers, but finding
+// the groups is NP-hard: with more than maxExactSettle members, everyone is
+// settled as a single group (one transfer less than there are members)
+func settleUp(currency string, balances []MemberBalance) []SettleTransfer {
+	balances = append([]MemberBalance(nil), balances...)
+	sort.Slice(balances, func(i, j int) bool {
+		return balances[i].UserID < balances[j].UserID
+	})
+	var transfers []SettleTransfer
+	for _, group := range zeroSumGroups(balances) {
+		transfers = append(transfers, settleGroup(currency, group)...)
+	}
+	return transfers
+}
+
+// zeroSumGroups splits the balances in as many groups adding up to zero as
+// possible. There is a single group if there are more than maxExactSettle
+// balances, or if their sums overflow
+func zeroSumGroups(balances []MemberBalance) [][]MemberBalance {
+	n := len(balances)
+	if n > maxExactSettle {
+		return [][]MemberBalance{balances}
+	}
+	// the subsets of balances are bit masks
+	sums := make([]Money, 1<<n)
+	for mask := 1; mask < len(sums); mask++ {
+		i := bits.TrailingZeros(uint(mask))
+		var err error
+		if sums[mask], err = sums[mask&(mask-1)].Add(balances[i].Balance); err != nil {
+			return [][]MemberBalance{balances}
+		}
+	}
+	// groups[mask] is the most prefixes adding up to zero an ordering of mask
+	// can have. If mask adds up to zero, each of those prefixes ends a group
+	groups := make([]int, 1<<n)
+	for mask := 1; mask < len(groups); mask++ {
+		for i := 0; i < n; i++ {
+			if mask&(1<<i) != 0 && groups[mask^(1<<i)] > groups[mask] {
+				groups[mask] = groups[mask^(1<<i)]
+			}
+		}
+		if sums[mask].IsZero() {
+			groups[mask]++
+		}
+	}
+
+	// take the balances back out in that ordering
+	var result [][]MemberBalance
+	var group []MemberBalance
+	for mask := len(groups) - 1; mask != 0; {
+		rest := groups[mask]
+		if sums[mask].IsZero() {
+			rest--
+		}
+		for i := 0; i < n; i++ {
+			if mask&(1<<i) != 0 && groups[mask^(1<<i)] == rest {
+				group = append(group, balances[i])
+				mask ^= 1 << i
+				break
+			}
+		}
+		if sums[mask].IsZero() {
+			result = append(result, group)
+			group = nil
+		}
+	}
+	return result
+}
+
+// settleGroup returns transfers which settle the balances: the biggest debtor
+// pays the biggest creditor as much as they can, until everyone is settled.
+// That's at most one transfer less than there are members
+func settleGroup(currency string, balances []MemberBalance) []SettleTransfer {
+	var creditors, debtors []MemberBalance
+	for _, b := range balances {
+		if b.Balance.Sign() > 0 {
+			creditors = append(creditors, b)
+		} else if b.Balance.Sign() < 0 {
+			b.Balance = b.Balance.Neg()
+			debtors = append(debtors, b)
+		}
+	}
+	biggestFirst := func(list []MemberBalance) {
+		sort.Slice(list, func(i, j int) bool {
+			if c := list[i].Balance.Cmp(list[j].Balance); c != 0 {
+				return c > 0
+			}
+			return list[i].UserID < list[j].UserID
+		})
+	}
+	biggestFirst(creditors)
+	biggestFirst(debtors)
+
+	var transfers []SettleTransfer
+	for i, j := 0, 0; i < len(debtors) && j < len(creditors); {
+		amount := debtors[i].Balance
+		if creditors[j].Balance.Cmp(amount) < 0 {
+			amount = creditors[j].Balance
+		}
+		transfers = append(transfers, SettleTransfer{
+			From:     debtors[i].UserID,
+			To:       creditors[j].UserID,
+			Amount:   amount,
+			Currency: currency,
+		})
+		// amount is at most both balances, so this can't overflow
+		debtors[i].Balance, _ = debtors[i].Balance.Sub(amount)
+		creditors[j].Balance, _ = creditors[j].Balance.Sub(amount)
+		if debtors[i].Balance.IsZero() {
+			i++
+		}
+		if creditors[j].Balance.IsZero() {
+			j++
+		}
+	}
+	return transfers
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+func TestAllocate(t *testing.T) {
+	cases := []struct {
+		amount  Money
+		weights []int64
+		parts   []string
+	}{
+		{Money{1000, 2}, []int64{1, 1, 1}, []string{"3.34", "3.33", "3.33"}},
+		{Money{-1000, 2}, []int64{1, 1, 1}, []string{"-3.34", "-3.33", "-3.33"}},
+		{Money{100, 0}, []int64{1, 2, 1}, []string{"25", "50", "25"}},
+		{Money{1, 2}, []int64{1, 1}, []string{"0.01", "0.00"}},
+		// 3.33 and 6.67: the second one lost more when rounding down
+		{Money{1000, 2}, []int64{1, 2}, []string{"3.33", "6.67"}},
+	}
+	for _, c := range cases {
+		var weights []*big.Rat
+		for _, w := range c.weights {
+			weights = append(weights, big.NewRat(w, 1))
+		}
+		parts := allocate(c.amount, weights)
+		got := fmt.Sprint(parts)
+		if want := fmt.Sprint(c.parts); got != want {
+			t.Errorf("allocate(%s, %v): should have %s, got %s", c.amount, c.weights, want, got)
+		}
+	}
+}
+
+func TestSettleUp(t *testing.T) {
+	cases := []struct {
+		balances  []int64
+		transfers int
+	}{
+		{[]int64{10, -10}, 1},
+		{[]int64{6, 4, -5, -3, -2}, 4},
+		// paying the biggest creditor first would take 5 transfers, but
+		// {5, -3, -2} and {5, -4, -1} settle on their own
+		{[]int64{5, 5, -3, -2, -4, -1}, 4},
+		{[]int64{1, 2, 3, -1, -2, -3}, 3},
+	}
+	for _, c := range cases {
+		var balances []MemberBalance
+		for i, b := range c.balances {
+			balances = append(balances, MemberBalance{UserID: i + 1, Balance: Money{b, 0}})
+		}
+		transfers := settleUp("AUD", balances)
+		if len(transfers) != c.transfers {
+			t.Errorf("settling %v: should have %d transfers, got %v", c.balances, c.transfers, transfers)
+		}
+		settled := make(map[int]Money)
+		for _, b := range balances {
+			settled[b.UserID] = b.Balance
+		}
+		for _, transfer := range transfers {
+			settled[transfer.From], _ = settled[transfer.From].Add(transfer.Amount)
+			settled[transfer.To], _ = settled[transfer.To].Sub(transfer.Amount)
+		}
+		for userid, balance := range settled {
+			if !balance.IsZero() {
+				t.Errorf("settling %v: user %d should be settled, got %s", c.balances, userid, balance)
+			}
+		}
+	}
+}
+
+func TestSplits(t *testing.T) {
+	api, users, cleanup := newTestLedgersAPI(t, "a@example.com", "b@example.com", "c@example.com")
+	defer cleanup()
+	a, b, c := users[0], users[1], users[2]
+
+	l, err := api.CreateLedger(a, "Flat")
+	if err != nil {
+		t.Fatalf("creating ledger: %s", err)
+	}
+	for _, u := range users[1:] {
+		if _, err := api.InviteMember(a, l.ID, u.Email); err != nil {
+			t.Fatalf("inviting %s: %s", u.Email, err)
+		}
+		if _, err := api.AcceptInvite(u, l.ID); err != nil {
+			t.Fatalf("accepting invite: %s", err)
+		}
+	}
+	store, err := api.OpenLedger(a, l.ID)
+	if err != nil {
+		t.Fatalf("opening ledger: %s", err)
+	}
+
+	if _, err := api.AddPayment(a, []byte(`{"name": "x", "amount": "10", "date": "2020-03-01", "split": {"paid_by": 1, "method": "equal", "shares": [{"user_id": 1}]}}`)); !errors.Is(err, ErrInvalidPayment) {
+		t.Errorf("split outside of a ledger: should have ErrInvalidPayment, got %v", err)
+	}
+	invalid := []string{
+		`{"paid_by": 4, "method": "equal", "shares": [{"user_id": 1}]}`,
+		`{"paid_by": 1, "method": "equal", "shares": []}`,
+		`{"paid_by": 1, "method": "equal", "shares": [{"user_id": 1}, {"user_id": 1}]}`,
+		`{"paid_by": 1, "method": "percentage", "shares": [{"user_id": 1, "percent": "60"}, {"user_id": 2, "percent": "30"}]}`,
+		`{"paid_by": 1, "method": "exact", "shares": [{"user_id": 1, "amount": "5"}, {"user_id": 2, "amount": "4"}]}`,
+		`{"paid_by": 1, "method": "thirds", "shares": [{"user_id": 1}]}`,
+	}
+	for _, split := range invalid {
+		payment := fmt.Sprintf(`{"name": "x", "amount": "10", "date": "2020-03-01", "split": %s}`, split)
+		if _, err := api.AddPayment(store, []byte(payment)); !errors.Is(err, ErrInvalidPayment) {
+			t.Errorf("%s: should have ErrInvalidPayment, got %v", split, err)
+		}
+	}
+
+	// a pays 90 for everyone, b pays 30 for b and c (60/40), c gets a 12
+	// refund for a and c
+	payments := []string{
+		`{"name": "groceries", "amount": "90", "date": "2020-03-01", "split": {"paid_by": 1, "method": "equal", "shares": [{"user_id": 1}, {"user_id": 2}, {"user_id": 3}]}}`,
+		`{"name": "internet", "amount": "30", "date": "2020-03-02", "split": {"paid_by": 2, "method": "percentage", "shares": [{"user_id": 2, "percent": "60"}, {"user_id": 3, "percent": "40"}]}}`,
+		`{"name": "refund", "amount": "12", "direction": "income", "date": "2020-03-03", "split": {"paid_by": 3, "method": "exact", "shares": [{"user_id": 1, "amount": "5"}, {"user_id": 3, "amount": "7"}]}}`,
+	}
+	var ids []string
+	for _, serialized := range payments {
+		p, err := api.AddPayment(store, []byte(serialized))
+		if err != nil {
+			t.Fatalf("adding payment: %s", err)
+		}
+		ids = append(ids, p.ID)
+	}
+	p, err := api.UpdatePayment(store, ids[1], []byte(`{"name": "fibre"}`))
+	if err != nil {
+		t.Fatalf("updating payment: %s", err)
+	}
+	if got := fmt.Sprint(p.Split.Shares[0].Amount, p.Split.Shares[1].Amount); got != "18.00 12.00" {
+		t.Errorf("should keep the split on update, got %s", got)
+	}
+
+	// a: 90 - 30 + 5, b: -30 + 30 - 18, c: -30 - 12 - 12 (the refund they
+	// received) + 7
+	balances, err := api.SplitBalances(store)
+	if err != nil {
+		t.Fatalf("computing balances: %s", err)
+	}
+	want := map[int]string{1: "65.00", 2: "-18.00", 3: "-47.00"}
+	if len(balances.Balances) != len(want) {
+		t.Fatalf("should have %d balances, got %+v", len(want), balances.Balances)
+	}
+	for _, balance := range balances.Balances {
+		if balance.Balance.String() != want[balance.UserID] || balance.Currency != "AUD" {
+			t.Errorf("user %d: should have %s AUD, got %s %s", balance.UserID, want[balance.UserID], balance.Balance, balance.Currency)
+		}
+	}
+	if got := fmt.Sprint(balances.Transfers); got != "[{3 1 47.00 AUD} {2 1 18.00 AUD}]" {
+		t.Errorf("should have c and b pay a, got %s", got)
+	}
+
+	if _, err := api.AddSettlement(store, []byte(`{"from": 2, "to": 2, "amount": "18", "date": "2020-03-05"}`)); !errors.Is(err, ErrInvalidSettlement) {
+		t.Errorf("settling with oneself: should have ErrInvalidSettlement, got %v", err)
+	}
+	if _, err := api.AddSettlement(b, []byte(`{"from": 2, "to": 1, "amount": "18", "date": "2020-03-05"}`)); !errors.Is(err, ErrInvalidSettlement) {
+		t.Errorf("settling outside of a ledger: should have ErrInvalidSettlement, got %v", err)
+	}
+	for _, transfer := range balances.Transfers {
+		settlement := fmt.Sprintf(`{"from": %d, "to": %d, "amount": %q, "date": "2020-03-05"}`, transfer.From, transfer.To, transfer.Amount)
+		if _, err := api.AddSettlement(store, []byte(settlement)); err != nil {
+			t.Fatalf("adding settlement: %s", err)
+		}
+	}
+	balances, err = api.SplitBalances(store)
+	if err != nil {
+		t.Fatalf("computing balances: %s", err)
+	}
+	if len(balances.Balances) != 0 || len(balances.Transfers) != 0 {
+		t.Errorf("should be settled up, got %+v", balances)
+	}
+
+	// c leaves: they can still settle what they owe
+	if err := api.RemoveMember(a, l.ID, c.ID); err != nil {
+		t.Fatalf("removing c: %s", err)
+	}
+	store, err = api.OpenLedger(a, l.ID)
+	if err != nil {
+		t.Fatalf("reopening ledger: %s", err)
+	}
+	if _, err := api.AddSettlement(store, []byte(`{"from": 1, "to": 3, "amount": "1", "date": "2020-03-06"}`)); err != nil {
+		t.Errorf("settling with a former member: %s", err)
+	}
+	settlements, err := api.ListSettlements(store)
+	if err != nil || len(settlements) != 3 {
+		t.Fatalf("should have 3 settlements, got %+v (%v)", settlements, err)
+	}
+	if err := api.DeleteSettlement(store, settlements[2].ID); err != nil {
+		t.Errorf("deleting settlement: %s", err)
+	}
+	if err := api.DeleteSettlement(store, settlements[2].ID); err != ErrSettlementNotFound {
+		t.Errorf("should have ErrSettlementNotFound, got %v", err)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"os"
 	"path/filepath"
 	"strconv"
 
@@ -18,6 +17,10 @@ var ErrEmailAlreadyUsed = errors.New("email already used")
 
 var ErrWrongIdentifiers = errors.New("wrong identifiers")
 
+// usersList is the key of the users list, in the backend of "" (see
+// db.Backends)
+const usersList = "users.list"
+
 type user struct {
 	Email    string
 	Password []byte
@@ -36,16 +39,15 @@ func (api *API) SignUp(email, password string) (*db.User, error) {
 	log.Printf("Sign up %q", email)
 
 	// check taken entry in users file
-	f, err := os.Open(api.userslist)
+	content, err := api.backends("").Get(usersList)
 	if err != nil {
 		// TODO: could send an email to email (apologise)
-		return nil, fmt.Errorf("signing up, opening users list %q: %s", api.userslist, err)
+		return nil, fmt.Errorf("signing up, reading users list: %s", err)
 	}
-	decoder := json.NewDecoder(f)
 
 	var users []user
-	if err := decoder.Decode(&users); err != nil {
-		return nil, fmt.Errorf("signing up, parsing users list: %q: %s", api.userslist, err)
+	if err := json.Unmarshal(content, &users); err != nil {
+		return nil, fmt.Errorf("signing up, parsing users list: %s", err)
 	}
 
 	// check if the email has already been used
@@ -70,44 +72,69 @@ func (api *API) SignUp(email, password string) (*db.User, error) {
 		ID:       userid,
 	})
 
-	f.Close()
-	f, err = os.Create(api.userslist)
+	content, err = json.Marshal(users)
 	if err != nil {
-		return nil, fmt.Errorf("signing up, recreating users list: %s", err)
+		return nil, fmt.Errorf("signing up, json encoding users list: %s", err)
 	}
-	encoder := json.NewEncoder(f)
-	if err := encoder.Encode(users); err != nil {
-		// FIXME: the users file is now corrupted. Try to rewrite the old
-		// version
+	// never leaves a truncated users list, even if the server crashes
+	if err := api.backends("").Put(usersList, content); err != nil {
 		return nil, fmt.Errorf("signing up, saving user to database: %s", err)
 	}
 
-	u := db.NewUser(userid, email, filepath.Join(api.Usersdir, strconv.Itoa(userid)))
+	u := api.OpenUser(userid, email)
 	if err := u.SignUp([]byte(password)); err != nil {
 		return nil, fmt.Errorf("signing up db.User: %s", err)
 	}
+	// there's nothing to migrate, but from now on the legacy format is
+	// refused
+	if err := api.Migrate(u); err != nil {
+		return nil, err
+	}
 
 	return u, nil
 }
 
+// findUser returns the user with the given email (the ID is 0 if there is
+// none)
+func (api *API) findUser(email string) (user, error) {
+	content, err := api.backends("").Get(usersList)
+	if err != nil {
+		return user{}, fmt.Errorf("reading users list: %s", err)
+	}
+	var users []user
+	if err := json.Unmarshal(content, &users); err != nil {
+		return user{}, fmt.Errorf("parsing users list: %s", err)
+	}
+	for _, u := range users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return user{}, nil
+}
+
+// OpenUser returns the (logged out) db.User of a user
+func (api *API) OpenUser(id int, email string) *db.User {
+	root := filepath.Join(api.Usersdir, strconv.Itoa(id))
+	return db.NewUserWithBackend(id, email, root, api.backends("users/"+strconv.Itoa(id)))
+}
+
 // Login adds the user to loggedusers
 func (api *API) Login(email, password string) (*db.User, error) {
 
 	// FIXME: that's a lot of duplicate logic from sign up...
 
-	f, err := os.Open(api.userslist)
+	content, err := api.backends("").Get(usersList)
 	if err != nil {
 		// TODO: could send an email to email (apologise)
-		return nil, fmt.Errorf("signing up, opening users list %q: %s", api.userslist, err)
+		return nil, fmt.Errorf("signing up, reading users list: %s", err)
 	}
-	defer f.Close()
-	decoder := json.NewDecoder(f)
 
 	// FIXME: this is extrememly inefficient. It reads all the user data into
 	// memory just to compare emails and password pairs...
 	var users []user
-	if err := decoder.Decode(&users); err != nil {
-		return nil, fmt.Errorf("signing up, parsing users list: %q: %s", api.userslist, err)
+	if err := json.Unmarshal(content, &users); err != nil {
+		return nil, fmt.Errorf("signing up, parsing users list: %s", err)
 	}
 
 	hashedpassword := scryptKey([]byte(password), api.sm.Get(saltpassword))
@@ -126,10 +153,13 @@ func (api *API) Login(email, password string) (*db.User, error) {
 		return nil, ErrWrongIdentifiers
 	}
 
-	u := db.NewUser(match.ID, match.Email, filepath.Join(api.Usersdir, strconv.Itoa(match.ID)))
+	u := api.OpenUser(match.ID, match.Email)
 	if err := u.Login([]byte(password)); err != nil {
 		return nil, fmt.Errorf("logging in: %s", err)
 	}
+	if err := api.Migrate(u); err != nil {
+		return nil, err
+	}
 
 	log.Printf("user is now logged in: %v", u)
 
@@ -1,5 +1,14 @@
 package api
 
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/math2001/money/db"
+)
+
 const testdir = "test-tmp"
 
 // func TestIntegration(t *testing.T) {
@@ -13,3 +22,23 @@ const testdir = "test-tmp"
 // make sure that user A info is still the original, and that user B info
 // is what we just put in
 // }
+
+// newTestUser signs up a user in a temporary directory. Call the returned
+// function to remove it
+func newTestUser(t *testing.T) (*db.User, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "money-test-"+t.Name())
+	if err != nil {
+		t.Fatalf("creating temporary directory: %s", err)
+	}
+	u := db.NewUser(1, "test@example.com", filepath.Join(dir, "1"))
+	if err := u.SignUp([]byte("test password")); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("signing up test user: %s", err)
+	}
+	return u, func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatalf("removing temporary directory: %s", err)
+		}
+	}
+}
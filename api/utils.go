@@ -1,8 +1,12 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 
+	"github.com/math2001/money/db"
 	"golang.org/x/crypto/scrypt"
 )
 
@@ -17,3 +21,31 @@ func scryptKey(payload, salt []byte) []byte {
 	}
 	return k
 }
+
+// loadJSON decodes the user's file into v. It returns false if the file
+// doesn't exist (v is then left untouched)
+func loadJSON(u db.Store, filename string, v interface{}) (bool, error) {
+	content, err := u.Load(filename)
+	var patherr *os.PathError
+	if errors.As(err, &patherr) && os.IsNotExist(patherr) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("loading %s: %s", filename, err)
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return false, fmt.Errorf("parsing %s: %s", filename, err)
+	}
+	return true, nil
+}
+
+// saveJSON encodes v and saves it to the user's file
+func saveJSON(u db.Store, filename string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("json encoding %s: %s", filename, err)
+	}
+	if err := u.Save(filename, content); err != nil {
+		return fmt.Errorf("saving %s to db: %s", filename, err)
+	}
+	return nil
+}
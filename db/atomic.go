@@ -0,0 +1,96 @@
+package db
+
+// Writing a file in place isn't safe: if the server crashes half way through,
+// the file is left truncated. Instead, the content is written to a temporary
+// file next to it, flushed to the disk, and renamed over the file (which is
+// atomic). The folder is flushed too, otherwise the rename itself could be
+// lost.
+//
+// A crash before the rename leaves the temporary file behind, and the old
+// file untouched. RemoveTempFiles cleans them up on startup.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempSuffix ends the name of every temporary file
+const tempSuffix = ".tmp"
+
+// WriteFileAtomic replaces filename with content: after a crash, the file
+// either has its old content or the new one, never a mix
+func WriteFileAtomic(filename string, content []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(filename)
+	f, err := ioutil.TempFile(dir, base+".*"+tempSuffix)
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %s", err)
+	}
+	tmp := f.Name()
+	// doesn't do anything once renamed
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return fmt.Errorf("writing temporary file: %s", err)
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return fmt.Errorf("chmod temporary file: %s", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing temporary file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing temporary file: %s", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("renaming temporary file: %s", err)
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes the folder's entries (new files, renames) to the disk
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("opening folder: %s", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing folder: %s", err)
+	}
+	return nil
+}
+
+// RemoveTempFiles removes the temporary files left in root (recursively) by
+// writes which crashed. It must only be called when nothing is writing. It
+// returns how many files were removed
+func RemoveTempFiles(root string) (int, error) {
+	removed := 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), tempSuffix) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return removed, fmt.Errorf("removing temporary files: %s", err)
+	}
+	return removed, nil
+}
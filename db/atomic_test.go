@@ -0,0 +1,83 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	t.Parallel()
+	dir := filepath.Join(storedir, "test-"+t.Name())
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("creating folder: %s", err)
+	}
+	filename := filepath.Join(dir, "file")
+
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFileAtomic(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("writing %q: %s", content, err)
+		}
+		got, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("reading file: %s", err)
+		}
+		if string(got) != content {
+			t.Errorf("should have %q, got %q", content, got)
+		}
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("listing folder: %s", err)
+	}
+	if len(infos) != 1 {
+		t.Errorf("should only have the file, got %d files", len(infos))
+	}
+	if infos[0].Mode().Perm() != 0600 {
+		t.Errorf("should have mode 0600, got %s", infos[0].Mode())
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	t.Parallel()
+	dir := filepath.Join(storedir, "test-"+t.Name())
+	if err := os.MkdirAll(filepath.Join(dir, "users", "1"), 0700); err != nil {
+		t.Fatalf("creating folders: %s", err)
+	}
+
+	// a crash before the rename: the file still has its old content
+	files := map[string]string{
+		"users.list":                  "[]",
+		"users.list.123" + tempSuffix: "[{",
+		"users/1/payments":            "old",
+		"users/1/payments.456.tmp":    "new",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("writing %s: %s", name, err)
+		}
+	}
+
+	removed, err := RemoveTempFiles(dir)
+	if err != nil {
+		t.Fatalf("removing temporary files: %s", err)
+	}
+	if removed != 2 {
+		t.Errorf("should have removed 2 files, got %d", removed)
+	}
+	for name, content := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if filepath.Ext(name) == tempSuffix {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s should have been removed, got %v", name, err)
+			}
+		} else if string(got) != content {
+			t.Errorf("%s should have %q, got %q (%v)", name, content, got, err)
+		}
+	}
+
+	if removed, err := RemoveTempFiles(filepath.Join(dir, "nope")); err != nil || removed != 0 {
+		t.Errorf("missing folder: should have removed nothing, got %d (%v)", removed, err)
+	}
+}
@@ -0,0 +1,312 @@
+package db
+
+// A Backend is where a store's files are kept: a folder on the disk (the
+// default), memory (for tests), or an S3-compatible object storage (see
+// s3.go). Backends only see the encrypted content.
+//
+// Files are identified by keys, which are slash separated paths without the
+// leading slash ("payments", "payments.log/00000001.seg"). A missing file is
+// an *os.PathError for which os.IsNotExist is true, whatever the backend, so
+// callers can check for it the same way.
+//
+// The server picks the backends with Backends: every store gets the backend
+// of its own prefix ("users/1", "ledgers/{id}/data"), and the users list and
+// the ledgers' members are in the backends of "" and "ledgers/{id}". The keys
+// (the users' secrets, the salts) stay on the disk whatever the backend.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend stores the (encrypted) files of a store
+type Backend interface {
+	Get(key string) ([]byte, error)
+	// Put replaces the file atomically: it's either the old content or the
+	// new one, never a mix
+	Put(key string, content []byte) error
+	// Append adds content at the end of the file, which is created if it
+	// doesn't exist. It isn't atomic: if it fails, the file can end with a
+	// part of content
+	Append(key string, content []byte) error
+	// Delete doesn't fail if the file doesn't exist
+	Delete(key string) error
+	// List returns the keys starting with prefix, sorted
+	List(prefix string) ([]string, error)
+	// Rename moves a file. The file at to is replaced atomically
+	Rename(from, to string) error
+	// String identifies where the files are. Backends with the same String
+	// share their locks (see lock.go)
+	String() string
+}
+
+// Backends returns the backend of the files under prefix, which is a key
+// without the trailing slash ("users/1"), or "" for every file
+type Backends func(prefix string) Backend
+
+// FSBackends keeps the files in the folder root
+func FSBackends(root string) Backends {
+	return func(prefix string) Backend {
+		return NewFSBackend(JoinRootPath(root, prefix))
+	}
+}
+
+// MemoryBackends keeps the files in memory, for tests. The backend of a
+// prefix sees the files of the backends of longer prefixes, like a folder
+func MemoryBackends() Backends {
+	b := NewMemoryBackend()
+	return func(prefix string) Backend {
+		if prefix == "" {
+			return b
+		}
+		return &prefixedBackend{b: b, prefix: prefix + "/"}
+	}
+}
+
+// prefixedBackend is the part of a backend whose keys start with prefix
+type prefixedBackend struct {
+	b      Backend
+	prefix string
+}
+
+func (b *prefixedBackend) Get(key string) ([]byte, error) {
+	return b.b.Get(b.prefix + key)
+}
+
+func (b *prefixedBackend) Put(key string, content []byte) error {
+	return b.b.Put(b.prefix+key, content)
+}
+
+func (b *prefixedBackend) Append(key string, content []byte) error {
+	return b.b.Append(b.prefix+key, content)
+}
+
+func (b *prefixedBackend) Delete(key string) error {
+	return b.b.Delete(b.prefix + key)
+}
+
+func (b *prefixedBackend) List(prefix string) ([]string, error) {
+	keys, err := b.b.List(b.prefix + prefix)
+	for i := range keys {
+		keys[i] = strings.TrimPrefix(keys[i], b.prefix)
+	}
+	return keys, err
+}
+
+func (b *prefixedBackend) Rename(from, to string) error {
+	return b.b.Rename(b.prefix+from, b.prefix+to)
+}
+
+func (b *prefixedBackend) String() string {
+	return b.b.String() + "/" + strings.TrimSuffix(b.prefix, "/")
+}
+
+// storeKey returns the key of a store's file
+func storeKey(filename string) string {
+	return strings.TrimPrefix(JoinRootPath("/", filename), "/")
+}
+
+func notExist(op, key string) error {
+	return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+}
+
+// FSBackend keeps the files in a folder. A user's folder also has their keys,
+// in the secrets folder (see User), which List skips
+type FSBackend struct {
+	root string
+}
+
+// NewFSBackend returns the backend for the folder root. It is created when
+// the first file is written
+func NewFSBackend(root string) *FSBackend {
+	return &FSBackend{root: root}
+}
+
+func (b *FSBackend) path(key string) string {
+	return JoinRootPath(b.root, key)
+}
+
+func (b *FSBackend) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(b.path(key))
+}
+
+func (b *FSBackend) Put(key string, content []byte) error {
+	path := b.path(key)
+	if err := b.mkdir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, content, 0600)
+}
+
+func (b *FSBackend) Append(key string, content []byte) error {
+	path := b.path(key)
+	if err := b.mkdir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	_, err := os.Stat(path)
+	created := os.IsNotExist(err)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("opening file: %s", err)
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return fmt.Errorf("writing file: %s", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing file: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing file: %s", err)
+	}
+	if created {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// mkdir creates the folder if it doesn't exist, and makes sure it isn't lost
+func (b *FSBackend) mkdir(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating folder: %s", err)
+	}
+	return syncDir(filepath.Dir(dir))
+}
+
+func (b *FSBackend) Delete(key string) error {
+	if err := os.Remove(b.path(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing file: %s", err)
+	}
+	return nil
+}
+
+// List skips the temporary files of the writes in progress (see
+// WriteFileAtomic), and the secrets folder
+func (b *FSBackend) List(prefix string) ([]string, error) {
+	var keys []string
+	secrets := filepath.Join(b.root, secretsFolder)
+	err := filepath.Walk(b.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path == secrets {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || strings.HasSuffix(info.Name(), tempSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("listing files: %s", err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (b *FSBackend) Rename(from, to string) error {
+	path := b.path(to)
+	if err := b.mkdir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	// os.Rename's error is a *os.LinkError
+	if err := os.Rename(b.path(from), path); os.IsNotExist(err) {
+		return notExist("rename", from)
+	} else if err != nil {
+		return fmt.Errorf("renaming file: %s", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func (b *FSBackend) String() string {
+	return b.root
+}
+
+// MemoryBackend keeps the files in memory, for tests
+type MemoryBackend struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{files: make(map[string][]byte)}
+}
+
+func (b *MemoryBackend) Get(key string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	content, ok := b.files[key]
+	if !ok {
+		return nil, notExist("get", key)
+	}
+	return append([]byte(nil), content...), nil
+}
+
+func (b *MemoryBackend) Put(key string, content []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files[key] = append([]byte(nil), content...)
+	return nil
+}
+
+func (b *MemoryBackend) Append(key string, content []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files[key] = append(b.files[key], content...)
+	return nil
+}
+
+func (b *MemoryBackend) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.files, key)
+	return nil
+}
+
+func (b *MemoryBackend) List(prefix string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var keys []string
+	for key := range b.files {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (b *MemoryBackend) Rename(from, to string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	content, ok := b.files[from]
+	if !ok {
+		return notExist("rename", from)
+	}
+	b.files[to] = content
+	delete(b.files, from)
+	return nil
+}
+
+// String is unique for every MemoryBackend
+func (b *MemoryBackend) String() string {
+	return fmt.Sprintf("memory %p", b)
+}
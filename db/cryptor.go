@@ -12,6 +12,19 @@ package db
 // cryptor could (should) be private. I've just bounced between private and
 // public so many times now, I'm don't wanna change it...
 
+// Files are now written with AES-GCM, which authenticates the ciphertext by
+// itself, and binds it to some associated data: the path of the file in the
+// store, so that a file can't be swapped with an other one. They start with a
+// header giving the version of the format:
+//
+//     "mny" version(1 byte) | nonce (12 bytes) | ciphertext and tag
+//
+// Files without the header are in the legacy format (version 1): an HMAC sum,
+// the IV and the AES-CBC ciphertext. The sum of most of them is the same for
+// every file (see decryptLegacy), so they can't be trusted: they are only read
+// while a store is migrated (see files.Migrate), which rewrites them in the
+// current format. Once it is, only the current format is accepted.
+
 import (
 	"bytes"
 	"crypto/aes"
@@ -21,9 +34,7 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
-	"io/ioutil"
 )
 
 // ErrDifferentMACSum is returned if the mac sum of the file doesn't match
@@ -36,35 +47,104 @@ var ErrDifferentMACSum = errors.New("mac sum don't match")
 // may reveal to be an attack (see padding oracle)
 var ErrInvalidPadding = errors.New("invalid padding")
 
+// ErrUnknownFormat is returned for files written by a newer version
+var ErrUnknownFormat = errors.New("unknown file format")
+
+// ErrLegacyFormat is returned for files without the header, outside of a
+// migration
+var ErrLegacyFormat = errors.New("legacy file format")
+
+const (
+	formatMagic   = "mny"
+	formatVersion = 2
+)
+
 // manages decrypting and encrypting from/to a file
 
 // Cryptor is a simple API which writes and read encrypted files using the
 // password given to the constructor
 type Cryptor struct {
-	block cipher.Block
-	mac   hash.Hash
+	aead cipher.AEAD
+
+	// for the legacy format
+	block  cipher.Block
+	macKey []byte
 }
 
-func (c *Cryptor) Decrypt(content []byte) ([]byte, error) {
-	givenMACSum := content[:c.mac.Size()]
-	ciphertext := content[c.mac.Size():]
+func hasHeader(content []byte) bool {
+	return len(content) > len(formatMagic) && string(content[:len(formatMagic)]) == formatMagic
+}
+
+// Decrypt returns the plaintext of content, which must have been encrypted
+// with the same associated data. Only the current format is accepted
+func (c *Cryptor) Decrypt(content, ad []byte) ([]byte, error) {
+	if !hasHeader(content) {
+		return nil, ErrLegacyFormat
+	}
+	if version := content[len(formatMagic)]; version != formatVersion {
+		return nil, fmt.Errorf("version %d (%w)", version, ErrUnknownFormat)
+	}
+
+	content = content[len(formatMagic)+1:]
+	if len(content) < c.aead.NonceSize()+c.aead.Overhead() {
+		return nil, fmt.Errorf("ciphertext too short (%w)", ErrDifferentMACSum)
+	}
+	nonce := content[:c.aead.NonceSize()]
+	plaintext, err := c.aead.Open(nil, nonce, content[c.aead.NonceSize():], ad)
+	if err != nil {
+		return nil, fmt.Errorf("%s (%w)", err, ErrDifferentMACSum)
+	}
+	return plaintext, nil
+}
+
+// decryptMigrating is Decrypt for a store which isn't migrated yet: the legacy
+// format is accepted too. It says if content was in the legacy format
+func (c *Cryptor) decryptMigrating(content, ad []byte) ([]byte, bool, error) {
+	plaintext, err := c.Decrypt(content, ad)
+	if err == nil {
+		return plaintext, false, nil
+	}
+	// a legacy sum can start with the header by chance
+	legacy, legacyErr := c.decryptLegacy(content)
+	if legacyErr != nil {
+		if errors.Is(err, ErrLegacyFormat) {
+			return nil, false, legacyErr
+		}
+		return nil, false, err
+	}
+	return legacy, true, nil
+}
+
+// decryptLegacy decrypts the version 1 format. Because of a bug, the sum was
+// the HMAC of nothing rather than of the ciphertext, so files from that time
+// aren't authenticated. Both sums are accepted, which is why it's only used
+// while migrating
+func (c *Cryptor) decryptLegacy(content []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, c.macKey)
+	if len(content) < mac.Size() {
+		return nil, fmt.Errorf("content too short (%w)", ErrDifferentMACSum)
+	}
+	givenMACSum := content[:mac.Size()]
+	ciphertext := content[mac.Size():]
 
 	// check MAC sum
-	c.mac.Write(ciphertext)
-	computedSum := c.mac.Sum(nil)
+	emptySum := mac.Sum(nil)
+	mac.Write(ciphertext)
+	computedSum := mac.Sum(nil)
 
-	if hmac.Equal(computedSum, givenMACSum) {
+	if !hmac.Equal(computedSum, givenMACSum) && !hmac.Equal(emptySum, givenMACSum) {
 		return nil, ErrDifferentMACSum
 	}
 
-	if len(ciphertext) < c.block.BlockSize() {
+	blocksize := c.block.BlockSize()
+	if len(ciphertext) < 2*blocksize {
 		return nil, fmt.Errorf("ciphertext too short (file corrupted)")
 	}
 
-	iv := ciphertext[:c.block.BlockSize()]
-	ciphertext = ciphertext[c.block.BlockSize():]
+	iv := ciphertext[:blocksize]
+	ciphertext = ciphertext[blocksize:]
 
-	if len(ciphertext)%c.block.BlockSize() != 0 {
+	if len(ciphertext)%blocksize != 0 {
 		return nil, fmt.Errorf("ciphertext length isn't a multiple of block size (file corrupted)")
 	}
 
@@ -75,76 +155,68 @@ func (c *Cryptor) Decrypt(content []byte) ([]byte, error) {
 	mode := cipher.NewCBCDecrypter(c.block, iv)
 	mode.CryptBlocks(plaintext, ciphertext)
 
-	// remove padding from plaintext
+	// remove padding from plaintext. There's always at least one byte of
+	// padding, and at most a block
 	npaddingbyte := plaintext[len(plaintext)-1]
 	npadding := int(npaddingbyte)
 
-	if npadding > c.mac.BlockSize() {
-		// should we give more details in this error message?
+	if npadding == 0 || npadding > blocksize {
 		return nil, ErrInvalidPadding
 	}
 
-	for i := len(plaintext) - npadding; i < len(plaintext); i++ {
-		if plaintext[i] != npaddingbyte {
-			// should more detail be given in this error message?
-			return nil, ErrInvalidPadding
-		}
+	if !bytes.Equal(plaintext[len(plaintext)-npadding:], bytes.Repeat([]byte{npaddingbyte}, npadding)) {
+		return nil, ErrInvalidPadding
 	}
 
 	return plaintext[:len(plaintext)-npadding], nil
 }
 
-// Load opens <filename>, decrypts its content, and returns it
-func (c *Cryptor) Load(filename string) ([]byte, error) {
-	content, err := ioutil.ReadFile(filename)
+// Load gets the file from the backend, decrypts its content, and returns it
+func (c *Cryptor) Load(b Backend, key string, ad []byte) ([]byte, error) {
+	content, err := b.Get(key)
 	if err != nil {
 		// wrap the error to allow the user to determine whether the file
 		// existed or if it was an other kind of error
 		return nil, fmt.Errorf("reading file: %w", err)
 	}
-	return c.Decrypt(content)
+	return c.Decrypt(content, ad)
 }
 
-func (c *Cryptor) Encrypt(plaintext []byte) ([]byte, error) {
-	iv := make([]byte, c.block.BlockSize())
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return nil, fmt.Errorf("generating IV: %s", err)
+// migrate rewrites the file in the current format if it's in the legacy one
+func (c *Cryptor) migrate(b Backend, key string, ad []byte) error {
+	content, err := b.Get(key)
+	if err != nil {
+		return fmt.Errorf("reading file: %w", err)
 	}
+	plaintext, legacy, err := c.decryptMigrating(content, ad)
+	if err != nil || !legacy {
+		return err
+	}
+	return c.Save(b, key, ad, plaintext)
+}
 
-	blocksize := c.block.BlockSize()
-
-	// the number of padding bytes required
-	npaddingbytes := blocksize - (len(plaintext) % blocksize)
-
-	// we add 3 threes if we have 3 padding bytes, 1 one if we have 1 padding
-	// byte, etc. It seems to be the standard way of padding
-	plaintext = append(plaintext, bytes.Repeat([]byte{byte(npaddingbytes)}, npaddingbytes)...)
-
-	ciphertext := make([]byte, blocksize+len(plaintext))
-
-	// the IV doesn't need to be secret, just unique, so we store at the
-	// beginning of the ciphertext
-	copy(ciphertext[:blocksize], iv)
-
-	mode := cipher.NewCBCEncrypter(c.block, iv)
-	mode.CryptBlocks(ciphertext[blocksize:], plaintext)
-
-	// ciphertext includes the IV and the regular blocks
-	c.mac.Write(ciphertext)
-	c.mac.Reset()
-
-	signature := c.mac.Sum(nil)
+// Encrypt encrypts and authenticates plaintext, and binds it to the
+// associated data
+func (c *Cryptor) Encrypt(plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %s", err)
+	}
 
-	return append(signature, ciphertext...), nil
+	content := make([]byte, 0, len(formatMagic)+1+len(nonce)+len(plaintext)+c.aead.Overhead())
+	content = append(content, formatMagic...)
+	content = append(content, formatVersion)
+	content = append(content, nonce...)
+	return c.aead.Seal(content, nonce, plaintext, ad), nil
 }
 
-// Save encrypts plaintext and saves it to filename
-func (c *Cryptor) Save(filename string, plaintext []byte) error {
-	ciphertext, err := c.Encrypt(plaintext)
+// Save encrypts plaintext and saves it to the backend
+func (c *Cryptor) Save(b Backend, key string, ad, plaintext []byte) error {
+	ciphertext, err := c.Encrypt(plaintext, ad)
 	if err != nil {
 		return err
 	}
-	if err := ioutil.WriteFile(filename, ciphertext, 0644); err != nil {
+	if err := b.Put(key, ciphertext); err != nil {
 		return fmt.Errorf("writing file: %s", err)
 	}
 	return nil
@@ -160,8 +232,29 @@ func NewCryptor(encryptionKey, macKey []byte) (*Cryptor, error) {
 		return nil, fmt.Errorf("new cipher: %s", err)
 	}
 
+	// the legacy format already uses the encryption key with CBC, so GCM gets
+	// its own key
+	derive := hmac.New(sha256.New, macKey)
+	derive.Write([]byte("mny aead key"))
+	derive.Write(encryptionKey)
+	aeadBlock, err := aes.NewCipher(derive.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("new aead cipher: %s", err)
+	}
+	aead, err := cipher.NewGCM(aeadBlock)
+	if err != nil {
+		return nil, fmt.Errorf("new gcm: %s", err)
+	}
+
 	return &Cryptor{
-		block: block,
-		mac:   hmac.New(sha256.New, macKey),
+		aead:   aead,
+		block:  block,
+		macKey: append([]byte(nil), macKey...),
 	}, nil
 }
+
+// fileAD is the associated data of a store's file: its path in the store, so
+// that it doesn't depend on where the store is
+func fileAD(key string) []byte {
+	return []byte("/" + key)
+}
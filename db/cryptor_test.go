@@ -2,10 +2,17 @@ package db
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"os"
-	"path/filepath"
 	"testing"
 )
 
@@ -18,7 +25,8 @@ var keys [][]byte
 
 func TestBasicCryptor(t *testing.T) {
 	t.Parallel()
-	storefile := filepath.Join(storedir, "test-"+t.Name())
+	backend := NewFSBackend(storedir)
+	storefile := "test-" + t.Name()
 	cryptor, err := NewCryptor(keys[0], keys[1])
 	if err != nil {
 		t.Fatalf("creating cryptor: %s", err)
@@ -26,11 +34,11 @@ func TestBasicCryptor(t *testing.T) {
 
 	input := []byte("aaaaa bbbb cccc dddd")
 
-	if err := cryptor.Save(storefile, input); err != nil {
+	if err := cryptor.Save(backend, storefile, []byte("/basic"), input); err != nil {
 		t.Fatalf("saving to %s: %s", storefile, err)
 	}
 
-	output, err := cryptor.Load(storefile)
+	output, err := cryptor.Load(backend, storefile, []byte("/basic"))
 	if err != nil {
 		t.Fatalf("loading from %s: %s", storefile, err)
 	}
@@ -43,7 +51,8 @@ func TestBasicCryptor(t *testing.T) {
 // Test saving with one cryptor and loading with an other
 func TestDifferentCryptor(t *testing.T) {
 	t.Parallel()
-	storefile := filepath.Join(storedir, "test-"+t.Name())
+	backend := NewFSBackend(storedir)
+	storefile := "test-" + t.Name()
 	cryptorw, err := NewCryptor(keys[2], keys[3])
 	if err != nil {
 		t.Fatalf("creating writting cryptor: %s", err)
@@ -51,7 +60,7 @@ func TestDifferentCryptor(t *testing.T) {
 
 	input := []byte("asdf poijwqefad asdf owqiejfasldfkw")
 
-	if err := cryptorw.Save(storefile, input); err != nil {
+	if err := cryptorw.Save(backend, storefile, nil, input); err != nil {
 		t.Fatalf("saving to %s: %s", storefile, err)
 	}
 
@@ -60,7 +69,7 @@ func TestDifferentCryptor(t *testing.T) {
 		t.Fatalf("create reading cryptor: %s", err)
 	}
 
-	output, err := cryptorr.Load(storefile)
+	output, err := cryptorr.Load(backend, storefile, nil)
 	if err != nil {
 		t.Fatalf("loading from %s: %s", storefile, err)
 	}
@@ -69,6 +78,172 @@ func TestDifferentCryptor(t *testing.T) {
 		t.Errorf("input should equal output\n%q\n%q", input, output)
 	}
 }
+
+func TestCryptorTampering(t *testing.T) {
+	t.Parallel()
+	cryptor, err := NewCryptor(keys[4], keys[5])
+	if err != nil {
+		t.Fatalf("creating cryptor: %s", err)
+	}
+	input := []byte("some secret payments")
+	ad := []byte("/payments")
+	content, err := cryptor.Encrypt(input, ad)
+	if err != nil {
+		t.Fatalf("encrypting: %s", err)
+	}
+	if string(content[:4]) != "mny\x02" {
+		t.Errorf("should start with the header, got %q", content[:4])
+	}
+
+	// flip a bit of the nonce, the ciphertext and the tag
+	for _, i := range []int{5, 4 + 12 + 3, len(content) - 1} {
+		tampered := append([]byte(nil), content...)
+		tampered[i] ^= 1
+		if _, err := cryptor.Decrypt(tampered, ad); !errors.Is(err, ErrDifferentMACSum) {
+			t.Errorf("byte %d flipped: should have ErrDifferentMACSum, got %v", i, err)
+		}
+	}
+	if _, err := cryptor.Decrypt(content[:len(content)-1], ad); !errors.Is(err, ErrDifferentMACSum) {
+		t.Errorf("truncated: should have ErrDifferentMACSum, got %v", err)
+	}
+	// an other file's content
+	if _, err := cryptor.Decrypt(content, []byte("/settings")); !errors.Is(err, ErrDifferentMACSum) {
+		t.Errorf("other path: should have ErrDifferentMACSum, got %v", err)
+	}
+	// a newer format
+	newer := append([]byte(nil), content...)
+	newer[3] = formatVersion + 1
+	if _, err := cryptor.Decrypt(newer, ad); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("newer version: should have ErrUnknownFormat, got %v", err)
+	}
+
+	output, err := cryptor.Decrypt(content, ad)
+	if err != nil || !bytes.Equal(output, input) {
+		t.Errorf("should have %q, got %q (%v)", input, output, err)
+	}
+}
+
+// encryptLegacy encrypts like the version 1 format did. With emptySum, the
+// sum is the HMAC of nothing, like the buggy version wrote
+func encryptLegacy(t *testing.T, encKey, macKey, plaintext []byte, emptySum bool) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		t.Fatalf("new cipher: %s", err)
+	}
+	npadding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(npadding)}, npadding)...)
+	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
+	if _, err := rand.Read(ciphertext[:aes.BlockSize]); err != nil {
+		t.Fatalf("generating iv: %s", err)
+	}
+	cipher.NewCBCEncrypter(block, ciphertext[:aes.BlockSize]).CryptBlocks(ciphertext[aes.BlockSize:], plaintext)
+	mac := hmac.New(sha256.New, macKey)
+	if !emptySum {
+		mac.Write(ciphertext)
+	}
+	return append(mac.Sum(nil), ciphertext...)
+}
+
+func TestCryptorLegacy(t *testing.T) {
+	t.Parallel()
+	cryptor, err := NewCryptor(keys[6], keys[7])
+	if err != nil {
+		t.Fatalf("creating cryptor: %s", err)
+	}
+	for _, emptySum := range []bool{true, false} {
+		input := []byte("written before the new format")
+		legacy := encryptLegacy(t, keys[6], keys[7], append([]byte(nil), input...), emptySum)
+
+		if _, err := cryptor.Decrypt(legacy, []byte("/legacy")); !errors.Is(err, ErrLegacyFormat) {
+			t.Errorf("empty sum %t: should have ErrLegacyFormat, got %v", emptySum, err)
+		}
+		output, legacyFormat, err := cryptor.decryptMigrating(legacy, []byte("/legacy"))
+		if err != nil || !legacyFormat || !bytes.Equal(output, input) {
+			t.Errorf("empty sum %t: migrating should have %q, got %q (legacy %t, %v)", emptySum, input, output, legacyFormat, err)
+		}
+	}
+
+	legacy := encryptLegacy(t, keys[6], keys[7], []byte("tampered"), false)
+	legacy[len(legacy)-1] ^= 1
+	if _, _, err := cryptor.decryptMigrating(legacy, nil); !errors.Is(err, ErrDifferentMACSum) {
+		t.Errorf("tampered legacy: should have ErrDifferentMACSum, got %v", err)
+	}
+
+	// a file in the current format which doesn't decrypt is never read as a
+	// legacy one
+	content, err := cryptor.Encrypt([]byte("new"), []byte("/new"))
+	if err != nil {
+		t.Fatalf("encrypting: %s", err)
+	}
+	if _, _, err := cryptor.decryptMigrating(content, []byte("/other")); !errors.Is(err, ErrDifferentMACSum) {
+		t.Errorf("other path: should have ErrDifferentMACSum, got %v", err)
+	}
+}
+
+func TestStoreMigrate(t *testing.T) {
+	t.Parallel()
+	cryptor, err := NewCryptor(keys[8], keys[9])
+	if err != nil {
+		t.Fatalf("creating cryptor: %s", err)
+	}
+	backend := NewMemoryBackend()
+	store := &files{backend: backend, cryptor: cryptor, plain: []string{"publickey", "secrets/"}}
+
+	legacy := encryptLegacy(t, keys[8], keys[9], []byte("settings"), true)
+	record := encryptLegacy(t, keys[8], keys[9], []byte("a"), true)
+	var frame [4]byte
+	binary.BigEndian.PutUint32(frame[:], uint32(len(record)))
+	written := map[string][]byte{
+		"settings":                  legacy,
+		"payments.log/00000001.seg": append(frame[:], record...),
+		"publickey":                 []byte("not encrypted"),
+		"secrets/keys":              []byte("not encrypted either"),
+	}
+	for key, content := range written {
+		if err := backend.Put(key, content); err != nil {
+			t.Fatalf("writing %s: %s", key, err)
+		}
+	}
+	if err := store.Append("/payments.log", []byte("b")); err != nil {
+		t.Fatalf("appending: %s", err)
+	}
+
+	if _, err := store.Load("/settings"); !errors.Is(err, ErrLegacyFormat) {
+		t.Errorf("before migrating: should have ErrLegacyFormat, got %v", err)
+	}
+	if err := store.Migrate(); err != nil {
+		t.Fatalf("migrating: %s", err)
+	}
+	if got, err := store.Load("/settings"); err != nil || string(got) != "settings" {
+		t.Errorf("should have %q, got %q (%v)", "settings", got, err)
+	}
+	var records []string
+	err = store.ReadLog("/payments.log", func(record []byte) error {
+		records = append(records, string(record))
+		return nil
+	})
+	if err != nil || fmt.Sprint(records) != "[a b]" {
+		t.Errorf("should have records [a b], got %v (%v)", records, err)
+	}
+	for _, key := range []string{"publickey", "secrets/keys"} {
+		if got, err := backend.Get(key); err != nil || !bytes.Equal(got, written[key]) {
+			t.Errorf("%s shouldn't have changed, got %q (%v)", key, got, err)
+		}
+	}
+
+	// once migrated, an old file can't replace a new one
+	if err := backend.Put("settings", legacy); err != nil {
+		t.Fatalf("writing legacy file: %s", err)
+	}
+	if err := store.Migrate(); err != nil {
+		t.Fatalf("migrating again: %s", err)
+	}
+	if _, err := store.Load("/settings"); !errors.Is(err, ErrLegacyFormat) {
+		t.Errorf("after migrating: should have ErrLegacyFormat, got %v", err)
+	}
+}
+
 func returningTestMain(m *testing.M) int {
 	if err := os.MkdirAll(storedir, os.ModePerm); err != nil {
 		log.Fatalf("makdir %s: %s", storedir, err)
@@ -0,0 +1,112 @@
+package db
+
+// Every user has a key pair, so that other users can give them keys (the key
+// of a shared ledger for example) without knowing their password. The private
+// key is encrypted like the rest of the user's files, the public key is in
+// clear text so that it can be read when the user isn't logged in.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// ErrNoPublicKey is returned when a user doesn't have a key pair yet (they
+// haven't logged in since key pairs were introduced)
+var ErrNoPublicKey = errors.New("no public key")
+
+// ErrCannotUnwrap is returned when a wrapped key wasn't wrapped for the user,
+// or has been tampered with
+var ErrCannotUnwrap = errors.New("can't unwrap key")
+
+const (
+	privateKeyFile = "/privatekey"
+	publicKeyFile  = "publickey"
+)
+
+// ensureKeyPair generates the user's key pair if they don't have one yet.
+// Requires the cryptor
+func (u *User) ensureKeyPair() error {
+	_, err := u.Load(privateKeyFile)
+	var patherr *os.PathError
+	if err == nil {
+		return nil
+	} else if !errors.As(err, &patherr) || !os.IsNotExist(patherr) {
+		return fmt.Errorf("loading private key: %s", err)
+	}
+
+	public, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating key pair: %s", err)
+	}
+	// the public key first, so that we never have a private key without it
+	if err := u.backend.Put(publicKeyFile, []byte(hex.EncodeToString(public[:]))); err != nil {
+		return fmt.Errorf("writing public key: %s", err)
+	}
+	if err := u.Save(privateKeyFile, private[:]); err != nil {
+		return fmt.Errorf("saving private key: %s", err)
+	}
+	return nil
+}
+
+// PublicKey returns the user's public key. The user doesn't need to be logged
+// in. Errors: ErrNoPublicKey, err
+func (u *User) PublicKey() (*[32]byte, error) {
+	content, err := u.backend.Get(publicKeyFile)
+	var patherr *os.PathError
+	if errors.As(err, &patherr) && os.IsNotExist(patherr) {
+		return nil, ErrNoPublicKey
+	} else if err != nil {
+		return nil, fmt.Errorf("reading public key: %s", err)
+	}
+	var public [32]byte
+	if n, err := hex.Decode(public[:], content); err != nil || n != len(public) {
+		return nil, fmt.Errorf("invalid public key %q", content)
+	}
+	return &public, nil
+}
+
+// WrapKey encrypts key so that only the owner of publickey can decrypt it (see
+// User.UnwrapKey). The wrapped key is an ephemeral public key, a nonce and the
+// sealed key
+func WrapKey(key []byte, publickey *[32]byte) ([]byte, error) {
+	ephemeral, private, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating ephemeral key pair: %s", err)
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, fmt.Errorf("generating nonce: %s", err)
+	}
+	wrapped := append(ephemeral[:], nonce[:]...)
+	return box.Seal(wrapped, key, &nonce, publickey, private), nil
+}
+
+// UnwrapKey decrypts a key given by WrapKey. Errors: ErrCannotUnwrap, err
+func (u *User) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 32+24+box.Overhead {
+		return nil, fmt.Errorf("wrapped key too short (%w)", ErrCannotUnwrap)
+	}
+	content, err := u.Load(privateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading private key: %s", err)
+	}
+	var private, ephemeral [32]byte
+	var nonce [24]byte
+	if copy(private[:], content) != len(private) {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	copy(ephemeral[:], wrapped[:32])
+	copy(nonce[:], wrapped[32:56])
+
+	key, ok := box.Open(nil, wrapped[56:], &nonce, &ephemeral, &private)
+	if !ok {
+		return nil, ErrCannotUnwrap
+	}
+	return key, nil
+}
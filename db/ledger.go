@@ -0,0 +1,96 @@
+package db
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// LedgerKeySize is the size of a ledger's key: an encryption key and a MAC key
+const LedgerKeySize = 64
+
+// Ledger is a folder shared by several users. Its files are encrypted with a
+// random key, which is wrapped for each member (see WrapKey)
+type Ledger struct {
+	ID string
+	files
+}
+
+// NewLedgerKey generates a random ledger key
+func NewLedgerKey() ([]byte, error) {
+	key := make([]byte, LedgerKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("generating ledger key: %s", err)
+	}
+	return key, nil
+}
+
+// NewLedger opens the ledger in root (which is created if it doesn't exist)
+func NewLedger(id, root string, key []byte) (*Ledger, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("creating ledger folder: %s", err)
+	}
+	return NewLedgerWithBackend(id, NewFSBackend(root), key)
+}
+
+// NewLedgerWithBackend opens the ledger whose files are in backend
+func NewLedgerWithBackend(id string, backend Backend, key []byte) (*Ledger, error) {
+	if len(key) != LedgerKeySize {
+		return nil, fmt.Errorf("ledger key should be %d bytes, got %d", LedgerKeySize, len(key))
+	}
+	c, err := NewCryptor(key[:32], key[32:])
+	if err != nil {
+		return nil, fmt.Errorf("ledger newcryptor: %s", err)
+	}
+	return &Ledger{ID: id, files: files{backend: backend, cryptor: c}}, nil
+}
+
+func (l *Ledger) String() string {
+	return "ledger " + l.ID
+}
+
+// Rekey encrypts every file of the ledger with next's key, into next's
+// backend (which should be empty). l doesn't change: the caller switches to
+// next once the copy is complete, so that a failed rekey leaves the ledger as
+// it was. The ledger must be locked (see Lock)
+func (l *Ledger) Rekey(next *Ledger) error {
+	keys, err := l.keys()
+	if err != nil {
+		return fmt.Errorf("listing ledger files: %s", err)
+	}
+	copied := make(map[string]bool)
+	for _, k := range keys {
+		if strings.Contains(k, "/") {
+			// logs are compacted with the new key
+			dir := path.Dir(k)
+			if copied[dir] {
+				continue
+			}
+			copied[dir] = true
+			records, err := l.log(dir).readAll()
+			if err != nil {
+				return fmt.Errorf("decrypting %s: %s", dir, err)
+			}
+			if err := next.log(dir).compact(records); err != nil {
+				return fmt.Errorf("encrypting %s: %s", dir, err)
+			}
+			continue
+		}
+		if strings.HasSuffix(k, ".rekey") {
+			// left over by a rekey which failed, when ledgers were rekeyed
+			// in place
+			continue
+		}
+		plaintext, err := l.Load(k)
+		if err != nil {
+			return fmt.Errorf("decrypting %s: %s", k, err)
+		}
+		if err := next.Save(k, plaintext); err != nil {
+			return fmt.Errorf("encrypting %s: %s", k, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package db
+
+// Requests for the same user run at the same time (their phone and their
+// laptop syncing for example), each with its own db.User. So the locks can't
+// be in the db.User: they are in a table, by path, shared by everyone.
+//
+// There are two levels:
+//  - every file (and log) is locked while it's read or written, so that a
+//    reader never sees half a file, and two appends don't mix
+//  - the whole store is locked (Store.Lock) while its data is read, changed
+//    and saved back, so that two changes don't overwrite each other
+
+import "sync"
+
+type pathLock struct {
+	sync.RWMutex
+	// refs is how many are using or waiting for the lock. The lock is
+	// removed from the table once nobody is
+	refs int
+}
+
+var locks = struct {
+	sync.Mutex
+	paths map[string]*pathLock
+}{paths: make(map[string]*pathLock)}
+
+func acquireLock(path string) *pathLock {
+	locks.Lock()
+	defer locks.Unlock()
+	l, ok := locks.paths[path]
+	if !ok {
+		l = &pathLock{}
+		locks.paths[path] = l
+	}
+	l.refs++
+	return l
+}
+
+func releaseLock(path string, l *pathLock) {
+	locks.Lock()
+	defer locks.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(locks.paths, path)
+	}
+}
+
+// LockPath locks path for writing. It returns the function which unlocks it
+func LockPath(path string) (unlock func()) {
+	l := acquireLock(path)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		releaseLock(path, l)
+	}
+}
+
+// RLockPath locks path for reading: other readers can have it at the same
+// time, writers can't. It returns the function which unlocks it
+func RLockPath(path string) (unlock func()) {
+	l := acquireLock(path)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		releaseLock(path, l)
+	}
+}
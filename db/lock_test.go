@@ -0,0 +1,76 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestStoreLock(t *testing.T) {
+	t.Parallel()
+	root := filepath.Join(storedir, "test-"+t.Name())
+	key := append(append([]byte(nil), keys[8]...), keys[9]...)
+
+	// every request has its own db.Ledger, they share the lock
+	const n = 20
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			l, err := NewLedger("test", root, key)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer l.Lock()()
+			count := 0
+			content, err := l.Load("/count")
+			var patherr *os.PathError
+			if err == nil {
+				count, err = strconv.Atoi(string(content))
+			} else if errors.As(err, &patherr) && os.IsNotExist(patherr) {
+				err = nil
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- l.Save("/count", []byte(strconv.Itoa(count+1)))
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("incrementing count: %s", err)
+		}
+	}
+
+	l, err := NewLedger("test", root, key)
+	if err != nil {
+		t.Fatalf("opening ledger: %s", err)
+	}
+	content, err := l.Load("/count")
+	if err != nil {
+		t.Fatalf("loading count: %s", err)
+	}
+	if string(content) != strconv.Itoa(n) {
+		t.Errorf("should have counted %d, got %s", n, content)
+	}
+}
+
+func TestLockTable(t *testing.T) {
+	unlock := LockPath("a")
+	runlock := RLockPath("b")
+	runlock2 := RLockPath("b")
+	unlock()
+	runlock()
+	runlock2()
+
+	locks.Lock()
+	defer locks.Unlock()
+	for path := range locks.paths {
+		if path == "a" || path == "b" {
+			t.Errorf("%s should have been removed from the table", path)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package db
+
+// A log is a list of records which only grows at the end, so that adding a
+// record doesn't rewrite the others. It's a folder of segments:
+//
+//     00000001.snap   # the records when the log was last compacted
+//     00000002.seg    # the records appended since, in order
+//     00000003.seg
+//
+// Every segment is a list of frames: the length of the encrypted record (4
+// bytes, big endian), and the encrypted record. Records are appended to the
+// last segment until it's bigger than maxSegmentSize. Compacting writes a new
+// snapshot, after which the older segments are ignored (and removed).
+//
+// Appending only writes the new frames at the end of the last segment (see
+// Backend.Append). If the server crashes in the middle, the segment ends with
+// an incomplete frame: it is ignored when reading, and cut off when appending
+// again.
+//
+// A record is bound to its place in the log (the log's name, the segment and
+// its index in it), so that records can't be moved around. Records in the
+// legacy format (see cryptor.go) are only read while the store is migrated,
+// which compacts the log to rewrite them.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrCorruptedLog is returned when a segment which isn't the last one ends
+// with an incomplete record
+var ErrCorruptedLog = errors.New("corrupted log")
+
+const (
+	maxSegmentSize = 1 << 20
+
+	segmentExt  = ".seg"
+	snapshotExt = ".snap"
+)
+
+type recordLog struct {
+	backend Backend
+	// dir is the key of the log's folder (see storeKey)
+	dir     string
+	cryptor *Cryptor
+	// legacy counts the records in the legacy format if it isn't nil. They
+	// are refused otherwise
+	legacy *int
+}
+
+type segment struct {
+	n    int
+	name string
+	snap bool
+}
+
+func (l *recordLog) key(name string) string {
+	return l.dir + "/" + name
+}
+
+// segments returns the segments which are read, in order: the last snapshot
+// and the segments which came after it. stale are the older ones, which can
+// be removed
+func (l *recordLog) segments() (live, stale []segment, err error) {
+	keys, err := l.backend.List(l.dir + "/")
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing segments: %s", err)
+	}
+	var all []segment
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, l.dir+"/")
+		ext := path.Ext(name)
+		if ext != segmentExt && ext != snapshotExt {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(name, ext))
+		if err != nil {
+			continue
+		}
+		all = append(all, segment{n: n, name: name, snap: ext == snapshotExt})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].n < all[j].n })
+
+	start := 0
+	for i, s := range all {
+		if s.snap {
+			start = i
+		}
+	}
+	return all[start:], all[:start], nil
+}
+
+func segmentName(n int, ext string) string {
+	return fmt.Sprintf("%08d%s", n, ext)
+}
+
+// read calls fn with every record, oldest first
+func (l *recordLog) read(fn func(record []byte) error) error {
+	live, _, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for i, s := range live {
+		if err := l.readSegment(s, i == len(live)-1, fn); err != nil {
+			return fmt.Errorf("segment %s: %w", s.name, err)
+		}
+	}
+	return nil
+}
+
+func (l *recordLog) readSegment(s segment, last bool, fn func(record []byte) error) error {
+	content, err := l.backend.Get(l.key(s.name))
+	if err != nil {
+		return err
+	}
+	size, _, err := parseFrames(content, func(i int, ciphertext []byte) error {
+		var record []byte
+		var err error
+		if l.legacy != nil {
+			var legacy bool
+			record, legacy, err = l.cryptor.decryptMigrating(ciphertext, l.recordAD(s.name, i))
+			if legacy {
+				*l.legacy++
+			}
+		} else {
+			record, err = l.cryptor.Decrypt(ciphertext, l.recordAD(s.name, i))
+		}
+		if err != nil {
+			return fmt.Errorf("decrypting record: %w", err)
+		}
+		return fn(record)
+	})
+	if err != nil {
+		return err
+	}
+	// the segment ends in the middle of a frame: it's the record which was
+	// being appended if the segment is the last one
+	if size < len(content) && !last {
+		return fmt.Errorf("incomplete record (%w)", ErrCorruptedLog)
+	}
+	return nil
+}
+
+// parseFrames calls fn (if it isn't nil) with every complete frame of the
+// segment. It returns the size and the number of the complete frames
+func parseFrames(content []byte, fn func(i int, ciphertext []byte) error) (size, n int, err error) {
+	for size+4 <= len(content) {
+		length := int(binary.BigEndian.Uint32(content[size:]))
+		if length > len(content)-size-4 {
+			break
+		}
+		if fn != nil {
+			if err := fn(n, content[size+4:size+4+length]); err != nil {
+				return 0, 0, err
+			}
+		}
+		size += 4 + length
+		n++
+	}
+	return size, n, nil
+}
+
+// recordAD is the associated data of the record at index in the segment
+func (l *recordLog) recordAD(segment string, index int) []byte {
+	return []byte(fmt.Sprintf("/%s/%s#%d", l.dir, segment, index))
+}
+
+// frames encrypts the records, which go in the segment from index first
+func (l *recordLog) frames(records [][]byte, segment string, first int) ([]byte, error) {
+	var frames []byte
+	for i, record := range records {
+		ciphertext, err := l.cryptor.Encrypt(record, l.recordAD(segment, first+i))
+		if err != nil {
+			return nil, err
+		}
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(ciphertext)))
+		frames = append(frames, header[:]...)
+		frames = append(frames, ciphertext...)
+	}
+	return frames, nil
+}
+
+// append adds the records at the end of the log. The last segment is read to
+// number the records, but only the new frames are written
+func (l *recordLog) append(records [][]byte) error {
+	if len(records) == 0 {
+		return nil
+	}
+	live, _, err := l.segments()
+	if err != nil {
+		return err
+	}
+
+	name := segmentName(1, segmentExt)
+	var content []byte
+	if len(live) > 0 {
+		last := live[len(live)-1]
+		name = segmentName(last.n+1, segmentExt)
+		if !last.snap {
+			current, err := l.backend.Get(l.key(last.name))
+			if err != nil {
+				return fmt.Errorf("reading segment: %s", err)
+			}
+			if len(current) < maxSegmentSize {
+				name = last.name
+				content = current
+			}
+		}
+	}
+
+	end, n, err := parseFrames(content, nil)
+	if err != nil {
+		return err
+	}
+	frames, err := l.frames(records, name, n)
+	if err != nil {
+		return err
+	}
+	if end < len(content) {
+		// cut off the frame which was being appended when the server
+		// crashed
+		if err := l.backend.Put(l.key(name), append(content[:end], frames...)); err != nil {
+			return fmt.Errorf("writing segment: %s", err)
+		}
+		return nil
+	}
+	if err := l.backend.Append(l.key(name), frames); err != nil {
+		return fmt.Errorf("appending to segment: %s", err)
+	}
+	return nil
+}
+
+// compact replaces every record of the log with records
+func (l *recordLog) compact(records [][]byte) error {
+	live, _, err := l.segments()
+	if err != nil {
+		return err
+	}
+	n := 1
+	if len(live) > 0 {
+		n = live[len(live)-1].n + 1
+	}
+
+	// the snapshot only counts once it's complete
+	name := segmentName(n, snapshotExt)
+	frames, err := l.frames(records, name, 0)
+	if err != nil {
+		return err
+	}
+	if err := l.backend.Put(l.key(name), frames); err != nil {
+		return fmt.Errorf("writing snapshot: %s", err)
+	}
+
+	_, stale, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for _, s := range stale {
+		if err := l.backend.Delete(l.key(s.name)); err != nil {
+			return fmt.Errorf("removing old segment: %s", err)
+		}
+	}
+	return nil
+}
+
+// readAll returns every record of the log
+func (l *recordLog) readAll() ([][]byte, error) {
+	var records [][]byte
+	err := l.read(func(record []byte) error {
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+// migrate compacts the log if it has records in the legacy format, so that
+// they are all in the current one
+func (l *recordLog) migrate() error {
+	legacy := 0
+	migrating := *l
+	migrating.legacy = &legacy
+	records, err := migrating.readAll()
+	if err != nil || legacy == 0 {
+		return err
+	}
+	return l.compact(records)
+}
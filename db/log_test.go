@@ -0,0 +1,166 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func newTestLog(t *testing.T) *recordLog {
+	t.Helper()
+	cryptor, err := NewCryptor(keys[0], keys[1])
+	if err != nil {
+		t.Fatalf("creating cryptor: %s", err)
+	}
+	backend := NewFSBackend(filepath.Join(storedir, "test-"+t.Name()))
+	return &recordLog{backend: backend, dir: "log", cryptor: cryptor}
+}
+
+func checkSegments(t *testing.T, l *recordLog, want ...string) {
+	t.Helper()
+	keys, err := l.backend.List(l.dir + "/")
+	if err != nil {
+		t.Fatalf("listing segments: %s", err)
+	}
+	for i := range want {
+		want[i] = l.key(want[i])
+	}
+	if fmt.Sprint(keys) != fmt.Sprint(want) {
+		t.Errorf("should have segments %v, got %v", want, keys)
+	}
+}
+
+func checkRecords(t *testing.T, l *recordLog, want ...string) {
+	t.Helper()
+	records, err := l.readAll()
+	if err != nil {
+		t.Fatalf("reading log: %s", err)
+	}
+	if got := fmt.Sprintf("%q", records); got != fmt.Sprintf("%q", want) {
+		t.Errorf("should have records %q, got %s", want, got)
+	}
+}
+
+func TestLog(t *testing.T) {
+	t.Parallel()
+	l := newTestLog(t)
+
+	checkRecords(t, l)
+	if err := l.append([][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatalf("appending: %s", err)
+	}
+	if err := l.append([][]byte{[]byte("c")}); err != nil {
+		t.Fatalf("appending: %s", err)
+	}
+	checkRecords(t, l, "a", "b", "c")
+
+	if err := l.compact([][]byte{[]byte("c")}); err != nil {
+		t.Fatalf("compacting: %s", err)
+	}
+	if err := l.append([][]byte{[]byte("d")}); err != nil {
+		t.Fatalf("appending: %s", err)
+	}
+	checkRecords(t, l, "c", "d")
+	checkSegments(t, l, "00000002.snap", "00000003.seg")
+}
+
+func TestLogCrash(t *testing.T) {
+	t.Parallel()
+	l := newTestLog(t)
+
+	if err := l.append([][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatalf("appending: %s", err)
+	}
+	// the server crashed while appending c
+	frames, err := l.frames([][]byte{[]byte("c")}, segmentName(1, segmentExt), 2)
+	if err != nil {
+		t.Fatalf("encrypting: %s", err)
+	}
+	key := l.key(segmentName(1, segmentExt))
+	content, err := l.backend.Get(key)
+	if err != nil {
+		t.Fatalf("reading segment: %s", err)
+	}
+	if err := l.backend.Put(key, append(content, frames[:len(frames)/2]...)); err != nil {
+		t.Fatalf("writing half a frame: %s", err)
+	}
+	checkRecords(t, l, "a", "b")
+
+	if err := l.append([][]byte{[]byte("d")}); err != nil {
+		t.Fatalf("appending after crash: %s", err)
+	}
+	checkRecords(t, l, "a", "b", "d")
+
+	// a compaction which crashed before the snapshot was complete
+	tmp := filepath.Join(storedir, "test-"+t.Name(), "log", segmentName(2, snapshotExt)+".1"+tempSuffix)
+	if err := ioutil.WriteFile(tmp, []byte("garbage"), 0600); err != nil {
+		t.Fatalf("writing temporary snapshot: %s", err)
+	}
+	checkRecords(t, l, "a", "b", "d")
+	if err := l.compact(nil); err != nil {
+		t.Fatalf("compacting: %s", err)
+	}
+	checkRecords(t, l)
+
+	// an incomplete record in the middle of the log is corruption
+	if err := l.append([][]byte{[]byte("e")}); err != nil {
+		t.Fatalf("appending: %s", err)
+	}
+	key = l.key(segmentName(3, segmentExt))
+	content, err = l.backend.Get(key)
+	if err != nil {
+		t.Fatalf("reading segment: %s", err)
+	}
+	if err := l.backend.Put(key, content[:len(content)-1]); err != nil {
+		t.Fatalf("truncating segment: %s", err)
+	}
+	if err := l.backend.Put(l.key(segmentName(4, segmentExt)), nil); err != nil {
+		t.Fatalf("writing segment: %s", err)
+	}
+	if _, err := l.readAll(); !errors.Is(err, ErrCorruptedLog) {
+		t.Errorf("should have ErrCorruptedLog, got %v", err)
+	}
+}
+
+func TestLogTampering(t *testing.T) {
+	t.Parallel()
+	l := newTestLog(t)
+
+	if err := l.append([][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatalf("appending: %s", err)
+	}
+	// swap the two records
+	key := l.key(segmentName(1, segmentExt))
+	content, err := l.backend.Get(key)
+	if err != nil {
+		t.Fatalf("reading segment: %s", err)
+	}
+	half := len(content) / 2
+	swapped := append(append([]byte(nil), content[half:]...), content[:half]...)
+	if err := l.backend.Put(key, swapped); err != nil {
+		t.Fatalf("writing segment: %s", err)
+	}
+	if _, err := l.readAll(); !errors.Is(err, ErrDifferentMACSum) {
+		t.Errorf("should have ErrDifferentMACSum, got %v", err)
+	}
+}
+
+func TestLogSegments(t *testing.T) {
+	t.Parallel()
+	l := newTestLog(t)
+
+	big := bytes.Repeat([]byte("x"), maxSegmentSize/3)
+	var want []string
+	for i := 0; i < 5; i++ {
+		record := append([]byte(fmt.Sprint(i)), big...)
+		if err := l.append([][]byte{record}); err != nil {
+			t.Fatalf("appending: %s", err)
+		}
+		want = append(want, string(record))
+	}
+	checkRecords(t, l, want...)
+	checkSegments(t, l, "00000001.seg", "00000002.seg")
+}
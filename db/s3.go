@@ -0,0 +1,320 @@
+package db
+
+// S3Backend keeps the files in a bucket of an S3-compatible object storage
+// (AWS, MinIO, ...). It only uses a handful of plain HTTP requests, signed
+// with AWS Signature Version 4, so it doesn't need the SDK:
+//
+//     GET    /bucket/key                  Get
+//     PUT    /bucket/key                  Put (objects are replaced atomically)
+//     DELETE /bucket/key                  Delete
+//     GET    /bucket?list-type=2&prefix=  List (ListObjectsV2)
+//     PUT    /bucket/key + copy source    Rename, followed by a DELETE
+//
+// Objects can't be appended to, so Append gets the object and puts it back
+// with the content at the end.
+//
+// The URLs are path style (the bucket isn't in the host name), which is what
+// MinIO expects.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config is where the bucket is, and how to access it
+type S3Config struct {
+	// Endpoint is the URL of the server, like http://localhost:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is added in front of every key, so that several stores can
+	// share a bucket (users/1/ for example)
+	Prefix string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+type S3Backend struct {
+	config S3Config
+}
+
+// NewS3Backend returns the backend for the bucket. It must exist
+func NewS3Backend(config S3Config) *S3Backend {
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &S3Backend{config: config}
+}
+
+// S3Backends keeps the files in the bucket, under config.Prefix
+func S3Backends(config S3Config) Backends {
+	return func(prefix string) Backend {
+		c := config
+		if prefix != "" {
+			c.Prefix += prefix + "/"
+		}
+		return NewS3Backend(c)
+	}
+}
+
+// s3Error is the body of a failed request
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request for the object key (the bucket itself if it's
+// empty). It returns the status code and the body of the response
+func (b *S3Backend) do(method, key string, query url.Values, header http.Header, body []byte) (int, []byte, error) {
+	u, err := url.Parse(b.config.Endpoint)
+	if err != nil {
+		return 0, nil, fmt.Errorf("parsing endpoint: %s", err)
+	}
+	path := "/" + b.config.Bucket
+	if key != "" {
+		path += "/" + b.config.Prefix + key
+	}
+	// S3 wants every character but the unreserved ones escaped, which is
+	// more than url.URL does
+	u.RawPath = u.EscapedPath() + uriEncode(path, false)
+	u.Path += path
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, fmt.Errorf("creating request: %s", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), b.config.AccessKey, b.config.SecretKey, b.config.Region, time.Now())
+
+	res, err := b.config.Client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading response: %s", err)
+	}
+	return res.StatusCode, content, nil
+}
+
+// checkS3 returns the error of a failed request
+func checkS3(op, key string, status int, body []byte) error {
+	if status >= 200 && status < 300 {
+		return nil
+	}
+	var e s3Error
+	if xml.Unmarshal(body, &e) != nil || e.Code == "" {
+		return fmt.Errorf("s3 %s %q: status %d", op, key, status)
+	}
+	if e.Code == "NoSuchKey" {
+		return notExist(op, key)
+	}
+	return fmt.Errorf("s3 %s %q: %s: %s", op, key, e.Code, e.Message)
+}
+
+func (b *S3Backend) Get(key string) ([]byte, error) {
+	status, body, err := b.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkS3("get", key, status, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (b *S3Backend) Put(key string, content []byte) error {
+	status, body, err := b.do(http.MethodPut, key, nil, nil, content)
+	if err != nil {
+		return err
+	}
+	return checkS3("put", key, status, body)
+}
+
+func (b *S3Backend) Append(key string, content []byte) error {
+	current, err := b.Get(key)
+	var patherr *os.PathError
+	if errors.As(err, &patherr) && os.IsNotExist(patherr) {
+		current = nil
+	} else if err != nil {
+		return err
+	}
+	return b.Put(key, append(current, content...))
+}
+
+func (b *S3Backend) Delete(key string) error {
+	status, body, err := b.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		return nil
+	}
+	return checkS3("delete", key, status, body)
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *S3Backend) List(prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {b.config.Prefix + prefix},
+	}
+	for {
+		status, body, err := b.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkS3("list", prefix, status, body); err != nil {
+			return nil, err
+		}
+		var result listBucketResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("parsing list: %s", err)
+		}
+		for _, content := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(content.Key, b.config.Prefix))
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Rename copies the file, and removes the original. The copy replaces the
+// destination atomically, but the original is left behind if the server
+// crashes in between
+func (b *S3Backend) Rename(from, to string) error {
+	header := http.Header{
+		"X-Amz-Copy-Source": {uriEncode("/"+b.config.Bucket+"/"+b.config.Prefix+from, false)},
+	}
+	status, body, err := b.do(http.MethodPut, to, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	if err := checkS3("rename", from, status, body); err != nil {
+		return err
+	}
+	// a copy can fail after the status was sent
+	if bytes.Contains(body, []byte("<Error>")) {
+		return checkS3("rename", from, http.StatusInternalServerError, body)
+	}
+	return b.Delete(from)
+}
+
+func (b *S3Backend) String() string {
+	return b.config.Endpoint + "/" + b.config.Bucket + "/" + b.config.Prefix
+}
+
+// signV4 signs the request with AWS Signature Version 4. payloadHash is the
+// hex encoded SHA-256 of the body. Every header already set is signed
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, t time.Time) {
+	t = t.UTC()
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// uriEncode escapes every character but the unreserved ones (and slashes if
+// encodeSlash is false), the way AWS does
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes the query sorted by name, which is the order it's
+// signed in
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
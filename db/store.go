@@ -0,0 +1,178 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Store is a folder of encrypted files. It's a user's own folder (User), or a
+// ledger shared between several users (Ledger)
+type Store interface {
+	Load(filename string) ([]byte, error)
+	Save(filename string, plaintext []byte) error
+	// Remove doesn't fail if the file doesn't exist
+	Remove(filename string) error
+
+	// Append adds records at the end of a log (see log.go), without rewriting
+	// the ones already in it
+	Append(filename string, records ...[]byte) error
+	// ReadLog calls fn with every record of the log, oldest first. A log
+	// which doesn't exist is empty
+	ReadLog(filename string, fn func(record []byte) error) error
+	// Compact replaces every record of the log
+	Compact(filename string, records [][]byte) error
+	// String identifies the store in logs
+	String() string
+
+	// Lock locks the whole store for writing, RLock for reading (see
+	// lock.go). The files are locked on their own anyway, these are for
+	// changes which read files and save them back
+	Lock() (unlock func())
+	RLock() (unlock func())
+
+	// Migrate rewrites the files still in the legacy format (see cryptor.go).
+	// Until it's called, they can't be read. The store must be locked for
+	// writing
+	Migrate() error
+}
+
+// formatFile marks a migrated store. Once it's there, files in the legacy
+// format are refused, so that an old file can't be put back in place of a
+// new one
+const formatFile = "/format"
+
+// files implements Store for User and Ledger: the files are encrypted with
+// cryptor, and kept in backend
+type files struct {
+	backend Backend
+	cryptor *Cryptor
+	// plain are the keys (or the prefixes of the keys, when they end with a
+	// slash) of the backend's files which aren't the store's: they aren't
+	// encrypted with cryptor
+	plain []string
+}
+
+// keys returns the keys of the store's files
+func (f *files) keys() ([]string, error) {
+	all, err := f.backend.List("")
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, key := range all {
+		plain := false
+		for _, p := range f.plain {
+			if key == p || strings.HasSuffix(p, "/") && strings.HasPrefix(key, p) {
+				plain = true
+			}
+		}
+		if !plain {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// lockKey is the key of a file's lock (see lock.go)
+func (f *files) lockKey(key string) string {
+	return f.backend.String() + "/" + key
+}
+
+func (f *files) Save(filename string, plaintext []byte) error {
+	key := storeKey(filename)
+	defer LockPath(f.lockKey(key))()
+	return f.cryptor.Save(f.backend, key, fileAD(key), plaintext)
+}
+
+func (f *files) Load(filename string) ([]byte, error) {
+	key := storeKey(filename)
+	defer RLockPath(f.lockKey(key))()
+	return f.cryptor.Load(f.backend, key, fileAD(key))
+}
+
+// Remove deletes the file. It isn't an error if it doesn't exist
+func (f *files) Remove(filename string) error {
+	key := storeKey(filename)
+	defer LockPath(f.lockKey(key))()
+	return f.backend.Delete(key)
+}
+
+func (f *files) log(filename string) *recordLog {
+	return &recordLog{backend: f.backend, dir: storeKey(filename), cryptor: f.cryptor}
+}
+
+func (f *files) Append(filename string, records ...[]byte) error {
+	l := f.log(filename)
+	defer LockPath(f.lockKey(l.dir))()
+	return l.append(records)
+}
+
+func (f *files) ReadLog(filename string, fn func(record []byte) error) error {
+	l := f.log(filename)
+	defer RLockPath(f.lockKey(l.dir))()
+	return l.read(fn)
+}
+
+func (f *files) Compact(filename string, records [][]byte) error {
+	l := f.log(filename)
+	defer LockPath(f.lockKey(l.dir))()
+	return l.compact(records)
+}
+
+// Lock locks the whole store for writing. Every store on the same backend
+// shares the lock
+func (f *files) Lock() (unlock func()) {
+	// the empty key keeps it apart from the lock of a file
+	return LockPath(f.lockKey(""))
+}
+
+// RLock locks the whole store for reading
+func (f *files) RLock() (unlock func()) {
+	return RLockPath(f.lockKey(""))
+}
+
+// Migrate rewrites the files and the logs which are in the legacy format, and
+// marks the store as migrated. The files of a log are in a folder, the
+// others are at the root of the store
+func (f *files) Migrate() error {
+	key := storeKey(formatFile)
+	_, err := f.cryptor.Load(f.backend, key, fileAD(key))
+	var patherr *os.PathError
+	if err == nil {
+		return nil
+	} else if !errors.As(err, &patherr) || !os.IsNotExist(patherr) {
+		return fmt.Errorf("loading format: %s", err)
+	}
+
+	keys, err := f.keys()
+	if err != nil {
+		return fmt.Errorf("listing files: %s", err)
+	}
+	logs := make(map[string]bool)
+	for _, k := range keys {
+		if strings.Contains(k, "/") {
+			logs[path.Dir(k)] = true
+			continue
+		}
+		unlock := LockPath(f.lockKey(k))
+		err := f.cryptor.migrate(f.backend, k, fileAD(k))
+		unlock()
+		if err != nil {
+			return fmt.Errorf("migrating %s: %s", k, err)
+		}
+	}
+	for dir := range logs {
+		l := f.log(dir)
+		unlock := LockPath(f.lockKey(l.dir))
+		err := l.migrate()
+		unlock()
+		if err != nil {
+			return fmt.Errorf("migrating %s: %s", dir, err)
+		}
+	}
+	return f.Save(formatFile, []byte(strconv.Itoa(formatVersion)))
+}
@@ -11,25 +11,23 @@ import (
 
 // Maybe rename to db.go?
 
+// secretsFolder is where the keysmanager keeps a user's keys, in their root
+const secretsFolder = "secrets"
+
 // UserDB is the folder containing all the user's data.
 // Everything in their is encrypted using his password
 type User struct {
-	// root is the user's own folder (see api.go)
-	ID          int
-	Email       string
-	root        string
-	cryptor     *Cryptor
+	// root is the user's own folder (see api.go). Their keys are there, their
+	// files are in the backend
+	ID    int
+	Email string
+	root  string
+	files
 	keysmanager *keysmanager.KeysManager
 }
 
-func (u *User) Save(filename string, plaintext []byte) error {
-	path := JoinRootPath(u.root, filename)
-	return u.cryptor.Save(path, plaintext)
-}
-
-func (u *User) Load(filename string) ([]byte, error) {
-	path := JoinRootPath(u.root, filename)
-	return u.cryptor.Load(path)
+func (u *User) String() string {
+	return u.Email
 }
 
 // Login can return keysmanager.ErrWrongPassword, keysmanager.ErrPrivCorrupted,
@@ -58,6 +56,10 @@ func (u *User) Login(password []byte) error {
 	}
 	u.cryptor = c
 
+	if err := u.ensureKeyPair(); err != nil {
+		return fmt.Errorf("db.login ensureKeyPair: %s", err)
+	}
+
 	return nil
 }
 
@@ -88,14 +90,26 @@ func (u *User) SignUp(password []byte) error {
 	}
 	u.cryptor = c
 
+	if err := u.ensureKeyPair(); err != nil {
+		return fmt.Errorf("db.signup ensureKeyPair: %s", err)
+	}
+
 	return nil
 }
 
+// NewUser returns the user whose keys and files are in root
 func NewUser(id int, email, root string) *User {
+	return NewUserWithBackend(id, email, root, NewFSBackend(root))
+}
+
+// NewUserWithBackend returns the user whose keys are in root, and files in
+// backend
+func NewUserWithBackend(id int, email, root string, backend Backend) *User {
 	return &User{
 		root:        root,
 		Email:       email,
 		ID:          id,
-		keysmanager: keysmanager.NewKeysManager(filepath.Join(root, "secrets")),
+		files:       files{backend: backend, plain: []string{publicKeyFile}},
+		keysmanager: keysmanager.NewKeysManager(filepath.Join(root, secretsFolder)),
 	}
 }
@@ -4,10 +4,30 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
+	"github.com/math2001/money/db"
 	"github.com/math2001/money/server"
 )
 
+// backends keeps the files in an S3-compatible bucket if MONEY_S3_ENDPOINT is
+// set, and in the data folder otherwise (nil)
+func backends() db.Backends {
+	endpoint := os.Getenv("MONEY_S3_ENDPOINT")
+	if endpoint == "" {
+		return nil
+	}
+	log.Printf("Storing the files in %s", endpoint)
+	return db.S3Backends(db.S3Config{
+		Endpoint:  endpoint,
+		Region:    os.Getenv("MONEY_S3_REGION"),
+		Bucket:    os.Getenv("MONEY_S3_BUCKET"),
+		AccessKey: os.Getenv("MONEY_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("MONEY_S3_SECRET_KEY"),
+		Prefix:    os.Getenv("MONEY_S3_PREFIX"),
+	})
+}
+
 func main() {
 	fmt.Println("Welcome to Money!")
 	fmt.Println("=================")
@@ -18,7 +38,7 @@ func main() {
 	// FIXME: make this configurable
 	ocrserver := "localhost:31563" // int("ocr", 10 + 26) -> 31563
 
-	handler, err := server.New("data", ocrserver, password)
+	handler, err := server.New("data", ocrserver, password, backends())
 	if err != nil {
 		log.Fatalf("creating server: %s", err)
 	}
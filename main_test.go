@@ -33,7 +33,7 @@ func TestLegalMethods(t *testing.T) {
 	var logs strings.Builder
 	logs.WriteString("Logs:\n")
 	log.SetOutput(&logs)
-	handler, err := server.New(dataroot, []byte(""))
+	handler, err := server.New(dataroot, "", []byte(""), nil)
 
 	type headers map[string]string
 	type resp struct {
@@ -115,17 +115,29 @@ export default class AddManual {
       payment[input.value] = corresponding.value;
     }
 
-    payment["amount"] = parseFloat(payment["amount"]);
-
+    // the amount is sent as typed (a string) so that it isn't rounded to a
+    // float
     const formdata = new FormData();
     formdata.append("payment", JSON.stringify(payment));
 
-    const resp = await fetch(this.form.action, {
+    let resp = await fetch(this.form.action, {
       method: this.form.method,
       body: formdata
     });
 
-    const obj = await resp.json();
+    let obj = await resp.json();
+    if (obj.id === "duplicate payment") {
+      // strict mode: the user has to confirm it isn't a duplicate
+      if (!confirm(obj.msg)) {
+        return;
+      }
+      formdata.append("force", "1");
+      resp = await fetch(this.form.action, {
+        method: this.form.method,
+        body: formdata
+      });
+      obj = await resp.json();
+    }
     if (obj.kind === undefined) {
       console.error(obj);
       throw new Error("expected 'kind' field");
@@ -22,16 +22,22 @@ export default class List {
       throw new Error("expected kind 'success'");
     }
 
-    const payments = obj.payments;
-    if (payments === null) {
+    if (obj.payments === null) {
       this.table.textContent = "No payments yet";
       return;
     }
-    if (!Array.isArray(payments)) {
-      console.error(payments);
+    if (!Array.isArray(obj.payments)) {
+      console.error(obj.payments);
       throw new Error("expected array of payments");
     }
 
+    // custom fields are displayed like any other field
+    const payments = obj.payments.map((p: { [key: string]: any }) => {
+      const flat = Object.assign({}, p, p.custom);
+      delete flat.custom;
+      return flat;
+    });
+
     const head = document.createElement("tr");
 
     const fields = new Set<string>();
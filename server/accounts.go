@@ -0,0 +1,343 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/math2001/money/api"
+)
+
+// accountErrorResp returns the response for the errors caused by the user,
+// and nil for the others
+func accountErrorResp(err error) *resp {
+	if errors.Is(err, api.ErrAccountNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no account with this id",
+			},
+		}
+	} else if errors.Is(err, api.ErrInvalidAccount) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "error",
+				"id":   "invalid account",
+				"msg":  err.Error(),
+			},
+		}
+	} else if errors.Is(err, api.ErrAccountInUse) {
+		return &resp{
+			code: http.StatusConflict,
+			msg: kv{
+				"kind": "error",
+				"id":   "account in use",
+				"msg":  "payments or transfers use this account",
+			},
+		}
+	} else if errors.Is(err, api.ErrTransferNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no transfer with this id",
+			},
+		}
+	} else if errors.Is(err, api.ErrInvalidTransfer) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "error",
+				"id":   "invalid transfer",
+				"msg":  err.Error(),
+			},
+		}
+	}
+	return nil
+}
+
+func (s *Server) listAccounts(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	accounts, err := s.api.ListAccounts(user)
+	if err != nil {
+		log.Printf("[err] listing accounts: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":     "success",
+			"accounts": accounts,
+		},
+	}
+}
+
+func (s *Server) addAccount(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	account, err := s.api.AddAccount(user, []byte(r.PostFormValue("account")), api.NewDate(time.Now()))
+	if errresp := accountErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] adding account: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":    "success",
+			"account": account,
+		},
+	}
+}
+
+func (s *Server) updateAccount(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	r.ParseMultipartForm(1 << 20) // 1 MB of memory
+
+	account, err := s.api.UpdateAccount(user, mux.Vars(r)["id"], []byte(r.PostFormValue("account")))
+	if errresp := accountErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] updating account: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":    "success",
+			"account": account,
+		},
+	}
+}
+
+func (s *Server) deleteAccount(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	err := s.api.DeleteAccount(user, mux.Vars(r)["id"])
+	if errresp := accountErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] deleting account: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
+
+// balances returns the balance of every account at the end of today, or of
+// ?date=YYYY-MM-DD
+func (s *Server) balances(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	on := api.NewDate(time.Now())
+	if date := r.URL.Query().Get("date"); date != "" {
+		var err error
+		if on, err = api.ParseDate(date); err != nil {
+			return &resp{
+				code: http.StatusBadRequest,
+				msg: kv{
+					"kind": "bad request",
+					"msg":  "invalid 'date': " + err.Error(),
+				},
+			}
+		}
+	}
+
+	balances, err := s.api.Balances(user, on)
+	if err != nil {
+		log.Printf("[err] computing balances: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":     "success",
+			"date":     on,
+			"balances": balances,
+		},
+	}
+}
+
+// listTransfers returns the transfers, optionally between from and to
+func (s *Server) listTransfers(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	values := r.URL.Query()
+	query, err := parsePaymentsQuery(url.Values{
+		"from": values["from"],
+		"to":   values["to"],
+	})
+	if err != nil {
+		return &resp{
+			code: http.StatusBadRequest,
+			msg: kv{
+				"kind": "bad request",
+				"msg":  err.Error(),
+			},
+		}
+	}
+
+	transfers, err := s.api.ListTransfers(user, query.From, query.To)
+	if err != nil {
+		log.Printf("[err] listing transfers: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":      "success",
+			"transfers": transfers,
+		},
+	}
+}
+
+func (s *Server) addTransfer(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	transfer, err := s.api.AddTransfer(user, []byte(r.PostFormValue("transfer")))
+	if errresp := accountErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] adding transfer: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":     "success",
+			"transfer": transfer,
+		},
+	}
+}
+
+func (s *Server) updateTransfer(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	r.ParseMultipartForm(1 << 20) // 1 MB of memory
+
+	transfer, err := s.api.UpdateTransfer(user, mux.Vars(r)["id"], []byte(r.PostFormValue("transfer")))
+	if errresp := accountErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] updating transfer: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":     "success",
+			"transfer": transfer,
+		},
+	}
+}
+
+func (s *Server) deleteTransfer(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	err := s.api.DeleteTransfer(user, mux.Vars(r)["id"])
+	if errresp := accountErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] deleting transfer: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
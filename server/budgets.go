@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/math2001/money/api"
+)
+
+// budgetErrorResp returns the response for the errors caused by the user, and
+// nil for the others
+func budgetErrorResp(err error) *resp {
+	if errors.Is(err, api.ErrBudgetNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no budget with this id",
+			},
+		}
+	} else if errors.Is(err, api.ErrInvalidBudget) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "error",
+				"id":   "invalid budget",
+				"msg":  err.Error(),
+			},
+		}
+	}
+	return nil
+}
+
+// listBudgets returns the status of every budget for the current period, or
+// the period ?date=YYYY-MM-DD is in
+func (s *Server) listBudgets(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	on := api.NewDate(time.Now())
+	if date := r.URL.Query().Get("date"); date != "" {
+		var err error
+		if on, err = api.ParseDate(date); err != nil {
+			return &resp{
+				code: http.StatusBadRequest,
+				msg: kv{
+					"kind": "bad request",
+					"msg":  "invalid 'date': " + err.Error(),
+				},
+			}
+		}
+	}
+
+	budgets, err := s.api.BudgetStatuses(user, on)
+	if err != nil {
+		log.Printf("[err] listing budgets: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":    "success",
+			"budgets": budgets,
+		},
+	}
+}
+
+func (s *Server) addBudget(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	budget, err := s.api.AddBudget(user, []byte(r.PostFormValue("budget")), api.NewDate(time.Now()))
+	if errresp := budgetErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] adding budget: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":   "success",
+			"budget": budget,
+		},
+	}
+}
+
+func (s *Server) updateBudget(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	r.ParseMultipartForm(1 << 20) // 1 MB of memory
+
+	budget, err := s.api.UpdateBudget(user, mux.Vars(r)["id"], []byte(r.PostFormValue("budget")))
+	if errresp := budgetErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] updating budget: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":   "success",
+			"budget": budget,
+		},
+	}
+}
+
+func (s *Server) deleteBudget(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	err := s.api.DeleteBudget(user, mux.Vars(r)["id"])
+	if errresp := budgetErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] deleting budget: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/math2001/money/api"
+)
+
+// categoryErrorResp returns the response for the errors caused by the user,
+// and nil for the others
+func categoryErrorResp(err error) *resp {
+	if errors.Is(err, api.ErrInvalidCategory) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "error",
+				"id":   "invalid category",
+				"msg":  err.Error(),
+			},
+		}
+	} else if errors.Is(err, api.ErrCategoryNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  err.Error(),
+			},
+		}
+	} else if errors.Is(err, api.ErrCategoryExists) {
+		return &resp{
+			code: http.StatusConflict,
+			msg: kv{
+				"kind": "error",
+				"id":   "category already exists",
+				"msg":  err.Error(),
+			},
+		}
+	} else if errors.Is(err, api.ErrCategoryInUse) {
+		return &resp{
+			code: http.StatusConflict,
+			msg: kv{
+				"kind": "error",
+				"id":   "category in use",
+				"msg":  err.Error(),
+				"help": []string{
+					"merge the category into an other one instead",
+				},
+			},
+		}
+	}
+	return nil
+}
+
+func (s *Server) listCategories(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	categories, err := s.api.ListCategories(user)
+	if err != nil {
+		log.Printf("[err] listing categories: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":       "success",
+			"categories": categories,
+		},
+	}
+}
+
+func (s *Server) addCategory(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	path, err := s.api.AddCategory(user, r.PostFormValue("category"))
+	if errresp := categoryErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] adding category: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":     "success",
+			"category": path,
+		},
+	}
+}
+
+func (s *Server) renameCategory(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	r.ParseMultipartForm(1 << 20) // 1 MB of memory
+
+	err := s.api.RenameCategory(user, r.PostFormValue("from"), r.PostFormValue("to"))
+	if errresp := categoryErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] renaming category: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
+
+func (s *Server) mergeCategory(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	err := s.api.MergeCategory(user, r.PostFormValue("from"), r.PostFormValue("into"))
+	if errresp := categoryErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] merging category: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
+
+func (s *Server) deleteCategory(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	err := s.api.DeleteCategory(user, r.URL.Query().Get("category"))
+	if errresp := categoryErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] deleting category: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
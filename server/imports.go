@@ -0,0 +1,240 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/math2001/money/api"
+)
+
+// profileErrorResp returns the response for the errors caused by the user, and
+// nil for the others
+func profileErrorResp(err error) *resp {
+	if errors.Is(err, api.ErrProfileNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no import profile with this id",
+			},
+		}
+	} else if errors.Is(err, api.ErrInvalidProfile) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "error",
+				"id":   "invalid import profile",
+				"msg":  err.Error(),
+			},
+		}
+	}
+	return nil
+}
+
+func (s *Server) listImportProfiles(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	profiles, err := s.api.ListImportProfiles(user)
+	if err != nil {
+		log.Printf("[err] listing import profiles: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":     "success",
+			"profiles": profiles,
+		},
+	}
+}
+
+func (s *Server) addImportProfile(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	profile, err := s.api.AddImportProfile(user, []byte(r.PostFormValue("profile")))
+	if errresp := profileErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] adding import profile: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":    "success",
+			"profile": profile,
+		},
+	}
+}
+
+func (s *Server) updateImportProfile(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	r.ParseMultipartForm(1 << 20) // 1 MB of memory
+
+	profile, err := s.api.UpdateImportProfile(user, mux.Vars(r)["id"], []byte(r.PostFormValue("profile")))
+	if errresp := profileErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] updating import profile: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":    "success",
+			"profile": profile,
+		},
+	}
+}
+
+func (s *Server) deleteImportProfile(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	err := s.api.DeleteImportProfile(user, mux.Vars(r)["id"])
+	if errresp := profileErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] deleting import profile: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
+
+// importOptions reads preview=1 and force=1
+func importOptions(r *http.Request) api.ImportOptions {
+	return api.ImportOptions{
+		Preview: r.FormValue("preview") == "1",
+		Force:   r.FormValue("force") == "1",
+	}
+}
+
+// importCSV imports the uploaded "file" with the import profile "profile".
+// With preview=1, nothing is saved. With force=1, rows which look like
+// existing payments are imported even in strict mode
+func (s *Server) importCSV(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		log.Printf("[err] import csv: loading file from post request: %s", err)
+		return &resp{
+			code: http.StatusBadRequest,
+			msg: kv{
+				"kind": "bad request",
+				"msg":  "error occurred when uploading file",
+			},
+		}
+	}
+	defer file.Close()
+
+	opts := importOptions(r)
+	result, err := s.api.ImportCSV(user, r.FormValue("profile"), file, opts)
+	return importResp(result, opts, err)
+}
+
+// importOFX imports the uploaded OFX or QFX "file". It takes the same options
+// as importCSV
+func (s *Server) importOFX(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		log.Printf("[err] import ofx: loading file from post request: %s", err)
+		return &resp{
+			code: http.StatusBadRequest,
+			msg: kv{
+				"kind": "bad request",
+				"msg":  "error occurred when uploading file",
+			},
+		}
+	}
+	defer file.Close()
+
+	opts := importOptions(r)
+	result, err := s.api.ImportOFX(user, file, opts)
+	return importResp(result, opts, err)
+}
+
+// importResp is the response of the import handlers
+func importResp(result *api.ImportResult, opts api.ImportOptions, err error) *resp {
+	if errresp := profileErrorResp(err); errresp != nil {
+		return errresp
+	} else if errors.Is(err, api.ErrInvalidImport) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind":   "error",
+				"id":     "invalid import",
+				"msg":    err.Error(),
+				"result": result,
+			},
+		}
+	} else if err != nil {
+		log.Printf("[err] importing payments: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":    "success",
+			"preview": opts.Preview,
+			"result":  result,
+		},
+	}
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/math2001/money/api"
+	"github.com/math2001/money/db"
+)
+
+// ledgerErrorResp returns the response for the errors caused by the user,
+// and nil for the others
+func ledgerErrorResp(err error) *resp {
+	if errors.Is(err, api.ErrLedgerNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no ledger with this id",
+			},
+		}
+	} else if errors.Is(err, api.ErrInviteNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no invite to this ledger",
+			},
+		}
+	} else if errors.Is(err, api.ErrUnknownUser) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "nobody signed up with this email",
+			},
+		}
+	} else if errors.Is(err, api.ErrInvalidLedger) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "error",
+				"id":   "invalid ledger",
+				"msg":  err.Error(),
+			},
+		}
+	}
+	return nil
+}
+
+// currentStore is currentUser for the handlers which work on the user's data:
+// with ?ledger={id}, they work on that shared ledger instead. The changes are
+// recorded in the history as made by the user, from this session. The store
+// is locked until the response is sent (see lockStore)
+func (s *Server) currentStore(r *http.Request) (db.Store, *resp) {
+	user, session, errresp := s.currentSession(r)
+	if errresp != nil {
+		return nil, errresp
+	}
+	store, errresp := s.userStore(r, user)
+	if errresp != nil {
+		return nil, errresp
+	}
+	s.lockStore(r, store)
+	return api.ActingAs(store, api.Actor{
+		UserID:  user.ID,
+		Email:   user.Email,
+		Session: session.Login,
+		Device:  r.UserAgent(),
+	}), nil
+}
+
+// userStore returns the ledger given in ?ledger=, or the user's own store
+func (s *Server) userStore(r *http.Request, user *db.User) (db.Store, *resp) {
+	id := r.URL.Query().Get("ledger")
+	if id == "" {
+		return user, nil
+	}
+	ledger, err := s.api.OpenLedger(user, id)
+	if errresp := ledgerErrorResp(err); errresp != nil {
+		return nil, errresp
+	} else if err != nil {
+		log.Printf("[err] opening ledger %s: %s", id, err)
+		return nil, &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+	s.runRecurring(ledger, false)
+	return ledger, nil
+}
+
+func (s *Server) listLedgers(r *http.Request) *resp {
+	user, errresp := s.currentUser(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	ledgers, err := s.api.ListLedgers(user)
+	if err != nil {
+		log.Printf("[err] listing ledgers: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+	invites, err := s.api.ListInvites(user)
+	if err != nil {
+		log.Printf("[err] listing invites: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":    "success",
+			"ledgers": ledgers,
+			"invites": invites,
+		},
+	}
+}
+
+func (s *Server) createLedger(r *http.Request) *resp {
+	user, errresp := s.currentUser(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	ledger, err := s.api.CreateLedger(user, r.PostFormValue("name"))
+	if errresp := ledgerErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] creating ledger: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":   "success",
+			"ledger": ledger,
+		},
+	}
+}
+
+// inviteMember invites the user who signed up with the email (form value
+// "email"). They need to accept before they can see the ledger
+func (s *Server) inviteMember(r *http.Request) *resp {
+	user, errresp := s.currentUser(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	ledger, err := s.api.InviteMember(user, mux.Vars(r)["id"], r.PostFormValue("email"))
+	if errresp := ledgerErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] inviting member: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":   "success",
+			"ledger": ledger,
+		},
+	}
+}
+
+func (s *Server) acceptInvite(r *http.Request) *resp {
+	user, errresp := s.currentUser(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	ledger, err := s.api.AcceptInvite(user, mux.Vars(r)["id"])
+	if errresp := ledgerErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] accepting invite: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":   "success",
+			"ledger": ledger,
+		},
+	}
+}
+
+func (s *Server) declineInvite(r *http.Request) *resp {
+	user, errresp := s.currentUser(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	err := s.api.DeclineInvite(user, mux.Vars(r)["id"])
+	if errresp := ledgerErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] declining invite: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
+
+// removeMember removes a member from the ledger (or cancels their invite).
+// Members can remove themselves to leave the ledger
+func (s *Server) removeMember(r *http.Request) *resp {
+	user, errresp := s.currentUser(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	userid, err := strconv.Atoi(mux.Vars(r)["userid"])
+	if err != nil {
+		return &resp{
+			code: http.StatusBadRequest,
+			msg: kv{
+				"kind": "bad request",
+				"msg":  "user id should be a number",
+			},
+		}
+	}
+
+	err = s.api.RemoveMember(user, mux.Vars(r)["id"], userid)
+	if errresp := ledgerErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] removing member: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
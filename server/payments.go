@@ -1,41 +1,103 @@
 package server
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"image/png"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
+	"github.com/gorilla/mux"
 	"github.com/math2001/money/api"
 )
 
+// addManualPayment adds the payment, and reports the existing payments it
+// looks like. In strict mode, those are refused unless force=1
 func (s *Server) addManualPayment(r *http.Request) *resp {
-	user, err := s.getCurrentUser(r)
-	if errors.Is(err, ErrNoCurrentUser) {
-		log.Printf("add payments: no current user")
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	add := s.api.AddPayment
+	if r.PostFormValue("force") == "1" {
+		add = s.api.ForceAddPayment
+	}
+	payment, err := add(user, []byte(r.PostFormValue("payment")))
+
+	var duplicate *api.DuplicateError
+	if errors.As(err, &duplicate) {
 		return &resp{
-			code: http.StatusNotAcceptable,
+			code: http.StatusConflict,
 			msg: kv{
-				"kind":    "require log in",
-				"msg":     "please authenticate first",
-				"details": "authentication cookie found, but user forgotten",
+				"kind":       "error",
+				"id":         "duplicate payment",
+				"msg":        "this payment looks like an existing one, add it with force=1 if it isn't",
+				"candidates": duplicate.Candidates,
 			},
 		}
-	} else if err != nil {
-		log.Printf("[err] loading session: %s", err)
+	} else if errors.Is(err, api.ErrInvalidPayment) {
+		log.Printf("invalid payment: %s", err)
 		return &resp{
 			code: http.StatusNotAcceptable,
 			msg: kv{
-				"kind": "not acceptable",
-				"msg":  "couldn't load session from cookie",
+				"kind": "error",
+				"id":   "invalid payment",
+				"msg":  err.Error(),
+			},
+		}
+	}
+	if err != nil {
+		log.Printf("add payments: api.addpayment: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+				"msg":  "adding payment failed",
 			},
 		}
 	}
 
-	err = s.api.AddPayment(user, []byte(r.PostFormValue("payment")))
+	duplicates, err := s.api.FindDuplicates(user, payment.ID)
+	if err != nil {
+		// the payment was added, so it's not worth failing the request
+		log.Printf("[err] finding duplicates: %s", err)
+	}
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":       "success",
+			"goto":       "/", // FIXME: where should it go
+			"payment":    payment,
+			"duplicates": duplicates,
+		},
+	}
+}
 
-	if _, ok := err.(api.ErrInvalidPayment); ok {
-		log.Printf("invalid payment: %s", err)
+// mergePayment merges the payment "duplicate" into the one in the url, and
+// deletes it
+func (s *Server) mergePayment(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	payment, err := s.api.MergePayments(user, mux.Vars(r)["id"], r.PostFormValue("duplicate"))
+	if errors.Is(err, api.ErrPaymentNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no payment with this id",
+			},
+		}
+	} else if errors.Is(err, api.ErrInvalidPayment) {
 		return &resp{
 			code: http.StatusNotAcceptable,
 			msg: kv{
@@ -44,52 +106,175 @@ func (s *Server) addManualPayment(r *http.Request) *resp {
 				"msg":  err.Error(),
 			},
 		}
-	}
-	if err != nil {
-		log.Printf("add payments: api.addpayment: %s", err)
+	} else if err != nil {
+		log.Printf("[err] merging payments: %s", err)
 		return &resp{
 			code: http.StatusInternalServerError,
 			msg: kv{
 				"kind": "internal error",
-				"msg":  "adding payment failed",
 			},
 		}
 	}
+
 	return &resp{
 		code: http.StatusOK,
 		msg: kv{
-			"kind": "success",
-			"goto": "/", // FIXME: where should it go
+			"kind":    "success",
+			"payment": payment,
 		},
 	}
 }
 
-func (s *Server) listPayments(r *http.Request) *resp {
+// versionConflictResp returns the response for an api.ErrVersionConflict, and
+// nil for the other errors. It has the payment as it is now
+func versionConflictResp(err error) *resp {
+	var conflict *api.VersionConflictError
+	if !errors.As(err, &conflict) {
+		return nil
+	}
+	return &resp{
+		code: http.StatusConflict,
+		msg: kv{
+			"kind":    "error",
+			"id":      "version conflict",
+			"msg":     "this payment was changed since it was loaded",
+			"payment": conflict.Current,
+		},
+	}
+}
 
-	user, err := s.getCurrentUser(r)
-	if errors.Is(err, ErrNoCurrentUser) {
-		log.Printf("add payments: no current user")
+// updatePayment changes the payment. If the patch has the version the client
+// loaded, it's refused with a 409 if the payment has changed since
+func (s *Server) updatePayment(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	r.ParseMultipartForm(1 << 20) // 1 MB of memory
+
+	payment, err := s.api.UpdatePayment(user, mux.Vars(r)["id"], []byte(r.PostFormValue("payment")))
+	if errresp := versionConflictResp(err); errresp != nil {
+		return errresp
+	} else if errors.Is(err, api.ErrPaymentNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no payment with this id",
+			},
+		}
+	} else if errors.Is(err, api.ErrInvalidPayment) {
+		log.Printf("invalid payment update: %s", err)
 		return &resp{
 			code: http.StatusNotAcceptable,
 			msg: kv{
-				"kind":    "require log in",
-				"msg":     "please authenticate first",
-				"details": "authentication cookie found, but user forgotten",
+				"kind": "error",
+				"id":   "invalid payment",
+				"msg":  err.Error(),
 			},
 		}
 	} else if err != nil {
-		log.Printf("[err] loading session: %s", err)
+		log.Printf("[err] update payment: %s", err)
 		return &resp{
-			code: http.StatusNotAcceptable,
+			code: http.StatusInternalServerError,
 			msg: kv{
-				"kind": "not acceptable",
-				"msg":  "couldn't load session from cookie",
+				"kind": "internal error",
+				"msg":  "updating payment failed",
 			},
 		}
 	}
 
-	payments, err := s.api.ListPayments(user)
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":    "success",
+			"payment": payment,
+		},
+	}
+}
+
+// deletePayment deletes the payment. With ?version=, it's refused with a 409
+// if the payment has changed since the client loaded it
+func (s *Server) deletePayment(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	version := 0
+	if v := r.FormValue("version"); v != "" {
+		var err error
+		version, err = strconv.Atoi(v)
+		if err != nil {
+			return &resp{
+				code: http.StatusBadRequest,
+				msg: kv{
+					"kind": "bad request",
+					"msg":  "version should be a number",
+				},
+			}
+		}
+	}
+
+	err := s.api.DeletePayment(user, mux.Vars(r)["id"], version)
+	if errresp := versionConflictResp(err); errresp != nil {
+		return errresp
+	} else if errors.Is(err, api.ErrPaymentNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no payment with this id",
+			},
+		}
+	} else if err != nil {
+		log.Printf("[err] delete payment: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+				"msg":  "deleting payment failed",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
+
+func (s *Server) listPayments(r *http.Request) *resp {
+
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	query, err := parsePaymentsQuery(r.URL.Query())
 	if err != nil {
+		return &resp{
+			code: http.StatusBadRequest,
+			msg: kv{
+				"kind": "bad request",
+				"msg":  err.Error(),
+			},
+		}
+	}
+
+	page, err := s.api.ListPayments(user, query)
+	if errors.Is(err, api.ErrInvalidQuery) {
+		return &resp{
+			code: http.StatusBadRequest,
+			msg: kv{
+				"kind": "bad request",
+				"msg":  err.Error(),
+			},
+		}
+	} else if err != nil {
 		log.Printf("[err] listing payments: %s", err)
 		return &resp{
 			code: http.StatusInternalServerError,
@@ -102,36 +287,178 @@ func (s *Server) listPayments(r *http.Request) *resp {
 	return &resp{
 		code: http.StatusOK,
 		msg: kv{
-			"kind":     "success",
-			"payments": payments,
+			"kind":      "success",
+			"payments":  page.Payments,
+			"total":     page.Total,
+			"next":      page.Next,
+			"totals":    page.Totals,
+			"converted": page.Converted,
 		},
 	}
 }
 
-func (s *Server) scan(r *http.Request) *resp {
+// exportFiles are the content type and file extension of each export format
+var exportFiles = map[string][2]string{
+	api.FormatCSV:    {"text/csv; charset=utf-8", "csv"},
+	api.FormatJSON:   {"application/json; charset=utf-8", "json"},
+	api.FormatLedger: {"text/plain; charset=utf-8", "journal"},
+}
+
+// exportPayments downloads the payments as a file. The query is
+// format=csv|json|ledger, and optionally from and to
+func (s *Server) exportPayments(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
 
-	user, err := s.getCurrentUser(r)
-	if errors.Is(err, ErrNoCurrentUser) {
-		log.Printf("scan: no current user")
+	values := r.URL.Query()
+	query, err := parsePaymentsQuery(url.Values{
+		"from": values["from"],
+		"to":   values["to"],
+	})
+	if err != nil {
 		return &resp{
-			code: http.StatusNotAcceptable,
+			code: http.StatusBadRequest,
 			msg: kv{
-				"kind":    "require log in",
-				"msg":     "please authenticate first",
-				"details": "authentication cookie found, but user forgotten",
+				"kind": "bad request",
+				"msg":  err.Error(),
+			},
+		}
+	}
+
+	format := values.Get("format")
+	stream, err := s.api.ExportPayments(user, format, query.From, query.To)
+	if errors.Is(err, api.ErrUnknownFormat) {
+		return &resp{
+			code: http.StatusBadRequest,
+			msg: kv{
+				"kind": "bad request",
+				"msg":  "format should be csv, json or ledger",
 			},
 		}
 	} else if err != nil {
-		log.Printf("[err] scan: loading session: %s", err)
+		log.Printf("[err] exporting payments: %s", err)
 		return &resp{
-			code: http.StatusNotAcceptable,
+			code: http.StatusInternalServerError,
 			msg: kv{
-				"kind": "not acceptable",
-				"msg":  "couldn't load session from cookie",
+				"kind": "internal error",
 			},
 		}
 	}
 
+	file := exportFiles[format]
+	return &resp{
+		code:   http.StatusOK,
+		stream: stream,
+		header: http.Header{
+			"Content-Type":        {file[0]},
+			"Content-Disposition": {fmt.Sprintf("attachment; filename=\"payments.%s\"", file[1])},
+		},
+	}
+}
+
+// parsePaymentsQuery reads the filters, sort order and pagination from the url
+// query. Custom fields are given as custom.<field>=<value>
+func parsePaymentsQuery(values url.Values) (api.PaymentsQuery, error) {
+	var q api.PaymentsQuery
+	var err error
+
+	if from := values.Get("from"); from != "" {
+		if q.From, err = api.ParseDate(from); err != nil {
+			return q, fmt.Errorf("invalid 'from' date: %s", err)
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if q.To, err = api.ParseDate(to); err != nil {
+			return q, fmt.Errorf("invalid 'to' date: %s", err)
+		}
+	}
+	if min := values.Get("min"); min != "" {
+		amount, err := api.ParseMoney(min)
+		if err != nil {
+			return q, fmt.Errorf("invalid 'min' amount: %s", err)
+		}
+		q.MinAmount = &amount
+	}
+	if max := values.Get("max"); max != "" {
+		amount, err := api.ParseMoney(max)
+		if err != nil {
+			return q, fmt.Errorf("invalid 'max' amount: %s", err)
+		}
+		q.MaxAmount = &amount
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			return q, fmt.Errorf("invalid 'limit': %s", err)
+		}
+	}
+
+	switch order := values.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("invalid 'order' %q, should be 'asc' or 'desc'", order)
+	}
+
+	q.Convert = values.Get("convert") == "1"
+	q.Currency = strings.ToUpper(values.Get("currency"))
+	q.Name = values.Get("name")
+	q.Account = values.Get("account")
+	switch q.Direction = values.Get("direction"); q.Direction {
+	case "", api.DirectionExpense, api.DirectionIncome:
+	default:
+		return q, fmt.Errorf("invalid 'direction' %q, should be 'expense' or 'income'", q.Direction)
+	}
+	q.Sort = values.Get("sort")
+	q.Cursor = values.Get("cursor")
+
+	for key := range values {
+		if strings.HasPrefix(key, "custom.") {
+			if q.Custom == nil {
+				q.Custom = make(map[string]string)
+			}
+			q.Custom[strings.TrimPrefix(key, "custom.")] = values.Get(key)
+		}
+	}
+
+	return q, nil
+}
+
+// maxReceiptSize is the biggest receipt which can be scanned, in bytes, and
+// maxReceiptPixels in pixels (a small PNG can decode to a huge image)
+const (
+	maxReceiptSize   = 10 << 20
+	maxReceiptPixels = 40 << 20
+)
+
+func (s *Server) scan(r *http.Request) *resp {
+
+	user, errresp := s.currentUser(r)
+	if errresp != nil {
+		return errresp
+	}
+	// not locked here (see lockStore): waiting for the ocr server can take a
+	// while, so api.Scan locks the store once it answered
+	store, errresp := s.userStore(r, user)
+	if errresp != nil {
+		return errresp
+	}
+
+	tooLarge := &resp{
+		code: http.StatusRequestEntityTooLarge,
+		msg: kv{
+			"kind": "request entity too large",
+			"msg":  fmt.Sprintf("receipts should be at most %d MB", maxReceiptSize>>20),
+		},
+	}
+	if r.ContentLength > maxReceiptSize {
+		return tooLarge
+	}
+	// the length can be unknown
+	r.Body = http.MaxBytesReader(nil, r.Body, maxReceiptSize)
+
 	file, header, err := r.FormFile("img")
 	if err != nil {
 		log.Printf("[err] scan: loading file from post requets: %s", err)
@@ -144,10 +471,24 @@ func (s *Server) scan(r *http.Request) *resp {
 		}
 	}
 	defer file.Close()
-	// FIXME: SECURITY check file size before uploading
 	// FIXME: check that it's the right image format
 
-	img, err := png.Decode(file)
+	original, err := ioutil.ReadAll(file)
+	if err != nil {
+		log.Printf("[err] scan: reading uploaded file: %s", err)
+		return &resp{
+			code: http.StatusBadRequest,
+			msg: kv{
+				"kind": "bad request",
+				"msg":  "error occurred when uploading file",
+			},
+		}
+	}
+
+	if config, err := png.DecodeConfig(bytes.NewReader(original)); err == nil && config.Width*config.Height > maxReceiptPixels {
+		return tooLarge
+	}
+	img, err := png.Decode(bytes.NewReader(original))
 	if err != nil {
 		log.Printf("[err] png.Decoding file")
 		return &resp{
@@ -160,7 +501,7 @@ func (s *Server) scan(r *http.Request) *resp {
 		}
 	}
 
-	payment, err := s.api.Scan(user, header, img)
+	payment, err := s.api.Scan(user, store, header, original, img)
 	if err != nil {
 		log.Printf("[err] listing payments: %s", err)
 		return &resp{
@@ -180,3 +521,132 @@ func (s *Server) scan(r *http.Request) *resp {
 		},
 	}
 }
+
+// receipt sends the receipt of a payment, or its thumbnail with ?thumbnail=1
+func (s *Server) receipt(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	thumbnail := r.URL.Query().Get("thumbnail") == "1"
+	content, contenttype, err := s.api.Receipt(user, mux.Vars(r)["id"], thumbnail)
+	if errors.Is(err, api.ErrPaymentNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no payment with this id",
+			},
+		}
+	} else if errors.Is(err, api.ErrReceiptNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "this payment doesn't have a receipt",
+			},
+		}
+	} else if err != nil {
+		log.Printf("[err] loading receipt: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		stream: func(w io.Writer) error {
+			_, err := w.Write(content)
+			return err
+		},
+		header: http.Header{
+			"Content-Type": {contenttype},
+			// it's decrypted, it shouldn't end up in a shared cache
+			"Cache-Control": {"private, max-age=3600"},
+		},
+	}
+}
+
+// paymentHistory sends every change made to the payment, oldest first
+func (s *Server) paymentHistory(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	events, err := s.api.PaymentHistory(user, mux.Vars(r)["id"])
+	if errors.Is(err, api.ErrPaymentNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no payment with this id",
+			},
+		}
+	} else if err != nil {
+		log.Printf("[err] loading payment history: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":   "success",
+			"events": events,
+		},
+	}
+}
+
+// undo reverts the last change made to the payments. Calling it again
+// reverts the one before
+func (s *Server) undo(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	events, err := s.api.Undo(user)
+	if errors.Is(err, api.ErrNothingToUndo) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "there is nothing to undo",
+			},
+		}
+	} else if errors.Is(err, api.ErrUndoConflict) {
+		return &resp{
+			code: http.StatusConflict,
+			msg: kv{
+				"kind": "error",
+				"id":   "undo conflict",
+				"msg":  err.Error(),
+			},
+		}
+	} else if err != nil {
+		log.Printf("[err] undoing: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":   "success",
+			"events": events,
+		},
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/math2001/money/api"
+)
+
+// recurringErrorResp returns the response for the errors caused by the user,
+// and nil for the others
+func recurringErrorResp(err error) *resp {
+	if errors.Is(err, api.ErrRecurringNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no recurring payment with this id",
+			},
+		}
+	} else if errors.Is(err, api.ErrInvalidRecurring) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "error",
+				"id":   "invalid recurring payment",
+				"msg":  err.Error(),
+			},
+		}
+	}
+	return nil
+}
+
+func (s *Server) listRecurring(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	recurring, err := s.api.ListRecurring(user)
+	if err != nil {
+		log.Printf("[err] listing recurring payments: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":      "success",
+			"recurring": recurring,
+		},
+	}
+}
+
+// addRecurring adds the recurring payment, and creates the payments which are
+// already due
+func (s *Server) addRecurring(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	recurring, err := s.api.AddRecurring(user, []byte(r.PostFormValue("recurring")), api.NewDate(time.Now()))
+	if errresp := recurringErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] adding recurring payment: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+	s.runRecurring(user, true)
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":      "success",
+			"recurring": recurring,
+		},
+	}
+}
+
+func (s *Server) updateRecurring(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	r.ParseMultipartForm(1 << 20) // 1 MB of memory
+
+	recurring, err := s.api.UpdateRecurring(user, mux.Vars(r)["id"], []byte(r.PostFormValue("recurring")))
+	if errresp := recurringErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] updating recurring payment: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+	s.runRecurring(user, true)
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":      "success",
+			"recurring": recurring,
+		},
+	}
+}
+
+func (s *Server) deleteRecurring(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	err := s.api.DeleteRecurring(user, mux.Vars(r)["id"])
+	if errresp := recurringErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] deleting recurring payment: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/math2001/money/api"
+)
+
+// report aggregates the payments. The query is period=day|week|month|year,
+// group=category|tag|name|merchant|source (optional), direction=expense|income
+// (optional), from and to (optional)
+func (s *Server) report(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	values := r.URL.Query()
+	q := api.ReportQuery{
+		Period:    api.Period(values.Get("period")),
+		GroupBy:   values.Get("group"),
+		Direction: values.Get("direction"),
+	}
+	var err error
+	if from := values.Get("from"); from != "" {
+		if q.From, err = api.ParseDate(from); err != nil {
+			return &resp{
+				code: http.StatusBadRequest,
+				msg: kv{
+					"kind": "bad request",
+					"msg":  "invalid 'from' date: " + err.Error(),
+				},
+			}
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if q.To, err = api.ParseDate(to); err != nil {
+			return &resp{
+				code: http.StatusBadRequest,
+				msg: kv{
+					"kind": "bad request",
+					"msg":  "invalid 'to' date: " + err.Error(),
+				},
+			}
+		}
+	}
+
+	report, err := s.api.Report(user, q)
+	if errors.Is(err, api.ErrInvalidReport) {
+		return &resp{
+			code: http.StatusBadRequest,
+			msg: kv{
+				"kind": "bad request",
+				"msg":  err.Error(),
+			},
+		}
+	} else if err != nil {
+		log.Printf("[err] building report: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":   "success",
+			"report": report,
+		},
+	}
+}
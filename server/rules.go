@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/math2001/money/api"
+)
+
+// ruleErrorResp returns the response for the errors caused by the user, and
+// nil for the others
+func ruleErrorResp(err error) *resp {
+	if errors.Is(err, api.ErrRuleNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no rule with this id",
+			},
+		}
+	} else if errors.Is(err, api.ErrInvalidRule) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "error",
+				"id":   "invalid rule",
+				"msg":  err.Error(),
+			},
+		}
+	}
+	return nil
+}
+
+func (s *Server) listRules(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	rules, err := s.api.ListRules(user)
+	if err != nil {
+		log.Printf("[err] listing rules: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":  "success",
+			"rules": rules,
+		},
+	}
+}
+
+func (s *Server) addRule(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	rule, err := s.api.AddRule(user, []byte(r.PostFormValue("rule")))
+	if errresp := ruleErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] adding rule: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+			"rule": rule,
+		},
+	}
+}
+
+func (s *Server) updateRule(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	r.ParseMultipartForm(1 << 20) // 1 MB of memory
+
+	rule, err := s.api.UpdateRule(user, mux.Vars(r)["id"], []byte(r.PostFormValue("rule")))
+	if errresp := ruleErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] updating rule: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+			"rule": rule,
+		},
+	}
+}
+
+func (s *Server) deleteRule(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	err := s.api.DeleteRule(user, mux.Vars(r)["id"])
+	if errresp := ruleErrorResp(err); errresp != nil {
+		return errresp
+	} else if err != nil {
+		log.Printf("[err] deleting rule: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
+
+// applyRules re-applies the rules to the existing payments. With dryrun=1, it
+// only reports what would change
+func (s *Server) applyRules(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	dryrun := r.FormValue("dryrun") == "1"
+	changes, err := s.api.ApplyRules(user, dryrun)
+	if err != nil {
+		log.Printf("[err] applying rules: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":    "success",
+			"dryrun":  dryrun,
+			"changes": changes,
+		},
+	}
+}
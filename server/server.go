@@ -1,17 +1,20 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/math2001/money/api"
@@ -25,10 +28,17 @@ type Session struct {
 	ID       int
 	Email    string
 	Password secret
+	// Login is a random id given at login, so that the history can tell
+	// sessions apart
+	Login string
 }
 
 type secret []byte
 
+// sessionPasswordAD is the associated data the password in the session is
+// encrypted with
+var sessionPasswordAD = []byte("session password")
+
 func (secret) String() string {
 	return "[secret]"
 }
@@ -45,21 +55,33 @@ type resp struct {
 	// FIXME: rename to body
 	msg     kv
 	session *Session
+
+	// stream is written instead of msg if it's set (for files and other non
+	// json responses). header is added to the response's
+	stream func(io.Writer) error
+	header http.Header
 }
 
 type Server struct {
 	sessions *sessions.S
 	api      *api.API
 	cryptor  *db.Cryptor
+
+	// recurringRuns is the day the recurring payments were last created for
+	// each user and ledger (see db.Store's String)
+	recurringRuns   map[string]api.Date
+	recurringRunsMu sync.Mutex
 }
 
-func New(dataroot, ocrserver string, password []byte) (*mux.Router, error) {
+// New returns the server's handler. The keys are in dataroot, and the files in
+// backends (in dataroot too if it's nil)
+func New(dataroot, ocrserver string, password []byte, backends db.Backends) (*mux.Router, error) {
 
 	r := mux.NewRouter().StrictSlash(true)
 
 	km := keysmanager.NewKeysManager(filepath.Join(dataroot, "appsecrets"))
 
-	api := api.NewAPI(dataroot, ocrserver)
+	api := api.NewAPI(dataroot, ocrserver, backends)
 
 	// the datafoot folder doesn't exists, start from scratch
 	if _, err := os.Stat(dataroot); os.IsNotExist(err) {
@@ -134,9 +156,79 @@ func New(dataroot, ocrserver string, password []byte) (*mux.Router, error) {
 	post.HandleFunc("/signup", s.h(s.signup))
 	post.HandleFunc("/logout", s.h(s.logout))
 
+	get := rapi.Methods(http.MethodGet).Subrouter()
+	patch := rapi.Methods(http.MethodPatch).Subrouter()
+	del := rapi.Methods(http.MethodDelete).Subrouter()
+
 	post.HandleFunc("/payments/add-manual", s.h(s.addManualPayment))
 	rapi.HandleFunc("/payments/list", s.h(s.listPayments))
 	rapi.HandleFunc("/payments/scan", s.h(s.scan))
+	get.HandleFunc("/payments/export", s.h(s.exportPayments))
+	patch.HandleFunc("/payments/{id}", s.h(s.updatePayment))
+	del.HandleFunc("/payments/{id}", s.h(s.deletePayment))
+	post.HandleFunc("/payments/{id}/merge", s.h(s.mergePayment))
+	get.HandleFunc("/payments/{id}/receipt", s.h(s.receipt))
+	get.HandleFunc("/payments/{id}/history", s.h(s.paymentHistory))
+	post.HandleFunc("/payments/undo", s.h(s.undo))
+
+	get.HandleFunc("/settings", s.h(s.getSettings))
+	patch.HandleFunc("/settings", s.h(s.updateSettings))
+	get.HandleFunc("/rates", s.h(s.listRates))
+	post.HandleFunc("/rates/import", s.h(s.importRates))
+
+	get.HandleFunc("/categories", s.h(s.listCategories))
+	post.HandleFunc("/categories", s.h(s.addCategory))
+	patch.HandleFunc("/categories", s.h(s.renameCategory))
+	post.HandleFunc("/categories/merge", s.h(s.mergeCategory))
+	del.HandleFunc("/categories", s.h(s.deleteCategory))
+
+	get.HandleFunc("/rules", s.h(s.listRules))
+	post.HandleFunc("/rules", s.h(s.addRule))
+	post.HandleFunc("/rules/apply", s.h(s.applyRules))
+	patch.HandleFunc("/rules/{id}", s.h(s.updateRule))
+	del.HandleFunc("/rules/{id}", s.h(s.deleteRule))
+
+	get.HandleFunc("/budgets", s.h(s.listBudgets))
+	post.HandleFunc("/budgets", s.h(s.addBudget))
+	patch.HandleFunc("/budgets/{id}", s.h(s.updateBudget))
+	del.HandleFunc("/budgets/{id}", s.h(s.deleteBudget))
+
+	get.HandleFunc("/recurring", s.h(s.listRecurring))
+	post.HandleFunc("/recurring", s.h(s.addRecurring))
+	patch.HandleFunc("/recurring/{id}", s.h(s.updateRecurring))
+	del.HandleFunc("/recurring/{id}", s.h(s.deleteRecurring))
+
+	get.HandleFunc("/reports", s.h(s.report))
+
+	get.HandleFunc("/accounts", s.h(s.listAccounts))
+	post.HandleFunc("/accounts", s.h(s.addAccount))
+	get.HandleFunc("/accounts/balances", s.h(s.balances))
+	patch.HandleFunc("/accounts/{id}", s.h(s.updateAccount))
+	del.HandleFunc("/accounts/{id}", s.h(s.deleteAccount))
+
+	get.HandleFunc("/transfers", s.h(s.listTransfers))
+	post.HandleFunc("/transfers", s.h(s.addTransfer))
+	patch.HandleFunc("/transfers/{id}", s.h(s.updateTransfer))
+	del.HandleFunc("/transfers/{id}", s.h(s.deleteTransfer))
+
+	get.HandleFunc("/ledgers", s.h(s.listLedgers))
+	post.HandleFunc("/ledgers", s.h(s.createLedger))
+	post.HandleFunc("/ledgers/{id}/invite", s.h(s.inviteMember))
+	post.HandleFunc("/ledgers/{id}/accept", s.h(s.acceptInvite))
+	post.HandleFunc("/ledgers/{id}/decline", s.h(s.declineInvite))
+	del.HandleFunc("/ledgers/{id}/members/{userid}", s.h(s.removeMember))
+
+	get.HandleFunc("/splits/balances", s.h(s.splitBalances))
+	get.HandleFunc("/settlements", s.h(s.listSettlements))
+	post.HandleFunc("/settlements", s.h(s.addSettlement))
+	del.HandleFunc("/settlements/{id}", s.h(s.deleteSettlement))
+
+	get.HandleFunc("/import/profiles", s.h(s.listImportProfiles))
+	post.HandleFunc("/import/profiles", s.h(s.addImportProfile))
+	patch.HandleFunc("/import/profiles/{id}", s.h(s.updateImportProfile))
+	del.HandleFunc("/import/profiles/{id}", s.h(s.deleteImportProfile))
+	post.HandleFunc("/import/csv", s.h(s.importCSV))
+	post.HandleFunc("/import/ofx", s.h(s.importOFX))
 
 	// make sure this stays at the bottom of the function
 	rapi.PathPrefix("/").HandlerFunc(s.h(func(r *http.Request) *resp {
@@ -189,7 +281,29 @@ func (s *Server) h(h func(*http.Request) *resp) http.HandlerFunc {
 	handlerName := getFuncName(h)
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		// the locks taken by the handler (see lockStore) are held until the
+		// response is sent, because streams can still read the store
+		var unlocks []func()
+		defer func() {
+			for i := len(unlocks) - 1; i >= 0; i-- {
+				unlocks[i]()
+			}
+		}()
+		r = r.WithContext(context.WithValue(r.Context(), unlocksKey{}, &unlocks))
+
 		resp := h(r)
+		if resp.stream != nil {
+			for key, values := range resp.header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(resp.code)
+			// the status has been sent already, all we can do is stop
+			if err := resp.stream(w); err != nil {
+				log.Printf("[err] streaming response in %s: %s", handlerName, err)
+			}
+			return
+		}
+
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		encoder := json.NewEncoder(w)
 		if resp.msg == nil {
@@ -235,37 +349,139 @@ func (s *Server) h(h func(*http.Request) *resp) http.HandlerFunc {
 	}
 }
 
-func (s *Server) getCurrentUser(r *http.Request) (*db.User, error) {
+// unlocksKey is the key of the request's locks in its context
+type unlocksKey struct{}
+
+// lockStore locks the store until the response is sent: for reading if the
+// request only reads (GET), for writing otherwise. So two requests can't
+// change the same data at the same time, and loose one of the changes
+func (s *Server) lockStore(r *http.Request, store db.Store) {
+	unlocks, ok := r.Context().Value(unlocksKey{}).(*[]func())
+	if !ok {
+		// nothing would unlock it
+		log.Printf("[err] %q: locking store outside of a handler", r.URL.Path)
+		return
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		*unlocks = append(*unlocks, store.RLock())
+	} else {
+		*unlocks = append(*unlocks, store.Lock())
+	}
+}
+
+func (s *Server) getCurrentUser(r *http.Request) (*db.User, *Session, error) {
 	session := &Session{}
 	err := s.sessions.Load(r, session)
 	if errors.Is(err, sessions.ErrInvalidSignature) {
 		log.Println("!! Warning !! potential attack on cookie signature")
-		return nil, err
+		return nil, nil, err
 	} else if errors.Is(err, sessions.ErrNoSession) {
-		return nil, ErrNoCurrentUser
+		return nil, nil, ErrNoCurrentUser
 	} else if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if session.ID == 0 || session.Email == "" || len(session.Password) == 0 {
 		log.Println("!! warning !! internal error or potential attack on session")
 		log.Println("!! warning !! current session:", session)
-		return nil, errors.New("missing fields from session")
+		return nil, nil, errors.New("missing fields from session")
 	}
 
-	// breaking abstraction here, but I don't know what's better...
-	// FIXME: this clearly isn't the right way
-	user := db.NewUser(session.ID, session.Email, filepath.Join(s.api.Usersdir, strconv.Itoa(session.ID)))
+	user := s.api.OpenUser(session.ID, session.Email)
 
-	password, err := s.cryptor.Decrypt(session.Password)
+	password, err := s.cryptor.Decrypt(session.Password, sessionPasswordAD)
 	if err != nil {
 		log.Printf("!! Warning !! decrypting password from session")
-		return nil, err
+		return nil, nil, err
 	}
 
 	user.Login(password)
+	if err := s.api.Migrate(user); err != nil {
+		return nil, nil, err
+	}
 
-	return user, nil
+	return user, session, nil
+}
+
+// currentUser is getCurrentUser for handlers: if there is no valid current
+// user, it returns the response to send back
+func (s *Server) currentUser(r *http.Request) (*db.User, *resp) {
+	user, _, errresp := s.currentSession(r)
+	return user, errresp
+}
+
+// currentSession is currentUser, with the session
+func (s *Server) currentSession(r *http.Request) (*db.User, *Session, *resp) {
+	user, session, err := s.getCurrentUser(r)
+	if errors.Is(err, ErrNoCurrentUser) {
+		log.Printf("%q: no current user", r.URL.Path)
+		return nil, nil, &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind":    "require log in",
+				"msg":     "please authenticate first",
+				"details": "authentication cookie found, but user forgotten",
+			},
+		}
+	} else if err != nil {
+		log.Printf("[err] %q: loading session: %s", r.URL.Path, err)
+		return nil, nil, &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "not acceptable",
+				"msg":  "couldn't load session from cookie",
+			},
+		}
+	}
+	s.runRecurring(user, false)
+	return user, session, nil
+}
+
+// runRecurring creates the user's recurring payments which are due. The users'
+// data can only be decrypted with their password, so it can't run for everyone
+// when the server starts. Instead, it runs when the user logs in, and on their
+// first request after the server started (and then on the first one of every
+// day). Errors are only logged: they shouldn't stop the user from using the
+// rest of the app. Shared ledgers are the same, with any of their members
+func (s *Server) runRecurring(store db.Store, force bool) {
+	today := api.NewDate(time.Now())
+	key := store.String()
+
+	// the day is marked before running, and the mutex released: waiting for
+	// the store (behind a long export for example) mustn't hold up the other
+	// users
+	s.recurringRunsMu.Lock()
+	if s.recurringRuns == nil {
+		s.recurringRuns = make(map[string]api.Date)
+	}
+	last, ok := s.recurringRuns[key]
+	if ok && !force && last == today {
+		s.recurringRunsMu.Unlock()
+		return
+	}
+	s.recurringRuns[key] = today
+	s.recurringRunsMu.Unlock()
+
+	unlock := store.Lock()
+	created, err := s.api.RunRecurring(store, today)
+	unlock()
+	if err != nil {
+		log.Printf("[err] running recurring payments for %s: %s", store, err)
+		// try again on the next request
+		s.recurringRunsMu.Lock()
+		if s.recurringRuns[key] == today {
+			if ok {
+				s.recurringRuns[key] = last
+			} else {
+				delete(s.recurringRuns, key)
+			}
+		}
+		s.recurringRunsMu.Unlock()
+		return
+	}
+	if len(created) > 0 {
+		log.Printf("created %d recurring payments for %s", len(created), store)
+	}
 }
 
 func getFuncName(i interface{}) string {
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/math2001/money/api"
+)
+
+func (s *Server) getSettings(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	settings, err := s.api.GetSettings(user)
+	if err != nil {
+		log.Printf("[err] loading settings: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":     "success",
+			"settings": settings,
+		},
+	}
+}
+
+func (s *Server) updateSettings(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	r.ParseMultipartForm(1 << 20) // 1 MB of memory
+
+	settings, err := s.api.UpdateSettings(user, []byte(r.PostFormValue("settings")))
+	if errors.Is(err, api.ErrInvalidSettings) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "error",
+				"id":   "invalid settings",
+				"msg":  err.Error(),
+			},
+		}
+	} else if err != nil {
+		log.Printf("[err] updating settings: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":     "success",
+			"settings": settings,
+		},
+	}
+}
+
+func (s *Server) listRates(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	rates, err := s.api.ListRates(user)
+	if err != nil {
+		log.Printf("[err] listing rates: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":  "success",
+			"rates": rates,
+		},
+	}
+}
+
+func (s *Server) importRates(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	file, _, err := r.FormFile("rates")
+	if err != nil {
+		log.Printf("[err] import rates: loading file from post request: %s", err)
+		return &resp{
+			code: http.StatusBadRequest,
+			msg: kv{
+				"kind": "bad request",
+				"msg":  "error occurred when uploading file",
+			},
+		}
+	}
+	defer file.Close()
+
+	n, err := s.api.ImportRates(user, file)
+	if errors.Is(err, api.ErrInvalidRates) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "error",
+				"id":   "invalid rates",
+				"msg":  err.Error(),
+			},
+		}
+	} else if err != nil {
+		log.Printf("[err] importing rates: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":     "success",
+			"imported": n,
+		},
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/math2001/money/api"
+)
+
+// splitBalances sends who owes whom in the ledger (?ledger=), and the
+// transfers which would settle up
+func (s *Server) splitBalances(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	balances, err := s.api.SplitBalances(user)
+	if err != nil {
+		log.Printf("[err] computing split balances: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":      "success",
+			"balances":  balances.Balances,
+			"transfers": balances.Transfers,
+		},
+	}
+}
+
+func (s *Server) listSettlements(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	settlements, err := s.api.ListSettlements(user)
+	if err != nil {
+		log.Printf("[err] listing settlements: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":        "success",
+			"settlements": settlements,
+		},
+	}
+}
+
+func (s *Server) addSettlement(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	settlement, err := s.api.AddSettlement(user, []byte(r.PostFormValue("settlement")))
+	if errors.Is(err, api.ErrInvalidSettlement) {
+		return &resp{
+			code: http.StatusNotAcceptable,
+			msg: kv{
+				"kind": "error",
+				"id":   "invalid settlement",
+				"msg":  err.Error(),
+			},
+		}
+	} else if err != nil {
+		log.Printf("[err] adding settlement: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind":       "success",
+			"settlement": settlement,
+		},
+	}
+}
+
+func (s *Server) deleteSettlement(r *http.Request) *resp {
+	user, errresp := s.currentStore(r)
+	if errresp != nil {
+		return errresp
+	}
+
+	err := s.api.DeleteSettlement(user, mux.Vars(r)["id"])
+	if errors.Is(err, api.ErrSettlementNotFound) {
+		return &resp{
+			code: http.StatusNotFound,
+			msg: kv{
+				"kind": "not found",
+				"msg":  "no settlement with this id",
+			},
+		}
+	} else if err != nil {
+		log.Printf("[err] deleting settlement: %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
+
+	return &resp{
+		code: http.StatusOK,
+		msg: kv{
+			"kind": "success",
+		},
+	}
+}
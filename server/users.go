@@ -1,8 +1,11 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 
@@ -10,6 +13,15 @@ import (
 	"github.com/math2001/money/api"
 )
 
+// newLoginID generates the id of a new session
+func newLoginID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", fmt.Errorf("generating login id: %s", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
 func (s *Server) login(r *http.Request) *resp {
 	email := r.PostFormValue("email")
 	password := r.PostFormValue("password")
@@ -32,7 +44,9 @@ func (s *Server) login(r *http.Request) *resp {
 		}
 	}
 
-	encryptedPassword, err := s.cryptor.Encrypt([]byte(password))
+	s.runRecurring(user, true)
+
+	encryptedPassword, err := s.cryptor.Encrypt([]byte(password), sessionPasswordAD)
 	if err != nil {
 		log.Printf("[err] encrypting password: %s", err)
 		return &resp{
@@ -42,6 +56,16 @@ func (s *Server) login(r *http.Request) *resp {
 			},
 		}
 	}
+	login, err := newLoginID()
+	if err != nil {
+		log.Printf("[err] %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
 
 	return &resp{
 		code: http.StatusOK,
@@ -49,6 +73,7 @@ func (s *Server) login(r *http.Request) *resp {
 			ID:       user.ID,
 			Email:    user.Email,
 			Password: encryptedPassword,
+			Login:    login,
 		},
 		msg: kv{
 			"kind":  "success",
@@ -172,7 +197,7 @@ func (s *Server) signup(r *http.Request) *resp {
 		}
 	}
 
-	encryptedPassword, err := s.cryptor.Encrypt([]byte(password))
+	encryptedPassword, err := s.cryptor.Encrypt([]byte(password), sessionPasswordAD)
 	if err != nil {
 		log.Printf("[err] encrypting password: %s", err)
 		return &resp{
@@ -182,6 +207,16 @@ func (s *Server) signup(r *http.Request) *resp {
 			},
 		}
 	}
+	login, err := newLoginID()
+	if err != nil {
+		log.Printf("[err] %s", err)
+		return &resp{
+			code: http.StatusInternalServerError,
+			msg: kv{
+				"kind": "internal error",
+			},
+		}
+	}
 
 	// FIXME: check session for where the user is coming from, and redirect him
 	// there (don't forget to remove that session item)
@@ -192,6 +227,7 @@ func (s *Server) signup(r *http.Request) *resp {
 			ID:       user.ID,
 			Email:    user.Email,
 			Password: encryptedPassword,
+			Login:    login,
 		},
 		msg: kv{
 			"kind":  "success",
@@ -221,7 +257,7 @@ func (s *Server) logout(r *http.Request) *resp {
 	// and correct) will just be logged out of both things. But we know that
 	// there was a problem somewhere...
 
-	user, err := s.getCurrentUser(r)
+	user, _, err := s.getCurrentUser(r)
 	if errors.Is(err, ErrNoCurrentUser) {
 		return &resp{
 			code: http.StatusNotAcceptable,